@@ -1,15 +1,21 @@
 CREATE TABLE IF NOT EXISTS DISBURSEMENT (
     record_uuid UUID PRIMARY KEY ,
     disbursement_group_id UUID,
-    transaction_id UUID, -- not implemented. when payout is confirmed by payment method/system the id for the payment transaction should be saved
+    transaction_id varchar(64), -- id of the payout provider transfer that paid out the disbursement group
     merchReference varchar(255) NOT NULL,
     order_id char(12) NOT NULL UNIQUE ,
+    order_amount INT,
+    currency char(3) NOT NULL DEFAULT 'EUR', -- ISO 4217 code of the order, the amounts of the record and of its group are in its minor unit
     order_fee INT NOT NULL,
-    order_fee_running_total INT,
+    fee_schedule_id UUID, -- fee schedule the order_fee was charged under, the nil UUID for the default schedule
+    fee_schedule_version INT, -- version of that fee schedule, 0 for the default schedule
     payout_date datetime,
-    payout_running_total INT,
+    rolled_payout_date date, -- payout_date rolled forward to the business day the group is paid out on
     payout_total INT,
+    monthly_fee_deduction INT, -- minimum monthly fees deducted from the payout, set on the closing record of the group
     is_paid_out INT,
+    on_request BOOLEAN NOT NULL DEFAULT FALSE, -- accrued by an ON_DEMAND merchant, not due until it requests a payout
+    imported BOOLEAN NOT NULL DEFAULT FALSE, -- written by an import, replaced when the merchant is imported again with changes
     createdAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP);
 
 CREATE TABLE IF NOT EXISTS ORDERS (
@@ -17,6 +23,7 @@ CREATE TABLE IF NOT EXISTS ORDERS (
     merchant_reference varchar(255) NOT NULL,
     merchant_id uuid NOT NULL,
     amount INT NOT NULL,
+    currency char(3) NOT NULL DEFAULT 'EUR', -- ISO 4217 code, amount is in its minor unit
     created_at datetime);
 
 CREATE TABLE IF NOT EXISTS MERCHANTS (
@@ -24,19 +31,203 @@ CREATE TABLE IF NOT EXISTS MERCHANTS (
     reference varchar(255),
     email varchar(255),
     live_on date,
-    disbursement_frequency varchar(6),
-    minimum_monthly_fee varchar(5));
+    disbursement_frequency varchar(16),
+    minimum_monthly_fee varchar(5),
+    currency char(3) NOT NULL DEFAULT 'EUR', -- ISO 4217 code of the minimum monthly fee, and of the merchant's orders unless they say otherwise
+    timezone varchar(64) NOT NULL DEFAULT '', -- IANA timezone the merchant's payout days are counted in, UTC when empty
+    payout_day INT NOT NULL DEFAULT 0, -- day of the month MONTHLY merchants are paid out on, the day of live_on when 0
+    reserve_rate_basis_points INT NOT NULL DEFAULT 0, -- part of every payout held back in the merchant's reserve
+    reserve_days INT NOT NULL DEFAULT 0); -- days a reserve is held back before it is released
 
 CREATE TABLE IF NOT EXISTS MONTHLY (
     id UUID primary key,
     merchant_id UUID,
     merchant_reference varchar(255),
+    currency char(3) NOT NULL DEFAULT 'EUR', -- the merchant's currency, only its orders count towards the minimum monthly fee
     monthly_fee_date date,
     did_pay_fee INT,
     monthly_fee INT,
     total_order_amt INT,
     order_fee_total INT,
     amt_monthly_fee_paid INT GENERATED ALWAYS AS (monthly_fee-order_fee_total) VIRTUAL,
+    fee_deducted INT DEFAULT 0, -- part of the shortfall deducted from payouts so far
+    disbursement_group_id UUID, -- the disbursement group the shortfall was last deducted from
+    imported BOOLEAN NOT NULL DEFAULT FALSE, -- written by an import, replaced when the merchant is imported again with changes
     createdAt datetime,
-    updatedAt datetime
-);
\ No newline at end of file
+    updatedAt datetime,
+    UNIQUE (merchant_reference, monthly_fee_date)
+);
+
+CREATE TABLE IF NOT EXISTS DISBURSEMENT_GROUP (
+    id UUID PRIMARY KEY, -- the disbursement_group_id of the DISBURSEMENT records paid out together
+    run_id UUID NOT NULL,
+    merchReference varchar(255) NOT NULL,
+    currency char(3) NOT NULL DEFAULT 'EUR', -- ISO 4217 code of the orders of the group and of its payout
+    payout_date date,
+    rolled_payout_date date, -- business day the group was due to be paid out on
+    number_of_orders INT,
+    order_total INT,
+    order_fee_total INT,
+    adjustment_total INT, -- sum of the adjustments applied to the payout
+    monthly_fee_deduction INT, -- minimum monthly fees of earlier months deducted from the payout
+    reserve_amount INT NOT NULL DEFAULT 0, -- part of the payout held back in the merchant's reserve
+    payout_total INT,
+    transaction_id varchar(64),
+    paid_at datetime);
+
+CREATE TABLE IF NOT EXISTS DISBURSEMENT_RUN (
+    id UUID PRIMARY KEY,
+    run_date date NOT NULL UNIQUE, -- one run per day keeps the disbursement job idempotent
+    status varchar(16) NOT NULL,
+    groups_paid INT,
+    groups_failed INT,
+    groups_held INT NOT NULL DEFAULT 0, -- due groups left open because their merchant is on hold
+    reserves_paid INT NOT NULL DEFAULT 0, -- reserves released to merchants by the run
+    payout_total INT, -- payout and order fee totals in the default currency, EUR
+    order_fee_total INT,
+    totals TEXT, -- JSON array of {"currency", "payout_total", "order_fee_total"}, the totals of the run per currency
+    started_at datetime,
+    completed_at datetime);
+
+CREATE TABLE IF NOT EXISTS FEE_SCHEDULE (
+    id UUID PRIMARY KEY,
+    merchant_reference varchar(255) NOT NULL,
+    currency char(3) NOT NULL DEFAULT 'EUR', -- ISO 4217 code of the orders charged under the schedule, the thresholds and fees are in its minor unit
+    version INT NOT NULL,
+    effective_from datetime NOT NULL,
+    effective_to datetime, -- exclusive end of the window the schedule is in force, NULL while open
+    flat_fee INT NOT NULL DEFAULT 0,
+    max_order INT NOT NULL DEFAULT 0, -- 0 uses the default max order
+    tiers TEXT NOT NULL, -- JSON array of {"up_to": cents, "rate_basis_points": bps}, the last tier has up_to 0
+    created_at datetime,
+    UNIQUE (merchant_reference, version));
+
+CREATE TABLE IF NOT EXISTS ADJUSTMENTS (
+    id UUID PRIMARY KEY,
+    merchant_reference varchar(255) NOT NULL,
+    disbursement_group_id UUID, -- group whose payout the adjustment is applied to, NULL while pending for the next payout
+    kind varchar(16) NOT NULL,
+    source_id UUID, -- the refund or disbursement group the adjustment came from
+    amount INT NOT NULL, -- negative amounts reduce the payout
+    currency char(3) NOT NULL DEFAULT 'EUR', -- only applied to payouts in the same currency
+    reason varchar(255),
+    created_at datetime,
+    applied_at datetime);
+
+CREATE TABLE IF NOT EXISTS PAYOUT_HOLDS (
+    id UUID PRIMARY KEY,
+    merchant_reference varchar(255) NOT NULL,
+    reason varchar(255) NOT NULL,
+    placed_at datetime NOT NULL,
+    lifted_at datetime, -- NULL while the hold is in place
+    lift_reason varchar(255),
+    active_merchant_reference varchar(255) AS (IF(lifted_at IS NULL, merchant_reference, NULL)) PERSISTENT, -- set while the hold is in place
+    UNIQUE (active_merchant_reference)); -- one hold in place per merchant
+
+CREATE TABLE IF NOT EXISTS RESERVES (
+    id UUID PRIMARY KEY,
+    merchant_reference varchar(255) NOT NULL,
+    disbursement_group_id UUID NOT NULL, -- group whose payout the reserve was held back from
+    amount INT NOT NULL,
+    currency char(3) NOT NULL DEFAULT 'EUR', -- currency of the group
+    release_date date NOT NULL, -- day of the disbursement run that releases the reserve
+    transaction_id varchar(64), -- id of the payout provider transfer that released the reserve
+    released_at datetime,
+    created_at datetime NOT NULL);
+
+CREATE TABLE IF NOT EXISTS REFUNDS (
+    id UUID PRIMARY KEY,
+    order_id char(12) NOT NULL,
+    merchant_reference varchar(255) NOT NULL,
+    amount INT NOT NULL,
+    currency char(3) NOT NULL DEFAULT 'EUR', -- currency of the order
+    reason varchar(255),
+    adjustment_id UUID NOT NULL,
+    created_at datetime);
+
+CREATE TABLE IF NOT EXISTS JOURNAL_ENTRY (
+    id UUID PRIMARY KEY,
+    kind varchar(16) NOT NULL,
+    reference varchar(64) NOT NULL, -- the order id, disbursement group, monthly record or refund the entry records
+    merchant_reference varchar(255) NOT NULL,
+    effective_date date,
+    created_at datetime,
+    imported BOOLEAN NOT NULL DEFAULT FALSE, -- posted for imported records, replaced along with them
+    UNIQUE (kind, reference));
+
+CREATE TABLE IF NOT EXISTS LEDGER_POSTING (
+    id UUID PRIMARY KEY,
+    entry_id UUID NOT NULL,
+    account varchar(32) NOT NULL,
+    merchant_reference varchar(255) NOT NULL,
+    currency char(3) NOT NULL DEFAULT 'EUR', -- every posting of an entry is in the same currency, balances are kept per currency
+    amount INT NOT NULL, -- debits are positive and credits negative, the postings of an entry sum to zero
+    INDEX (account, merchant_reference, currency),
+    INDEX (entry_id));
+
+CREATE TABLE IF NOT EXISTS IMPORT_JOBS (
+    id UUID PRIMARY KEY,
+    state varchar(16) NOT NULL,
+    rows_processed INT NOT NULL DEFAULT 0,
+    rows_rejected INT NOT NULL DEFAULT 0,
+    error TEXT, -- why a failed or cancelled job stopped
+    stats TEXT, -- JSON summary of the records the job wrote
+    created_at datetime NOT NULL,
+    started_at datetime,
+    completed_at datetime);
+
+CREATE TABLE IF NOT EXISTS IMPORT_REJECTS (
+    job_id UUID NOT NULL,
+    file varchar(16) NOT NULL, -- orders or merchants
+    line INT NOT NULL,
+    record TEXT,
+    reason TEXT NOT NULL,
+    INDEX (job_id));
+
+CREATE TABLE IF NOT EXISTS IMPORT_DIGESTS (
+    merchant_reference varchar(255) PRIMARY KEY,
+    digest char(64) NOT NULL, -- SHA-256 of the merchant record, fee schedules and orders the merchant was last imported with
+    updated_at datetime);
+
+CREATE TABLE IF NOT EXISTS IMPORT_WATERMARKS (
+    merchant_reference varchar(255) PRIMARY KEY,
+    created_at datetime NOT NULL, -- creation time of the latest imported order of the merchant
+    order_ids TEXT NOT NULL, -- comma separated ids of the imported orders created at that time
+    updated_at datetime);
+
+-- Migrations of a database created with an earlier version of this file. CREATE TABLE IF NOT EXISTS leaves existing tables as they
+-- are, so the columns added since are added here. Every statement can be run again, on a new database they change nothing.
+ALTER TABLE DISBURSEMENT
+    MODIFY COLUMN transaction_id varchar(64),
+    ADD COLUMN IF NOT EXISTS order_amount INT AFTER order_id,
+    ADD COLUMN IF NOT EXISTS currency char(3) NOT NULL DEFAULT 'EUR' AFTER order_amount,
+    ADD COLUMN IF NOT EXISTS fee_schedule_id UUID AFTER order_fee,
+    ADD COLUMN IF NOT EXISTS fee_schedule_version INT AFTER fee_schedule_id,
+    ADD COLUMN IF NOT EXISTS rolled_payout_date date AFTER payout_date,
+    ADD COLUMN IF NOT EXISTS monthly_fee_deduction INT AFTER payout_total,
+    ADD COLUMN IF NOT EXISTS on_request BOOLEAN NOT NULL DEFAULT FALSE AFTER is_paid_out,
+    ADD COLUMN IF NOT EXISTS imported BOOLEAN NOT NULL DEFAULT FALSE AFTER on_request,
+    DROP COLUMN IF EXISTS order_fee_running_total, -- derived from the ledger postings of the group's orders
+    DROP COLUMN IF EXISTS payout_running_total;
+
+-- disbursement records written before order_amount take the amount of their order
+UPDATE DISBURSEMENT d JOIN ORDERS o ON o.id = d.order_id SET d.order_amount = o.amount WHERE d.order_amount IS NULL;
+
+ALTER TABLE ORDERS
+    ADD COLUMN IF NOT EXISTS currency char(3) NOT NULL DEFAULT 'EUR' AFTER amount;
+
+ALTER TABLE MERCHANTS
+    MODIFY COLUMN disbursement_frequency varchar(16),
+    ADD COLUMN IF NOT EXISTS currency char(3) NOT NULL DEFAULT 'EUR',
+    ADD COLUMN IF NOT EXISTS timezone varchar(64) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS payout_day INT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS reserve_rate_basis_points INT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS reserve_days INT NOT NULL DEFAULT 0;
+
+-- the unique key fails while a merchant has more than one MONTHLY record for a month, those have to be merged first
+ALTER TABLE MONTHLY
+    ADD COLUMN IF NOT EXISTS currency char(3) NOT NULL DEFAULT 'EUR' AFTER merchant_reference,
+    ADD COLUMN IF NOT EXISTS fee_deducted INT DEFAULT 0 AFTER amt_monthly_fee_paid,
+    ADD COLUMN IF NOT EXISTS disbursement_group_id UUID AFTER fee_deducted,
+    ADD COLUMN IF NOT EXISTS imported BOOLEAN NOT NULL DEFAULT FALSE AFTER disbursement_group_id,
+    ADD UNIQUE INDEX IF NOT EXISTS merchant_reference (merchant_reference, monthly_fee_date);
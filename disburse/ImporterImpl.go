@@ -1,14 +1,14 @@
 package disburse
 
 import (
-	"cmp"
 	"context"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/levtk/sequra/repo"
 	"github.com/levtk/sequra/types"
+	"io"
 	"log/slog"
-	"net/http"
 	"os"
 	"slices"
 	"time"
@@ -20,360 +20,974 @@ func NewImport(logger *slog.Logger, ctx context.Context, repo *repo.DisburserRep
 		Ctx:               ctx,
 		OrdersFileName:    types.OREDERS_FILENAME,
 		MerchantsFileName: types.MERCHANTS_FILENAME,
+		ChunkSize:         types.IMPORT_CHUNK_SIZE,
+		BatchSize:         types.IMPORT_BATCH_SIZE,
 		Repo:              repo,
 	}
 }
 
-func (i *Import) ImportOrders() ([]types.Disbursement, map[string]types.Merchant, []types.Monthly, error) {
-	var orders Orders
-	var disbursements []types.Disbursement
-	var merchants map[string]types.Merchant
-	var monthly []types.Monthly
+// ImportOrders imports the merchants and orders files of files, streaming the orders file through an external sort by merchant and
+// creation date into a disbursementBuilder. The merchants are written first, then the orders and their disbursement and monthly
+// records are written with bulk inserts of BatchSize rows as their disbursement groups and months close, so memory stays bounded by
+// ChunkSize orders whatever the size of the orders file. Each merchant is written in its own transaction: when the import fails or
+// ctx is cancelled the merchants already imported stay committed and the merchant being imported is rolled back. Merchant and order
+// records that fail validation are handed to the observer's Reject and left out. observer, when not nil, is also told as the import
+// moves through its states and after every BatchSize orders.
+//
+// Imports can be run again with the same or amended files. Merchants are upserted by id, and the orders of a merchant are only
+// imported when its merchant record, fee schedules or orders differ from those it was last imported with, see importDigests. The
+// imported records of such a merchant are then replaced: new and changed orders are upserted and its disbursement and monthly
+// records are recomputed from all of its orders in the file. Merchants a disbursement run has already paid out imported records
+// for are left as they were and counted as skipped.
+//
+// Incremental imports only take the orders created after the high-water mark of their merchant, see types.ImportWatermark, and
+// extend the merchant's records from where the last import left them rather than recomputing them, see importResume. Merchants
+// without a high-water mark are imported in full.
+//
+// Both files are read as semicolon separated files, JSON Lines or JSON arrays of objects keyed by the CSV column names, see
+// newRecordReader, written in the Dialect of files, and their records are validated alike whatever their format.
+func (i *Import) ImportOrders(ctx context.Context, files ImportFiles, observer ImportObserver) (types.ImportStats, error) {
+	var stats types.ImportStats
+	if observer == nil {
+		observer = nopImportObserver{}
+	}
+	progress := observer.Progress
+	reject := func(r types.ImportReject) error {
+		stats.Rejected++
+		return observer.Reject(r)
+	}
 
-	orders, err := parseDataFromOrders(i.OrdersFileName)
-	if err != nil {
-		i.Logger.Error("failed to parse data from orders", "error", err.Error())
-		return disbursements, merchants, monthly, err
+	if files.Merchants == "" {
+		files.Merchants = i.MerchantsFileName
+	}
+	if files.Orders == "" {
+		files.Orders = i.OrdersFileName
 	}
 
-	sortOrdersByMerchant(orders)
+	progress(types.IMPORT_PARSING, stats)
+	mfd, err := os.Open(files.Merchants)
+	if err != nil {
+		i.Logger.Error("failed to open merchants file", "error", err.Error())
+		return stats, err
+	}
+	defer mfd.Close()
 
-	merchants, err = parseDataFromMerchants(i.MerchantsFileName)
+	merchants, err := parseMerchants(mfd, files.MerchantsFormat, files.Dialect, reject)
 	if err != nil {
 		i.Logger.Error("failed to parse data from merchants", "error", err.Error())
-		return disbursements, merchants, monthly, err
+		return stats, err
+	}
+
+	feeSchedules, err := i.Repo.GetFeeSchedules(ctx)
+	if err != nil {
+		i.Logger.Error("failed to get fee schedules", "error", err.Error())
+		return stats, err
 	}
 
-	disbursements, monthly, err = buildDisbursementRecordsFromImport(1_500_000, orders, merchants)
-	return disbursements, merchants, monthly, err
+	all := make([]types.Merchant, 0, len(merchants))
+	for ref, merchant := range merchants {
+		merchant.FeeSchedules = feeSchedules[ref]
+		merchants[ref] = merchant
+		all = append(all, merchant)
+	}
+
+	stats.MerchantChanges, err = i.upsertMerchants(ctx, all)
+	if err != nil {
+		i.Logger.Error("failed to upsert merchants", "error", err.Error())
+		return stats, err
+	}
+	stats.Merchants = len(merchants)
+
+	ofd, err := os.Open(files.Orders)
+	if err != nil {
+		i.Logger.Error("failed to open orders file", "error", err.Error())
+		return stats, err
+	}
+	defer ofd.Close()
+
+	extend := map[string]types.ImportWatermark{}
+	if files.Incremental {
+		extend, err = i.Repo.GetImportWatermarks(ctx)
+		if err != nil {
+			i.Logger.Error("failed to get import watermarks", "error", err.Error())
+			return stats, err
+		}
+	}
+
+	digests := newImportDigests(merchants)
+	validator := newOrderValidator(merchants)
+	or, err := newFormatOrderReader(ofd, files.OrdersFormat, files.Dialect)
+	if err != nil {
+		i.Logger.Error("failed to read orders file", "error", err.Error())
+		return stats, err
+	}
+	or.reject = reject
+	or.check = func(o *Order) error {
+		wm, ok := extend[o.MerchantReference]
+		if ok && wm.Covers(o.ID, o.CreatedAt) {
+			stats.OrderChanges.Unchanged++
+			stats.Processed++
+			return errOrderImported
+		}
+
+		return validator.check(o)
+	}
+
+	// the orders are sorted by id first, so the orders repeating an id follow each other whatever their merchant and creation date
+	byID, cleanupByID, err := sortOrders(&contextSource{ctx: ctx, src: or}, compareOrdersByID, i.ChunkSize, os.TempDir())
+	if err != nil {
+		i.Logger.Error("failed to sort orders by id", "error", err.Error())
+		return stats, err
+	}
+	unique := &uniqueOrders{src: byID, reject: or.rejectOrder, accept: digests.add}
+	orders, cleanup, err := sortOrders(&contextSource{ctx: ctx, src: unique}, compareOrdersByMerchant, i.ChunkSize, os.TempDir())
+	removeErr := cleanupByID() // the orders sorted by id have all been read
+	if removeErr != nil {
+		i.Logger.Error("failed to remove order chunks sorted by id", "error", removeErr)
+	}
+	if err != nil {
+		i.Logger.Error("failed to sort orders", "error", err.Error())
+		return stats, err
+	}
+	defer func() {
+		err := cleanup()
+		if err != nil {
+			i.Logger.Error("failed to remove sorted order chunks", "error", err)
+		}
+	}()
+
+	stored, err := i.Repo.GetImportDigests(ctx)
+	if err != nil {
+		i.Logger.Error("failed to get import digests", "error", err.Error())
+		return stats, err
+	}
+	changed := digests.changed(stored)
+
+	// records are written as they are built, the job is inserting once the first merchant's records are written
+	state := types.IMPORT_BUILDING
+	progress(state, stats)
+	w := newImportWriter(ctx, i.Logger, i.Repo, i.BatchSize, changed, extend, &stats)
+	w.inserting = func() {
+		state = types.IMPORT_INSERTING
+		progress(state, stats)
+	}
+	defer w.Close()
+
+	b := newDisbursementBuilder(merchants, w.addDisbursements, w.addMonthly)
+	b.emitDeductions = w.addDeductions
+	b.calendar = i.Calendar
+	if files.Incremental {
+		b.resume = i.resumeFrom(ctx, extend)
+	}
+	for {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+
+		o, err := orders.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			i.Logger.Error("failed to read orders", "error", err.Error())
+			return stats, err
+		}
+
+		_, extended := extend[o.MerchantReference]
+		if _, ok := changed[o.MerchantReference]; !ok && !extended {
+			stats.OrderChanges.Unchanged++
+			stats.Processed++
+			continue
+		}
+
+		err = b.Add(o)
+		if err != nil {
+			i.Logger.Error("failed to build disbursement record", "order_id", o.ID, "error", err.Error())
+			return stats, err
+		}
+
+		o.MerchantID = merchants[o.MerchantReference].ID
+		err = w.addOrder(o)
+		if err != nil {
+			i.Logger.Error("failed to import orders of merchant", "merchant", w.merchant, "error", err.Error())
+			return stats, err
+		}
+
+		stats.Processed++
+		if stats.Processed%w.size == 0 {
+			progress(state, stats)
+		}
+	}
+
+	progress(state, stats)
+	err = b.Finish()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		i.Logger.Error("failed to import orders of merchant", "merchant", w.merchant, "error", err.Error())
+		return stats, err
+	}
+	if !b.pastCalendar.IsZero() {
+		warnPastCalendar(i.Logger, i.Calendar, b.pastCalendar)
+	}
+
+	// merchants imported before whose orders have all been removed from the file never reached the writer
+	var cleared []string
+	for ref := range changed {
+		_, extended := extend[ref]
+		if !w.visited[ref] && !extended && stored[ref] != "" {
+			cleared = append(cleared, ref)
+		}
+	}
+	slices.Sort(cleared)
+	for _, ref := range cleared {
+		err = w.clear(ref)
+		if err != nil {
+			i.Logger.Error("failed to clear the imported records of merchant", "merchant", ref, "error", err.Error())
+			return stats, err
+		}
+	}
+	return stats, nil
 }
 
-func sortOrdersByMerchant(orders Orders) {
-	slices.SortFunc(orders, func(a, b *Order) int {
-		if a != nil && b != nil {
-			if n := cmp.Compare(a.MerchantReference, b.MerchantReference); n != 0 {
-				return n
+// resumeFrom returns the resume func of a disbursementBuilder that picks up the merchants of watermarks where the import that set
+// their high-water mark left them.
+func (i *Import) resumeFrom(ctx context.Context, watermarks map[string]types.ImportWatermark) func(types.Merchant) (importResume, bool, error) {
+	return func(merchant types.Merchant) (importResume, bool, error) {
+		wm, ok := watermarks[merchant.Reference]
+		if !ok || len(wm.OrderIDs) == 0 {
+			return importResume{}, false, nil
+		}
+
+		payoutDate, err := importedPayoutDate(merchant, wm.CreatedAt)
+		if err != nil {
+			return importResume{}, false, err
+		}
+
+		r := importResume{
+			last:       &Order{ID: wm.OrderIDs[len(wm.OrderIDs)-1], MerchantReference: merchant.Reference, CreatedAt: wm.CreatedAt},
+			payoutDate: payoutDate,
+		}
+
+		open, err := i.Repo.GetOpenImportedGroups(ctx, merchant.Reference)
+		if err != nil {
+			return r, false, err
+		}
+		freq, err := NewPayoutFrequency(merchant.DisbursementFrequency)
+		if err != nil {
+			return importResume{}, false, err
+		}
+
+		r.groups = map[string][]types.Disbursement{}
+		for _, d := range open {
+			if freq.OnRequest() && d.OnRequest || d.PayoutDate.Equal(payoutDate) {
+				currency := types.CurrencyCode(d.Currency)
+				r.groups[currency] = append(r.groups[currency], d)
 			}
-			return a.CreatedAt.Compare(b.CreatedAt)
 		}
-		return 0
-	})
+
+		r.monthOrderTotal, r.monthOrderFeeTotal, err = i.Repo.GetMonthTotals(ctx, merchant.Reference, merchant.Currency, types.StartOfMonth(payoutDate))
+		if err != nil {
+			return r, false, err
+		}
+
+		r.outstanding, err = i.Repo.GetOutstandingMonthlyFees(ctx, merchant.Reference)
+		if err != nil {
+			return r, false, err
+		}
+
+		r.recordedThrough, err = i.Repo.GetLastMonthlyFeeDate(ctx, merchant.Reference)
+		return r, err == nil, err
+	}
 }
 
-// TODO add monthly fees charged logic and to disbursement or another table.
-// calculatePayout takes a sorted list of type Orders and calculates their distribution payouts and creates the distribution id.
-func buildDisbursementRecordsFromImport(size int, o Orders, m map[string]types.Merchant) ([]types.Disbursement, []types.Monthly, error) {
-	var merchant types.Merchant
-	disbursements := make([]types.Disbursement, size)
-	monthly := make([]types.Monthly, 2_000_000)
-	monthlyCount := 0
-	var frequency string
-	var disbursementGroupID uuid.UUID
-	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
-
-	for i := 0; i < len(o); i++ {
-		if o[i] != nil {
-			merchant = m[o[i].MerchantReference]
-			frequency = merchant.DisbursementFrequency
-
-			if i == 0 { //For the first order, create the disbursement for index 0
-				disbursements[i].RecordUUID = uuid.New()
-				disbursementGroupID = uuid.New()
-				orderFee, err := o[i].CalculateOrderFee()
-				if err != nil {
-					return disbursements, monthly, err
-				}
+// nopImportObserver ignores the progress and the rejects of an import.
+type nopImportObserver struct{}
 
-				disbursements[i].OrderFee = orderFee
-				disbursements[i].OrderFeeRunningTotal = orderFee
-				disbursements[i].PayoutRunningTotal = o[i].Amount - orderFee
-				disbursements[i].DisbursementGroupID = disbursementGroupID
-				disbursements[i].MerchReference = m[o[i].MerchantReference].Reference
-				disbursements[i].OrderID = o[i].ID
+func (nopImportObserver) Progress(string, types.ImportStats) {}
 
-				if frequency == types.DAILY {
-					disbursements[i].PayoutDate = o[i].CreatedAt
-				}
+func (nopImportObserver) Reject(types.ImportReject) error { return nil }
 
-				if m[o[i].MerchantReference].DisbursementFrequency == types.WEEKLY {
-					disbursements[i].PayoutDate, err = merchant.CalculatePastPayoutDate(o[i].CreatedAt)
-					if err != nil {
-						return disbursements, monthly, err
-					}
-				}
-				continue
-			}
-			if i > 0 && o[i] != nil { //after first disbursement record is created we can calculate values based on the past records
-				newPayoutPeriod, err := isNewPayoutPeriod(o[i-1], o[i], m[o[i].MerchantReference]) //checking to see if this is a new payout period
-				if err != nil {
-					return nil, monthly, err
-				}
+// upsertMerchants stores the merchants that are new or differ from the stored merchant with the same id in a single transaction and
+// counts them against the stored merchants.
+func (i *Import) upsertMerchants(ctx context.Context, merchants []types.Merchant) (types.ImportChanges, error) {
+	var changes types.ImportChanges
+	stored, err := i.Repo.GetMerchants(ctx)
+	if err != nil {
+		return changes, err
+	}
 
-				if o[i] != nil {
-					frequency = m[o[i].MerchantReference].DisbursementFrequency
-					switch frequency {
-					case types.DAILY:
-						if !newPayoutPeriod {
-							orderFee, err := o[i].CalculateOrderFee()
-							if err != nil {
-								return disbursements, monthly, err
-							}
-							disbursements[i].RecordUUID = uuid.New()
-							disbursements[i].MerchReference = o[i].MerchantReference
-
-							disbursements[i].OrderFeeRunningTotal = orderFee + disbursements[i-1].OrderFeeRunningTotal
-							disbursements[i].PayoutRunningTotal = disbursements[i-1].PayoutRunningTotal + (o[i].Amount - orderFee)
-							disbursements[i].DisbursementGroupID = disbursements[i-1].DisbursementGroupID //use the previous disbursement group RecordUUID
-
-							disbursements[i].OrderID = o[i].ID
-							disbursements[i].OrderFee = orderFee
-							disbursements[i].PayoutDate = o[i].CreatedAt
-							continue
-
-						} else {
-							orderFee, err := o[i].CalculateOrderFee()
-							if err != nil {
-								return disbursements, monthly, err
-							}
-
-							disbursements[i].RecordUUID = uuid.New()
-							disbursements[i-1].PayoutTotal = disbursements[i-1].PayoutRunningTotal //The last running total record within the frequency period becomes the PayoutTotal
-							disbursements[i].DisbursementGroupID = uuid.New()                      //create new disbursement group RecordUUID
-							disbursements[i].MerchReference = o[i].MerchantReference               //set the merchant var to the new value
-							disbursements[i].OrderFeeRunningTotal = orderFee
-							disbursements[i].PayoutRunningTotal = o[i].Amount - orderFee
-							disbursements[i].OrderID = o[i].ID
-							disbursements[i].OrderFee = orderFee
-							disbursements[i].PayoutDate = o[i].CreatedAt
-
-							disbursements[i-1].PayoutTotal = disbursements[i-1].PayoutRunningTotal
-							disbursements[i-1].IsPaidOut = true
-
-							if types.IsNewMonth(disbursements[i-1].PayoutDate, disbursements[i].PayoutDate) {
-								monthlyFee, err := types.StrToInt64(m[o[i].MerchantReference].MinMonthlyFee)
-								if err != nil {
-									logger.Error("failed to parse monthly fee to int64", "error", err)
-								}
-
-								var didPayFee = 1
-								if (disbursements[i-1].OrderFeeRunningTotal-monthlyFee > 0) || m[o[i].MerchantReference].MinMonthlyFee == "0.0" {
-									didPayFee = 0
-								}
-
-								monthly[monthlyCount] = types.Monthly{
-									ID:                uuid.New(),
-									MerchantReference: m[o[i].MerchantReference].Reference,
-									MerchantID:        merchant.ID,
-									MonthlyFeeDate:    disbursements[i].PayoutDate,
-									DidPayFee:         didPayFee,
-									MonthlyFee:        monthlyFee,
-									TotalOrderAmt:     disbursements[i-1].PayoutRunningTotal,
-									OrderFeeTotal:     disbursements[i-1].OrderFeeRunningTotal,
-									CreatedAt:         disbursements[i].PayoutDate,
-									UpdatedAt:         time.Now().UTC(),
-								}
-								monthlyCount++
-							}
-							continue
-						}
-					case types.WEEKLY:
-						orderFee, err := o[i].CalculateOrderFee()
-						if err != nil {
-							return disbursements, monthly, err
-						}
-
-						if !newPayoutPeriod {
-							previousRecordPayoutDate, err := merchant.CalculatePastPayoutDate(o[i-1].CreatedAt)
-							if err != nil {
-								return disbursements, monthly, err
-							}
-
-							disbursements[i].RecordUUID = uuid.New()
-							disbursements[i].MerchReference = o[i].MerchantReference
-							disbursements[i].OrderFeeRunningTotal = orderFee + disbursements[i-1].OrderFeeRunningTotal
-							disbursements[i].PayoutRunningTotal = disbursements[i-1].PayoutRunningTotal + (o[i].Amount - orderFee)
-							disbursements[i].DisbursementGroupID = disbursements[i-1].DisbursementGroupID
-							disbursements[i].OrderID = o[i].ID
-							disbursements[i].OrderFee = orderFee
-							disbursements[i].PayoutDate = previousRecordPayoutDate.UTC()
-							continue
-						} else {
-							currentRecordsPayoutDate, err := merchant.CalculatePastPayoutDate(o[i].CreatedAt)
-							if err != nil {
-								return disbursements, monthly, err
-							}
-
-							disbursements[i].RecordUUID = uuid.New()
-							disbursements[i].MerchReference = o[i].MerchantReference
-							disbursements[i].OrderFeeRunningTotal = orderFee
-							disbursements[i].PayoutRunningTotal = o[i].Amount - orderFee
-							disbursements[i].DisbursementGroupID = uuid.New()
-							disbursements[i].OrderID = o[i].ID
-							disbursements[i].OrderFee = orderFee
-							disbursements[i].PayoutDate = currentRecordsPayoutDate.UTC()
-
-							disbursements[i-1].PayoutTotal = disbursements[i-1].PayoutRunningTotal
-							disbursements[i-1].IsPaidOut = true
-
-							if types.IsNewMonth(disbursements[i-1].PayoutDate, disbursements[i].PayoutDate) {
-								monthlyFee, err := types.StrToInt64(m[o[i].MerchantReference].MinMonthlyFee)
-								if err != nil {
-									logger.Error("failed to parse monthly fee to int64", "error", err)
-								}
-
-								didPayFee := 1
-								if (disbursements[i-1].OrderFeeRunningTotal-monthlyFee > 0) || m[o[i].MerchantReference].MinMonthlyFee == "0.0" {
-									didPayFee = 0
-								}
-
-								monthly[monthlyCount] = types.Monthly{
-									ID:                uuid.New(),
-									MerchantReference: m[o[i].MerchantReference].Reference,
-									MerchantID:        merchant.ID,
-									MonthlyFeeDate:    disbursements[i].PayoutDate,
-									DidPayFee:         didPayFee,
-									MonthlyFee:        monthlyFee,
-									TotalOrderAmt:     disbursements[i-1].PayoutRunningTotal,
-									OrderFeeTotal:     disbursements[i-1].OrderFeeRunningTotal,
-									CreatedAt:         disbursements[i].PayoutDate,
-									UpdatedAt:         time.Now().UTC(),
-								}
-								monthlyCount++
-							}
-							continue
-						}
-					default:
-						logger.Info("failed to match select case for payout period", "got", frequency)
-
-					}
-				}
-			}
+	var upserts []types.Merchant
+	for _, m := range merchants {
+		s, ok := stored[m.ID]
+		switch {
+		case !ok:
+			changes.Inserted++
+		case sameMerchant(s, m):
+			changes.Unchanged++
+			continue
+		default:
+			changes.Updated++
 		}
+		upserts = append(upserts, m)
+	}
+
+	if len(upserts) == 0 {
+		return changes, nil
+	}
+
+	tx, err := i.Repo.BeginBulk(ctx, i.BatchSize)
+	if err != nil {
+		return types.ImportChanges{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.UpsertMerchants(upserts)
+	if err == nil {
+		err = tx.Commit()
 	}
-	return disbursements, monthly, nil
+	if err != nil {
+		return types.ImportChanges{}, err
+	}
+	return changes, nil
 }
 
-func isNewPayoutPeriod(o1 *Order, o2 *Order, m types.Merchant) (bool, error) {
-	if o1 != nil && o2 != nil {
-		if m.DisbursementFrequency == types.DAILY {
-			if (o1.MerchantReference == o2.MerchantReference) && (o1.CreatedAt != o2.CreatedAt) {
-				return true, nil
-			}
+// sameMerchant reports whether the stored merchant a has the fields of the merchant record b, every field the merchant's digest is
+// computed from, so a merchant whose records are recomputed is always stored again.
+func sameMerchant(a, b types.Merchant) bool {
+	return a.Reference == b.Reference && a.Email == b.Email && a.LiveOn.Equal(b.LiveOn) &&
+		a.DisbursementFrequency == b.DisbursementFrequency && a.MinMonthlyFee == b.MinMonthlyFee && types.SameCurrency(a.Currency, b.Currency) &&
+		a.Timezone == b.Timezone && a.PayoutDay == b.PayoutDay
+}
 
-			if o1.MerchantReference != o2.MerchantReference {
-				return true, nil
-			}
-			return false, nil
+// sameOrder reports whether the stored order a has the fields of the order record b.
+func sameOrder(a, b types.Order) bool {
+	return a.MerchantReference == b.MerchantReference && a.Amount == b.Amount && types.SameCurrency(a.Currency, b.Currency) &&
+		a.CreatedAt.Equal(b.CreatedAt)
+}
+
+// disbursementBuilder turns orders sorted by merchant and creation date into disbursement and monthly records one order at a time.
+// Only the open disbursement groups and the monthly records of the current merchant are held in memory: the records of a group are
+// emitted once the group closes, with its payout total on the closing record, and the monthly records of a merchant once the
+// next merchant starts. The emit funcs must not retain the slices they are passed.
+//
+// The orders of each currency go in a disbursement group of their own, so a merchant is paid out once per currency and payout
+// period. Only the orders in the merchant's currency count towards its minimum monthly fee, which is deducted from the payouts in
+// that currency.
+//
+// When resume is set the builder picks up every merchant where an earlier import left it, see importResume, instead of starting from
+// the merchant's first order: the open groups are extended and the stored outstanding monthly fees are deducted from the payouts
+// before those of the new months, their deductions emitted with emitDeductions.
+//
+// Payout dates are rolled forward to the business days of calendar, which has weekends but no holidays when nil. pastCalendar is the
+// latest rolled payout date after the last year of the holidays of calendar, zero when every payout date is covered.
+type disbursementBuilder struct {
+	merchants          map[string]types.Merchant
+	emitDisbursements  func([]types.Disbursement) error
+	emitMonthly        func([]types.Monthly) error
+	emitDeductions     func([]types.Monthly) error
+	resume             func(merchant types.Merchant) (importResume, bool, error)
+	calendar           *types.Calendar
+	prev               *Order
+	payoutDate         time.Time
+	groups             map[string][]types.Disbursement
+	monthOrderTotal    int64
+	monthOrderFeeTotal int64
+	monthly            []types.Monthly
+	outstanding        []types.Monthly
+	recordedThrough    time.Time
+	pastCalendar       time.Time
+}
+
+// importResume is the state an earlier import left a merchant in: its last imported order, which only needs the id, merchant
+// reference and creation date, and that order's payout date, the records of its disbursement groups still open keyed by currency,
+// the order totals in the merchant's currency of the month of that payout date, the monthly fees still outstanding and the month of
+// its latest monthly record.
+type importResume struct {
+	last               *Order
+	payoutDate         time.Time
+	groups             map[string][]types.Disbursement
+	monthOrderTotal    int64
+	monthOrderFeeTotal int64
+	outstanding        []types.Monthly
+	recordedThrough    time.Time
+}
+
+func newDisbursementBuilder(merchants map[string]types.Merchant, emitDisbursements func([]types.Disbursement) error, emitMonthly func([]types.Monthly) error) *disbursementBuilder {
+	return &disbursementBuilder{
+		merchants:         merchants,
+		emitDisbursements: emitDisbursements,
+		emitMonthly:       emitMonthly,
+		groups:            map[string][]types.Disbursement{},
+	}
+}
+
+// Add builds the disbursement record of the order. When the order starts a new payout period the open groups are closed first, and
+// when it also starts a new month of the same merchant the months since the previous order are closed.
+func (b *disbursementBuilder) Add(o *Order) error {
+	merchant, ok := b.merchants[o.MerchantReference]
+	if !ok {
+		return fmt.Errorf("unknown merchant %s", o.MerchantReference)
+	}
+
+	payoutDate, err := importedPayoutDate(merchant, o.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	orderFee, feeSchedule, err := o.CalculateOrderFee(merchant)
+	if err != nil {
+		return err
+	}
+
+	if b.prev != nil && b.prev.MerchantReference != o.MerchantReference {
+		err = b.closeGroups()
+		if err != nil {
+			return err
 		}
 
-		if m.DisbursementFrequency == types.WEEKLY {
-			if o1.MerchantReference != o2.MerchantReference {
-				return true, nil
-			}
+		err = b.closeMerchant()
+		if err != nil {
+			return err
+		}
+		b.prev = nil
+	}
+
+	if b.prev == nil && b.resume != nil {
+		err = b.resumeMerchant(merchant)
+		if err != nil {
+			return err
+		}
+	}
 
-			payoutDate1, err := m.CalculatePastPayoutDate(o1.CreatedAt)
+	if b.prev != nil {
+		newPayoutPeriod, err := isNewPayoutPeriod(b.prev, o, merchant)
+		if err != nil {
+			return err
+		}
+
+		if newPayoutPeriod {
+			err = b.closeGroups()
 			if err != nil {
-				return false, err
+				return err
 			}
+		}
 
-			payoutDate2, err := m.CalculatePastPayoutDate(o2.CreatedAt)
+		if !types.StartOfMonth(b.payoutDate).Equal(types.StartOfMonth(payoutDate)) {
+			closed, err := closeMonthlyFees(merchant, b.payoutDate, payoutDate, b.monthOrderTotal, b.monthOrderFeeTotal)
 			if err != nil {
-				return false, err
+				return err
 			}
 
-			if o1.MerchantReference == o2.MerchantReference && payoutDate1 == payoutDate2 {
-				return false, nil
+			for _, m := range closed {
+				if m.MonthlyFeeDate.After(b.recordedThrough) {
+					b.monthly = append(b.monthly, m)
+				}
 			}
+			b.monthOrderTotal, b.monthOrderFeeTotal = 0, 0
+		}
+	}
 
-			if o1.MerchantReference == o2.MerchantReference && payoutDate1 != payoutDate2 {
-				return true, nil
-			}
+	freq, err := NewPayoutFrequency(merchant.DisbursementFrequency)
+	if err != nil {
+		return err
+	}
+
+	currency := types.CurrencyCode(o.Currency)
+	d := types.Disbursement{
+		RecordUUID:           uuid.New(),
+		DisbursementGroupID:  uuid.New(),
+		MerchReference:       o.MerchantReference,
+		OrderID:              o.ID,
+		OrderAmount:          o.Amount,
+		Currency:             currency,
+		OrderFee:             orderFee,
+		FeeScheduleID:        feeSchedule.ID,
+		FeeScheduleVersion:   feeSchedule.Version,
+		OrderFeeRunningTotal: orderFee,
+		PayoutDate:           payoutDate,
+		RolledPayoutDate:     b.calendar.RollForward(payoutDate),
+		PayoutRunningTotal:   o.Amount - orderFee,
+	}
+	if freq.OnRequest() {
+		d.RolledPayoutDate = time.Time{}
+		d.OnRequest = true
+	} else if !b.calendar.Covers(d.RolledPayoutDate) && d.RolledPayoutDate.After(b.pastCalendar) {
+		b.pastCalendar = d.RolledPayoutDate
+	}
+	group := b.groups[currency]
+	if len(group) > 0 {
+		prev := group[len(group)-1]
+		d.DisbursementGroupID = prev.DisbursementGroupID
+		d.OrderFeeRunningTotal += prev.OrderFeeRunningTotal
+		d.PayoutRunningTotal += prev.PayoutRunningTotal
+	}
+
+	b.groups[currency] = append(group, d)
+	if types.SameCurrency(currency, merchant.Currency) {
+		b.monthOrderTotal += o.Amount
+		b.monthOrderFeeTotal += orderFee
+	}
+	b.prev = o
+	b.payoutDate = payoutDate
+	return nil
+}
+
+// resumeMerchant picks up the merchant where an earlier import left it, when it did.
+func (b *disbursementBuilder) resumeMerchant(merchant types.Merchant) error {
+	r, ok, err := b.resume(merchant)
+	if err != nil || !ok {
+		return err
+	}
 
+	b.prev = r.last
+	b.payoutDate = r.payoutDate
+	for currency, group := range r.groups {
+		currency = types.CurrencyCode(currency)
+		b.groups[currency] = append(b.groups[currency][:0], group...)
+	}
+	b.monthOrderTotal, b.monthOrderFeeTotal = r.monthOrderTotal, r.monthOrderFeeTotal
+	b.outstanding = r.outstanding
+	b.recordedThrough = r.recordedThrough
+	return nil
+}
+
+// Finish emits the disbursement groups that are still open, unpaid, and the monthly records of the last merchant.
+func (b *disbursementBuilder) Finish() error {
+	for _, currency := range b.openCurrencies() {
+		err := b.emitDisbursements(b.groups[currency])
+		if err != nil {
+			return err
 		}
+		b.groups[currency] = b.groups[currency][:0]
+	}
+	return b.closeMerchant()
+}
+
+// openCurrencies returns the currencies of the open disbursement groups in alphabetical order, the order the groups are emitted in.
+func (b *disbursementBuilder) openCurrencies() []string {
+	var open []string
+	for currency, group := range b.groups {
+		if len(group) > 0 {
+			open = append(open, currency)
+		}
+	}
+	slices.Sort(open)
+	return open
+}
+
+// closeGroups closes the open disbursement group of every currency, see closeGroup.
+func (b *disbursementBuilder) closeGroups() error {
+	for _, currency := range b.openCurrencies() {
+		err := b.closeGroup(currency)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeGroup deducts the merchant's outstanding minimum monthly fees from the payout of the open group in currency when it is the
+// merchant's currency, stores the payout total on its closing record, marks every record of the group as paid out and emits them.
+// The group of a merchant paid out on request is emitted unpaid instead, its orders accrue until the merchant requests a payout and
+// the disbursement run deducts the fees then.
+func (b *disbursementBuilder) closeGroup(currency string) error {
+	group := b.groups[currency]
+	if len(group) == 0 {
+		return nil
+	}
 
-		return false, errors.New("no determination of payout same merchant")
+	if group[0].OnRequest {
+		err := b.emitDisbursements(group)
+		b.groups[currency] = group[:0]
+		return err
 	}
-	return false, nil
+
+	last := &group[len(group)-1]
+	if types.SameCurrency(currency, b.merchants[last.MerchReference].Currency) {
+		last.MonthlyFeeDeduction = deductMonthlyFees(b.outstanding, last.PayoutRunningTotal, last.DisbursementGroupID)
+		last.MonthlyFeeDeduction += deductMonthlyFees(b.monthly, last.PayoutRunningTotal-last.MonthlyFeeDeduction, last.DisbursementGroupID)
+	}
+	last.PayoutTotal = last.PayoutRunningTotal - last.MonthlyFeeDeduction //The last running total record within the frequency period becomes the PayoutTotal
+	for i := range group {
+		group[i].IsPaidOut = true
+	}
+
+	err := b.emitDisbursements(group)
+	b.groups[currency] = group[:0]
+	return err
 }
 
-func buildWeeklyRecord(o Orders, m map[string]types.Merchant, disbursements []types.Disbursement, i int) ([]types.Disbursement, error) {
-	orderFee, err := o[i].CalculateOrderFee()
+// closeMerchant emits the monthly records and the deductions from stored monthly records of the current merchant and resets the
+// month totals for the next one.
+func (b *disbursementBuilder) closeMerchant() error {
+	var err error
+	if len(b.monthly) > 0 {
+		err = b.emitMonthly(b.monthly)
+	}
+	if err == nil && len(b.outstanding) > 0 {
+		err = b.emitDeductions(b.outstanding)
+	}
+	b.monthly, b.outstanding = nil, nil
+	b.recordedThrough = time.Time{}
+	b.monthOrderTotal, b.monthOrderFeeTotal = 0, 0
+	return err
+}
+
+// importedPayoutDate returns the payout date of an imported order, dated by its creation time like the orders posted to the API
+// are by the time they are received, see orderPayoutDate.
+func importedPayoutDate(merchant types.Merchant, createdAt time.Time) (time.Time, error) {
+	freq, err := NewPayoutFrequency(merchant.DisbursementFrequency)
 	if err != nil {
-		return disbursements, err
+		return createdAt, fmt.Errorf("merchant %s: %w", merchant.Reference, err)
 	}
 
-	if i <= len(o)-1 {
-		newPayoutPeriod, err := isNewPayoutPeriod(o[i-1], o[i], m[o[i].MerchantReference])
-		if err != nil {
-			return disbursements, err
-		}
-
-		if !newPayoutPeriod {
-			disbursements[i].RecordUUID = uuid.New()
-			disbursements[i].OrderFeeRunningTotal = orderFee + disbursements[i-1].OrderFeeRunningTotal
-			disbursements[i].DisbursementGroupID = disbursements[i-1].DisbursementGroupID
-			disbursements[i].OrderID = o[i].ID
-			disbursements[i].OrderFee = orderFee
-			disbursements[i].PayoutDate = disbursements[i-1].PayoutDate
-			return disbursements, nil
-		} else {
-			newPayoutPeriod = true
-			disbursements[i].DisbursementGroupID = uuid.New()
-			disbursements[i].RecordUUID = uuid.New()
-			disbursements[i].OrderFeeRunningTotal = orderFee
-			disbursements[i].OrderID = o[i].ID
-			disbursements[i].OrderFee = orderFee
-			merchant := m[o[i].MerchantReference]
-			pastPayoutDate, err := merchant.CalculatePastPayoutDate(o[i].CreatedAt)
+	payoutDate, err := orderPayoutDate(merchant, freq, createdAt)
+	if err != nil {
+		return createdAt, err
+	}
+	return payoutDate, nil
+}
+
+// importWriter buffers the orders and records built by the import and writes them with bulk inserts of size rows. Every merchant is
+// written in its own transaction, committed once the records of the next merchant arrive or the import is flushed, so each
+// merchant is either imported in full or not at all. The transaction first replaces the merchant's imported records and ends by
+// recording the merchant's digest from digests; a merchant whose imported records have been paid out is skipped instead. The
+// records of the merchants in extend are added to those already stored instead of replacing them. Either way the transaction
+// records the merchant's new high-water mark. inserting, when set, is called once before the first transaction is started.
+type importWriter struct {
+	repo          *repo.DisburserRepo
+	ctx           context.Context
+	logger        *slog.Logger
+	size          int
+	digests       map[string]string
+	extend        map[string]types.ImportWatermark
+	stats         *types.ImportStats
+	inserting     func()
+	merchant      string
+	visited       map[string]bool
+	tx            *repo.BulkTx
+	skip          bool
+	extending     bool
+	mark          types.ImportWatermark
+	stored        map[string]types.Order
+	pending       types.ImportStats
+	orders        []types.Order
+	disbursements []types.Disbursement
+	monthly       []types.Monthly
+	deductions    []types.Monthly
+}
+
+func newImportWriter(ctx context.Context, logger *slog.Logger, r *repo.DisburserRepo, size int, digests map[string]string, extend map[string]types.ImportWatermark, stats *types.ImportStats) *importWriter {
+	if size <= 0 {
+		size = types.IMPORT_BATCH_SIZE
+	}
+	return &importWriter{
+		repo:          r,
+		ctx:           ctx,
+		logger:        logger,
+		size:          size,
+		digests:       digests,
+		extend:        extend,
+		stats:         stats,
+		visited:       map[string]bool{},
+		orders:        make([]types.Order, 0, size),
+		disbursements: make([]types.Disbursement, 0, size),
+		monthly:       make([]types.Monthly, 0, size),
+	}
+}
+
+func (w *importWriter) addOrder(o *Order) error {
+	err := w.forMerchant(o.MerchantReference)
+	if err != nil || w.skip {
+		return err
+	}
+
+	switch {
+	case o.CreatedAt.After(w.mark.CreatedAt):
+		w.mark.CreatedAt = o.CreatedAt
+		w.mark.OrderIDs = append(w.mark.OrderIDs[:0], o.ID)
+	case o.CreatedAt.Equal(w.mark.CreatedAt):
+		w.mark.OrderIDs = append(w.mark.OrderIDs, o.ID)
+	}
+
+	w.orders = append(w.orders, types.Order{ID: o.ID, MerchantReference: o.MerchantReference, MerchantID: o.MerchantID, Amount: o.Amount,
+		Currency: types.CurrencyCode(o.Currency), CreatedAt: o.CreatedAt})
+	if len(w.orders) == w.size {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *importWriter) addDisbursements(ds []types.Disbursement) error {
+	for _, d := range ds {
+		err := w.forMerchant(d.MerchReference)
+		if err != nil || w.skip {
+			return err
+		}
+
+		w.disbursements = append(w.disbursements, d)
+		if len(w.disbursements) == w.size {
+			err = w.flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *importWriter) addMonthly(ms []types.Monthly) error {
+	for _, m := range ms {
+		err := w.forMerchant(m.MerchantReference)
+		if err != nil || w.skip {
+			return err
+		}
+
+		w.monthly = append(w.monthly, m)
+		if len(w.monthly) == w.size {
+			err = w.flush()
 			if err != nil {
-				return disbursements, err
+				return err
 			}
-			disbursements[i].PayoutDate = pastPayoutDate
-			return disbursements, nil
 		}
 	}
-	return disbursements, nil
+	return nil
 }
 
-func calculateDisbursementPeriodPayout(disbursements []types.Disbursement, i int) (int64, error) {
-	payoutTotal := disbursements[i].PayoutRunningTotal - disbursements[i].OrderFeeRunningTotal
-	if payoutTotal < 0 {
-		return 0, errors.New("payout total less than zero and is not an accounting adjustment")
+// addDeductions buffers monthly fee deductions from stored monthly records, which are few per merchant.
+func (w *importWriter) addDeductions(ms []types.Monthly) error {
+	for _, m := range ms {
+		err := w.forMerchant(m.MerchantReference)
+		if err != nil || w.skip {
+			return err
+		}
+		w.deductions = append(w.deductions, m)
 	}
-	return payoutTotal, nil
+	return nil
 }
 
-func (i *Import) Import(w http.ResponseWriter, r *http.Request) {
+// forMerchant commits the transaction of the current merchant when a record of another merchant arrives.
+func (w *importWriter) forMerchant(merchRef string) error {
+	if merchRef == w.merchant {
+		return nil
+	}
 
-	op := NewOrderProcessor(i.Logger, i.Ctx, i.Repo)
-	distributions, merchants, monthly, err := i.ImportOrders()
+	err := w.Flush()
 	if err != nil {
-		i.Logger.Error("failed to import orders or merchants", "error", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return err
 	}
+	w.merchant = merchRef
+	w.visited[merchRef] = true
+	w.skip = false
+	var wm types.ImportWatermark
+	wm, w.extending = w.extend[merchRef]
+	w.mark = types.ImportWatermark{MerchantReference: merchRef, CreatedAt: wm.CreatedAt, OrderIDs: slices.Clone(wm.OrderIDs)}
+	return nil
+}
 
-	for _, v := range merchants {
-		err := i.Repo.InsertMerchant(v)
-		if err != nil {
-			i.Logger.Error(err.Error())
+// begin starts the transaction of the current merchant and, unless it is being extended, deletes its imported records. When they
+// have been paid out the merchant is skipped and its buffered records dropped.
+func (w *importWriter) begin() error {
+	if w.inserting != nil {
+		w.inserting()
+		w.inserting = nil
+	}
+
+	tx, err := w.repo.BeginBulk(w.ctx, w.size)
+	if err != nil {
+		return err
+	}
+
+	if w.extending {
+		w.stored = nil
+		w.tx = tx
+		return nil
+	}
+
+	err = tx.ResetImported(w.merchant)
+	if err == nil {
+		w.stored, err = tx.GetStoredOrders(w.merchant)
+	}
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		if !errors.Is(err, repo.ErrImportPaidOut) {
+			return errors.Join(err, rollbackErr)
+		}
+
+		w.logger.Warn("skipping changed merchant", "merchant", w.merchant, "error", err.Error())
+		w.stats.Skipped++
+		w.skip = true
+		w.orders = w.orders[:0]
+		w.disbursements = w.disbursements[:0]
+		w.monthly = w.monthly[:0]
+		w.deductions = w.deductions[:0]
+		return rollbackErr
+	}
+	w.tx = tx
+	return nil
+}
+
+// flush writes the buffered records into the transaction of the current merchant, starting it if needed. Buffered orders that
+// match the stored order are left as they are.
+func (w *importWriter) flush() error {
+	if len(w.orders) == 0 && len(w.disbursements) == 0 && len(w.monthly) == 0 && len(w.deductions) == 0 {
+		return nil
+	}
+
+	if w.tx == nil {
+		err := w.begin()
+		if err != nil || w.skip {
+			return err
+		}
+	}
+
+	upserts := w.orders[:0]
+	for _, o := range w.orders {
+		s, ok := w.stored[o.ID]
+		switch {
+		case !ok:
+			w.pending.OrderChanges.Inserted++
+		case sameOrder(s, o):
+			w.pending.OrderChanges.Unchanged++
+			continue
+		default:
+			w.pending.OrderChanges.Updated++
+		}
+		upserts = append(upserts, o)
+	}
+
+	err := w.tx.UpsertOrders(upserts)
+	if err != nil {
+		return err
+	}
+
+	if w.extending {
+		err = w.tx.UpsertDisbursements(w.disbursements)
+	} else {
+		err = w.tx.InsertDisbursements(w.disbursements)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = w.tx.InsertMonthly(w.monthly)
+	if err != nil {
+		return err
+	}
+
+	err = w.tx.UpdateMonthlyFeeDeductions(w.deductions)
+	if err != nil {
+		return err
+	}
+
+	w.pending.Orders += len(upserts)
+	w.pending.Disbursements += len(w.disbursements)
+	w.pending.Monthly += len(w.monthly)
+	w.orders = w.orders[:0]
+	w.disbursements = w.disbursements[:0]
+	w.monthly = w.monthly[:0]
+	w.deductions = w.deductions[:0]
+	return nil
+}
+
+// Flush writes the records still buffered and commits the transaction of the current merchant.
+func (w *importWriter) Flush() error {
+	err := w.flush()
+	if err != nil {
+		return err
+	}
+
+	if w.tx == nil {
+		return nil
+	}
+
+	if w.extending {
+		err = w.tx.ClearImportDigest(w.merchant)
+	} else {
+		w.pending.OrderChanges.Deleted, err = w.tx.DeleteRemovedOrders(w.merchant)
+		if err == nil {
+			err = w.tx.SetImportDigest(w.merchant, w.digests[w.merchant])
 		}
+	}
+	if err == nil && len(w.mark.OrderIDs) > 0 {
+		err = w.tx.SetImportWatermark(w.mark)
+	}
+	if err == nil {
+		err = w.tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+	w.tx = nil
+
+	w.stats.Orders += w.pending.Orders
+	w.stats.Disbursements += w.pending.Disbursements
+	w.stats.Monthly += w.pending.Monthly
+	w.stats.OrderChanges.Inserted += w.pending.OrderChanges.Inserted
+	w.stats.OrderChanges.Updated += w.pending.OrderChanges.Updated
+	w.stats.OrderChanges.Unchanged += w.pending.OrderChanges.Unchanged
+	w.stats.OrderChanges.Deleted += w.pending.OrderChanges.Deleted
+	if w.extending {
+		w.stats.Extended++
+	} else {
+		w.stats.Recomputed++
+	}
+	w.pending = types.ImportStats{}
+	return nil
+}
 
+// clear replaces the imported records of the merchant, none of whose orders are in the file anymore, with none and deletes its
+// orders, see Flush.
+func (w *importWriter) clear(merchRef string) error {
+	err := w.forMerchant(merchRef)
+	if err == nil && w.tx == nil {
+		err = w.begin()
+	}
+	if err != nil || w.skip {
+		return err
+	}
+	return w.Flush()
+}
+
+// Close rolls back the transaction of a merchant that has not been flushed.
+func (w *importWriter) Close() error {
+	if w.tx == nil {
+		return nil
 	}
 
-	err = op.ProcessBatchMonthly(monthly)
+	err := w.tx.Rollback()
+	w.tx = nil
+	return err
+}
+
+// isNewPayoutPeriod reports whether o2 is paid out with another payout than o1, the order before it: orders of another merchant or
+// with another payout date are. The orders of a merchant paid out on request are all paid out together.
+func isNewPayoutPeriod(o1 *Order, o2 *Order, m types.Merchant) (bool, error) {
+	if o1 == nil || o2 == nil {
+		return false, nil
+	}
+	if o1.MerchantReference != o2.MerchantReference {
+		return true, nil
+	}
+
+	freq, err := NewPayoutFrequency(m.DisbursementFrequency)
 	if err != nil {
-		i.Logger.Error("failed to process batch monthly records", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return false, err
+	}
+	if freq.OnRequest() {
+		return false, nil
 	}
 
-	err = op.ProcessBatchDistributions(distributions)
+	payoutDate1, err := importedPayoutDate(m, o1.CreatedAt)
 	if err != nil {
-		i.Logger.Error("failed to process batch distributions", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return false, err
 	}
 
-	w.WriteHeader(http.StatusOK)
+	payoutDate2, err := importedPayoutDate(m, o2.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	return !payoutDate1.Equal(payoutDate2), nil
 }
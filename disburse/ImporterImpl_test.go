@@ -7,6 +7,8 @@ import (
 	"github.com/levtk/sequra/types"
 	"log/slog"
 	"reflect"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -18,12 +20,13 @@ func TestImport_ImportOrders(t *testing.T) {
 		Repo              *repo.DisburserRepo
 		OrdersFileName    string
 		MerchantsFileName string
+		ChunkSize         int
+		BatchSize         int
 	}
 	tests := []struct {
 		name    string
 		fields  fields
-		want    []types.Disbursement
-		want1   map[string]types.Merchant
+		want    types.ImportStats
 		wantErr bool
 	}{
 		// TODO: Add test cases.
@@ -36,8 +39,10 @@ func TestImport_ImportOrders(t *testing.T) {
 				Repo:              tt.fields.Repo,
 				OrdersFileName:    tt.fields.OrdersFileName,
 				MerchantsFileName: tt.fields.MerchantsFileName,
+				ChunkSize:         tt.fields.ChunkSize,
+				BatchSize:         tt.fields.BatchSize,
 			}
-			got, got1, _, err := i.ImportOrders()
+			got, err := i.ImportOrders(context.Background(), ImportFiles{}, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ImportOrders() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -45,9 +50,6 @@ func TestImport_ImportOrders(t *testing.T) {
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("ImportOrders() got = %v, want %v", got, tt.want)
 			}
-			if !reflect.DeepEqual(got1, tt.want1) {
-				t.Errorf("ImportOrders() got1 = %v, want %v", got1, tt.want1)
-			}
 		})
 	}
 }
@@ -74,7 +76,30 @@ func TestNewImport(t *testing.T) {
 	}
 }
 
-func Test_buildDisbursementRecordsFromImport(t *testing.T) {
+// buildRecords builds the disbursement and monthly records of orders sorted by merchant and creation date with a
+// disbursementBuilder, as the import streams them.
+func buildRecords(orders Orders, merchants map[string]types.Merchant) ([]types.Disbursement, []types.Monthly, error) {
+	var disbursements []types.Disbursement
+	var monthly []types.Monthly
+	b := newDisbursementBuilder(merchants,
+		func(ds []types.Disbursement) error {
+			disbursements = append(disbursements, ds...)
+			return nil
+		},
+		func(ms []types.Monthly) error {
+			monthly = append(monthly, ms...)
+			return nil
+		})
+	for _, o := range orders {
+		err := b.Add(o)
+		if err != nil {
+			return disbursements, monthly, err
+		}
+	}
+	return disbursements, monthly, b.Finish()
+}
+
+func Test_disbursementBuilder(t *testing.T) {
 	var orders = make([]*Order, 5)
 	pd, _ := time.Parse("2006-01-02 15:04:05 -0700 MST", "2023-02-01 00:00:00 +0000 UTC")
 	o1, _ := newOrder("e653f3e14bc4", "padberg_group", 10229, "2023-02-01")
@@ -141,18 +166,400 @@ func Test_buildDisbursementRecordsFromImport(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, _, err := buildDisbursementRecordsFromImport(5, tt.args.o, tt.args.m)
+			got, _, err := buildRecords(tt.args.o, tt.args.m)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("buildDisbursementRecordsFromImport() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("Add() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if got[2].OrderID != tt.want[0].OrderID {
-				t.Errorf("buildDisbursementRecordsFromImport() got = %v, want %v", got, tt.want)
+				t.Errorf("Add() got = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func Test_disbursementBuilder_cutOff(t *testing.T) {
+	at := func(s string) time.Time {
+		ts, _ := time.Parse(time.RFC3339, s)
+		return ts
+	}
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	merchants := map[string]types.Merchant{
+		"padberg_group":      {Reference: "padberg_group", LiveOn: day("2023-02-01"), DisbursementFrequency: types.DAILY, MinMonthlyFee: "0.0"},
+		"rosenbaum_parisian": {Reference: "rosenbaum_parisian", LiveOn: day("2022-11-09"), DisbursementFrequency: types.WEEKLY, MinMonthlyFee: "0.0"},
+	}
+	orders := Orders{
+		{ID: "d1", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: at("2023-02-01T07:59:59Z")},
+		{ID: "d2", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: at("2023-02-01T08:00:00Z")},
+		{ID: "d3", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: at("2023-02-02T06:00:00Z")},
+		{ID: "w1", MerchantReference: "rosenbaum_parisian", Amount: 10000, CreatedAt: at("2022-11-16T07:00:00Z")},
+		{ID: "w2", MerchantReference: "rosenbaum_parisian", Amount: 10000, CreatedAt: at("2022-11-16T09:00:00Z")},
+		{ID: "w3", MerchantReference: "rosenbaum_parisian", Amount: 10000, CreatedAt: at("2022-11-22T10:00:00Z")},
+	}
+	want := map[string]time.Time{
+		"d1": day("2023-02-01"),
+		"d2": day("2023-02-02"),
+		"d3": day("2023-02-02"),
+		"w1": day("2022-11-16"),
+		"w2": day("2022-11-23"),
+		"w3": day("2022-11-23"),
+	}
+
+	got, _, err := buildRecords(orders, merchants)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	groups := map[string]uuid.UUID{}
+	for _, d := range got {
+		if !d.PayoutDate.Equal(want[d.OrderID]) {
+			t.Errorf("Add() order %s payout date = %s, want %s", d.OrderID, d.PayoutDate.Format(time.DateOnly),
+				want[d.OrderID].Format(time.DateOnly))
+		}
+		groups[d.OrderID] = d.DisbursementGroupID
+	}
+	if groups["d1"] == groups["d2"] || groups["d2"] != groups["d3"] || groups["w1"] == groups["w2"] || groups["w2"] != groups["w3"] {
+		t.Errorf("Add() groups = %v, want d2 with d3 and w2 with w3", groups)
+	}
+}
+
+func Test_disbursementBuilder_timezone(t *testing.T) {
+	at := func(s string) time.Time {
+		ts, _ := time.Parse(time.RFC3339, s)
+		return ts
+	}
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	merchants := map[string]types.Merchant{
+		"padberg_group": {Reference: "padberg_group", LiveOn: day("2023-01-01"), DisbursementFrequency: types.DAILY, MinMonthlyFee: "0.0", Timezone: "America/Mexico_City"},
+	}
+	orders := Orders{
+		{ID: "d1", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: at("2023-02-01T13:00:00Z")},
+		{ID: "d2", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: at("2023-02-01T15:00:00Z")},
+		{ID: "d3", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: at("2023-02-02T05:00:00Z")},
+		{ID: "d4", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: at("2023-02-28T13:00:00Z")},
+		{ID: "d5", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: at("2023-03-02T13:00:00Z")},
+	}
+	want := map[string]time.Time{
+		"d1": day("2023-02-01"),
+		"d2": day("2023-02-02"),
+		"d3": day("2023-02-02"),
+		"d4": day("2023-02-28"),
+		"d5": day("2023-03-02"),
+	}
+
+	got, monthly, err := buildRecords(orders, merchants)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	for _, d := range got {
+		if !d.PayoutDate.Equal(want[d.OrderID]) {
+			t.Errorf("Add() order %s payout date = %s, want %s", d.OrderID, d.PayoutDate.Format(time.DateOnly),
+				want[d.OrderID].Format(time.DateOnly))
+		}
+	}
+	if len(monthly) == 0 || !monthly[0].MonthlyFeeDate.Equal(day("2023-02-01")) || monthly[0].TotalOrderAmt != 40000 {
+		t.Errorf("Add() monthly = %+v, want february with the 4 orders of the merchant's february", monthly)
+	}
+}
+
+func Test_disbursementBuilder_calendar(t *testing.T) {
+	calendars, err := types.LoadCalendars(strings.NewReader("calendar;date;name\nES;2023-10-12;Fiesta Nacional de España\nTARGET2;2023-12-25;Christmas Day\n"))
+	if err != nil {
+		t.Fatalf("LoadCalendars() error = %v", err)
+	}
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	merchants := map[string]types.Merchant{
+		"padberg_group": {Reference: "padberg_group", LiveOn: day("2023-02-01"), DisbursementFrequency: types.DAILY, MinMonthlyFee: "0.0"},
+	}
+	orders := Orders{
+		{ID: "o1", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: day("2023-10-11")},
+		{ID: "o2", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: day("2023-10-12")},
+		{ID: "o3", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: day("2023-10-13")},
+		{ID: "o4", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: day("2023-10-14")},
+		{ID: "o5", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: day("2023-10-15")},
+	}
+	want := map[string]time.Time{
+		"o1": day("2023-10-11"),
+		"o2": day("2023-10-13"),
+		"o3": day("2023-10-13"),
+		"o4": day("2023-10-16"),
+		"o5": day("2023-10-16"),
+	}
+
+	var got []types.Disbursement
+	b := newDisbursementBuilder(merchants,
+		func(ds []types.Disbursement) error {
+			got = append(got, ds...)
+			return nil
+		},
+		func(ms []types.Monthly) error { return nil })
+	b.calendar = types.CombineCalendars("TARGET2,ES", calendars["TARGET2"], calendars["ES"])
+	for _, o := range orders {
+		err = b.Add(o)
+		if err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	err = b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+
+	groups := map[uuid.UUID]bool{}
+	for _, d := range got {
+		if !d.RolledPayoutDate.Equal(want[d.OrderID]) {
+			t.Errorf("Add() order %s rolled payout date = %s, want %s", d.OrderID, d.RolledPayoutDate.Format(time.DateOnly), want[d.OrderID].Format(time.DateOnly))
+		}
+		groups[d.DisbursementGroupID] = true
+	}
+	if len(got) != len(orders) || len(groups) != len(orders) {
+		t.Errorf("Add() built %d records in %d groups, want a group per nominal payout date", len(got), len(groups))
+	}
+}
+
+func Test_disbursementBuilder_pastCalendar(t *testing.T) {
+	calendars, err := types.LoadCalendars(strings.NewReader("calendar;date;name\nES;2023-10-12;Fiesta Nacional de España\nES;2024-10-12;Fiesta Nacional de España\nTARGET2;2023-12-25;Christmas Day\n"))
+	if err != nil {
+		t.Fatalf("LoadCalendars() error = %v", err)
+	}
+	calendar := types.CombineCalendars("TARGET2,ES", calendars["TARGET2"], calendars["ES"])
+	if calendars["ES"].Through != 2024 || calendar.Through != 2023 {
+		t.Fatalf("holidays through ES %d, combined %d, want 2024 and 2023", calendars["ES"].Through, calendar.Through)
+	}
+
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	merchants := map[string]types.Merchant{
+		"padberg_group": {Reference: "padberg_group", LiveOn: day("2023-02-01"), DisbursementFrequency: types.DAILY, MinMonthlyFee: "0.0"},
+	}
+	b := newDisbursementBuilder(merchants, func(ds []types.Disbursement) error { return nil }, func(ms []types.Monthly) error { return nil })
+	b.calendar = calendar
+	for _, o := range (Orders{
+		{ID: "o1", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: day("2023-12-29")},
+		{ID: "o2", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: day("2024-01-03")},
+		{ID: "o3", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: day("2024-01-06")},
+	}) {
+		err = b.Add(o)
+		if err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		if o.ID == "o1" && !b.pastCalendar.IsZero() {
+			t.Errorf("Add() past calendar = %s after an order of a covered year, want zero", b.pastCalendar.Format(time.DateOnly))
+		}
+	}
+	if !b.pastCalendar.Equal(day("2024-01-08")) {
+		t.Errorf("Add() past calendar = %s, want the latest rolled payout date 2024-01-08", b.pastCalendar.Format(time.DateOnly))
+	}
+}
+
+func Test_disbursementBuilder_onRequest(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	merchants := map[string]types.Merchant{
+		"deckow_gibson": {Reference: "deckow_gibson", LiveOn: day("2023-01-01"), DisbursementFrequency: types.ON_DEMAND, MinMonthlyFee: "0.0"},
+		"padberg_group": {Reference: "padberg_group", LiveOn: day("2023-01-01"), DisbursementFrequency: types.DAILY, MinMonthlyFee: "0.0"},
+	}
+	orders := Orders{
+		{ID: "o1", MerchantReference: "padberg_group", Amount: 10000, CreatedAt: day("2023-03-02")},
+		{ID: "o2", MerchantReference: "deckow_gibson", Amount: 10000, CreatedAt: day("2023-01-30")},
+		{ID: "o3", MerchantReference: "deckow_gibson", Amount: 10000, CreatedAt: day("2023-02-14")},
+		{ID: "o4", MerchantReference: "deckow_gibson", Amount: 10000, CreatedAt: day("2023-03-02")},
+	}
+
+	var got []types.Disbursement
+	var monthly []types.Monthly
+	b := newDisbursementBuilder(merchants,
+		func(ds []types.Disbursement) error {
+			got = append(got, ds...)
+			return nil
+		},
+		func(ms []types.Monthly) error {
+			monthly = append(monthly, ms...)
+			return nil
+		})
+	for _, o := range orders {
+		err := b.Add(o)
+		if err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+
+	if len(got) != len(orders) {
+		t.Fatalf("Add() built %d records, want %d", len(got), len(orders))
+	}
+	if got[0].OnRequest || !got[0].IsPaidOut {
+		t.Errorf("Add() order of the daily merchant = %+v, want it paid out", got[0])
+	}
+	for _, d := range got[1:] {
+		if d.DisbursementGroupID != got[1].DisbursementGroupID || d.IsPaidOut || !d.OnRequest || !d.RolledPayoutDate.IsZero() {
+			t.Errorf("Add() order %s = %+v, want it accrued unpaid in the group of the first order without a rolled payout date", d.OrderID, d)
+		}
+	}
+	if got[3].PayoutRunningTotal != 28500 || got[3].PayoutTotal != 0 {
+		t.Errorf("Add() accrued running total = %d, payout total = %d, want 28500 and no payout total", got[3].PayoutRunningTotal, got[3].PayoutTotal)
+	}
+
+	var months []string
+	for _, m := range monthly {
+		if m.MerchantReference == "deckow_gibson" {
+			months = append(months, m.MonthlyFeeDate.Format(time.DateOnly))
+		}
+	}
+	if strings.Join(months, ",") != "2023-01-01,2023-02-01" {
+		t.Errorf("Add() monthly records of the on demand merchant = %v, want january and february", months)
+	}
+}
+
+func Test_disbursementBuilder_currencies(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	merchants := map[string]types.Merchant{
+		"padberg_group": {Reference: "padberg_group", LiveOn: day("2023-01-01"), DisbursementFrequency: types.DAILY, MinMonthlyFee: "30.0", Currency: "EUR"},
+	}
+	orders := Orders{
+		{ID: "o1", MerchantReference: "padberg_group", Amount: 10000, Currency: "EUR", CreatedAt: day("2023-01-31")},
+		{ID: "o2", MerchantReference: "padberg_group", Amount: 10000, Currency: "GBP", CreatedAt: day("2023-02-01")},
+		{ID: "o3", MerchantReference: "padberg_group", Amount: 10000, Currency: "EUR", CreatedAt: day("2023-02-01")},
+		{ID: "o4", MerchantReference: "padberg_group", Amount: 20000, Currency: "GBP", CreatedAt: day("2023-02-01")},
+		{ID: "o5", MerchantReference: "padberg_group", Amount: 10000, Currency: "EUR", CreatedAt: day("2023-02-02")},
+	}
+
+	var got []types.Disbursement
+	b := newDisbursementBuilder(merchants,
+		func(ds []types.Disbursement) error {
+			got = append(got, ds...)
+			return nil
+		},
+		func(ms []types.Monthly) error { return nil })
+	for _, o := range orders {
+		err := b.Add(o)
+		if err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+
+	byOrder := map[string]types.Disbursement{}
+	for _, d := range got {
+		byOrder[d.OrderID] = d
+	}
+	if len(byOrder) != len(orders) {
+		t.Fatalf("Add() built %d records, want %d", len(byOrder), len(orders))
+	}
+	eur, gbp := byOrder["o3"], byOrder["o4"]
+	if eur.Currency != "EUR" || gbp.Currency != "GBP" || byOrder["o2"].Currency != "GBP" {
+		t.Errorf("Add() currencies = %s, %s, %s, want the currency of each order", byOrder["o2"].Currency, eur.Currency, gbp.Currency)
+	}
+	if eur.DisbursementGroupID == gbp.DisbursementGroupID || byOrder["o2"].DisbursementGroupID != gbp.DisbursementGroupID {
+		t.Errorf("Add() grouped the orders of february 1st as %s, %s, %s, want a group per currency", byOrder["o2"].DisbursementGroupID, eur.DisbursementGroupID, gbp.DisbursementGroupID)
+	}
+	if gbp.PayoutRunningTotal != 28500 || gbp.MonthlyFeeDeduction != 0 || gbp.PayoutTotal != 28500 {
+		t.Errorf("Add() GBP group running total = %d, deduction = %d, payout total = %d, want 28500 paid out in full", gbp.PayoutRunningTotal, gbp.MonthlyFeeDeduction, gbp.PayoutTotal)
+	}
+	if eur.MonthlyFeeDeduction == 0 || eur.PayoutTotal != eur.PayoutRunningTotal-eur.MonthlyFeeDeduction {
+		t.Errorf("Add() EUR group deduction = %d, payout total = %d, want january's minimum monthly fee deducted", eur.MonthlyFeeDeduction, eur.PayoutTotal)
+	}
+}
+
+func Test_disbursementBuilder_resume(t *testing.T) {
+	feb1 := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+	merchants := map[string]types.Merchant{"padberg_group": {
+		ID:                    uuid.MustParse("86312006-4d7e-45c4-9c28-788f4aa68a62"),
+		Reference:             "padberg_group",
+		LiveOn:                time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		DisbursementFrequency: types.DAILY,
+		MinMonthlyFee:         "30.0",
+	}}
+	groupID := uuid.New()
+	resume := importResume{
+		last:       &Order{ID: "e653f3e14bc4", MerchantReference: "padberg_group", CreatedAt: feb1},
+		payoutDate: feb1,
+		groups: map[string][]types.Disbursement{"EUR": {{RecordUUID: uuid.New(), DisbursementGroupID: groupID, MerchReference: "padberg_group", OrderID: "e653f3e14bc4",
+			OrderAmount: 1000, OrderFee: 100, Currency: "EUR", OrderFeeRunningTotal: 100, PayoutDate: feb1, PayoutRunningTotal: 900}}},
+		monthOrderTotal:    1000,
+		monthOrderFeeTotal: 100,
+		outstanding: []types.Monthly{{ID: uuid.New(), MerchantReference: "padberg_group", MonthlyFeeDate: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+			DidPayFee: 1, MonthlyFee: 3000, OrderFeeTotal: 2800}},
+		recordedThrough: feb1,
+	}
+
+	var groups [][]types.Disbursement
+	var monthly, deductions []types.Monthly
+	b := newDisbursementBuilder(merchants,
+		func(ds []types.Disbursement) error {
+			groups = append(groups, slices.Clone(ds))
+			return nil
+		},
+		func(ms []types.Monthly) error {
+			monthly = append(monthly, ms...)
+			return nil
+		})
+	b.emitDeductions = func(ms []types.Monthly) error {
+		deductions = append(deductions, ms...)
+		return nil
+	}
+	b.resume = func(m types.Merchant) (importResume, bool, error) {
+		return resume, true, nil
+	}
+
+	orders := Orders{
+		{ID: "20b674c93ea6", MerchantReference: "padberg_group", Amount: 2000, CreatedAt: feb1},
+		{ID: "adaf77dffa91", MerchantReference: "padberg_group", Amount: 1000, CreatedAt: feb1.AddDate(0, 0, 1)},
+		{ID: "f1d9ec2b3d51", MerchantReference: "padberg_group", Amount: 1000, CreatedAt: feb1.AddDate(0, 1, 0)},
+	}
+	for _, o := range orders {
+		err := b.Add(o)
+		if err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+
+	if len(groups) != 3 {
+		t.Fatalf("builder emitted %d groups, want 3", len(groups))
+	}
+	extended := groups[0]
+	if len(extended) != 2 || extended[1].DisbursementGroupID != groupID || extended[1].OrderFeeRunningTotal != 300 || extended[1].PayoutRunningTotal != 2700 {
+		t.Errorf("builder extended group = %+v, want the stored record and the new order with running totals carried on", extended)
+	}
+	if !extended[0].IsPaidOut || extended[1].MonthlyFeeDeduction != 200 || extended[1].PayoutTotal != 2500 {
+		t.Errorf("builder closed extended group = %+v, want it paid out less the outstanding monthly fee", extended)
+	}
+	if groups[2][0].IsPaidOut {
+		t.Errorf("builder last group = %+v, want it left open", groups[2])
+	}
+	if len(monthly) != 0 {
+		t.Errorf("builder monthly = %+v, want none for months already recorded", monthly)
+	}
+	if len(deductions) != 1 || deductions[0].FeeDeducted != 200 || deductions[0].DisbursementGroupID != groupID {
+		t.Errorf("builder deductions = %+v, want the outstanding fee deducted from the extended group", deductions)
+	}
+}
+
 func Test_isNewPayoutPeriod(t *testing.T) {
 	type args struct {
 		o1 *Order
@@ -165,7 +572,69 @@ func Test_isNewPayoutPeriod(t *testing.T) {
 		want    bool
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{
+			name: "daily orders before and after the cut-off",
+			args: args{
+				o1: &Order{MerchantReference: "padberg_group", CreatedAt: time.Date(2023, 2, 1, 7, 0, 0, 0, time.UTC)},
+				o2: &Order{MerchantReference: "padberg_group", CreatedAt: time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC)},
+				m:  types.Merchant{DisbursementFrequency: types.DAILY},
+			},
+			want: true,
+		},
+		{
+			name: "daily order after the cut-off and the next day's before it",
+			args: args{
+				o1: &Order{MerchantReference: "padberg_group", CreatedAt: time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC)},
+				o2: &Order{MerchantReference: "padberg_group", CreatedAt: time.Date(2023, 2, 2, 7, 0, 0, 0, time.UTC)},
+				m:  types.Merchant{DisbursementFrequency: types.DAILY},
+			},
+			want: false,
+		},
+		{
+			name: "weekly order after the cut-off on the payout day",
+			args: args{
+				o1: &Order{MerchantReference: "rosenbaum_parisian", CreatedAt: time.Date(2022, 11, 16, 7, 0, 0, 0, time.UTC)},
+				o2: &Order{MerchantReference: "rosenbaum_parisian", CreatedAt: time.Date(2022, 11, 16, 9, 0, 0, 0, time.UTC)},
+				m:  types.Merchant{LiveOn: time.Date(2022, 11, 9, 0, 0, 0, 0, time.UTC), DisbursementFrequency: types.WEEKLY},
+			},
+			want: true,
+		},
+		{
+			name: "on demand orders of different months",
+			args: args{
+				o1: &Order{MerchantReference: "deckow_gibson", CreatedAt: time.Date(2023, 1, 30, 0, 0, 0, 0, time.UTC)},
+				o2: &Order{MerchantReference: "deckow_gibson", CreatedAt: time.Date(2023, 2, 14, 0, 0, 0, 0, time.UTC)},
+				m:  types.Merchant{DisbursementFrequency: types.ON_DEMAND},
+			},
+			want: false,
+		},
+		{
+			name: "biweekly orders of the same fortnight",
+			args: args{
+				o1: &Order{MerchantReference: "rosenbaum_parisian", CreatedAt: time.Date(2022, 11, 10, 0, 0, 0, 0, time.UTC)},
+				o2: &Order{MerchantReference: "rosenbaum_parisian", CreatedAt: time.Date(2022, 11, 22, 0, 0, 0, 0, time.UTC)},
+				m:  types.Merchant{LiveOn: time.Date(2022, 11, 9, 0, 0, 0, 0, time.UTC), DisbursementFrequency: types.BIWEEKLY},
+			},
+			want: false,
+		},
+		{
+			name: "unknown frequency",
+			args: args{
+				o1: &Order{MerchantReference: "padberg_group", CreatedAt: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)},
+				o2: &Order{MerchantReference: "padberg_group", CreatedAt: time.Date(2023, 2, 2, 0, 0, 0, 0, time.UTC)},
+				m:  types.Merchant{DisbursementFrequency: "HOURLY"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "another merchant",
+			args: args{
+				o1: &Order{MerchantReference: "padberg_group", CreatedAt: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)},
+				o2: &Order{MerchantReference: "rosenbaum_parisian", CreatedAt: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)},
+				m:  types.Merchant{DisbursementFrequency: types.DAILY},
+			},
+			want: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -181,47 +650,35 @@ func Test_isNewPayoutPeriod(t *testing.T) {
 	}
 }
 
-func Test_sortOrdersByMerchant(t *testing.T) {
-	type args struct {
-		orders Orders
-	}
+func Test_sameMerchant(t *testing.T) {
+	stored := types.Merchant{Reference: "padberg_group", Email: "info@padberg-group.com", LiveOn: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC),
+		DisbursementFrequency: types.DAILY, MinMonthlyFee: "0.0", Currency: "EUR"}
 	tests := []struct {
-		name string
-		args args
+		name   string
+		change func(m *types.Merchant)
+		want   bool
 	}{
-		// TODO: Add test cases.
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			sortOrdersByMerchant(tt.args.orders)
-		})
+		{name: "re-imported unchanged", change: func(m *types.Merchant) {}, want: true},
+		{name: "currency left to the default", change: func(m *types.Merchant) { m.Currency = "" }, want: true},
+		{name: "frequency", change: func(m *types.Merchant) { m.DisbursementFrequency = types.WEEKLY }, want: false},
+		{name: "currency", change: func(m *types.Merchant) { m.Currency = "GBP" }, want: false},
+		{name: "timezone", change: func(m *types.Merchant) { m.Timezone = "Atlantic/Canary" }, want: false},
+		{name: "moved to monthly on a payout day", change: func(m *types.Merchant) { m.DisbursementFrequency, m.PayoutDay = types.MONTHLY, 15 }, want: false},
+		{name: "payout day", change: func(m *types.Merchant) { m.PayoutDay = 28 }, want: false},
 	}
-}
-
-func Test_buildWeeklyRecord(t *testing.T) {
-	type args struct {
-		o             Orders
-		m             map[string]types.Merchant
-		disbursements []types.Disbursement
-		i             int
-	}
-	tests := []struct {
-		name    string
-		args    args
-		want    []types.Disbursement
-		wantErr bool
-	}{
-		// TODO: Add test cases.
+	digest := func(m types.Merchant) string {
+		return newImportDigests(map[string]types.Merchant{m.Reference: m}).digest(m.Reference)
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := buildWeeklyRecord(tt.args.o, tt.args.m, tt.args.disbursements, tt.args.i)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("buildWeeklyRecord() error = %v, wantErr %v", err, tt.wantErr)
-				return
+			reimported := stored
+			tt.change(&reimported)
+			got := sameMerchant(stored, reimported)
+			if got != tt.want {
+				t.Errorf("sameMerchant() = %v, want %v", got, tt.want)
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("buildWeeklyRecord() got = %v, want %v", got, tt.want)
+			if got != (digest(stored) == digest(reimported)) {
+				t.Errorf("sameMerchant() = %v, want it to agree with the digests of the merchants", got)
 			}
 		})
 	}
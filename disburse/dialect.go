@@ -0,0 +1,121 @@
+package disburse
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Dialect describes how a partner writes its import files: the field delimiter of CSV files, the decimal separator of amounts, the
+// layout of dates and the timezone of dates and timestamps without an offset. Columns maps the header names of the partner's files,
+// in lower case, to the column names of the legacy files, so CSV columns can be named differently, come in any order and be mixed
+// with columns the import does not use. The zero value is the legacy dialect of semicolon separated files with dot decimal amounts
+// and YYYY-MM-DD dates in UTC.
+type Dialect struct {
+	Delimiter  rune
+	Decimal    rune
+	DateLayout string
+	Location   *time.Location
+	Columns    map[string]string
+}
+
+var legacyDialect = Dialect{Delimiter: ';', Decimal: '.', DateLayout: time.DateOnly, Location: time.UTC}
+
+// orDefaults returns d with the settings it leaves empty taken from the legacy dialect.
+func (d Dialect) orDefaults() Dialect {
+	if d.Delimiter == 0 {
+		d.Delimiter = legacyDialect.Delimiter
+	}
+	if d.Decimal == 0 {
+		d.Decimal = legacyDialect.Decimal
+	}
+	if d.DateLayout == "" {
+		d.DateLayout = legacyDialect.DateLayout
+	}
+	if d.Location == nil {
+		d.Location = legacyDialect.Location
+	}
+	return d
+}
+
+// column returns the column a header name of the file stands for. A byte order mark, surrounding spaces and case are ignored.
+func (d Dialect) column(name string) string {
+	name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+	if c, ok := d.Columns[name]; ok {
+		return c
+	}
+	return name
+}
+
+// header returns the position in the header line rec of each of columns, -1 for optional columns it leaves out. Columns the import
+// does not use are ignored; a missing or repeated column is an errInvalidHeader.
+func (d Dialect) header(rec []string, columns []string) ([]int, error) {
+	index := make([]int, len(columns))
+	for i := range index {
+		index[i] = -1
+	}
+
+	for pos, name := range rec {
+		i := slices.Index(columns, d.column(name))
+		if i < 0 {
+			continue
+		}
+		if index[i] >= 0 {
+			return nil, fmt.Errorf("%w: column %s is repeated in %q", errInvalidHeader, columns[i], strings.Join(rec, string(d.Delimiter)))
+		}
+		index[i] = pos
+	}
+
+	for i, pos := range index {
+		if pos < 0 && !slices.Contains(optionalColumns, columns[i]) {
+			return nil, fmt.Errorf("%w: column %s is missing from %q, want %q", errInvalidHeader, columns[i],
+				strings.Join(rec, string(d.Delimiter)), strings.Join(columns, string(d.Delimiter)))
+		}
+	}
+	return index, nil
+}
+
+// amount returns the amount s written with the decimal separator of d as a dot decimal number. Thousands separators are not
+// accepted.
+func (d Dialect) amount(s string) (string, error) {
+	if d.Decimal == '.' {
+		return s, nil
+	}
+	if strings.Contains(s, ".") {
+		return "", fmt.Errorf("malformed amount %q", s)
+	}
+	return strings.Replace(s, string(d.Decimal), ".", 1), nil
+}
+
+// date returns the day of the date or timestamp s in the timezone of d, as midnight UTC like the dates of the legacy files.
+func (d Dialect) date(s string) (time.Time, error) {
+	t, err := time.Parse(time.DateOnly, s)
+	if err == nil {
+		return t, nil
+	}
+
+	t, err = time.ParseInLocation(d.DateLayout, s, d.Location)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	y, m, day := t.In(d.Location).Date()
+	return time.Date(y, m, day, 0, 0, 0, 0, time.UTC), nil
+}
+
+// timestamp returns the time s in UTC. Timestamps are read with the date layout of d, in the timezone of d unless they carry an
+// offset. Plain YYYY-MM-DD dates are accepted whatever the layout and read as midnight UTC, like the dates of the legacy files, so
+// that orders only known by their date are taken as received before the cut-off, see types.CutOffDay.
+func (d Dialect) timestamp(s string) (time.Time, error) {
+	t, err := time.Parse(time.DateOnly, s)
+	if err == nil {
+		return t, nil
+	}
+
+	t, err = time.ParseInLocation(d.DateLayout, s, d.Location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
@@ -0,0 +1,133 @@
+package disburse
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDialect_header(t *testing.T) {
+	d := Dialect{Columns: map[string]string{"order_id": "id", "shop": "merchant_reference"}}
+	tests := []struct {
+		name    string
+		columns []string
+		rec     []string
+		want    []int
+		wantErr error
+	}{
+		{name: "legacy", rec: []string{"id", "merchant_reference", "amount", "created_at"}, want: []int{0, 1, 2, 3, -1}},
+		{name: "mapped, reordered and extra columns", rec: []string{"Created_At", "channel", "Shop", "amount", " order_id "}, want: []int{4, 2, 3, 0, -1}},
+		{name: "missing column", rec: []string{"id", "merchant_reference", "amount"}, wantErr: errInvalidHeader},
+		{name: "repeated column", rec: []string{"id", "order_id", "merchant_reference", "amount", "created_at"}, wantErr: errInvalidHeader},
+		{name: "optional column left out", columns: merchantColumns, rec: []string{"id", "reference", "email", "live_on", "disbursement_frequency", "minimum_monthly_fee"}, want: []int{0, 1, 2, 3, 4, 5, -1, -1, -1}},
+		{name: "optional currency column", rec: []string{"currency", "id", "merchant_reference", "amount", "created_at"}, want: []int{1, 2, 3, 4, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.columns == nil {
+				tt.columns = orderColumns
+			}
+			got, err := d.header(tt.rec, tt.columns)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("header() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("header() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialect_date(t *testing.T) {
+	madrid := time.FixedZone("CET", 3600)
+	tests := []struct {
+		name    string
+		dialect Dialect
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "legacy date", dialect: legacyDialect, value: "2023-02-01", want: "2023-02-01"},
+		{name: "legacy rejects timestamps", dialect: legacyDialect, value: "2023-02-01T07:00:00Z", wantErr: true},
+		{name: "timestamp with an offset", dialect: Dialect{DateLayout: time.RFC3339, Location: madrid}, value: "2023-02-01T23:30:00Z", want: "2023-02-02"},
+		{name: "timestamp in the dialect timezone", dialect: Dialect{DateLayout: time.DateTime, Location: madrid}, value: "2023-02-01 23:30:00", want: "2023-02-01"},
+		{name: "plain date with a timestamp layout", dialect: Dialect{DateLayout: time.RFC3339, Location: madrid}, value: "2023-02-01", want: "2023-02-01"},
+		{name: "day first layout", dialect: Dialect{DateLayout: "02/01/2006"}, value: "01/02/2023", want: "2023-02-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.dialect.orDefaults().date(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("date() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (got.Format(time.DateOnly) != tt.want || got.Location() != time.UTC || got.Hour() != 0) {
+				t.Errorf("date() = %v, want %s at midnight UTC", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialect_timestamp(t *testing.T) {
+	madrid := time.FixedZone("CET", 3600)
+	tests := []struct {
+		name    string
+		dialect Dialect
+		value   string
+		want    time.Time
+	}{
+		{name: "plain date", dialect: Dialect{DateLayout: time.DateTime, Location: madrid}, value: "2023-02-01", want: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "timestamp with an offset", dialect: Dialect{DateLayout: time.RFC3339}, value: "2023-02-01T09:30:00+01:00", want: time.Date(2023, 2, 1, 8, 30, 0, 0, time.UTC)},
+		{name: "timestamp in the dialect timezone", dialect: Dialect{DateLayout: time.DateTime, Location: madrid}, value: "2023-02-01 08:30:00", want: time.Date(2023, 2, 1, 7, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.dialect.orDefaults().timestamp(tt.value)
+			if err != nil {
+				t.Fatalf("timestamp() error = %v", err)
+			}
+			if !got.Equal(tt.want) || got.Location() != time.UTC {
+				t.Errorf("timestamp() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_orderReader_dialect(t *testing.T) {
+	d := Dialect{Delimiter: '|', Decimal: ',', DateLayout: time.RFC3339, Columns: map[string]string{"order_id": "id", "shop": "merchant_reference"}}
+	input := `channel|created_at|shop|amount|order_id
+web|2023-02-01T07:15:00Z|padberg_group|102,29|e653f3e14bc4
+app|2023-02-01|padberg_group|433|20b674c93ea6
+web|2023-02-02T07:15:00Z|padberg_group|194.37|0b73fb1d3332
+`
+	or, err := newFormatOrderReader(strings.NewReader(input), "", d)
+	if err != nil {
+		t.Fatalf("newFormatOrderReader() error = %v", err)
+	}
+
+	type order struct {
+		id, merchantReference, createdAt string
+		amount                           int64
+	}
+	var got []order
+	for {
+		o, err := or.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !strings.Contains(err.Error(), "line 4") {
+				t.Errorf("Next() error = %v, want the dot decimal amount on line 4", err)
+			}
+			break
+		}
+		got = append(got, order{o.ID, o.MerchantReference, o.CreatedAt.Format(time.DateOnly), o.Amount})
+	}
+
+	want := []order{{"e653f3e14bc4", "padberg_group", "2023-02-01", 10229}, {"20b674c93ea6", "padberg_group", "2023-02-01", 43300}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Next() = %+v, want %+v", got, want)
+	}
+}
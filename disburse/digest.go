@@ -0,0 +1,88 @@
+package disburse
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/levtk/sequra/types"
+	"time"
+)
+
+// importDigests fingerprints the inputs of every merchant of an import: the merchant record, its fee schedules and its orders. A
+// merchant whose digest matches the one it was last imported with has nothing new to import. Orders are folded in as they are read,
+// in any order, by adding the SHA-256 of each order into four 64 bit lanes, so the digests are known once the orders file has been
+// read and before the sorted orders are built.
+type importDigests struct {
+	merchants map[string]types.Merchant
+	orders    map[string]*orderDigest
+}
+
+type orderDigest struct {
+	lanes [4]uint64
+	count int
+}
+
+func newImportDigests(merchants map[string]types.Merchant) *importDigests {
+	return &importDigests{merchants: merchants, orders: map[string]*orderDigest{}}
+}
+
+// add folds the order into the digest of its merchant.
+func (d *importDigests) add(o *Order) {
+	od, ok := d.orders[o.MerchantReference]
+	if !ok {
+		od = &orderDigest{}
+		d.orders[o.MerchantReference] = od
+	}
+
+	record := fmt.Sprintf("%s;%d;%s", o.ID, o.Amount, o.CreatedAt.UTC().Format(time.RFC3339))
+	if !types.SameCurrency(o.Currency, types.DEFAULT_CURRENCY) { // orders in the default currency keep the digest they had before currencies
+		record += ";" + o.Currency
+	}
+
+	sum := sha256.Sum256([]byte(record))
+	for i := range od.lanes {
+		od.lanes[i] += binary.BigEndian.Uint64(sum[i*8:])
+	}
+	od.count++
+}
+
+// digest returns the hex encoded digest of the merchant.
+func (d *importDigests) digest(merchRef string) string {
+	m := d.merchants[merchRef]
+	h := sha256.New()
+	fmt.Fprintf(h, "%s;%s;%s;%s;%s;%s\n", m.ID, m.Reference, m.Email, m.LiveOn.Format(time.DateOnly), m.DisbursementFrequency, m.MinMonthlyFee)
+	if m.Timezone != "" { // merchants without a timezone keep the digest they were imported with before timezones
+		fmt.Fprintf(h, "timezone;%s\n", m.Timezone)
+	}
+	if m.PayoutDay != 0 {
+		fmt.Fprintf(h, "payout_day;%d\n", m.PayoutDay)
+	}
+	if !types.SameCurrency(m.Currency, types.DEFAULT_CURRENCY) {
+		fmt.Fprintf(h, "currency;%s\n", m.Currency)
+	}
+	for _, fs := range m.FeeSchedules {
+		fmt.Fprintf(h, "%s;%d;%s\n", fs.ID, fs.Version, fs.EffectiveTo.UTC().Format(time.RFC3339))
+	}
+
+	od := d.orders[merchRef]
+	if od != nil {
+		fmt.Fprintf(h, "%d", od.count)
+		for _, lane := range od.lanes {
+			_ = binary.Write(h, binary.BigEndian, lane)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// changed returns the digests of the merchants whose digest differs from stored, the digests they were last imported with.
+func (d *importDigests) changed(stored map[string]string) map[string]string {
+	changed := map[string]string{}
+	for ref := range d.merchants {
+		digest := d.digest(ref)
+		if digest != stored[ref] {
+			changed[ref] = digest
+		}
+	}
+	return changed
+}
@@ -0,0 +1,101 @@
+package disburse
+
+import (
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/types"
+	"testing"
+	"time"
+)
+
+func Test_importDigests_changed(t *testing.T) {
+	merchants := map[string]types.Merchant{
+		"padberg_group": {ID: uuid.MustParse("86312006-4d7e-45c4-9c28-788f4aa68a62"), Reference: "padberg_group", LiveOn: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), DisbursementFrequency: types.DAILY, MinMonthlyFee: "0.0"},
+		"deckow_gibson": {ID: uuid.MustParse("d1649242-a612-46ba-82d8-225542bb9576"), Reference: "deckow_gibson", LiveOn: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), DisbursementFrequency: types.WEEKLY, MinMonthlyFee: "30.0"},
+	}
+	orders := Orders{
+		{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: 10229, CreatedAt: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: "056d024481a9", MerchantReference: "padberg_group", Amount: 44045, CreatedAt: time.Date(2023, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{ID: "20b674c93ea6", MerchantReference: "deckow_gibson", Amount: 43321, CreatedAt: time.Date(2023, 1, 3, 0, 0, 0, 0, time.UTC)},
+	}
+
+	first := newImportDigests(merchants)
+	for _, o := range orders {
+		first.add(o)
+	}
+	stored := first.changed(nil)
+	if len(stored) != 2 {
+		t.Fatalf("changed() = %v, want every merchant changed on the first import", stored)
+	}
+
+	tests := []struct {
+		name      string
+		merchants func(map[string]types.Merchant) map[string]types.Merchant
+		orders    func(Orders) Orders
+		want      []string
+	}{
+		{
+			name: "same orders in another order",
+			orders: func(o Orders) Orders {
+				return Orders{o[2], o[1], o[0]}
+			},
+		},
+		{
+			name: "changed order amount",
+			orders: func(o Orders) Orders {
+				changed := &Order{ID: o[0].ID, MerchantReference: o[0].MerchantReference, Amount: o[0].Amount + 1, CreatedAt: o[0].CreatedAt}
+				return Orders{changed, o[1], o[2]}
+			},
+			want: []string{"padberg_group"},
+		},
+		{
+			name: "removed order",
+			orders: func(o Orders) Orders {
+				return o[1:]
+			},
+			want: []string{"padberg_group"},
+		},
+		{
+			name: "changed merchant record",
+			merchants: func(m map[string]types.Merchant) map[string]types.Merchant {
+				deckow := m["deckow_gibson"]
+				deckow.MinMonthlyFee = "15.0"
+				return map[string]types.Merchant{"padberg_group": m["padberg_group"], "deckow_gibson": deckow}
+			},
+			want: []string{"deckow_gibson"},
+		},
+		{
+			name: "new fee schedule",
+			merchants: func(m map[string]types.Merchant) map[string]types.Merchant {
+				padberg := m["padberg_group"]
+				padberg.FeeSchedules = []types.FeeSchedule{{ID: uuid.New(), MerchantReference: "padberg_group", Version: 1}}
+				return map[string]types.Merchant{"padberg_group": padberg, "deckow_gibson": m["deckow_gibson"]}
+			},
+			want: []string{"padberg_group"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, o := merchants, orders
+			if tt.merchants != nil {
+				m = tt.merchants(merchants)
+			}
+			if tt.orders != nil {
+				o = tt.orders(orders)
+			}
+
+			d := newImportDigests(m)
+			for _, order := range o {
+				d.add(order)
+			}
+			got := d.changed(stored)
+			if len(got) != len(tt.want) {
+				t.Fatalf("changed() = %v, want %v", got, tt.want)
+			}
+			for _, ref := range tt.want {
+				if _, ok := got[ref]; !ok {
+					t.Errorf("changed() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
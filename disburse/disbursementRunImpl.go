@@ -0,0 +1,321 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"log/slog"
+	"time"
+)
+
+func NewRunner(logger *slog.Logger, ctx context.Context, repo repo.DisburserRepoRepository, provider PayoutProvider, clock types.Clock) *Runner {
+	return &Runner{
+		Logger:   logger,
+		Ctx:      ctx,
+		Repo:     repo,
+		Provider: provider,
+		Clock:    clock,
+	}
+}
+
+// Run executes the disbursement job for runDate. Every open disbursement group whose rolled payout date is on or before runDate is closed:
+// its payout and order fee totals are computed, its adjustments are applied, outstanding minimum monthly fees of the merchant are
+// deducted when the group is in the merchant's currency, the merchant's reserve is held back, the payout is sent through the payout provider, all of its records are marked paid
+// with the provider's transaction id and a disbursement group record is written. The groups of merchants on hold are left open
+// until the hold is lifted. Once the groups are paid the reserves due on runDate are released, see releaseReserves. A group or
+// reserve the provider rejects stays open and the run is recorded as failed. The run itself is recorded per day, so running it again for a day that already completed is a no-op
+// and a run that failed part way through resumes with the groups that are still unpaid.
+func (r *Runner) Run(ctx context.Context, runDate time.Time) (types.DisbursementRun, error) {
+	runDate = types.StartOfDay(runDate)
+	run, err := r.Repo.GetDisbursementRunByDate(ctx, runDate)
+	switch {
+	case err == nil && run.Status == types.RUN_COMPLETED:
+		r.Logger.Info("disbursement run already completed", "run_date", runDate.Format(time.DateOnly), "run_id", run.ID)
+		return run, nil
+	case err == nil:
+		r.Logger.Warn("resuming incomplete disbursement run", "run_date", runDate.Format(time.DateOnly), "run_id", run.ID, "status", run.Status)
+		run.Status = types.RUN_RUNNING
+		run.GroupsFailed = 0
+		run.GroupsHeld = 0
+	case errors.Is(err, sql.ErrNoRows):
+		run = types.DisbursementRun{
+			ID:        uuid.New(),
+			RunDate:   runDate,
+			Status:    types.RUN_RUNNING,
+			StartedAt: r.Clock.Now(),
+		}
+		err = r.Repo.InsertDisbursementRun(ctx, run)
+		if err != nil {
+			r.Logger.Error("failed to insert disbursement run", "error", err)
+			return run, err
+		}
+	default:
+		r.Logger.Error("failed to get disbursement run by date", "error", err)
+		return run, err
+	}
+
+	groups, err := r.Repo.GetDueDisbursementGroups(ctx, runDate)
+	if err != nil {
+		r.Logger.Error("failed to get due disbursement groups", "error", err)
+		return r.failRun(ctx, run, err)
+	}
+
+	for _, g := range groups {
+		if ctx.Err() != nil {
+			return r.failRun(ctx, run, ctx.Err())
+		}
+
+		g.RunID = run.ID
+		merch, err := r.Repo.GetMerchantByReferenceID(g.MerchReference)
+		if err != nil {
+			r.Logger.Error("failed to get merchant of disbursement group", "disbursement_group_id", g.ID, "merchant", g.MerchReference, "error", err)
+			return r.failRun(ctx, run, err)
+		}
+
+		if merch.Hold != nil {
+			r.Logger.Info("disbursement group held", "disbursement_group_id", g.ID, "merchant", g.MerchReference, "reason", merch.Hold.Reason)
+			run.GroupsHeld++
+			continue
+		}
+
+		adjustments, err := r.Repo.GetAdjustmentsForGroup(ctx, g.MerchReference, g.Currency, g.ID)
+		if err != nil {
+			r.Logger.Error("failed to get adjustments for disbursement group", "disbursement_group_id", g.ID, "error", err)
+			return r.failRun(ctx, run, err)
+		}
+		g = applyAdjustments(g, adjustments, r.Clock.Now())
+
+		if types.SameCurrency(g.Currency, merch.Currency) {
+			g.MonthlyFees, err = r.monthlyFees(ctx, g)
+			if err != nil {
+				r.Logger.Error("failed to get minimum monthly fees for disbursement group", "disbursement_group_id", g.ID, "merchant", g.MerchReference, "error", err)
+				return r.failRun(ctx, run, err)
+			}
+			g.MonthlyFeeDeduction = deductMonthlyFees(g.MonthlyFees, g.PayoutTotal, g.ID)
+			g.PayoutTotal -= g.MonthlyFeeDeduction
+		}
+		g = applyReserve(g, merch.Reserve, runDate, r.Clock.Now())
+
+		if g.PayoutTotal > 0 {
+			g.TransactionID, err = r.Provider.InitiateTransfer(ctx, types.Transfer{
+				DisbursementGroupID: g.ID,
+				MerchReference:      g.MerchReference,
+				Amount:              g.PayoutTotal,
+				Currency:            types.CurrencyCode(g.Currency),
+			})
+			if err != nil {
+				r.Logger.Error("payout provider rejected transfer", "disbursement_group_id", g.ID, "merchant", g.MerchReference, "error", err)
+				run.GroupsFailed++
+				continue
+			}
+		}
+
+		g.PaidAt = r.Clock.Now()
+		err = r.Repo.PayDisbursementGroup(ctx, g)
+		if err != nil {
+			r.Logger.Error("failed to pay disbursement group", "disbursement_group_id", g.ID, "transaction_id", g.TransactionID, "error", err)
+			return r.failRun(ctx, run, err)
+		}
+
+		run.GroupsPaid++
+		run.AddPayout(g.Currency, g.PayoutTotal, g.OrderFeeTotal)
+		err = r.Repo.UpdateDisbursementRun(ctx, run)
+		if err != nil {
+			r.Logger.Error("failed to update disbursement run", "run_id", run.ID, "error", err)
+		}
+	}
+
+	reservesFailed, err := r.releaseReserves(ctx, &run, runDate)
+	if err != nil {
+		r.Logger.Error("failed to release reserves", "run_date", runDate.Format(time.DateOnly), "error", err)
+		return r.failRun(ctx, run, err)
+	}
+
+	if run.GroupsFailed > 0 || reservesFailed > 0 {
+		return r.failRun(ctx, run, fmt.Errorf("%d disbursement groups and %d reserves could not be transferred", run.GroupsFailed, reservesFailed))
+	}
+
+	run.Status = types.RUN_COMPLETED
+	run.CompletedAt = r.Clock.Now()
+	err = r.Repo.UpdateDisbursementRun(ctx, run)
+	if err != nil {
+		r.Logger.Error("failed to complete disbursement run", "run_id", run.ID, "error", err)
+		return run, err
+	}
+
+	r.Logger.Info("disbursement run completed", "run_date", runDate.Format(time.DateOnly), "groups_paid", run.GroupsPaid, "totals", run.Totals)
+	return run, nil
+}
+
+// applyAdjustments applies the adjustments to the payout of the group. When the adjustments take the payout below zero nothing is
+// paid and the remainder is carried into the merchant's next payout as a new pending adjustment, created at now.
+func applyAdjustments(g types.DisbursementGroup, adjustments []types.Adjustment, now time.Time) types.DisbursementGroup {
+	g.Adjustments = adjustments
+	g.AdjustmentTotal = 0
+	g.CarryForward = nil
+	for _, adj := range adjustments {
+		g.AdjustmentTotal += adj.Amount
+	}
+
+	g.PayoutTotal = g.OrderTotal - g.OrderFeeTotal + g.AdjustmentTotal
+	if g.PayoutTotal < 0 {
+		g.CarryForward = &types.Adjustment{
+			ID:                uuid.New(),
+			MerchantReference: g.MerchReference,
+			Kind:              types.ADJUSTMENT_CARRY_FORWARD,
+			SourceID:          g.ID,
+			Amount:            g.PayoutTotal,
+			Currency:          types.CurrencyCode(g.Currency),
+			Reason:            fmt.Sprintf("carried forward from disbursement group %s", g.ID),
+			CreatedAt:         now,
+		}
+		g.PayoutTotal = 0
+	}
+	return g
+}
+
+// applyReserve holds back the part of the payout of the group taken by the merchant's reserve policy, released by the run of the
+// day policy.Days after runDate. The reserve is created at now.
+func applyReserve(g types.DisbursementGroup, policy types.ReservePolicy, runDate time.Time, now time.Time) types.DisbursementGroup {
+	g.Reserve = nil
+	g.ReserveAmount = policy.Amount(g.PayoutTotal)
+	if g.ReserveAmount == 0 {
+		return g
+	}
+
+	g.PayoutTotal -= g.ReserveAmount
+	g.Reserve = &types.Reserve{
+		ID:                  uuid.New(),
+		MerchantReference:   g.MerchReference,
+		DisbursementGroupID: g.ID,
+		Amount:              g.ReserveAmount,
+		Currency:            types.CurrencyCode(g.Currency),
+		ReleaseDate:         types.StartOfDay(runDate).AddDate(0, 0, policy.Days),
+		CreatedAt:           now,
+	}
+	return g
+}
+
+// releaseReserves pays the reserves due on runDate out to their merchants through the payout provider, using the id of the reserve
+// as the transfer's idempotency key. The reserves of merchants on hold are kept until the hold is lifted. A reserve the provider
+// rejects stays reserved for the next run; the number of them is returned.
+func (r *Runner) releaseReserves(ctx context.Context, run *types.DisbursementRun, runDate time.Time) (int64, error) {
+	reserves, err := r.Repo.GetDueReserves(ctx, runDate)
+	if err != nil {
+		return 0, err
+	}
+
+	var failed int64
+	held := map[string]bool{}
+	for _, res := range reserves {
+		onHold, ok := held[res.MerchantReference]
+		if !ok {
+			merch, err := r.Repo.GetMerchantByReferenceID(res.MerchantReference)
+			if err != nil {
+				return failed, err
+			}
+			onHold = merch.Hold != nil
+			held[res.MerchantReference] = onHold
+		}
+		if onHold {
+			continue
+		}
+
+		res.TransactionID, err = r.Provider.InitiateTransfer(ctx, types.Transfer{
+			DisbursementGroupID: res.ID,
+			MerchReference:      res.MerchantReference,
+			Amount:              res.Amount,
+			Currency:            types.CurrencyCode(res.Currency),
+		})
+		if err != nil {
+			r.Logger.Error("payout provider rejected reserve release", "reserve_id", res.ID, "merchant", res.MerchantReference, "error", err)
+			failed++
+			continue
+		}
+
+		res.ReleasedAt = r.Clock.Now()
+		err = r.Repo.ReleaseReserve(ctx, res)
+		if err != nil {
+			r.Logger.Error("failed to release reserve", "reserve_id", res.ID, "transaction_id", res.TransactionID, "error", err)
+			return failed, err
+		}
+
+		run.ReservesPaid++
+		run.AddPayout(res.Currency, res.Amount, 0)
+	}
+	return failed, nil
+}
+
+// failRun records the run as failed, keeping the totals of the groups paid so far, and returns the original error.
+func (r *Runner) failRun(ctx context.Context, run types.DisbursementRun, cause error) (types.DisbursementRun, error) {
+	run.Status = types.RUN_FAILED
+	run.CompletedAt = r.Clock.Now()
+	err := r.Repo.UpdateDisbursementRun(context.WithoutCancel(ctx), run)
+	if err != nil {
+		r.Logger.Error("failed to record failed disbursement run", "run_id", run.ID, "error", err)
+	}
+	return run, cause
+}
+
+// Schedule runs the disbursement job every business day at types.TIME_CUT_OFF UTC until ctx is cancelled. When the service starts after
+// today's cut off the run for today is executed straight away, which is safe because Run is idempotent per day.
+func (r *Runner) Schedule(ctx context.Context) {
+	cutOff, err := time.Parse(time.TimeOnly, types.TIME_CUT_OFF)
+	if err != nil {
+		r.Logger.Error("failed to parse time cut off, disbursement runs are not scheduled", "error", err)
+		return
+	}
+
+	now := r.Clock.Now()
+	if !now.Before(cutOffOn(now, cutOff)) {
+		r.runScheduled(ctx, now)
+	}
+
+	for {
+		now = r.Clock.Now()
+		next := nextRunTime(now, cutOff)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			r.runScheduled(ctx, next)
+		}
+	}
+}
+
+// runScheduled runs the disbursement job for runDate unless it is not a business day, when nothing is paid out and the groups due
+// are left to the run of the next business day.
+func (r *Runner) runScheduled(ctx context.Context, runDate time.Time) {
+	warnPastCalendar(r.Logger, r.Calendar, runDate)
+	if !r.Calendar.IsBusinessDay(runDate) {
+		holiday, _ := r.Calendar.Holiday(runDate)
+		r.Logger.Info("no disbursement run on a non business day", "run_date", runDate.Format(time.DateOnly), "holiday", holiday)
+		return
+	}
+
+	_, err := r.Run(ctx, runDate)
+	if err != nil {
+		r.Logger.Error("scheduled disbursement run failed", "run_date", runDate.Format(time.DateOnly), "error", err)
+	}
+}
+
+// cutOffOn returns the cut off time on the calendar day of t.
+func cutOffOn(t time.Time, cutOff time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), cutOff.Hour(), cutOff.Minute(), cutOff.Second(), 0, time.UTC)
+}
+
+// nextRunTime returns the first cut off strictly after now.
+func nextRunTime(now time.Time, cutOff time.Time) time.Time {
+	next := cutOffOn(now, cutOff)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
@@ -0,0 +1,563 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runRepo is an in-memory stand-in for the repo methods used by the disbursement run.
+type runRepo struct {
+	repo.DisburserRepoRepository
+	groups      []types.DisbursementGroup
+	paid        map[uuid.UUID]types.DisbursementGroup
+	runs        map[string]types.DisbursementRun
+	adjustments []types.Adjustment
+	merchants   map[string]types.Merchant
+	monthly     []types.Monthly
+	reserves    []types.Reserve
+}
+
+func newRunRepo(groups ...types.DisbursementGroup) *runRepo {
+	return &runRepo{groups: groups, paid: map[uuid.UUID]types.DisbursementGroup{}, runs: map[string]types.DisbursementRun{}}
+}
+
+func (rr *runRepo) GetDueDisbursementGroups(ctx context.Context, runDate time.Time) ([]types.DisbursementGroup, error) {
+	var due []types.DisbursementGroup
+	for _, g := range rr.groups {
+		payoutDate := g.RolledPayoutDate
+		if payoutDate.IsZero() {
+			payoutDate = g.PayoutDate
+		}
+		if _, ok := rr.paid[g.ID]; !ok && !payoutDate.After(runDate) {
+			due = append(due, g)
+		}
+	}
+	return due, nil
+}
+
+func (rr *runRepo) PayDisbursementGroup(ctx context.Context, g types.DisbursementGroup) error {
+	rr.paid[g.ID] = g
+	var pending []types.Adjustment
+	for _, adj := range rr.adjustments {
+		applied := false
+		for _, a := range g.Adjustments {
+			applied = applied || a.ID == adj.ID
+		}
+		if !applied {
+			pending = append(pending, adj)
+		}
+	}
+	if g.CarryForward != nil {
+		pending = append(pending, *g.CarryForward)
+	}
+	rr.adjustments = pending
+
+	if g.Reserve != nil {
+		rr.reserves = append(rr.reserves, *g.Reserve)
+	}
+
+	for _, m := range g.MonthlyFees {
+		for i := range rr.monthly {
+			if rr.monthly[i].ID == m.ID {
+				rr.monthly[i] = m
+			}
+		}
+	}
+	return nil
+}
+
+func (rr *runRepo) GetMerchantByReferenceID(merchRef string) (types.Merchant, error) {
+	m, ok := rr.merchants[merchRef]
+	if !ok {
+		return types.Merchant{Reference: merchRef, MinMonthlyFee: "0.0"}, nil
+	}
+	return m, nil
+}
+
+func (rr *runRepo) GetLastMonthlyFeeDate(ctx context.Context, merchRef string) (time.Time, error) {
+	var last time.Time
+	for _, m := range rr.monthly {
+		if m.MerchantReference == merchRef && m.MonthlyFeeDate.After(last) {
+			last = m.MonthlyFeeDate
+		}
+	}
+	return last, nil
+}
+
+func (rr *runRepo) GetMonthTotals(ctx context.Context, merchRef, currency string, month time.Time) (orderTotal, orderFeeTotal int64, err error) {
+	for _, g := range rr.groups {
+		if g.MerchReference == merchRef && types.SameCurrency(g.Currency, currency) && types.StartOfMonth(g.PayoutDate).Equal(month) {
+			orderTotal += g.OrderTotal
+			orderFeeTotal += g.OrderFeeTotal
+		}
+	}
+	return orderTotal, orderFeeTotal, nil
+}
+
+func (rr *runRepo) InsertMonthly(m types.Monthly) error {
+	rr.monthly = append(rr.monthly, m)
+	return nil
+}
+
+func (rr *runRepo) GetOutstandingMonthlyFees(ctx context.Context, merchRef string) ([]types.Monthly, error) {
+	var outstanding []types.Monthly
+	for _, m := range rr.monthly {
+		if m.MerchantReference == merchRef && m.FeeOutstanding() > 0 {
+			outstanding = append(outstanding, m)
+		}
+	}
+	return outstanding, nil
+}
+
+func (rr *runRepo) GetAdjustmentsForGroup(ctx context.Context, merchRef, currency string, groupID uuid.UUID) ([]types.Adjustment, error) {
+	var adjustments []types.Adjustment
+	for _, adj := range rr.adjustments {
+		if adj.MerchantReference == merchRef && types.SameCurrency(adj.Currency, currency) && (adj.DisbursementGroupID == groupID || adj.DisbursementGroupID == uuid.Nil) {
+			adjustments = append(adjustments, adj)
+		}
+	}
+	return adjustments, nil
+}
+
+func (rr *runRepo) GetDisbursementRunByDate(ctx context.Context, runDate time.Time) (types.DisbursementRun, error) {
+	run, ok := rr.runs[runDate.Format(time.DateOnly)]
+	if !ok {
+		return run, sql.ErrNoRows
+	}
+	return run, nil
+}
+
+func (rr *runRepo) InsertDisbursementRun(ctx context.Context, run types.DisbursementRun) error {
+	rr.runs[run.RunDate.Format(time.DateOnly)] = run
+	return nil
+}
+
+func (rr *runRepo) UpdateDisbursementRun(ctx context.Context, run types.DisbursementRun) error {
+	rr.runs[run.RunDate.Format(time.DateOnly)] = run
+	return nil
+}
+
+func TestRunner_Run(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	rr := newRunRepo(
+		types.DisbursementGroup{ID: uuid.New(), MerchReference: "padberg_group", PayoutDate: day("2023-02-01"), OrderTotal: 10229, OrderFeeTotal: 1022, PayoutTotal: 9207},
+		types.DisbursementGroup{ID: uuid.New(), MerchReference: "padberg_group", PayoutDate: day("2023-02-02"), OrderTotal: 44045, OrderFeeTotal: 2238, PayoutTotal: 41807},
+		types.DisbursementGroup{ID: uuid.New(), MerchReference: "rosenbaum_parisian", PayoutDate: day("2023-02-08"), OrderTotal: 8286, OrderFeeTotal: 414, PayoutTotal: 7872},
+	)
+	bank := NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json"))
+	r := NewRunner(logger, context.Background(), rr, bank, types.SystemClock{})
+
+	run, err := r.Run(context.Background(), day("2023-02-02").Add(8*time.Hour))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if run.Status != types.RUN_COMPLETED || run.GroupsPaid != 2 || run.PayoutTotal != 51014 || run.OrderFeeTotal != 3260 {
+		t.Errorf("Run() got = %+v, want 2 groups paid totalling 51014 with 3260 in fees", run)
+	}
+	for _, g := range rr.paid {
+		if g.RunID != run.ID {
+			t.Errorf("Run() paid group %s with run id %s, want %s", g.ID, g.RunID, run.ID)
+		}
+		transfer, err := bank.TransferStatus(context.Background(), g.TransactionID)
+		if err != nil || transfer.DisbursementGroupID != g.ID || transfer.Amount != g.PayoutTotal {
+			t.Errorf("Run() paid group %s with transfer %+v, error = %v", g.ID, transfer, err)
+		}
+	}
+
+	again, err := r.Run(context.Background(), day("2023-02-02"))
+	if err != nil {
+		t.Fatalf("Run() re-execution error = %v", err)
+	}
+	if again.ID != run.ID || len(rr.paid) != 2 {
+		t.Errorf("Run() re-execution got = %+v with %d groups paid, want the completed run unchanged", again, len(rr.paid))
+	}
+}
+
+func TestRunner_Run_currencies(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	rr := newRunRepo(
+		types.DisbursementGroup{ID: uuid.New(), MerchReference: "padberg_group", Currency: "EUR", PayoutDate: day("2023-02-01"), OrderTotal: 10229, OrderFeeTotal: 1022, PayoutTotal: 9207},
+		types.DisbursementGroup{ID: uuid.New(), MerchReference: "padberg_group", Currency: "GBP", PayoutDate: day("2023-02-01"), OrderTotal: 44045, OrderFeeTotal: 2238, PayoutTotal: 41807},
+	)
+	r := NewRunner(logger, context.Background(), rr, NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json")), types.SystemClock{})
+
+	run, err := r.Run(context.Background(), day("2023-02-01"))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if run.GroupsPaid != 2 || run.PayoutTotal != 9207 || run.OrderFeeTotal != 1022 {
+		t.Errorf("Run() got = %+v, want the default currency totals of 9207 with 1022 in fees", run)
+	}
+	want := map[string]types.RunTotal{
+		"EUR": {Currency: "EUR", PayoutTotal: 9207, OrderFeeTotal: 1022},
+		"GBP": {Currency: "GBP", PayoutTotal: 41807, OrderFeeTotal: 2238},
+	}
+	if len(run.Totals) != len(want) {
+		t.Fatalf("Run() totals = %+v, want one per currency", run.Totals)
+	}
+	for _, total := range run.Totals {
+		if total != want[total.Currency] {
+			t.Errorf("Run() total = %+v, want %+v", total, want[total.Currency])
+		}
+	}
+}
+
+func (rr *runRepo) GetDisbursementGroupID(ctx context.Context, today time.Time, merchRef, currency string) (uuid.UUID, error) {
+	for _, g := range rr.groups {
+		_, paid := rr.paid[g.ID]
+		if !paid && g.PayoutDate.Equal(today) && g.MerchReference == merchRef && types.SameCurrency(g.Currency, currency) {
+			return g.ID, nil
+		}
+	}
+	return uuid.Nil, sql.ErrNoRows
+}
+
+func (rr *runRepo) InsertDisbursement(d types.Disbursement) (int64, error) {
+	for i, g := range rr.groups {
+		if g.ID == d.DisbursementGroupID {
+			rr.groups[i].NumberOfOrders++
+			rr.groups[i].OrderTotal += d.OrderAmount
+			rr.groups[i].OrderFeeTotal += d.OrderFee
+			rr.groups[i].PayoutTotal += d.OrderAmount - d.OrderFee
+			return 0, nil
+		}
+	}
+	rr.groups = append(rr.groups, types.DisbursementGroup{ID: d.DisbursementGroupID, MerchReference: d.MerchReference, Currency: d.Currency,
+		PayoutDate: d.PayoutDate, RolledPayoutDate: d.RolledPayoutDate, NumberOfOrders: 1, OrderTotal: d.OrderAmount, OrderFeeTotal: d.OrderFee,
+		PayoutTotal: d.OrderAmount - d.OrderFee})
+	return 0, nil
+}
+
+func TestRunner_Run_orderAfterPayout(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	paid := types.DisbursementGroup{ID: uuid.New(), MerchReference: "padberg_group", Currency: "EUR", PayoutDate: day("2023-02-02"), NumberOfOrders: 1, OrderTotal: 10229, OrderFeeTotal: 1022, PayoutTotal: 9207}
+	rr := newRunRepo(paid)
+	rr.merchants = map[string]types.Merchant{
+		"padberg_group": {Reference: "padberg_group", LiveOn: day("2023-01-01"), DisbursementFrequency: types.DAILY, MinMonthlyFee: "0.0", Currency: "EUR"},
+	}
+	r := NewRunner(logger, context.Background(), rr, NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json")), types.SystemClock{})
+
+	run, err := r.Run(context.Background(), day("2023-02-02").Add(6*time.Hour))
+	if err != nil || run.GroupsPaid != 1 {
+		t.Fatalf("Run() got = %+v, error = %v, want the group of 2023-02-02 paid", run, err)
+	}
+
+	clock := types.NewTestClock(day("2023-02-02").Add(7 * time.Hour))
+	op := &OProcessor{disburserRepoRepository: rr, logger: logger, ctx: context.Background(), clock: clock}
+	o := NewOrder(clock, "056d024481a9", "padberg_group", 20000)
+	o.Currency = "EUR"
+	err = op.ProcessOrder(logger, context.Background(), rr, o)
+	if err != nil {
+		t.Fatalf("ProcessOrder() error = %v", err)
+	}
+	if len(rr.groups) != 2 || rr.groups[1].ID == paid.ID || !rr.groups[1].PayoutDate.Equal(day("2023-02-02")) {
+		t.Fatalf("ProcessOrder() groups = %+v, want a new group for 2023-02-02 next to the paid one", rr.groups)
+	}
+	if rr.paid[paid.ID].OrderTotal != paid.OrderTotal {
+		t.Errorf("ProcessOrder() changed the paid group to %+v", rr.paid[paid.ID])
+	}
+
+	next, err := r.Run(context.Background(), day("2023-02-03").Add(8*time.Hour))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if next.Status != types.RUN_COMPLETED || next.GroupsPaid != 1 || rr.paid[rr.groups[1].ID].OrderTotal != 20000 {
+		t.Errorf("Run() got = %+v, want the new group paid out with the order by the next run", next)
+	}
+}
+
+func TestRunner_runScheduled(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	friday := types.DisbursementGroup{ID: uuid.New(), MerchReference: "padberg_group", PayoutDate: day("2023-02-03"), RolledPayoutDate: day("2023-02-03"), OrderTotal: 10229, OrderFeeTotal: 1022, PayoutTotal: 9207}
+	saturday := types.DisbursementGroup{ID: uuid.New(), MerchReference: "padberg_group", PayoutDate: day("2023-02-04"), RolledPayoutDate: day("2023-02-06"), OrderTotal: 44045, OrderFeeTotal: 2238, PayoutTotal: 41807}
+	rr := newRunRepo(friday, saturday)
+	r := NewRunner(logger, context.Background(), rr, NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json")), types.SystemClock{})
+	r.Calendar = types.NewCalendar("TARGET2")
+
+	r.runScheduled(context.Background(), day("2023-02-03").Add(8*time.Hour))
+	if _, ok := rr.paid[friday.ID]; !ok || len(rr.paid) != 1 {
+		t.Errorf("runScheduled() on friday paid %d groups, want the group due on friday", len(rr.paid))
+	}
+
+	r.runScheduled(context.Background(), day("2023-02-04").Add(8*time.Hour))
+	if _, ok := rr.runs["2023-02-04"]; ok || len(rr.paid) != 1 {
+		t.Errorf("runScheduled() on saturday ran with %d groups paid, want no run", len(rr.paid))
+	}
+
+	r.runScheduled(context.Background(), day("2023-02-06").Add(8*time.Hour))
+	if g, ok := rr.paid[saturday.ID]; !ok || !g.PayoutDate.Equal(day("2023-02-04")) {
+		t.Errorf("runScheduled() on monday paid %+v, want the group of saturday rolled to monday", g)
+	}
+}
+
+func Test_nextRunTime(t *testing.T) {
+	cutOff, _ := time.Parse(time.TimeOnly, types.TIME_CUT_OFF)
+	tests := []struct {
+		name string
+		now  string
+		want string
+	}{
+		{name: "before cut off", now: "2023-02-01T07:59:59Z", want: "2023-02-01T08:00:00Z"},
+		{name: "at cut off", now: "2023-02-01T08:00:00Z", want: "2023-02-02T08:00:00Z"},
+		{name: "after cut off", now: "2023-02-01T13:00:00Z", want: "2023-02-02T08:00:00Z"},
+		{name: "year end", now: "2023-12-31T23:00:00Z", want: "2024-01-01T08:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now, _ := time.Parse(time.RFC3339, tt.now)
+			want, _ := time.Parse(time.RFC3339, tt.want)
+			if got := nextRunTime(now, cutOff); !got.Equal(want) {
+				t.Errorf("nextRunTime() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func (rr *runRepo) GetDueReserves(ctx context.Context, runDate time.Time) ([]types.Reserve, error) {
+	var due []types.Reserve
+	for _, r := range rr.reserves {
+		if r.ReleasedAt.IsZero() && !r.ReleaseDate.After(runDate) {
+			due = append(due, r)
+		}
+	}
+	return due, nil
+}
+
+func (rr *runRepo) ReleaseReserve(ctx context.Context, r types.Reserve) error {
+	for i := range rr.reserves {
+		if rr.reserves[i].ID == r.ID {
+			rr.reserves[i] = r
+		}
+	}
+	return nil
+}
+
+func TestRunner_Run_providerFailure(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	payoutDate, _ := time.Parse(time.DateOnly, "2023-02-01")
+	rr := newRunRepo(
+		types.DisbursementGroup{ID: uuid.New(), MerchReference: "padberg_group", PayoutDate: payoutDate, OrderTotal: 9207, PayoutTotal: 9207},
+		types.DisbursementGroup{ID: uuid.New(), MerchReference: "deckow_gibson", PayoutDate: payoutDate, OrderTotal: 1500, PayoutTotal: 1500},
+	)
+	bank := NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json"))
+	bank.FailMerchants["deckow_gibson"] = true
+	r := NewRunner(logger, context.Background(), rr, bank, types.SystemClock{})
+
+	run, err := r.Run(context.Background(), payoutDate)
+	if err == nil || run.Status != types.RUN_FAILED || run.GroupsPaid != 1 || run.GroupsFailed != 1 {
+		t.Fatalf("Run() got = %+v, error = %v, want a failed run with one group paid", run, err)
+	}
+
+	delete(bank.FailMerchants, "deckow_gibson")
+	run, err = r.Run(context.Background(), payoutDate)
+	if err != nil || run.Status != types.RUN_COMPLETED || run.GroupsPaid != 2 || run.GroupsFailed != 0 {
+		t.Errorf("Run() resumed got = %+v, error = %v, want the remaining group paid", run, err)
+	}
+}
+
+func TestRunner_Run_adjustments(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	first, second := uuid.New(), uuid.New()
+	rr := newRunRepo(
+		types.DisbursementGroup{ID: first, MerchReference: "padberg_group", PayoutDate: day("2023-02-01"), OrderTotal: 10000, OrderFeeTotal: 100, PayoutTotal: 9900},
+		types.DisbursementGroup{ID: second, MerchReference: "padberg_group", PayoutDate: day("2023-02-02"), OrderTotal: 5000, OrderFeeTotal: 50, PayoutTotal: 4950},
+	)
+	rr.adjustments = []types.Adjustment{
+		{ID: uuid.New(), MerchantReference: "padberg_group", DisbursementGroupID: first, Kind: types.ADJUSTMENT_REFUND, Amount: -12000},
+		{ID: uuid.New(), MerchantReference: "padberg_group", DisbursementGroupID: second, Kind: types.ADJUSTMENT_REFUND, Amount: -1000},
+		{ID: uuid.New(), MerchantReference: "deckow_gibson", Kind: types.ADJUSTMENT_REFUND, Amount: -500},
+	}
+	clock := types.NewTestClock(day("2023-02-01").Add(8 * time.Hour))
+	r := NewRunner(logger, context.Background(), rr, NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json")), clock)
+
+	run, err := r.Run(context.Background(), day("2023-02-01"))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !run.StartedAt.Equal(clock.Now()) || !run.CompletedAt.Equal(clock.Now()) {
+		t.Errorf("Run() started at %v and completed at %v, want both at %v", run.StartedAt, run.CompletedAt, clock.Now())
+	}
+	g := rr.paid[first]
+	if g.PayoutTotal != 0 || g.AdjustmentTotal != -12000 || g.CarryForward == nil || g.CarryForward.Amount != -2100 || g.TransactionID != "" {
+		t.Fatalf("Run() paid group %+v, want nothing transferred and -2100 carried forward", g)
+	}
+	if !g.PaidAt.Equal(clock.Now()) || !g.CarryForward.CreatedAt.Equal(clock.Now()) {
+		t.Errorf("Run() paid group at %v carrying forward %+v, want both at %v", g.PaidAt, g.CarryForward, clock.Now())
+	}
+	clock.Advance(24 * time.Hour)
+
+	_, err = r.Run(context.Background(), day("2023-02-02"))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	g = rr.paid[second]
+	if g.PayoutTotal != 1850 || g.AdjustmentTotal != -3100 || g.CarryForward != nil {
+		t.Errorf("Run() paid group %+v, want 1850 paid after the carried forward and group adjustments", g)
+	}
+	if len(rr.adjustments) != 1 || rr.adjustments[0].MerchantReference != "deckow_gibson" {
+		t.Errorf("Run() left adjustments %+v, want only the other merchant's adjustment pending", rr.adjustments)
+	}
+}
+
+func TestRunner_Run_monthlyFee(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	jan, feb1, feb2 := uuid.New(), uuid.New(), uuid.New()
+	rr := newRunRepo(
+		types.DisbursementGroup{ID: jan, MerchReference: "deckow_gibson", PayoutDate: day("2023-01-15"), OrderTotal: 10000, OrderFeeTotal: 100},
+		types.DisbursementGroup{ID: feb1, MerchReference: "deckow_gibson", PayoutDate: day("2023-02-01"), OrderTotal: 2000, OrderFeeTotal: 20},
+		types.DisbursementGroup{ID: feb2, MerchReference: "deckow_gibson", PayoutDate: day("2023-02-02"), OrderTotal: 5000, OrderFeeTotal: 50},
+	)
+	rr.merchants = map[string]types.Merchant{
+		"deckow_gibson": {Reference: "deckow_gibson", LiveOn: day("2023-01-01"), DisbursementFrequency: types.DAILY, MinMonthlyFee: "30.0"},
+	}
+	r := NewRunner(logger, context.Background(), rr, NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json")), types.SystemClock{})
+
+	for _, runDate := range []string{"2023-01-15", "2023-02-01", "2023-02-02"} {
+		_, err := r.Run(context.Background(), day(runDate))
+		if err != nil {
+			t.Fatalf("Run(%s) error = %v", runDate, err)
+		}
+	}
+
+	if g := rr.paid[jan]; g.PayoutTotal != 9900 || g.MonthlyFeeDeduction != 0 {
+		t.Errorf("Run() paid group %+v, want 9900 without a deduction in the merchant's first month", g)
+	}
+	if g := rr.paid[feb1]; g.PayoutTotal != 0 || g.MonthlyFeeDeduction != 1980 {
+		t.Errorf("Run() paid group %+v, want the whole 1980 payout deducted", g)
+	}
+	if g := rr.paid[feb2]; g.PayoutTotal != 4030 || g.MonthlyFeeDeduction != 920 {
+		t.Errorf("Run() paid group %+v, want the remaining 920 deducted from 4950", g)
+	}
+	if len(rr.monthly) != 1 || rr.monthly[0].OrderFeeTotal != 100 || rr.monthly[0].FeeDeducted != 2900 || rr.monthly[0].DisbursementGroupID != feb2 {
+		t.Errorf("Run() recorded monthly fees %+v, want January's 2900 shortfall fully deducted", rr.monthly)
+	}
+}
+
+func TestRunner_Run_monthlyFeeWithoutPayout(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	jan, apr := uuid.New(), uuid.New()
+	rr := newRunRepo(
+		types.DisbursementGroup{ID: jan, MerchReference: "deckow_gibson", PayoutDate: day("2023-01-15"), OrderTotal: 10000, OrderFeeTotal: 100},
+		types.DisbursementGroup{ID: apr, MerchReference: "deckow_gibson", PayoutDate: day("2023-04-03"), OrderTotal: 200000, OrderFeeTotal: 2000},
+	)
+	rr.merchants = map[string]types.Merchant{
+		"deckow_gibson": {Reference: "deckow_gibson", LiveOn: day("2023-01-01"), DisbursementFrequency: types.DAILY, MinMonthlyFee: "30.0"},
+	}
+	r := NewRunner(logger, context.Background(), rr, NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json")), types.SystemClock{})
+
+	for _, runDate := range []string{"2023-01-15", "2023-04-03"} {
+		_, err := r.Run(context.Background(), day(runDate))
+		if err != nil {
+			t.Fatalf("Run(%s) error = %v", runDate, err)
+		}
+	}
+
+	var months []string
+	for _, m := range rr.monthly {
+		months = append(months, m.MonthlyFeeDate.Format(time.DateOnly))
+	}
+	if strings.Join(months, ",") != "2023-01-01,2023-02-01,2023-03-01" {
+		t.Errorf("Run() recorded monthly fees for %v, want january to march", months)
+	}
+	if g := rr.paid[apr]; g.MonthlyFeeDeduction != 2900+3000+3000 {
+		t.Errorf("Run() paid group %+v, want the shortfalls of january to march deducted", g)
+	}
+}
+
+func TestRunner_Run_holdsAndReserves(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	held, reserved := uuid.New(), uuid.New()
+	rr := newRunRepo(
+		types.DisbursementGroup{ID: held, MerchReference: "deckow_gibson", PayoutDate: day("2023-02-01"), OrderTotal: 10000, OrderFeeTotal: 100, PayoutTotal: 9900},
+		types.DisbursementGroup{ID: reserved, MerchReference: "padberg_group", PayoutDate: day("2023-02-01"), OrderTotal: 10000, OrderFeeTotal: 100, PayoutTotal: 9900},
+	)
+	rr.merchants = map[string]types.Merchant{
+		"deckow_gibson": {Reference: "deckow_gibson", MinMonthlyFee: "0.0", Hold: &types.PayoutHold{Reason: "fraud review"}},
+		"padberg_group": {Reference: "padberg_group", MinMonthlyFee: "0.0", Reserve: types.ReservePolicy{RateBasisPoints: 1000, Days: 90}},
+	}
+	bank := NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json"))
+	clock := types.NewTestClock(day("2023-02-01").Add(8 * time.Hour))
+	r := NewRunner(logger, context.Background(), rr, bank, clock)
+
+	run, err := r.Run(context.Background(), day("2023-02-01"))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if run.GroupsPaid != 1 || run.GroupsHeld != 1 || run.PayoutTotal != 8910 {
+		t.Errorf("Run() got = %+v, want the held group left open and 8910 paid", run)
+	}
+	if _, ok := rr.paid[held]; ok {
+		t.Errorf("Run() paid the group of a merchant on hold")
+	}
+	g := rr.paid[reserved]
+	if g.ReserveAmount != 990 || g.PayoutTotal != 8910 || len(rr.reserves) != 1 || !rr.reserves[0].ReleaseDate.Equal(day("2023-05-02")) {
+		t.Fatalf("Run() paid group %+v with reserves %+v, want 990 reserved until 2023-05-02", g, rr.reserves)
+	}
+	if !rr.reserves[0].CreatedAt.Equal(clock.Now()) {
+		t.Errorf("Run() reserved at %v, want %v", rr.reserves[0].CreatedAt, clock.Now())
+	}
+
+	rr.merchants["deckow_gibson"] = types.Merchant{Reference: "deckow_gibson", MinMonthlyFee: "0.0"}
+	run, err = r.Run(context.Background(), day("2023-02-02"))
+	if err != nil || run.GroupsPaid != 1 || run.ReservesPaid != 0 {
+		t.Errorf("Run() after the hold is lifted got = %+v, error = %v, want the held group paid", run, err)
+	}
+
+	rr.merchants["padberg_group"] = types.Merchant{Reference: "padberg_group", MinMonthlyFee: "0.0", Hold: &types.PayoutHold{Reason: "chargebacks"}}
+	run, err = r.Run(context.Background(), day("2023-05-02"))
+	if err != nil || run.ReservesPaid != 0 || !rr.reserves[0].ReleasedAt.IsZero() {
+		t.Errorf("Run() on the release date of a merchant on hold got = %+v, error = %v, want the reserve kept", run, err)
+	}
+
+	rr.merchants["padberg_group"] = types.Merchant{Reference: "padberg_group", MinMonthlyFee: "0.0"}
+	clock.Set(day("2023-05-03").Add(8 * time.Hour))
+	run, err = r.Run(context.Background(), day("2023-05-03"))
+	if err != nil || run.ReservesPaid != 1 || run.PayoutTotal != 990 || !rr.reserves[0].ReleasedAt.Equal(clock.Now()) {
+		t.Fatalf("Run() after the release date got = %+v, error = %v, want the reserve released", run, err)
+	}
+	transfer, err := bank.TransferStatus(context.Background(), rr.reserves[0].TransactionID)
+	if err != nil || transfer.Amount != 990 || transfer.DisbursementGroupID != rr.reserves[0].ID {
+		t.Errorf("Run() released the reserve with transfer %+v, error = %v", transfer, err)
+	}
+}
@@ -0,0 +1,194 @@
+package disburse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/types"
+	"os"
+	"sync"
+	"time"
+)
+
+// FakeBank is a PayoutProvider that keeps its transfers in a local JSON file instead of moving money. It is meant for running the
+// whole disbursement flow locally and in tests, and can be configured to add latency and to reject transfers.
+type FakeBank struct {
+	FileName string
+	// Delay is added to every call to simulate provider latency.
+	Delay time.Duration
+	// SettleAfter is how long a transfer reports PENDING before it is COMPLETED.
+	SettleAfter time.Duration
+	// FailEvery rejects every nth transfer initiated when greater than zero.
+	FailEvery int
+	// FailMerchants rejects every transfer for the listed merchant references.
+	FailMerchants map[string]bool
+	mu            sync.Mutex
+	initiated     int
+}
+
+func NewFakeBank(fileName string) *FakeBank {
+	return &FakeBank{
+		FileName:      fileName,
+		FailMerchants: map[string]bool{},
+	}
+}
+
+// InitiateTransfer records a new transfer and returns its transaction id. Initiating a transfer for a disbursement group that already
+// has a pending or completed transfer returns the existing transaction id.
+func (fb *FakeBank) InitiateTransfer(ctx context.Context, t types.Transfer) (string, error) {
+	err := fb.wait(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	transfers, err := fb.load()
+	if err != nil {
+		return "", err
+	}
+
+	for _, existing := range transfers {
+		if existing.DisbursementGroupID == t.DisbursementGroupID && existing.Status != types.TRANSFER_FAILED && existing.Status != types.TRANSFER_CANCELLED {
+			return existing.TransactionID, nil
+		}
+	}
+
+	if t.Amount <= 0 {
+		return "", fmt.Errorf("transfer amount %d must be greater than zero", t.Amount)
+	}
+
+	fb.initiated++
+	now := time.Now().UTC()
+	t.TransactionID = uuid.NewString()
+	t.Status = types.TRANSFER_PENDING
+	t.CreatedAt = now
+	t.UpdatedAt = now
+
+	var rejected error
+	if fb.FailEvery > 0 && fb.initiated%fb.FailEvery == 0 {
+		rejected = errors.New("fake bank rejected transfer")
+	}
+	if fb.FailMerchants[t.MerchReference] {
+		rejected = fmt.Errorf("fake bank rejected transfers for merchant %s", t.MerchReference)
+	}
+	if rejected != nil {
+		t.Status = types.TRANSFER_FAILED
+		t.FailureReason = rejected.Error()
+	}
+
+	transfers[t.TransactionID] = t
+	err = fb.save(transfers)
+	if err != nil {
+		return "", err
+	}
+	return t.TransactionID, rejected
+}
+
+// TransferStatus returns the transfer, settling it once SettleAfter has elapsed since it was initiated.
+func (fb *FakeBank) TransferStatus(ctx context.Context, transactionID string) (types.Transfer, error) {
+	err := fb.wait(ctx)
+	if err != nil {
+		return types.Transfer{}, err
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	transfers, err := fb.load()
+	if err != nil {
+		return types.Transfer{}, err
+	}
+
+	t, ok := transfers[transactionID]
+	if !ok {
+		return types.Transfer{}, fmt.Errorf("transfer %s not found", transactionID)
+	}
+
+	if t.Status == types.TRANSFER_PENDING && time.Since(t.CreatedAt) >= fb.SettleAfter {
+		t.Status = types.TRANSFER_COMPLETED
+		t.UpdatedAt = time.Now().UTC()
+		transfers[transactionID] = t
+		err = fb.save(transfers)
+		if err != nil {
+			return types.Transfer{}, err
+		}
+	}
+	return t, nil
+}
+
+// CancelTransfer cancels a transfer that has not settled yet.
+func (fb *FakeBank) CancelTransfer(ctx context.Context, transactionID string) error {
+	err := fb.wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	transfers, err := fb.load()
+	if err != nil {
+		return err
+	}
+
+	t, ok := transfers[transactionID]
+	if !ok {
+		return fmt.Errorf("transfer %s not found", transactionID)
+	}
+
+	if t.Status != types.TRANSFER_PENDING || time.Since(t.CreatedAt) >= fb.SettleAfter {
+		return fmt.Errorf("transfer %s can not be cancelled", transactionID)
+	}
+
+	t.Status = types.TRANSFER_CANCELLED
+	t.UpdatedAt = time.Now().UTC()
+	transfers[transactionID] = t
+	return fb.save(transfers)
+}
+
+func (fb *FakeBank) wait(ctx context.Context) error {
+	if fb.Delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(fb.Delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (fb *FakeBank) load() (map[string]types.Transfer, error) {
+	transfers := map[string]types.Transfer{}
+	data, err := os.ReadFile(fb.FileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return transfers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &transfers)
+	if err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+func (fb *FakeBank) save(transfers map[string]types.Transfer) error {
+	data, err := json.MarshalIndent(transfers, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := fb.FileName + ".tmp"
+	err = os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fb.FileName)
+}
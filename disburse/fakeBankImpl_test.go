@@ -0,0 +1,108 @@
+package disburse
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/types"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFakeBank_InitiateTransfer(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "fakebank.json")
+	groupID := uuid.New()
+	tests := []struct {
+		name      string
+		failEvery int
+		failMerch string
+		transfer  types.Transfer
+		wantErr   bool
+	}{
+		{name: "success", transfer: types.Transfer{DisbursementGroupID: uuid.New(), MerchReference: "padberg_group", Amount: 9207}},
+		{name: "zero amount", transfer: types.Transfer{DisbursementGroupID: uuid.New(), MerchReference: "padberg_group"}, wantErr: true},
+		{name: "fail every transfer", failEvery: 1, transfer: types.Transfer{DisbursementGroupID: groupID, MerchReference: "padberg_group", Amount: 9207}, wantErr: true},
+		{name: "retry after failure", transfer: types.Transfer{DisbursementGroupID: groupID, MerchReference: "padberg_group", Amount: 9207}},
+		{name: "failing merchant", failMerch: "deckow_gibson", transfer: types.Transfer{DisbursementGroupID: uuid.New(), MerchReference: "deckow_gibson", Amount: 1500}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := NewFakeBank(fileName)
+			fb.FailEvery = tt.failEvery
+			fb.FailMerchants[tt.failMerch] = true
+			got, err := fb.InitiateTransfer(context.Background(), tt.transfer)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("InitiateTransfer() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			again, err := fb.InitiateTransfer(context.Background(), tt.transfer)
+			if err != nil || again != got {
+				t.Errorf("InitiateTransfer() for the same group = %v, error = %v, want %v", again, err, got)
+			}
+		})
+	}
+}
+
+func TestFakeBank_TransferStatus(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "fakebank.json")
+	fb := NewFakeBank(fileName)
+	fb.SettleAfter = time.Hour
+	txID, err := fb.InitiateTransfer(context.Background(), types.Transfer{DisbursementGroupID: uuid.New(), MerchReference: "padberg_group", Amount: 9207})
+	if err != nil {
+		t.Fatalf("InitiateTransfer() error = %v", err)
+	}
+
+	got, err := fb.TransferStatus(context.Background(), txID)
+	if err != nil || got.Status != types.TRANSFER_PENDING {
+		t.Errorf("TransferStatus() = %+v, error = %v, want %s", got, err, types.TRANSFER_PENDING)
+	}
+
+	reopened := NewFakeBank(fileName)
+	got, err = reopened.TransferStatus(context.Background(), txID)
+	if err != nil || got.Status != types.TRANSFER_COMPLETED || got.Amount != 9207 {
+		t.Errorf("TransferStatus() after reopening = %+v, error = %v, want %s", got, err, types.TRANSFER_COMPLETED)
+	}
+
+	_, err = fb.TransferStatus(context.Background(), "unknown")
+	if err == nil {
+		t.Errorf("TransferStatus() for unknown transfer error = nil, want error")
+	}
+}
+
+func TestFakeBank_CancelTransfer(t *testing.T) {
+	fb := NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json"))
+	fb.SettleAfter = time.Hour
+	txID, err := fb.InitiateTransfer(context.Background(), types.Transfer{DisbursementGroupID: uuid.New(), MerchReference: "padberg_group", Amount: 9207})
+	if err != nil {
+		t.Fatalf("InitiateTransfer() error = %v", err)
+	}
+
+	err = fb.CancelTransfer(context.Background(), txID)
+	if err != nil {
+		t.Fatalf("CancelTransfer() error = %v", err)
+	}
+
+	got, _ := fb.TransferStatus(context.Background(), txID)
+	if got.Status != types.TRANSFER_CANCELLED {
+		t.Errorf("TransferStatus() after cancel = %s, want %s", got.Status, types.TRANSFER_CANCELLED)
+	}
+
+	err = fb.CancelTransfer(context.Background(), txID)
+	if err == nil {
+		t.Errorf("CancelTransfer() of a cancelled transfer error = nil, want error")
+	}
+}
+
+func TestFakeBank_Delay(t *testing.T) {
+	fb := NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json"))
+	fb.Delay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := fb.InitiateTransfer(ctx, types.Transfer{DisbursementGroupID: uuid.New(), MerchReference: "padberg_group", Amount: 9207})
+	if err == nil {
+		t.Errorf("InitiateTransfer() with expired context error = nil, want error")
+	}
+}
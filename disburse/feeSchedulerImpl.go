@@ -0,0 +1,148 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var (
+	errUnknownMerchant = errors.New("unknown merchant")
+	errInvalidRequest  = errors.New("invalid request")
+)
+
+func NewFeeScheduler(logger *slog.Logger, ctx context.Context, repo repo.DisburserRepoRepository) *FeeScheduler {
+	return &FeeScheduler{
+		Logger: logger,
+		Ctx:    ctx,
+		Repo:   repo,
+	}
+}
+
+// AddFeeSchedule validates and stores a new version of a merchant's fee schedule for the orders in its currency, the merchant's
+// currency when it has none. Orders in that currency created from its EffectiveFrom are charged under it while the window of the
+// previous version in the currency is closed at that time, so orders created before the change keep their old tiers. A new version
+// can not start before the latest existing version in the same currency.
+func (f *FeeScheduler) AddFeeSchedule(ctx context.Context, fs types.FeeSchedule) (types.FeeSchedule, error) {
+	err := fs.Validate()
+	if err != nil {
+		return fs, fmt.Errorf("%w: %w", errInvalidRequest, err)
+	}
+
+	merch, err := f.Repo.GetMerchantByReferenceID(fs.MerchantReference)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fs, fmt.Errorf("%w %s", errUnknownMerchant, fs.MerchantReference)
+	}
+	if err != nil {
+		return fs, err
+	}
+
+	if fs.Currency == "" {
+		fs.Currency = types.CurrencyCode(merch.Currency)
+	}
+
+	for _, existing := range merch.FeeSchedules {
+		if !types.SameCurrency(existing.Currency, fs.Currency) {
+			continue
+		}
+		if !fs.EffectiveFrom.After(existing.EffectiveFrom) {
+			return fs, fmt.Errorf("%w: effective_from must be after %s when version %d took effect", errInvalidRequest,
+				existing.EffectiveFrom.Format(time.RFC3339), existing.Version)
+		}
+	}
+
+	fs.ID = uuid.New()
+	fs.EffectiveFrom = fs.EffectiveFrom.UTC()
+	if !fs.EffectiveTo.IsZero() {
+		fs.EffectiveTo = fs.EffectiveTo.UTC()
+	}
+	return f.Repo.InsertFeeSchedule(ctx, fs)
+}
+
+// FeeSchedules lists the fee schedules of the merchant in the merchant_reference query parameter on GET, the default fee schedule in
+// the merchant's currency when it has none, and adds a fee schedule from the JSON body on POST.
+func (f *FeeScheduler) FeeSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		merchRef := r.URL.Query().Get("merchant_reference")
+		if merchRef == "" {
+			http.Error(w, "merchant_reference is required", http.StatusBadRequest)
+			return
+		}
+
+		schedules, err := f.Repo.GetFeeSchedulesByMerchantReference(r.Context(), merchRef)
+		if err != nil {
+			f.Logger.Error("failed to get fee schedules", "merchant", merchRef, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if len(schedules) == 0 {
+			merch, err := f.Repo.GetMerchantByReferenceID(merchRef)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				f.Logger.Error("failed to get merchant", "merchant", merchRef, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			c, err := types.LookupCurrency(merch.Currency)
+			if err != nil {
+				f.Logger.Error("merchant has an unsupported currency", "merchant", merchRef, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			schedules = []types.FeeSchedule{types.DefaultFeeSchedule(c)}
+		}
+		writeJSON(w, f.Logger, http.StatusOK, schedules)
+
+	case http.MethodPost:
+		var fs types.FeeSchedule
+		err := json.NewDecoder(r.Body).Decode(&fs)
+		if err != nil {
+			f.Logger.Error("failed to decode fee schedule", "error", err)
+			http.Error(w, "malformed fee schedule", http.StatusBadRequest)
+			return
+		}
+
+		fs, err = f.AddFeeSchedule(r.Context(), fs)
+		if errors.Is(err, errUnknownMerchant) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, errInvalidRequest) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			f.Logger.Error("failed to insert fee schedule", "merchant", fs.MerchantReference, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, f.Logger, http.StatusCreated, fs)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// writeJSON encodes v as the response body with the given status code.
+func writeJSON(w http.ResponseWriter, logger *slog.Logger, status int, v any) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("failed to encode response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
@@ -0,0 +1,74 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// feeRepo is an in-memory stand-in for the repo methods used by the fee scheduler.
+type feeRepo struct {
+	repo.DisburserRepoRepository
+	merchants map[string]types.Merchant
+	schedules []types.FeeSchedule
+}
+
+func (fr *feeRepo) GetMerchantByReferenceID(merchRef string) (types.Merchant, error) {
+	m, ok := fr.merchants[merchRef]
+	if !ok {
+		return m, sql.ErrNoRows
+	}
+	return m, nil
+}
+
+func (fr *feeRepo) InsertFeeSchedule(ctx context.Context, fs types.FeeSchedule) (types.FeeSchedule, error) {
+	fs.Version = len(fr.schedules) + 1
+	fr.schedules = append(fr.schedules, fs)
+	return fs, nil
+}
+
+func TestFeeScheduler_AddFeeSchedule(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	effectiveFrom, _ := time.Parse(time.DateOnly, "2023-03-01")
+	jan, _ := time.Parse(time.DateOnly, "2023-01-01")
+	fr := &feeRepo{merchants: map[string]types.Merchant{
+		"padberg_group": {Reference: "padberg_group", FeeSchedules: []types.FeeSchedule{{MerchantReference: "padberg_group", Version: 1, EffectiveFrom: jan}}},
+	}}
+	f := NewFeeScheduler(logger, context.Background(), fr)
+	tiers := []types.FeeTier{{UpTo: 10000, RateBasisPoints: 150}, {RateBasisPoints: 90}}
+
+	tests := []struct {
+		name    string
+		fs      types.FeeSchedule
+		wantErr error
+	}{
+		{name: "success", fs: types.FeeSchedule{MerchantReference: "padberg_group", EffectiveFrom: effectiveFrom, FlatFee: 25, Tiers: tiers}},
+		{name: "before latest version", fs: types.FeeSchedule{MerchantReference: "padberg_group", EffectiveFrom: jan, Tiers: tiers}, wantErr: errInvalidRequest},
+		{name: "effective to before effective from", fs: types.FeeSchedule{MerchantReference: "padberg_group", EffectiveFrom: effectiveFrom, EffectiveTo: jan, Tiers: tiers}, wantErr: errInvalidRequest},
+		{name: "unknown merchant", fs: types.FeeSchedule{MerchantReference: "unknown", EffectiveFrom: effectiveFrom, Tiers: tiers}, wantErr: errUnknownMerchant},
+		{name: "missing effective from", fs: types.FeeSchedule{MerchantReference: "padberg_group", Tiers: tiers}, wantErr: errInvalidRequest},
+		{name: "no tiers", fs: types.FeeSchedule{MerchantReference: "padberg_group", EffectiveFrom: effectiveFrom}, wantErr: errInvalidRequest},
+		{name: "bounded last tier", fs: types.FeeSchedule{MerchantReference: "padberg_group", EffectiveFrom: effectiveFrom, Tiers: []types.FeeTier{{UpTo: 10000, RateBasisPoints: 150}}}, wantErr: errInvalidRequest},
+		{name: "descending tiers", fs: types.FeeSchedule{MerchantReference: "padberg_group", EffectiveFrom: effectiveFrom, Tiers: []types.FeeTier{{UpTo: 10000, RateBasisPoints: 150}, {UpTo: 5000, RateBasisPoints: 100}, {RateBasisPoints: 90}}}, wantErr: errInvalidRequest},
+		{name: "rate above 100%", fs: types.FeeSchedule{MerchantReference: "padberg_group", EffectiveFrom: effectiveFrom, Tiers: []types.FeeTier{{RateBasisPoints: 10001}}}, wantErr: errInvalidRequest},
+		{name: "negative flat fee", fs: types.FeeSchedule{MerchantReference: "padberg_group", EffectiveFrom: effectiveFrom, FlatFee: -1, Tiers: tiers}, wantErr: errInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := f.AddFeeSchedule(context.Background(), tt.fs)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("AddFeeSchedule() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr == nil && fr.schedules[len(fr.schedules)-1].ID != got.ID {
+				t.Errorf("AddFeeSchedule() stored %+v, want %+v", fr.schedules[len(fr.schedules)-1], got)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package disburse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/levtk/sequra/types"
+	"io"
+	"slices"
+	"strings"
+)
+
+var errInvalidFormat = errors.New("invalid import file format")
+
+const (
+	// jsonlMaxLine is the longest line of a JSON Lines file, longer lines are rejected
+	jsonlMaxLine = 4 * 1024 * 1024
+	// rejectedLinePrefix is the length of the start of an overlong line kept as the record of its reject
+	rejectedLinePrefix = 256
+)
+
+// importRecord is a record of an import file with its fields in the column order of the legacy semicolon separated files, so every
+// format is validated by the same record parsers. Line is the line of the record in its file, or its position in a JSON array, and
+// Raw the record as it was read.
+type importRecord struct {
+	fields []string
+	line   int
+	raw    string
+}
+
+// recordError is returned by a recordReader for a record that can not be read but does not stop the file from being read. The
+// record is returned with it, for the reject.
+type recordError struct {
+	err error
+}
+
+func (re *recordError) Error() string {
+	return re.err.Error()
+}
+
+func (re *recordError) Unwrap() error {
+	return re.err
+}
+
+// recordReader reads the records of an import file one at a time and returns io.EOF after the last one.
+type recordReader interface {
+	Read() (importRecord, error)
+}
+
+// newRecordReader returns a reader of the records of r in format, one of IMPORT_FORMAT_CSV, IMPORT_FORMAT_JSONL or IMPORT_FORMAT_JSON,
+// detected from the content of r when format is empty. columns are the header of a CSV file and the keys of the JSON objects, as
+// named by the dialect d.
+func newRecordReader(r io.Reader, format string, columns []string, d Dialect) (recordReader, error) {
+	d = d.orDefaults()
+	br := bufio.NewReader(r)
+	skipBOM(br)
+
+	if format == "" {
+		format = detectFormat(br)
+	}
+
+	switch format {
+	case types.IMPORT_FORMAT_CSV:
+		cr := csv.NewReader(br)
+		cr.Comma = d.Delimiter
+		cr.ReuseRecord = true
+		return &csvRecords{r: cr, columns: columns, dialect: d}, nil
+	case types.IMPORT_FORMAT_JSONL:
+		return &jsonlRecords{r: bufio.NewReaderSize(br, jsonlMaxLine), columns: columns, dialect: d}, nil
+	case types.IMPORT_FORMAT_JSON:
+		return &jsonArrayRecords{dec: json.NewDecoder(br), columns: columns, dialect: d}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown format %q, want %s, %s or %s", errInvalidFormat, format, types.IMPORT_FORMAT_CSV,
+		types.IMPORT_FORMAT_JSONL, types.IMPORT_FORMAT_JSON)
+}
+
+// skipBOM discards a UTF-8 byte order mark at the start of br.
+func skipBOM(br *bufio.Reader) {
+	bom, _ := br.Peek(3)
+	if bytes.Equal(bom, []byte("\ufeff")) {
+		_, _ = br.Discard(3)
+	}
+}
+
+// detectFormat tells the format of br from its first character that is not white space: a JSON array starts with [ and JSON Lines
+// with {; anything else is taken as CSV.
+func detectFormat(br *bufio.Reader) string {
+	head, _ := br.Peek(512)
+	head = bytes.TrimLeft(head, " \t\r\n")
+	switch {
+	case len(head) > 0 && head[0] == '[':
+		return types.IMPORT_FORMAT_JSON
+	case len(head) > 0 && head[0] == '{':
+		return types.IMPORT_FORMAT_JSONL
+	}
+	return types.IMPORT_FORMAT_CSV
+}
+
+// validateFile checks the beginning of r is a file of format, or of any format when format is empty, and that the header line of a
+// CSV file names columns in the dialect d.
+func validateFile(r io.Reader, format string, columns []string, d Dialect) error {
+	d = d.orDefaults()
+	br := bufio.NewReader(r)
+	skipBOM(br)
+
+	head, err := br.Peek(1)
+	if len(head) == 0 {
+		return fmt.Errorf("%w: the file is empty", errInvalidHeader)
+	}
+	if err != nil {
+		return err
+	}
+
+	detected := detectFormat(br)
+	if format != "" && format != detected {
+		return fmt.Errorf("%w: the file is not %s", errInvalidFormat, format)
+	}
+	if detected == types.IMPORT_FORMAT_CSV {
+		return validateHeader(br, columns, d)
+	}
+	return nil
+}
+
+// csvRecords reads a delimited file, taking the fields of columns from the positions its header line gives them.
+type csvRecords struct {
+	r       *csv.Reader
+	columns []string
+	dialect Dialect
+	index   []int
+	fields  []string
+}
+
+func (c *csvRecords) Read() (importRecord, error) {
+	for {
+		rec, err := c.r.Read()
+		if err == io.EOF {
+			return importRecord{}, err
+		}
+
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			return importRecord{line: pe.StartLine, raw: strings.Join(rec, string(c.dialect.Delimiter))}, &recordError{err: pe.Err}
+		}
+		if err != nil {
+			return importRecord{}, err
+		}
+
+		line, _ := c.r.FieldPos(0)
+		if line == 1 { //skipping header line
+			c.index, err = c.dialect.header(rec, c.columns)
+			if err != nil {
+				return importRecord{}, err
+			}
+			c.fields = make([]string, len(c.columns))
+			continue
+		}
+
+		for i, pos := range c.index {
+			c.fields[i] = ""
+			if pos >= 0 {
+				c.fields[i] = rec[pos]
+			}
+		}
+		return importRecord{fields: c.fields, line: line, raw: strings.Join(rec, string(c.dialect.Delimiter))}, nil
+	}
+}
+
+// jsonlRecords reads a file of one JSON object per line, skipping blank lines. Lines longer than jsonlMaxLine are rejected with the
+// start of the line as their record, and the file is read on from the next line.
+type jsonlRecords struct {
+	r       *bufio.Reader
+	columns []string
+	dialect Dialect
+	line    int
+}
+
+func (j *jsonlRecords) Read() (importRecord, error) {
+	for {
+		b, err := j.r.ReadSlice('\n')
+		if err == io.EOF && len(b) == 0 {
+			return importRecord{}, io.EOF
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			j.line++
+			rec := importRecord{line: j.line, raw: string(b[:rejectedLinePrefix]) + "..."}
+			err = j.skipLine()
+			if err != nil {
+				return importRecord{}, err
+			}
+			return rec, &recordError{err: fmt.Errorf("line longer than %d bytes", jsonlMaxLine)}
+		}
+		if err != nil && err != io.EOF {
+			return importRecord{}, err
+		}
+
+		j.line++
+		raw := strings.TrimSpace(string(b))
+		if raw == "" {
+			continue
+		}
+
+		rec := importRecord{line: j.line, raw: raw}
+		fields, err := jsonFields([]byte(raw), j.columns, j.dialect)
+		if err != nil {
+			return rec, &recordError{err: err}
+		}
+		rec.fields = fields
+		return rec, nil
+	}
+}
+
+// skipLine discards the rest of the line being read.
+func (j *jsonlRecords) skipLine() error {
+	for {
+		_, err := j.r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+}
+
+// jsonArrayRecords reads a JSON array of objects one element at a time. A malformed object is rejected but a syntax error stops
+// the file from being read, as the rest of the array can not be found.
+type jsonArrayRecords struct {
+	dec     *json.Decoder
+	columns []string
+	dialect Dialect
+	started bool
+	n       int
+}
+
+func (j *jsonArrayRecords) Read() (importRecord, error) {
+	if !j.started {
+		tok, err := j.dec.Token()
+		if err != nil {
+			return importRecord{}, fmt.Errorf("%w: %w", errInvalidFormat, err)
+		}
+		if tok != json.Delim('[') {
+			return importRecord{}, fmt.Errorf("%w: expected a JSON array", errInvalidFormat)
+		}
+		j.started = true
+	}
+
+	if !j.dec.More() {
+		return importRecord{}, io.EOF
+	}
+
+	var raw json.RawMessage
+	err := j.dec.Decode(&raw)
+	if err != nil {
+		return importRecord{}, fmt.Errorf("%w: element %d: %w", errInvalidFormat, j.n+1, err)
+	}
+	j.n++
+
+	var compact bytes.Buffer
+	_ = json.Compact(&compact, raw)
+	rec := importRecord{line: j.n, raw: compact.String()}
+	fields, err := jsonFields(raw, j.columns, j.dialect)
+	if err != nil {
+		return rec, &recordError{err: err}
+	}
+	rec.fields = fields
+	return rec, nil
+}
+
+// jsonFields returns the values of the keys columns of the JSON object raw in column order, with the keys named as in the dialect d.
+// Missing keys and nulls are empty and numbers are kept as written, so they are validated like the fields of a CSV record. Other
+// keys are ignored.
+func jsonFields(raw []byte, columns []string, d Dialect) ([]string, error) {
+	var obj map[string]json.RawMessage
+	err := json.Unmarshal(raw, &obj)
+	if err != nil {
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			return nil, errors.New("expected a JSON object")
+		}
+		return nil, fmt.Errorf("malformed JSON record: %w", err)
+	}
+	if obj == nil {
+		return nil, errors.New("expected a JSON object")
+	}
+
+	fields := make([]string, len(columns))
+	seen := make([]bool, len(columns))
+	for key, value := range obj {
+		i := slices.Index(columns, d.column(key))
+		if i < 0 {
+			continue
+		}
+		if seen[i] {
+			return nil, fmt.Errorf("column %s is repeated", columns[i])
+		}
+		seen[i] = true
+		fields[i], err = jsonField(value, d)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", columns[i], err)
+		}
+	}
+	return fields, nil
+}
+
+// jsonField returns the string or number value of a JSON record as text. Numbers are written with the decimal separator of d, so
+// they are read back like amounts written as strings.
+func jsonField(value json.RawMessage, d Dialect) (string, error) {
+	switch {
+	case len(value) == 0 || bytes.Equal(value, []byte("null")):
+		return "", nil
+	case value[0] == '"':
+		var s string
+		err := json.Unmarshal(value, &s)
+		return s, err
+	case value[0] == '-' || value[0] >= '0' && value[0] <= '9':
+		return strings.Replace(string(value), ".", string(d.Decimal), 1), nil
+	}
+	return "", fmt.Errorf("expected a string or a number, got %s", value)
+}
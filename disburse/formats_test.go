@@ -0,0 +1,189 @@
+package disburse
+
+import (
+	"errors"
+	"github.com/levtk/sequra/types"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_newRecordReader(t *testing.T) {
+	want := [][]string{
+		{"e653f3e14bc4", "padberg_group", "102.29", "2023-02-01", ""},
+		{"20b674c93ea6", "padberg_group", "433.21", "2023-02-01", ""},
+	}
+	tests := []struct {
+		name   string
+		format string
+		input  string
+	}{
+		{
+			name:   "csv",
+			format: types.IMPORT_FORMAT_CSV,
+			input:  "id;merchant_reference;amount;created_at\ne653f3e14bc4;padberg_group;102.29;2023-02-01\n20b674c93ea6;padberg_group;433.21;2023-02-01\n",
+		},
+		{
+			name:   "detected csv with a byte order mark",
+			format: "",
+			input:  "\ufeffid;merchant_reference;amount;created_at\ne653f3e14bc4;padberg_group;102.29;2023-02-01\n20b674c93ea6;padberg_group;433.21;2023-02-01\n",
+		},
+		{
+			name:   "jsonl",
+			format: types.IMPORT_FORMAT_JSONL,
+			input: `{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":102.29,"created_at":"2023-02-01"}
+
+{"created_at":"2023-02-01","amount":"433.21","merchant_reference":"padberg_group","id":"20b674c93ea6","extra":true}
+`,
+		},
+		{
+			name:   "detected json array",
+			format: "",
+			input: ` [
+  {"id": "e653f3e14bc4", "merchant_reference": "padberg_group", "amount": 102.29, "created_at": "2023-02-01"},
+  {"id": "20b674c93ea6", "merchant_reference": "padberg_group", "amount": 433.21, "created_at": "2023-02-01"}
+]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newRecordReader(strings.NewReader(tt.input), tt.format, orderColumns, Dialect{})
+			if err != nil {
+				t.Fatalf("newRecordReader() error = %v", err)
+			}
+
+			var got [][]string
+			for {
+				rec, err := r.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Read() error = %v", err)
+				}
+				got = append(got, append([]string(nil), rec.fields...))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Read() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_jsonlRecords_longLine(t *testing.T) {
+	input := `{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":102.29,"created_at":"2023-02-01"}` + "\n" +
+		`{"id":"` + strings.Repeat("x", jsonlMaxLine) + `"}` + "\n" +
+		`{"id":"20b674c93ea6","merchant_reference":"padberg_group","amount":433.21,"created_at":"2023-02-01"}`
+	r, err := newRecordReader(strings.NewReader(input), types.IMPORT_FORMAT_JSONL, orderColumns, Dialect{})
+	if err != nil {
+		t.Fatalf("newRecordReader() error = %v", err)
+	}
+
+	var got []string
+	var rejected []importRecord
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		var re *recordError
+		if errors.As(err, &re) {
+			rejected = append(rejected, rec)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		got = append(got, rec.fields[0])
+	}
+
+	if strings.Join(got, ",") != "e653f3e14bc4,20b674c93ea6" {
+		t.Errorf("Read() ids = %v, want e653f3e14bc4,20b674c93ea6", got)
+	}
+	if len(rejected) != 1 || rejected[0].line != 2 || len(rejected[0].raw) != rejectedLinePrefix+3 {
+		t.Fatalf("Read() rejected = %d records, want line 2 with the start of the line", len(rejected))
+	}
+}
+
+func Test_orderReader_jsonRejects(t *testing.T) {
+	merchants := map[string]types.Merchant{
+		"padberg_group": {Reference: "padberg_group", FeeSchedules: []types.FeeSchedule{{MaxOrder: 50000}}},
+	}
+	tests := []struct {
+		name      string
+		format    string
+		input     string
+		wantLines []int
+	}{
+		{
+			name:   "jsonl",
+			format: types.IMPORT_FORMAT_JSONL,
+			input: `{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":102.29,"created_at":"2023-02-01"}
+{"id":"20b674c93ea6","amount":433.21,"created_at":"2023-02-01"}
+{"id":"0b73fb1d3332","merchant_reference":"padberg_group","amount":194.37,
+["not", "an", "object"]
+{"id":"1b2ab4e3c1f4","merchant_reference":"padberg_group","amount":{"value":12},"created_at":"2023-02-01"}
+{"id":"f1b2c3d4e5f6","merchant_reference":"padberg_group","amount":25,"created_at":"2023-02-03"}
+`,
+			wantLines: []int{2, 3, 4, 5},
+		},
+		{
+			name:   "json array",
+			format: types.IMPORT_FORMAT_JSON,
+			input: `[{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":102.29,"created_at":"2023-02-01"},
+{"id":"20b674c93ea6","merchant_reference":"padberg_group","amount":-12,"created_at":"2023-02-01"},
+"not an object",
+{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":99,"created_at":"2023-02-02"},
+{"id":"f1b2c3d4e5f6","merchant_reference":"padberg_group","amount":25,"created_at":"2023-02-03"}]`,
+			wantLines: []int{2, 3, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			or, err := newFormatOrderReader(strings.NewReader(tt.input), tt.format, Dialect{})
+			if err != nil {
+				t.Fatalf("newFormatOrderReader() error = %v", err)
+			}
+			or.check = newOrderValidator(merchants).check
+			got, rejects := readUniqueOrders(t, or)
+
+			if strings.Join(got, ",") != "e653f3e14bc4,f1b2c3d4e5f6" {
+				t.Errorf("Next() orders = %v, want e653f3e14bc4,f1b2c3d4e5f6", got)
+			}
+			if len(rejects) != len(tt.wantLines) {
+				t.Fatalf("Next() rejects = %+v, want lines %v", rejects, tt.wantLines)
+			}
+			for i, line := range tt.wantLines {
+				if rejects[i].Line != line || rejects[i].Record == "" || rejects[i].Reason == "" {
+					t.Errorf("Next() reject %d = %+v, want line %d", i, rejects[i], line)
+				}
+			}
+		})
+	}
+}
+
+func Test_validateFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		input   string
+		wantErr error
+	}{
+		{name: "csv", input: "id;merchant_reference;amount;created_at\n"},
+		{name: "csv with the wrong header", input: "id;reference\n", wantErr: errInvalidHeader},
+		{name: "detected jsonl", input: `{"id":"e653f3e14bc4"}`},
+		{name: "json array", format: types.IMPORT_FORMAT_JSON, input: "\n[]"},
+		{name: "jsonl asked for a json array", format: types.IMPORT_FORMAT_JSONL, input: "[]", wantErr: errInvalidFormat},
+		{name: "csv asked for jsonl", format: types.IMPORT_FORMAT_JSONL, input: "id;merchant_reference;amount;created_at\n", wantErr: errInvalidFormat},
+		{name: "empty", input: "", wantErr: errInvalidHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFile(strings.NewReader(tt.input), tt.format, orderColumns, Dialect{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateFile() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
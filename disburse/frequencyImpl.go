@@ -0,0 +1,112 @@
+package disburse
+
+import (
+	"fmt"
+	"github.com/levtk/sequra/types"
+	"time"
+)
+
+var frequencies = map[string]PayoutFrequency{
+	types.DAILY:     dailyFrequency{},
+	types.WEEKLY:    weeklyFrequency{},
+	types.BIWEEKLY:  biweeklyFrequency{},
+	types.MONTHLY:   monthlyFrequency{},
+	types.ON_DEMAND: onDemandFrequency{},
+}
+
+// NewPayoutFrequency returns the PayoutFrequency of the disbursement frequency, one of DAILY, WEEKLY, BIWEEKLY, MONTHLY and
+// ON_DEMAND.
+func NewPayoutFrequency(frequency string) (PayoutFrequency, error) {
+	f, ok := frequencies[frequency]
+	if !ok {
+		return nil, fmt.Errorf("unknown disbursement frequency %q", frequency)
+	}
+	return f, nil
+}
+
+// orderPayoutDate returns the payout date of an order of the merchant received at t, freq applied to the day of t, or to the next
+// day when t is after the TIME_CUT_OFF, whatever the frequency: an order received after the cut-off on a weekly merchant's payout
+// day is paid out the next week. Days and the cut-off are those of the merchant's timezone, see types.Merchant.CutOffDay. Orders
+// posted to the API and imported orders are both dated with it, so an order gets the same payout date however it arrives.
+func orderPayoutDate(merchant types.Merchant, freq PayoutFrequency, t time.Time) (time.Time, error) {
+	day, err := merchant.CutOffDay(t)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return freq.PayoutDate(merchant, day)
+}
+
+// dailyFrequency pays out the orders of every day on that day.
+type dailyFrequency struct{}
+
+func (dailyFrequency) PayoutDate(m types.Merchant, day time.Time) (time.Time, error) {
+	return day, nil
+}
+
+func (dailyFrequency) OnRequest() bool { return false }
+
+// weeklyFrequency pays out once a week, on the weekday of the merchant's LiveOn.
+type weeklyFrequency struct{}
+
+func (weeklyFrequency) PayoutDate(m types.Merchant, day time.Time) (time.Time, error) {
+	days := (int(m.LiveOn.UTC().Weekday()) - int(day.Weekday()) + 7) % 7
+	return day.AddDate(0, 0, days), nil
+}
+
+func (weeklyFrequency) OnRequest() bool { return false }
+
+// biweeklyFrequency pays out every other week, every 14 days from the merchant's LiveOn. Orders received before LiveOn are paid out
+// on it.
+type biweeklyFrequency struct{}
+
+func (biweeklyFrequency) PayoutDate(m types.Merchant, day time.Time) (time.Time, error) {
+	anchor := types.StartOfDay(m.LiveOn)
+	if !day.After(anchor) {
+		return anchor, nil
+	}
+
+	days := int(day.Sub(anchor).Hours()/24) % 14
+	if days == 0 {
+		return day, nil
+	}
+	return day.AddDate(0, 0, 14-days), nil
+}
+
+func (biweeklyFrequency) OnRequest() bool { return false }
+
+// monthlyFrequency pays out once a month on the merchant's PayoutDay, or the day of its LiveOn, clamped to the last day of shorter
+// months: a merchant paid out on the 31st is paid out on the 30th in April and on the 28th, or 29th, in February.
+type monthlyFrequency struct{}
+
+func (monthlyFrequency) PayoutDate(m types.Merchant, day time.Time) (time.Time, error) {
+	payoutDay := m.PayoutDay
+	if payoutDay == 0 {
+		payoutDay = m.LiveOn.UTC().Day()
+	}
+	if payoutDay < 1 || payoutDay > 31 {
+		return time.Time{}, fmt.Errorf("invalid payout day %d of merchant %s", payoutDay, m.Reference)
+	}
+
+	payoutDate := dayOfMonth(day, payoutDay)
+	if payoutDate.Before(day) {
+		payoutDate = dayOfMonth(types.StartOfMonth(day).AddDate(0, 1, 0), payoutDay)
+	}
+	return payoutDate, nil
+}
+
+func (monthlyFrequency) OnRequest() bool { return false }
+
+// dayOfMonth returns the day d of the month of t, or the last day of the month when it is shorter.
+func dayOfMonth(t time.Time, d int) time.Time {
+	last := types.StartOfMonth(t).AddDate(0, 1, -1).Day()
+	return time.Date(t.Year(), t.Month(), min(d, last), 0, 0, 0, 0, time.UTC)
+}
+
+// onDemandFrequency accrues the orders of the merchant until it requests a payout. Orders are dated on the day they are received.
+type onDemandFrequency struct{}
+
+func (onDemandFrequency) PayoutDate(m types.Merchant, day time.Time) (time.Time, error) {
+	return day, nil
+}
+
+func (onDemandFrequency) OnRequest() bool { return true }
@@ -0,0 +1,83 @@
+package disburse
+
+import (
+	"github.com/levtk/sequra/types"
+	"testing"
+	"time"
+)
+
+func TestPayoutFrequency_PayoutDate(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	liveOn := day(2022, 11, 9) // a wednesday
+	tests := []struct {
+		name     string
+		merchant types.Merchant
+		day      time.Time
+		want     time.Time
+		wantErr  bool
+	}{
+		{name: "daily", merchant: types.Merchant{DisbursementFrequency: types.DAILY}, day: day(2023, 2, 4), want: day(2023, 2, 4)},
+		{name: "weekly on the payout day", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.WEEKLY}, day: day(2023, 2, 1), want: day(2023, 2, 1)},
+		{name: "weekly week wraparound", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.WEEKLY}, day: day(2023, 2, 4), want: day(2023, 2, 8)},
+		{name: "biweekly before live on", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.BIWEEKLY}, day: day(2022, 11, 1), want: liveOn},
+		{name: "biweekly on live on", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.BIWEEKLY}, day: liveOn, want: liveOn},
+		{name: "biweekly in the first week", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.BIWEEKLY}, day: day(2022, 11, 10), want: day(2022, 11, 23)},
+		{name: "biweekly on the off week payout weekday", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.BIWEEKLY}, day: day(2022, 11, 16), want: day(2022, 11, 23)},
+		{name: "biweekly on the payout day", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.BIWEEKLY}, day: day(2022, 11, 23), want: day(2022, 11, 23)},
+		{name: "biweekly across the year end", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.BIWEEKLY}, day: day(2022, 12, 29), want: day(2023, 1, 4)},
+		{name: "monthly on the live on day", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.MONTHLY}, day: day(2023, 2, 4), want: day(2023, 2, 9)},
+		{name: "monthly after the payout day", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.MONTHLY, PayoutDay: 15}, day: day(2023, 2, 16), want: day(2023, 3, 15)},
+		{name: "monthly on the payout day", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.MONTHLY, PayoutDay: 15}, day: day(2023, 2, 15), want: day(2023, 2, 15)},
+		{name: "monthly clamped to february", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.MONTHLY, PayoutDay: 31}, day: day(2023, 2, 1), want: day(2023, 2, 28)},
+		{name: "monthly clamped to a leap february", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.MONTHLY, PayoutDay: 30}, day: day(2024, 2, 10), want: day(2024, 2, 29)},
+		{name: "monthly after the clamped day", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.MONTHLY, PayoutDay: 31}, day: day(2023, 4, 30), want: day(2023, 4, 30)},
+		{name: "monthly into the next year", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.MONTHLY, PayoutDay: 31}, day: day(2023, 12, 31), want: day(2023, 12, 31)},
+		{name: "monthly invalid payout day", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.MONTHLY, PayoutDay: 32}, day: day(2023, 2, 1), wantErr: true},
+		{name: "on demand", merchant: types.Merchant{LiveOn: liveOn, DisbursementFrequency: types.ON_DEMAND}, day: day(2023, 2, 4), want: day(2023, 2, 4)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			freq, err := NewPayoutFrequency(tt.merchant.DisbursementFrequency)
+			if err != nil {
+				t.Fatalf("NewPayoutFrequency() error = %v", err)
+			}
+
+			got, err := freq.PayoutDate(tt.merchant, tt.day)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PayoutDate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("PayoutDate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPayoutFrequency(t *testing.T) {
+	tests := []struct {
+		frequency     string
+		wantOnRequest bool
+		wantErr       bool
+	}{
+		{frequency: types.DAILY},
+		{frequency: types.WEEKLY},
+		{frequency: types.BIWEEKLY},
+		{frequency: types.MONTHLY},
+		{frequency: types.ON_DEMAND, wantOnRequest: true},
+		{frequency: "HOURLY", wantErr: true},
+		{frequency: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.frequency, func(t *testing.T) {
+			got, err := NewPayoutFrequency(tt.frequency)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewPayoutFrequency() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.OnRequest() != tt.wantOnRequest {
+				t.Errorf("NewPayoutFrequency() on request = %v, want %v", got.OnRequest(), tt.wantOnRequest)
+			}
+		})
+	}
+}
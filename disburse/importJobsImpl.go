@@ -0,0 +1,582 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// importJobsListed is the number of most recent import jobs returned by GET /imports.
+const importJobsListed = 50
+
+var (
+	errUnknownImportJob  = errors.New("unknown import job")
+	errImportJobFinished = errors.New("import job has already finished")
+	errImportQueueFull   = errors.New("too many import jobs queued")
+)
+
+type queuedImport struct {
+	job   types.ImportJob
+	files ImportFiles
+	ctx   context.Context
+}
+
+func NewImportJobs(logger *slog.Logger, ctx context.Context, repo repo.DisburserRepoRepository, importer Importer) *ImportJobs {
+	return &ImportJobs{
+		Logger:   logger,
+		Ctx:      ctx,
+		Repo:     repo,
+		Importer: importer,
+		queue:    make(chan queuedImport, types.IMPORT_QUEUE_SIZE),
+		maxBody:  types.IMPORT_MAX_UPLOAD_SIZE,
+		cancels:  map[uuid.UUID]context.CancelFunc{},
+	}
+}
+
+// Submit records a new import job of files and queues it to run in the background. The job runs under the service context, not
+// ctx, so it outlives the request that submitted it until it finishes or is cancelled. Spooled files are removed once the job has
+// finished, or straight away when it can not be queued.
+func (ij *ImportJobs) Submit(ctx context.Context, files ImportFiles) (types.ImportJob, error) {
+	job := types.ImportJob{ID: uuid.New(), State: types.IMPORT_QUEUED, CreatedAt: time.Now().UTC()}
+
+	ij.mu.Lock()
+	defer ij.mu.Unlock()
+	if len(ij.queue) == cap(ij.queue) {
+		ij.removeSpooled(files)
+		return job, errImportQueueFull
+	}
+
+	err := ij.Repo.InsertImportJob(ctx, job)
+	if err != nil {
+		ij.removeSpooled(files)
+		return job, err
+	}
+
+	jobCtx, cancel := context.WithCancel(ij.Ctx)
+	ij.cancels[job.ID] = cancel
+	ij.queue <- queuedImport{job: job, files: files, ctx: jobCtx}
+	return job, nil
+}
+
+// Cancel cancels the context of a queued or running import job. A running job stops at its next order and rolls back the merchant
+// it was importing; the job is recorded as IMPORT_CANCELLED once it has stopped.
+func (ij *ImportJobs) Cancel(ctx context.Context, id uuid.UUID) (types.ImportJob, error) {
+	ij.mu.Lock()
+	cancel, running := ij.cancels[id]
+	ij.mu.Unlock()
+	if running {
+		cancel()
+	}
+
+	job, err := ij.Repo.GetImportJob(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return job, errUnknownImportJob
+	}
+	if err != nil {
+		return job, err
+	}
+
+	if !running && job.Finished() {
+		return job, errImportJobFinished
+	}
+	return job, nil
+}
+
+// Start runs the queued import jobs until ctx is cancelled. Jobs left queued or running by a previous instance of the service can
+// not be resumed, so they are marked as failed first.
+func (ij *ImportJobs) Start(ctx context.Context) {
+	n, err := ij.Repo.FailUnfinishedImportJobs(ctx, "interrupted by a service restart", time.Now().UTC())
+	if err != nil {
+		ij.Logger.Error("failed to fail unfinished import jobs", "error", err)
+	}
+	if n > 0 {
+		ij.Logger.Info("failed import jobs interrupted by a restart", "jobs", n)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case q := <-ij.queue:
+			ij.run(q)
+		}
+	}
+}
+
+// run imports the job, recording its state as the import progresses and how it ended.
+func (ij *ImportJobs) run(q queuedImport) {
+	defer ij.forget(q.job.ID)
+	defer ij.removeSpooled(q.files)
+
+	job := q.job
+	var stats types.ImportStats
+	err := q.ctx.Err()
+	if err == nil {
+		job.StartedAt = time.Now().UTC()
+		observer := &jobObserver{ij: ij, job: &job}
+		stats, err = ij.Importer.ImportOrders(q.ctx, q.files, observer)
+		flushErr := observer.flush()
+		if flushErr != nil {
+			ij.Logger.Error("failed to store import rejects", "job_id", job.ID, "error", flushErr)
+		}
+	}
+
+	job.RowsProcessed = int64(stats.Processed)
+	job.RowsRejected = int64(stats.Rejected)
+	job.Stats = stats
+	job.CompletedAt = time.Now().UTC()
+	switch {
+	case err == nil:
+		job.State = types.IMPORT_DONE
+		ij.Logger.Info("import completed", "job_id", job.ID, "merchants", stats.Merchants, "orders", stats.Orders,
+			"disbursements", stats.Disbursements, "monthly", stats.Monthly, "merchant_changes", stats.MerchantChanges,
+			"order_changes", stats.OrderChanges, "recomputed", stats.Recomputed, "skipped", stats.Skipped)
+	case q.ctx.Err() != nil:
+		job.State = types.IMPORT_CANCELLED
+		job.Error = "import cancelled"
+		ij.Logger.Info("import cancelled", "job_id", job.ID, "orders", stats.Orders)
+	default:
+		job.State = types.IMPORT_FAILED
+		job.Error = err.Error()
+		ij.Logger.Error("import failed", "job_id", job.ID, "error", err)
+	}
+	ij.update(job)
+}
+
+// update records the job under the service context, which unlike the job's context is not cancelled with the job.
+func (ij *ImportJobs) update(job types.ImportJob) {
+	err := ij.Repo.UpdateImportJob(ij.Ctx, job)
+	if err != nil {
+		ij.Logger.Error("failed to update import job", "job_id", job.ID, "state", job.State, "error", err)
+	}
+}
+
+// jobObserver records the progress of a running import job and stores its rejects in batches.
+type jobObserver struct {
+	ij      *ImportJobs
+	job     *types.ImportJob
+	rejects []types.ImportReject
+}
+
+func (o *jobObserver) Progress(state string, stats types.ImportStats) {
+	o.job.State = state
+	o.job.RowsProcessed = int64(stats.Processed)
+	o.job.RowsRejected = int64(stats.Rejected)
+	o.job.Stats = stats
+	err := o.flush()
+	if err != nil {
+		o.ij.Logger.Error("failed to store import rejects", "job_id", o.job.ID, "error", err)
+	}
+	o.ij.update(*o.job)
+}
+
+func (o *jobObserver) Reject(r types.ImportReject) error {
+	r.JobID = o.job.ID
+	o.rejects = append(o.rejects, r)
+	if len(o.rejects) == types.IMPORT_BATCH_SIZE {
+		return o.flush()
+	}
+	return nil
+}
+
+// flush stores the buffered rejects under the service context so they are kept when the job is cancelled.
+func (o *jobObserver) flush() error {
+	if len(o.rejects) == 0 {
+		return nil
+	}
+
+	err := o.ij.Repo.InsertImportRejects(o.ij.Ctx, o.rejects)
+	o.rejects = o.rejects[:0]
+	return err
+}
+
+func (ij *ImportJobs) forget(id uuid.UUID) {
+	ij.mu.Lock()
+	defer ij.mu.Unlock()
+	if cancel, ok := ij.cancels[id]; ok {
+		cancel()
+		delete(ij.cancels, id)
+	}
+}
+
+func (ij *ImportJobs) removeSpooled(files ImportFiles) {
+	if !files.Spooled {
+		return
+	}
+
+	for _, name := range []string{files.Merchants, files.Orders} {
+		if name == "" {
+			continue
+		}
+		err := os.Remove(name)
+		if err != nil {
+			ij.Logger.Error("failed to remove uploaded import file", "file", name, "error", err)
+		}
+	}
+}
+
+// Imports submits a new import job on POST and lists the most recent import jobs on GET. The files to import are sent as a
+// multipart/form-data upload with an orders and or a merchants file part, or the orders file is streamed as the raw request body,
+// or the merchants file with ?file=merchants. Files that are not sent are read from the service's working directory. The files are
+// semicolon separated, JSON Lines or JSON arrays, detected from their content unless ?orders_format= or ?merchants_format= name
+// one, and are written in the dialect given by the query, see importDialect. Uploads are spooled to temporary files with their
+// format and CSV header line checked before the job is queued. A request uploading more than IMPORT_MAX_UPLOAD_SIZE bytes is
+// refused with 413.
+func (ij *ImportJobs) Imports(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jobs, err := ij.Repo.GetImportJobs(r.Context(), importJobsListed)
+		if err != nil {
+			ij.Logger.Error("failed to get import jobs", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now().UTC()
+		for i := range jobs {
+			jobs[i].SetElapsed(now)
+		}
+		if jobs == nil {
+			jobs = []types.ImportJob{}
+		}
+		writeJSON(w, ij.Logger, http.StatusOK, jobs)
+
+	case http.MethodPost:
+		incremental, err := importMode(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, ij.maxBody)
+		files, err := ij.spoolUploads(r)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("upload exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, errInvalidRequest) || errors.Is(err, errInvalidHeader) || errors.Is(err, errInvalidFormat) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			ij.Logger.Error("failed to spool uploaded import files", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		files.Incremental = incremental
+		job, err := ij.Submit(r.Context(), files)
+		if errors.Is(err, errImportQueueFull) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			ij.Logger.Error("failed to submit import job", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, ij.Logger, http.StatusAccepted, job)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// importMode reports whether the mode query parameter asks for an incremental import; a full import is the default.
+func importMode(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("mode") {
+	case "", "full":
+		return false, nil
+	case "incremental":
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: mode must be full or incremental", errInvalidRequest)
+}
+
+// importFormat returns the file format named by the query parameter key, empty when the format is to be detected.
+func importFormat(r *http.Request, key string) (string, error) {
+	switch format := r.URL.Query().Get(key); format {
+	case "", types.IMPORT_FORMAT_CSV, types.IMPORT_FORMAT_JSONL, types.IMPORT_FORMAT_JSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("%w: %s must be %s, %s or %s", errInvalidRequest, key, types.IMPORT_FORMAT_CSV, types.IMPORT_FORMAT_JSONL,
+		types.IMPORT_FORMAT_JSON)
+}
+
+// importDialect returns the dialect of the import files given by the query parameters delimiter, a single character or tab,
+// decimal_separator, . or ,, date_layout, date, datetime, rfc3339 or a Go time layout, timezone, an IANA zone name, and columns, a
+// comma separated list of header:column pairs naming the columns of the legacy files. Parameters left out keep the legacy dialect.
+// The decimal separator and the delimiter must differ.
+func importDialect(r *http.Request) (Dialect, error) {
+	var d Dialect
+	q := r.URL.Query()
+
+	delimiter := q.Get("delimiter")
+	if delimiter == "tab" {
+		delimiter = "\t"
+	}
+	if delimiter != "" {
+		c, size := utf8.DecodeRuneInString(delimiter)
+		if size != len(delimiter) || c == utf8.RuneError || c == '"' || c == '\r' || c == '\n' {
+			return d, fmt.Errorf("%w: invalid delimiter %q", errInvalidRequest, delimiter)
+		}
+		d.Delimiter = c
+	}
+
+	switch decimal := q.Get("decimal_separator"); decimal {
+	case "":
+	case ".", ",":
+		d.Decimal = rune(decimal[0])
+	default:
+		return d, fmt.Errorf("%w: decimal_separator must be . or ,", errInvalidRequest)
+	}
+	// an amount whose decimal separator is the delimiter is split into two fields unless the partner quotes every amount
+	if withDefaults := d.orDefaults(); withDefaults.Decimal == withDefaults.Delimiter {
+		return d, fmt.Errorf("%w: decimal_separator %q can not be the delimiter", errInvalidRequest, withDefaults.Decimal)
+	}
+
+	switch layout := q.Get("date_layout"); layout {
+	case "date":
+		d.DateLayout = time.DateOnly
+	case "datetime":
+		d.DateLayout = time.DateTime
+	case "rfc3339":
+		d.DateLayout = time.RFC3339
+	default:
+		d.DateLayout = layout
+	}
+
+	if tz := q.Get("timezone"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return d, fmt.Errorf("%w: unknown timezone %q", errInvalidRequest, tz)
+		}
+		d.Location = loc
+	}
+
+	if columns := q.Get("columns"); columns != "" {
+		d.Columns = map[string]string{}
+		for _, pair := range strings.Split(columns, ",") {
+			header, column, ok := strings.Cut(pair, ":")
+			header = strings.ToLower(strings.TrimSpace(header))
+			column = strings.TrimSpace(column)
+			if !ok || header == "" || !slices.Contains(orderColumns, column) && !slices.Contains(merchantColumns, column) {
+				return d, fmt.Errorf("%w: columns must be header:column pairs naming the columns of the orders or merchants file, got %q",
+					errInvalidRequest, pair)
+			}
+			d.Columns[header] = column
+		}
+	}
+	return d, nil
+}
+
+// spoolUploads writes the files uploaded with the request to temporary files and checks their formats. A request without a body
+// imports the files of the working directory. A multipart upload may send each file once.
+func (ij *ImportJobs) spoolUploads(r *http.Request) (files ImportFiles, err error) {
+	files.Spooled = true
+	defer func() {
+		if err != nil {
+			ij.removeSpooled(files)
+		}
+	}()
+
+	files.OrdersFormat, err = importFormat(r, "orders_format")
+	if err != nil {
+		return files, err
+	}
+	files.MerchantsFormat, err = importFormat(r, "merchants_format")
+	if err != nil {
+		return files, err
+	}
+	files.Dialect, err = importDialect(r)
+	if err != nil {
+		return files, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "multipart/form-data":
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return files, fmt.Errorf("%w: %w", errInvalidRequest, err)
+		}
+
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return files, fmt.Errorf("%w: %w", errInvalidRequest, err)
+			}
+
+			switch part.FormName() {
+			case "orders":
+				if files.Orders != "" {
+					err = fmt.Errorf("%w: repeated part %q", errInvalidRequest, part.FormName())
+					break
+				}
+				files.Orders, err = spoolUpload(part, files.OrdersFormat, orderColumns, files.Dialect)
+			case "merchants":
+				if files.Merchants != "" {
+					err = fmt.Errorf("%w: repeated part %q", errInvalidRequest, part.FormName())
+					break
+				}
+				files.Merchants, err = spoolUpload(part, files.MerchantsFormat, merchantColumns, files.Dialect)
+			default:
+				err = fmt.Errorf("%w: unexpected part %q, want orders or merchants", errInvalidRequest, part.FormName())
+			}
+			part.Close()
+			if err != nil {
+				return files, err
+			}
+		}
+
+	case r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0:
+		switch r.URL.Query().Get("file") {
+		case "", "orders":
+			files.Orders, err = spoolUpload(r.Body, files.OrdersFormat, orderColumns, files.Dialect)
+		case "merchants":
+			files.Merchants, err = spoolUpload(r.Body, files.MerchantsFormat, merchantColumns, files.Dialect)
+		default:
+			err = fmt.Errorf("%w: file must be orders or merchants", errInvalidRequest)
+		}
+	}
+	return files, err
+}
+
+// spoolUpload copies an uploaded file to a temporary file and checks it is of format in the dialect d, see validateFile.
+func spoolUpload(r io.Reader, format string, columns []string, d Dialect) (string, error) {
+	f, err := os.CreateTemp("", "import-*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = validateFile(f, format, columns, d)
+	}
+	err = errors.Join(err, f.Close())
+	if err != nil {
+		return "", errors.Join(err, os.Remove(f.Name()))
+	}
+	return f.Name(), nil
+}
+
+// ImportJob reports the import job in the path, /imports/{id}, on GET and cancels it on DELETE. A GET of /imports/{id}/rejects
+// downloads the records the job rejected as a semicolon separated file.
+func (ij *ImportJobs) ImportJob(w http.ResponseWriter, r *http.Request) {
+	path, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/imports/"), "/")
+	id, err := uuid.Parse(path)
+	if err != nil {
+		http.Error(w, "invalid import job id", http.StatusBadRequest)
+		return
+	}
+
+	switch sub {
+	case "":
+	case "rejects":
+		ij.rejects(w, r, id)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		job, err := ij.Repo.GetImportJob(r.Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, errUnknownImportJob.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			ij.Logger.Error("failed to get import job", "job_id", id, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		job.SetElapsed(time.Now().UTC())
+		writeJSON(w, ij.Logger, http.StatusOK, job)
+
+	case http.MethodDelete:
+		job, err := ij.Cancel(r.Context(), id)
+		if errors.Is(err, errUnknownImportJob) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errImportJobFinished) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			ij.Logger.Error("failed to cancel import job", "job_id", id, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		job.SetElapsed(time.Now().UTC())
+		writeJSON(w, ij.Logger, http.StatusAccepted, job)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// rejects writes the rejects of the import job as a semicolon separated file with a file;line;reason;record header line.
+func (ij *ImportJobs) rejects(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, err := ij.Repo.GetImportJob(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errUnknownImportJob.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ij.Logger.Error("failed to get import job", "job_id", id, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rejects, err := ij.Repo.GetImportRejects(r.Context(), id)
+	if err != nil {
+		ij.Logger.Error("failed to get import rejects", "job_id", id, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "import-"+id.String()+"-rejects.csv"))
+	cw := csv.NewWriter(w)
+	cw.Comma = ';'
+	cw.Write([]string{"file", "line", "reason", "record"})
+	for _, rj := range rejects {
+		cw.Write([]string{rj.File, strconv.Itoa(rj.Line), rj.Reason, rj.Record})
+	}
+	cw.Flush()
+	if cw.Error() != nil {
+		ij.Logger.Error("failed to write import rejects", "job_id", id, "error", cw.Error())
+	}
+}
@@ -0,0 +1,501 @@
+package disburse
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// importJobRepo is an in-memory stand-in for the import job methods of the repo, keeping every state a job was recorded in.
+type importJobRepo struct {
+	repo.DisburserRepoRepository
+	mu      sync.Mutex
+	jobs    map[uuid.UUID]types.ImportJob
+	states  []string
+	rejects []types.ImportReject
+}
+
+func (jr *importJobRepo) InsertImportRejects(ctx context.Context, rejects []types.ImportReject) error {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	jr.rejects = append(jr.rejects, rejects...)
+	return nil
+}
+
+func (jr *importJobRepo) GetImportRejects(ctx context.Context, jobID uuid.UUID) ([]types.ImportReject, error) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	var rejects []types.ImportReject
+	for _, r := range jr.rejects {
+		if r.JobID == jobID {
+			rejects = append(rejects, r)
+		}
+	}
+	return rejects, nil
+}
+
+func (jr *importJobRepo) InsertImportJob(ctx context.Context, job types.ImportJob) error {
+	return jr.UpdateImportJob(ctx, job)
+}
+
+func (jr *importJobRepo) UpdateImportJob(ctx context.Context, job types.ImportJob) error {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	if jr.jobs == nil {
+		jr.jobs = map[uuid.UUID]types.ImportJob{}
+	}
+	jr.jobs[job.ID] = job
+	if n := len(jr.states); n == 0 || jr.states[n-1] != job.State {
+		jr.states = append(jr.states, job.State)
+	}
+	return nil
+}
+
+func (jr *importJobRepo) GetImportJob(ctx context.Context, id uuid.UUID) (types.ImportJob, error) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	job, ok := jr.jobs[id]
+	if !ok {
+		return job, sql.ErrNoRows
+	}
+	return job, nil
+}
+
+// fakeImporter reports every import state and rejects, then fails with err or, when block is set, waits for the import to be
+// cancelled.
+type fakeImporter struct {
+	err     error
+	block   bool
+	rejects []types.ImportReject
+}
+
+func (fi *fakeImporter) ImportOrders(ctx context.Context, files ImportFiles, observer ImportObserver) (types.ImportStats, error) {
+	stats := types.ImportStats{Merchants: 2}
+	observer.Progress(types.IMPORT_PARSING, stats)
+	for _, r := range fi.rejects {
+		stats.Rejected++
+		err := observer.Reject(r)
+		if err != nil {
+			return stats, err
+		}
+	}
+	stats.Processed = 3
+	observer.Progress(types.IMPORT_BUILDING, stats)
+	if fi.block {
+		<-ctx.Done()
+		return stats, ctx.Err()
+	}
+	observer.Progress(types.IMPORT_INSERTING, stats)
+	return stats, fi.err
+}
+
+func TestImportJobs_run(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tests := []struct {
+		name       string
+		importer   *fakeImporter
+		cancel     bool
+		wantStates []string
+		wantError  string
+	}{
+		{
+			name:       "completed import",
+			importer:   &fakeImporter{},
+			wantStates: []string{types.IMPORT_QUEUED, types.IMPORT_PARSING, types.IMPORT_BUILDING, types.IMPORT_INSERTING, types.IMPORT_DONE},
+		},
+		{
+			name:       "failed import",
+			importer:   &fakeImporter{err: errors.New("orders.csv: no such file")},
+			wantStates: []string{types.IMPORT_QUEUED, types.IMPORT_PARSING, types.IMPORT_BUILDING, types.IMPORT_INSERTING, types.IMPORT_FAILED},
+			wantError:  "orders.csv: no such file",
+		},
+		{
+			name:       "cancelled while running",
+			importer:   &fakeImporter{block: true},
+			cancel:     true,
+			wantStates: []string{types.IMPORT_QUEUED, types.IMPORT_PARSING, types.IMPORT_BUILDING, types.IMPORT_CANCELLED},
+			wantError:  "import cancelled",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jr := &importJobRepo{}
+			ij := NewImportJobs(logger, context.Background(), jr, tt.importer)
+			job, err := ij.Submit(context.Background(), ImportFiles{})
+			if err != nil {
+				t.Fatalf("Submit() error = %v", err)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				ij.run(<-ij.queue)
+				close(done)
+			}()
+
+			if tt.cancel {
+				for {
+					got, _ := jr.GetImportJob(context.Background(), job.ID)
+					if got.State == types.IMPORT_BUILDING {
+						break
+					}
+					time.Sleep(time.Millisecond)
+				}
+				_, err = ij.Cancel(context.Background(), job.ID)
+				if err != nil {
+					t.Fatalf("Cancel() error = %v", err)
+				}
+			}
+			<-done
+
+			got, _ := jr.GetImportJob(context.Background(), job.ID)
+			if len(jr.states) != len(tt.wantStates) {
+				t.Fatalf("run() states = %v, want %v", jr.states, tt.wantStates)
+			}
+			for i := range tt.wantStates {
+				if jr.states[i] != tt.wantStates[i] {
+					t.Errorf("run() states = %v, want %v", jr.states, tt.wantStates)
+					break
+				}
+			}
+			if got.Error != tt.wantError || got.RowsProcessed != 3 || got.StartedAt.IsZero() || got.CompletedAt.IsZero() {
+				t.Errorf("run() job = %+v, want error %q and 3 rows processed", got, tt.wantError)
+			}
+			if got.Stats.Merchants != 2 || got.Stats.Processed != 3 {
+				t.Errorf("run() job stats = %+v, want the stats of the import", got.Stats)
+			}
+
+			_, err = ij.Cancel(context.Background(), job.ID)
+			if !errors.Is(err, errImportJobFinished) {
+				t.Errorf("Cancel() of a finished job error = %v, want %v", err, errImportJobFinished)
+			}
+		})
+	}
+}
+
+func TestImportJobs_ImportJob(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	jr := &importJobRepo{}
+	ij := NewImportJobs(logger, context.Background(), jr, &fakeImporter{})
+	job, err := ij.Submit(context.Background(), ImportFiles{})
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{name: "queued job", method: http.MethodGet, path: "/imports/" + job.ID.String(), wantStatus: http.StatusOK},
+		{name: "unknown job", method: http.MethodGet, path: "/imports/" + uuid.NewString(), wantStatus: http.StatusNotFound},
+		{name: "invalid id", method: http.MethodGet, path: "/imports/latest", wantStatus: http.StatusBadRequest},
+		{name: "cancel queued job", method: http.MethodDelete, path: "/imports/" + job.ID.String(), wantStatus: http.StatusAccepted},
+		{name: "cancel unknown job", method: http.MethodDelete, path: "/imports/" + uuid.NewString(), wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ij.ImportJob(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("ImportJob() status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	ij.run(<-ij.queue)
+	got, _ := jr.GetImportJob(context.Background(), job.ID)
+	if got.State != types.IMPORT_CANCELLED || !got.StartedAt.IsZero() {
+		t.Errorf("run() of a cancelled queued job = %+v, want it cancelled without starting", got)
+	}
+}
+
+func TestImportJobs_Imports_upload(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	orders := "id;merchant_reference;amount;created_at\ne653f3e14bc4;padberg_group;102.29;2023-02-01\n"
+	merchants := "id;reference;email;live_on;disbursement_frequency;minimum_monthly_fee\n" +
+		"86312006-4d7e-45c4-9c28-788f4aa68a62;padberg_group;info@padberg-group.com;2023-02-01;DAILY;0.0\n"
+	jsonOrders := `[{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":102.29,"created_at":"2023-02-01"}]`
+	partnerOrders := "order_id\tmerchant_reference\tamount\tcreated_at\tchannel\ne653f3e14bc4\tpadberg_group\t102,29\t2023-02-01 07:15:00\tweb\n"
+
+	multipartBody := func(parts map[string]string) (io.Reader, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for name, content := range parts {
+			fw, _ := mw.CreateFormFile(name, name+".csv")
+			fw.Write([]byte(content))
+		}
+		mw.Close()
+		return &buf, mw.FormDataContentType()
+	}
+	repeatedBody := func(name string, contents ...string) (io.Reader, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for _, content := range contents {
+			fw, _ := mw.CreateFormFile(name, name+".csv")
+			fw.Write([]byte(content))
+		}
+		mw.Close()
+		return &buf, mw.FormDataContentType()
+	}
+
+	tests := []struct {
+		name            string
+		body            func() (io.Reader, string)
+		query           string
+		maxBody         int64
+		wantStatus      int
+		wantOrders      bool
+		wantMerchants   bool
+		wantIncremental bool
+		wantFormat      string
+		wantContent     string
+	}{
+		{
+			name: "multipart orders and merchants",
+			body: func() (io.Reader, string) {
+				return multipartBody(map[string]string{"orders": orders, "merchants": merchants})
+			},
+			wantStatus:    http.StatusAccepted,
+			wantOrders:    true,
+			wantMerchants: true,
+		},
+		{
+			name:       "raw orders body",
+			body:       func() (io.Reader, string) { return strings.NewReader(orders), "text/csv" },
+			wantStatus: http.StatusAccepted,
+			wantOrders: true,
+		},
+		{
+			name:          "raw merchants body",
+			body:          func() (io.Reader, string) { return strings.NewReader(merchants), "text/csv" },
+			query:         "?file=merchants",
+			wantStatus:    http.StatusAccepted,
+			wantMerchants: true,
+		},
+		{
+			name:            "incremental orders",
+			body:            func() (io.Reader, string) { return strings.NewReader(orders), "text/csv" },
+			query:           "?mode=incremental",
+			wantStatus:      http.StatusAccepted,
+			wantOrders:      true,
+			wantIncremental: true,
+		},
+		{
+			name:       "unknown mode",
+			body:       func() (io.Reader, string) { return strings.NewReader(orders), "text/csv" },
+			query:      "?mode=delta",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "json orders body",
+			body:        func() (io.Reader, string) { return strings.NewReader(jsonOrders), "application/json" },
+			query:       "?orders_format=json",
+			wantStatus:  http.StatusAccepted,
+			wantOrders:  true,
+			wantFormat:  types.IMPORT_FORMAT_JSON,
+			wantContent: jsonOrders,
+		},
+		{
+			name:        "orders in a partner dialect",
+			body:        func() (io.Reader, string) { return strings.NewReader(partnerOrders), "text/csv" },
+			query:       "?delimiter=tab&decimal_separator=,&date_layout=datetime&timezone=UTC&columns=order_id:id",
+			wantStatus:  http.StatusAccepted,
+			wantOrders:  true,
+			wantContent: partnerOrders,
+		},
+		{
+			name:       "orders in a partner dialect without the column mapping",
+			body:       func() (io.Reader, string) { return strings.NewReader(partnerOrders), "text/csv" },
+			query:      "?delimiter=tab&decimal_separator=,",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "decimal separator equal to the delimiter",
+			body:       func() (io.Reader, string) { return strings.NewReader(orders), "text/csv" },
+			query:      "?delimiter=,&decimal_separator=,",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "delimiter equal to the default decimal separator",
+			body:       func() (io.Reader, string) { return strings.NewReader(orders), "text/csv" },
+			query:      "?delimiter=.",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown timezone",
+			body:       func() (io.Reader, string) { return strings.NewReader(orders), "text/csv" },
+			query:      "?timezone=Mars/Olympus_Mons",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "column mapping to an unknown column",
+			body:       func() (io.Reader, string) { return strings.NewReader(orders), "text/csv" },
+			query:      "?columns=order_id:order",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "orders not in the format asked for",
+			body:       func() (io.Reader, string) { return strings.NewReader(orders), "text/csv" },
+			query:      "?orders_format=jsonl",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown merchants format",
+			body:       func() (io.Reader, string) { return strings.NewReader(merchants), "text/csv" },
+			query:      "?file=merchants&merchants_format=xml",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no body imports the working directory files",
+			body:       func() (io.Reader, string) { return nil, "" },
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "orders with the merchants header",
+			body:       func() (io.Reader, string) { return multipartBody(map[string]string{"orders": merchants}) },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unexpected part",
+			body:       func() (io.Reader, string) { return multipartBody(map[string]string{"refunds": orders}) },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "repeated orders part",
+			body:       func() (io.Reader, string) { return repeatedBody("orders", orders, orders) },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "repeated merchants part",
+			body:       func() (io.Reader, string) { return repeatedBody("merchants", merchants, merchants) },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "raw body too large",
+			body:       func() (io.Reader, string) { return strings.NewReader(orders), "text/csv" },
+			maxBody:    int64(len(orders) - 1),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "multipart upload too large",
+			body: func() (io.Reader, string) {
+				return multipartBody(map[string]string{"orders": orders, "merchants": merchants})
+			},
+			maxBody:    int64(len(orders) + len(merchants)),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "empty orders file",
+			body:       func() (io.Reader, string) { return multipartBody(map[string]string{"orders": ""}) },
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TMPDIR", t.TempDir())
+			ij := NewImportJobs(logger, context.Background(), &importJobRepo{}, &fakeImporter{})
+			if tt.maxBody > 0 {
+				ij.maxBody = tt.maxBody
+			}
+			body, contentType := tt.body()
+			req := httptest.NewRequest(http.MethodPost, "/imports"+tt.query, body)
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+
+			rec := httptest.NewRecorder()
+			ij.Imports(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("Imports() status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+
+			spooled, _ := filepath.Glob(filepath.Join(os.TempDir(), "import-*"))
+			if rec.Code != http.StatusAccepted {
+				if len(spooled) != 0 {
+					t.Errorf("Imports() left %d spooled files behind", len(spooled))
+				}
+				return
+			}
+
+			q := <-ij.queue
+			if (q.files.Orders != "") != tt.wantOrders || (q.files.Merchants != "") != tt.wantMerchants {
+				t.Errorf("Imports() queued files = %+v, want orders %v and merchants %v", q.files, tt.wantOrders, tt.wantMerchants)
+			}
+			if q.files.Incremental != tt.wantIncremental {
+				t.Errorf("Imports() queued incremental = %v, want %v", q.files.Incremental, tt.wantIncremental)
+			}
+			if q.files.OrdersFormat != tt.wantFormat {
+				t.Errorf("Imports() queued orders format = %q, want %q", q.files.OrdersFormat, tt.wantFormat)
+			}
+			if q.files.Orders != "" {
+				want := orders
+				if tt.wantContent != "" {
+					want = tt.wantContent
+				}
+				content, _ := os.ReadFile(q.files.Orders)
+				if string(content) != want {
+					t.Errorf("Imports() spooled orders = %q, want %q", content, want)
+				}
+			}
+
+			ij.run(q)
+			spooled, _ = filepath.Glob(filepath.Join(os.TempDir(), "import-*"))
+			if len(spooled) != 0 {
+				t.Errorf("run() left %d spooled files behind", len(spooled))
+			}
+		})
+	}
+}
+
+func TestImportJobs_ImportJob_rejects(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	jr := &importJobRepo{}
+	ij := NewImportJobs(logger, context.Background(), jr, &fakeImporter{rejects: []types.ImportReject{
+		{File: types.IMPORT_FILE_MERCHANTS, Line: 3, Record: "not-a-uuid;padberg_group", Reason: "expected 6 fields in merchant record, got 2"},
+		{File: types.IMPORT_FILE_ORDERS, Line: 7, Record: "e653f3e14bc4;padberg_group;-1.00;2023-02-01", Reason: "amount -1.00 must be greater than zero"},
+	}})
+	job, err := ij.Submit(context.Background(), ImportFiles{})
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	ij.run(<-ij.queue)
+
+	got, _ := jr.GetImportJob(context.Background(), job.ID)
+	if got.State != types.IMPORT_DONE || got.RowsRejected != 2 {
+		t.Errorf("run() job = %+v, want it done with 2 rows rejected", got)
+	}
+
+	rec := httptest.NewRecorder()
+	ij.ImportJob(rec, httptest.NewRequest(http.MethodGet, "/imports/"+job.ID.String()+"/rejects", nil))
+	want := "file;line;reason;record\n" +
+		"merchants;3;expected 6 fields in merchant record, got 2;\"not-a-uuid;padberg_group\"\n" +
+		"orders;7;amount -1.00 must be greater than zero;\"e653f3e14bc4;padberg_group;-1.00;2023-02-01\"\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("ImportJob() rejects = %d %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+	if rec.Header().Get("Content-Type") != "text/csv" {
+		t.Errorf("ImportJob() rejects Content-Type = %q, want text/csv", rec.Header().Get("Content-Type"))
+	}
+
+	rec = httptest.NewRecorder()
+	ij.ImportJob(rec, httptest.NewRequest(http.MethodGet, "/imports/"+uuid.NewString()+"/rejects", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("ImportJob() rejects of an unknown job status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -2,83 +2,244 @@ package disburse
 
 import (
 	"bufio"
+	"context"
 	"encoding/csv"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/levtk/sequra/types"
 	"io"
-	"log/slog"
-	"math"
 	"os"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
-// parseDataFromOrders parses the order data that was exported to a semicolon separated file formatted
-// per the legacy design specification prior to the new requirements documented in [link to jira story]
-func parseDataFromOrders(fileName string) (Orders, error) {
-	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
-	o := make([]*Order, 1500000)
-	var counter = 0
-	ofd, err := os.Open(fileName)
-	if err != nil {
-		return o, err
+var (
+	orderColumns    = []string{"id", "merchant_reference", "amount", "created_at", "currency"}
+	merchantColumns = []string{"id", "reference", "email", "live_on", "disbursement_frequency", "minimum_monthly_fee", "timezone", "payout_day", "currency"}
+
+	// optionalColumns may be left out of the header of a file; their fields are empty then
+	optionalColumns = []string{"timezone", "payout_day", "currency"}
+
+	errInvalidHeader = errors.New("invalid csv header")
+
+	// errOrderImported is returned by the check of an orderReader for orders an earlier import has taken, which are skipped
+	// without being rejected.
+	errOrderImported = errors.New("order already imported")
+)
+
+// orderSource yields orders one at a time and returns io.EOF after the last one.
+type orderSource interface {
+	Next() (*Order, error)
+}
+
+// contextSource stops reading src once ctx is cancelled.
+type contextSource struct {
+	ctx context.Context
+	src orderSource
+}
+
+func (cs *contextSource) Next() (*Order, error) {
+	if cs.ctx.Err() != nil {
+		return nil, cs.ctx.Err()
 	}
-	defer func(ofd *os.File) {
-		err := ofd.Close()
-		if err != nil {
-			logger.Error("failed to close file", "error", err)
-		}
-	}(ofd)
+	return cs.src.Next()
+}
+
+// rejectFunc is handed the records of an import file that fail validation. The file is not read any further when it returns an
+// error.
+type rejectFunc func(r types.ImportReject) error
+
+// orderReader streams the orders of an orders file one record at a time. Records that can not be read or parsed, or that check
+// rejects, are handed to reject and skipped; without a reject func they are returned as errors.
+type orderReader struct {
+	r       recordReader
+	dialect Dialect
+	reject  rejectFunc
+	check   func(o *Order) error
+}
 
-	r := csv.NewReader(bufio.NewReader(ofd))
-	r.Comma = ';'
+// newOrderReader returns a reader of the semicolon separated orders file r.
+func newOrderReader(r io.Reader) *orderReader {
+	or, _ := newFormatOrderReader(r, types.IMPORT_FORMAT_CSV, legacyDialect)
+	return or
+}
 
+// newFormatOrderReader returns a reader of the orders file r in format, detected from r when empty, written in the dialect d, see
+// newRecordReader.
+func newFormatOrderReader(r io.Reader, format string, d Dialect) (*orderReader, error) {
+	rr, err := newRecordReader(r, format, orderColumns, d)
+	if err != nil {
+		return nil, err
+	}
+	return &orderReader{r: rr, dialect: d.orDefaults()}, nil
+}
+
+func (or *orderReader) Next() (*Order, error) {
 	for {
-		rec, err := r.Read()
-		if err != nil && err != io.EOF {
-			logger.Error("error while reading orders file", "error", err)
+		rec, err := or.r.Read()
+		if err == io.EOF {
+			return nil, err
 		}
 
-		if err == nil {
-			line, _ := r.FieldPos(1)
-			if line == 1 { //skipping header line
-				continue
-			}
-
-			amount, err := strconv.ParseFloat(rec[2], 64)
+		var re *recordError
+		if errors.As(err, &re) {
+			err = or.rejectRecord(rec, re.err)
 			if err != nil {
-				return o, err
+				return nil, err
 			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
 
-			a := int64(math.Round(amount * 100))
-			if err != nil {
-				return o, err
-			}
-			createdAt, err := time.Parse("2006-01-02", rec[3])
+		o, err := parseOrderRecord(rec.fields, or.dialect)
+		if err == nil {
+			o.line, o.record = rec.line, rec.raw
+		}
+		if err == nil && or.check != nil {
+			err = or.check(o)
+		}
+		if errors.Is(err, errOrderImported) {
+			continue
+		}
+		if err != nil {
+			err = or.rejectRecord(rec, err)
 			if err != nil {
-				return o, err
+				return nil, err
 			}
+			continue
+		}
+		return o, nil
+	}
+}
 
-			order := Order{
-				ID:                rec[0],
-				MerchantReference: rec[1],
-				MerchantID:        uuid.UUID{},
-				Amount:            a,
-				CreatedAt:         createdAt,
-				RWMutex:           sync.RWMutex{},
-			}
-			o[counter] = &order
-			counter++
+// rejectOrder rejects an order the reader has returned, reporting it with its line and record as read.
+func (or *orderReader) rejectOrder(o *Order, cause error) error {
+	return or.rejectRecord(importRecord{line: o.line, raw: o.record}, cause)
+}
+
+func (or *orderReader) rejectRecord(rec importRecord, cause error) error {
+	if or.reject == nil {
+		return fmt.Errorf("line %d: %w", rec.line, cause)
+	}
+	return or.reject(types.ImportReject{File: types.IMPORT_FILE_ORDERS, Line: rec.line, Record: rec.raw, Reason: cause.Error()})
+}
+
+// parseOrderRecord converts a record of the orders file, id;merchant_reference;amount;created_at and an optional currency, written in
+// the dialect d into an Order. An order without a currency is in the currency of its merchant, see orderValidator.check.
+func parseOrderRecord(rec []string, d Dialect) (*Order, error) {
+	if len(rec) != len(orderColumns) {
+		return nil, fmt.Errorf("expected %d fields in order record, got %d", len(orderColumns), len(rec))
+	}
+
+	if rec[0] == "" {
+		return nil, errors.New("missing order id")
+	}
+
+	if rec[1] == "" {
+		return nil, errors.New("missing merchant reference")
+	}
+
+	currency, err := parseCurrency(rec[4])
+	if err != nil {
+		return nil, err
+	}
+
+	cents, err := parseAmount(rec[2], currency, d)
+	if err != nil {
+		return nil, err
+	}
+
+	if cents <= 0 {
+		return nil, fmt.Errorf("amount %s must be greater than zero", rec[2])
+	}
+
+	createdAt, err := d.timestamp(rec[3])
+	if err != nil {
+		return nil, fmt.Errorf("malformed created_at %q", rec[3])
+	}
+
+	return &Order{
+		ID:                rec[0],
+		MerchantReference: rec[1],
+		MerchantID:        uuid.UUID{},
+		Amount:            cents,
+		Currency:          currency,
+		CreatedAt:         createdAt,
+	}, nil
+}
+
+// orderValidator checks the orders of an import against its merchants, one order at a time. Repeated order ids are left to
+// uniqueOrders.
+type orderValidator struct {
+	merchants map[string]types.Merchant
+}
+
+func newOrderValidator(merchants map[string]types.Merchant) *orderValidator {
+	return &orderValidator{merchants: merchants}
+}
+
+// check returns why o can not be imported, nil when it can. An order without a currency is given the currency of its merchant.
+func (v *orderValidator) check(o *Order) error {
+	merchant, ok := v.merchants[o.MerchantReference]
+	if !ok {
+		return fmt.Errorf("unknown merchant %s", o.MerchantReference)
+	}
+
+	if o.CreatedAt.Before(merchant.LiveOn) {
+		return fmt.Errorf("order created on %s before the merchant went live on %s", o.CreatedAt.Format(time.DateOnly), merchant.LiveOn.Format(time.DateOnly))
+	}
+
+	if o.Currency == "" {
+		o.Currency = types.CurrencyCode(merchant.Currency)
+	}
+
+	c, err := types.LookupCurrency(o.Currency)
+	if err != nil {
+		return err
+	}
+
+	maxOrder := merchant.FeeScheduleAt(o.CreatedAt, c).MaxOrderAmount()
+	if o.Amount > maxOrder {
+		return fmt.Errorf("amount %s above the maximum order amount %s", c.FormatAmount(o.Amount), c.FormatAmount(maxOrder))
+	}
+
+	return nil
+}
+
+// uniqueOrders yields the orders of src, sorted with compareOrdersByID, that do not repeat the id of an order before them, so the
+// first order in the file with an id is imported whatever its merchant and creation date. The orders repeating an id are handed to
+// reject and the imported ones to accept. Only the id of the last order is held, the orders file is sorted by id on disk instead.
+type uniqueOrders struct {
+	src    orderSource
+	reject func(o *Order, cause error) error
+	accept func(o *Order)
+	prevID string
+}
+
+func (u *uniqueOrders) Next() (*Order, error) {
+	for {
+		o, err := u.src.Next()
+		if err != nil {
+			return nil, err
 		}
 
-		if err == io.EOF {
-			return o, nil
+		if o.ID == u.prevID {
+			err = u.reject(o, fmt.Errorf("duplicate order id %s", o.ID))
+			if err != nil {
+				return nil, err
+			}
+			continue
 		}
 
-		if err != nil && err != io.EOF {
-			return o, err
+		u.prevID = o.ID
+		if u.accept != nil {
+			u.accept(o)
 		}
+		return o, nil
 	}
 }
 
@@ -86,7 +247,6 @@ func parseDataFromOrders(fileName string) (Orders, error) {
 // per the legacy design specification prior to the new requirements documented in [link to jira story]
 // which returns a map[string]types.Merchant where the key is Merchant.reference
 func parseDataFromMerchants(fileName string) (map[string]types.Merchant, error) {
-	var m = map[string]types.Merchant{}
 	mfd, err := os.Open(fileName)
 
 	if err != nil {
@@ -94,9 +254,19 @@ func parseDataFromMerchants(fileName string) (map[string]types.Merchant, error)
 	}
 
 	defer mfd.Close()
+	return parseMerchants(mfd, types.IMPORT_FORMAT_CSV, legacyDialect, nil)
+}
 
-	r := csv.NewReader(bufio.NewReader(mfd))
-	r.Comma = ';'
+// parseMerchants parses the merchants of r in format, detected from r when empty, written in the dialect d, see
+// parseDataFromMerchants and newRecordReader. Records that fail validation are handed to reject and left out; without a reject func
+// the first one is returned as an error.
+func parseMerchants(mr io.Reader, format string, d Dialect, reject rejectFunc) (map[string]types.Merchant, error) {
+	var m = map[string]types.Merchant{}
+	d = d.orDefaults()
+	r, err := newRecordReader(mr, format, merchantColumns, d)
+	if err != nil {
+		return m, err
+	}
 
 	for {
 		rec, err := r.Read()
@@ -104,28 +274,147 @@ func parseDataFromMerchants(fileName string) (map[string]types.Merchant, error)
 			return m, nil
 		}
 
-		if err != nil {
+		var re *recordError
+		if errors.As(err, &re) {
+			err = re.err
+		} else if err != nil {
 			return m, err
 		}
 
-		line, _ := r.FieldPos(0)
-		if line == 1 { //skipping header line
-			continue
+		var merchant types.Merchant
+		if err == nil {
+			merchant, err = parseMerchantRecord(rec.fields, d)
 		}
-
-		uuid, err := uuid.Parse(rec[0])
-		if err != nil {
-			return m, err
+		if err == nil {
+			if _, ok := m[merchant.Reference]; ok {
+				err = fmt.Errorf("duplicate merchant reference %s", merchant.Reference)
+			}
 		}
-
-		liveon, err := time.Parse(time.DateOnly, rec[3])
 		if err != nil {
-			return m, err
+			if reject == nil {
+				return m, fmt.Errorf("line %d: %w", rec.line, err)
+			}
+
+			err = reject(types.ImportReject{File: types.IMPORT_FILE_MERCHANTS, Line: rec.line, Record: rec.raw, Reason: err.Error()})
+			if err != nil {
+				return m, err
+			}
+			continue
 		}
+		m[merchant.Reference] = merchant
+	}
+}
 
-		if err == nil {
-			merchant := types.Merchant{ID: uuid, Reference: rec[1], Email: rec[2], LiveOn: liveon, DisbursementFrequency: rec[4], MinMonthlyFee: rec[5]}
-			m[rec[1]] = merchant
+// parseMerchantRecord converts a record of the merchants file, id;reference;email;live_on;disbursement_frequency;minimum_monthly_fee
+// and an optional timezone, payout_day and currency, written in the dialect d into a Merchant. The timezone is an IANA name such as
+// Atlantic/Canary, the payout_day the day of the month, 1 to 31, MONTHLY merchants are paid out on, and the currency the ISO 4217
+// code of the currency the merchant sells in, the DEFAULT_CURRENCY when empty.
+func parseMerchantRecord(rec []string, d Dialect) (types.Merchant, error) {
+	if len(rec) != len(merchantColumns) {
+		return types.Merchant{}, fmt.Errorf("expected %d fields in merchant record, got %d", len(merchantColumns), len(rec))
+	}
+
+	id, err := uuid.Parse(rec[0])
+	if err != nil {
+		return types.Merchant{}, fmt.Errorf("malformed merchant id %q", rec[0])
+	}
+
+	if rec[1] == "" {
+		return types.Merchant{}, errors.New("missing merchant reference")
+	}
+
+	liveon, err := d.date(rec[3])
+	if err != nil {
+		return types.Merchant{}, fmt.Errorf("malformed live_on %q", rec[3])
+	}
+
+	_, err = NewPayoutFrequency(rec[4])
+	if err != nil {
+		return types.Merchant{}, err
+	}
+
+	currency, err := parseCurrency(rec[8])
+	if err != nil {
+		return types.Merchant{}, err
+	}
+
+	minMonthlyFee, err := d.amount(rec[5])
+	if err != nil {
+		return types.Merchant{}, fmt.Errorf("malformed minimum_monthly_fee %q", rec[5])
+	}
+
+	merchant := types.Merchant{ID: id, Reference: rec[1], Email: rec[2], LiveOn: liveon, DisbursementFrequency: rec[4], MinMonthlyFee: minMonthlyFee,
+		Timezone: strings.TrimSpace(rec[6]), Currency: types.CurrencyCode(currency)}
+	if payoutDay := strings.TrimSpace(rec[7]); payoutDay != "" {
+		merchant.PayoutDay, err = strconv.Atoi(payoutDay)
+		if err != nil || merchant.PayoutDay < 1 || merchant.PayoutDay > 31 {
+			return types.Merchant{}, fmt.Errorf("malformed payout_day %q", rec[7])
 		}
 	}
+	_, err = merchant.GetMinMonthlyFee()
+	if errors.Is(err, types.ErrAmountPrecision) {
+		return types.Merchant{}, fmt.Errorf("minimum_monthly_fee %s has more decimals than %s allows", rec[5], merchant.Currency)
+	}
+	if err != nil {
+		return types.Merchant{}, fmt.Errorf("malformed minimum_monthly_fee %q", rec[5])
+	}
+
+	_, err = merchant.Location()
+	if err != nil {
+		return types.Merchant{}, fmt.Errorf("unknown timezone %q", rec[6])
+	}
+	return merchant, nil
+}
+
+// parseCurrency returns the ISO 4217 code s of a supported currency in upper case, empty when s is.
+func parseCurrency(s string) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(s))
+	if code == "" {
+		return "", nil
+	}
+
+	_, err := types.LookupCurrency(code)
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// parseAmount parses the amount s of a record written in the dialect d exactly into the minor unit of the currency with the ISO 4217
+// code, see Currency.ParseAmount.
+func parseAmount(s, code string, d Dialect) (int64, error) {
+	c, err := types.LookupCurrency(code)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := d.amount(s)
+	if err != nil {
+		return 0, err
+	}
+
+	amount, err := c.ParseAmount(value)
+	if errors.Is(err, types.ErrAmountPrecision) {
+		return 0, fmt.Errorf("amount %s has more decimals than %s allows", s, c.Code)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("malformed amount %q", s)
+	}
+	return amount, nil
+}
+
+// validateHeader reads the header line of the delimited file r and checks it names columns in the dialect d, see Dialect.header.
+func validateHeader(r io.Reader, columns []string, d Dialect) error {
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.Comma = d.Delimiter
+	cr.FieldsPerRecord = -1
+	rec, err := cr.Read()
+	if err == io.EOF {
+		return fmt.Errorf("%w: the file is empty", errInvalidHeader)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidHeader, err)
+	}
+	_, err = d.header(rec, columns)
+	return err
 }
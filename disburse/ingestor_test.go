@@ -3,45 +3,14 @@ package disburse
 import (
 	"github.com/google/uuid"
 	"github.com/levtk/sequra/types"
+	"io"
 	"reflect"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
 
-func Test_importDataFromOrders(t *testing.T) {
-	o := make([]Order, 1310000)
-	created, _ := time.Parse(time.DateOnly, "2023-02-01")
-	o1 := Order{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: 10229, CreatedAt: created}
-	o2 := Order{ID: "20b674c93ea6", MerchantReference: "padberg_group", Amount: 43321, CreatedAt: created}
-	o3 := Order{ID: "0b73fb1d3332", MerchantReference: "padberg_group", Amount: 19437, CreatedAt: created}
-	o[0] = o1
-	o[1] = o2
-	o[2] = o3
-
-	tests := []struct {
-		name     string
-		fileName string
-		want     []Order
-		wantErr  bool
-	}{
-
-		{name: "success", fileName: "../orders_test.csv", want: o, wantErr: false},
-		{name: "fileNotFound", fileName: "../order.csv", want: []Order{}, wantErr: true},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, err := parseDataFromOrders(tt.fileName)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("parseDataFromOrders() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("parseDataFromOrders() = %v, want %v", got, tt.want)
-			}
-		})
-	}
-}
-
 func Test_importDataFromMerchants(t *testing.T) {
 	uu1, _ := uuid.Parse("86312006-4d7e-45c4-9c28-788f4aa68a62")
 	uu2, _ := uuid.Parse("d1649242-a612-46ba-82d8-225542bb9576")
@@ -63,6 +32,7 @@ func Test_importDataFromMerchants(t *testing.T) {
 			LiveOn:                lo1,
 			DisbursementFrequency: "DAILY",
 			MinMonthlyFee:         "0.0",
+			Currency:              "EUR",
 		},
 		"deckow_gibson": {
 			ID:                    uu2,
@@ -71,6 +41,7 @@ func Test_importDataFromMerchants(t *testing.T) {
 			LiveOn:                lo2,
 			DisbursementFrequency: "DAILY",
 			MinMonthlyFee:         "30.0",
+			Currency:              "EUR",
 		},
 		"romaguera_and_sons": {
 			ID:                    uu3,
@@ -79,6 +50,7 @@ func Test_importDataFromMerchants(t *testing.T) {
 			LiveOn:                lo3,
 			DisbursementFrequency: "DAILY",
 			MinMonthlyFee:         "15.0",
+			Currency:              "EUR",
 		},
 		"rosenbaum_parisian": {
 			ID:                    uu4,
@@ -87,6 +59,7 @@ func Test_importDataFromMerchants(t *testing.T) {
 			LiveOn:                lo4,
 			DisbursementFrequency: "WEEKLY",
 			MinMonthlyFee:         "15.0",
+			Currency:              "EUR",
 		},
 	}
 	tests := []struct {
@@ -113,3 +86,253 @@ func Test_importDataFromMerchants(t *testing.T) {
 		})
 	}
 }
+
+func Test_orderReader_rejects(t *testing.T) {
+	liveOn, _ := time.Parse(time.DateOnly, "2023-01-01")
+	merchants := map[string]types.Merchant{
+		"padberg_group": {Reference: "padberg_group", LiveOn: liveOn, FeeSchedules: []types.FeeSchedule{{MaxOrder: 50000}}},
+	}
+	input := `id;merchant_reference;amount;created_at
+e653f3e14bc4;padberg_group;102.29;2023-02-01
+20b674c93ea6;;433.21;2023-02-01
+0b73fb1d3332;unknown_group;194.37;2023-02-01
+1b2ab4e3c1f4;padberg_group;0;2023-02-01
+33c080831f5b;padberg_group;-12.00;2023-02-01
+056d024481a9;padberg_group;600.00;2023-02-01
+a1b2c3d4e5f6;padberg_group;12,00;2023-02-01
+b1b2c3d4e5f6;padberg_group;12.00;01/02/2023
+e653f3e14bc4;padberg_group;99.00;2023-02-02
+c1b2c3d4e5f6;padberg_group;12.00;2022-12-31
+d1b2c3d4e5f6;padberg_group;12.00
+e1b2c3d4e5f6;padberg_group;10.005;2023-02-01
+f1b2c3d4e5f6;padberg_group;25.00;2023-02-03
+`
+	want := []struct {
+		line   int
+		reason string
+	}{
+		{3, "missing merchant reference"},
+		{4, "unknown merchant unknown_group"},
+		{5, "amount 0 must be greater than zero"},
+		{6, "amount -12.00 must be greater than zero"},
+		{7, "amount 600.00 above the maximum order amount 500.00"},
+		{8, `malformed amount "12,00"`},
+		{9, `malformed created_at "01/02/2023"`},
+		{10, "duplicate order id e653f3e14bc4"},
+		{11, "order created on 2022-12-31 before the merchant went live on 2023-01-01"},
+		{12, "wrong number of fields"},
+		{13, "amount 10.005 has more decimals than EUR allows"},
+	}
+
+	or := newOrderReader(strings.NewReader(input))
+	or.check = newOrderValidator(merchants).check
+	got, rejects := readUniqueOrders(t, or)
+
+	if strings.Join(got, ",") != "e653f3e14bc4,f1b2c3d4e5f6" {
+		t.Errorf("Next() orders = %v, want e653f3e14bc4,f1b2c3d4e5f6", got)
+	}
+	if len(rejects) != len(want) {
+		t.Fatalf("Next() rejects = %+v, want %d", rejects, len(want))
+	}
+	for i, w := range want {
+		if rejects[i].Line != w.line || rejects[i].Reason != w.reason || rejects[i].File != types.IMPORT_FILE_ORDERS {
+			t.Errorf("Next() reject %d = %+v, want line %d: %s", i, rejects[i], w.line, w.reason)
+		}
+	}
+	if rejects[0].Record != "20b674c93ea6;;433.21;2023-02-01" {
+		t.Errorf("Next() reject record = %q, want the record as read", rejects[0].Record)
+	}
+}
+
+// readUniqueOrders reads the orders of or as an import does, sorted by id through uniqueOrders, and returns the ids of the orders
+// in id order and the rejects in line order.
+func readUniqueOrders(t *testing.T, or *orderReader) ([]string, []types.ImportReject) {
+	t.Helper()
+	var rejects []types.ImportReject
+	or.reject = func(r types.ImportReject) error {
+		rejects = append(rejects, r)
+		return nil
+	}
+
+	byID, cleanup, err := sortOrders(or, compareOrdersByID, 2, t.TempDir())
+	if err != nil {
+		t.Fatalf("sortOrders() error = %v", err)
+	}
+	defer cleanup()
+
+	var got []string
+	src := &uniqueOrders{src: byID, reject: or.rejectOrder}
+	for {
+		o, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, o.ID)
+	}
+
+	slices.SortStableFunc(rejects, func(a, b types.ImportReject) int {
+		return a.Line - b.Line
+	})
+	return got, rejects
+}
+
+func Test_orderReader_currency(t *testing.T) {
+	liveOn, _ := time.Parse(time.DateOnly, "2023-01-01")
+	merchants := map[string]types.Merchant{
+		"padberg_group": {Reference: "padberg_group", LiveOn: liveOn, Currency: "GBP"},
+	}
+	input := `id;merchant_reference;amount;created_at;currency
+e653f3e14bc4;padberg_group;102.29;2023-02-01;eur
+20b674c93ea6;padberg_group;433.21;2023-02-01;
+0b73fb1d3332;padberg_group;194.37;2023-02-01;XXX
+`
+
+	or := newOrderReader(strings.NewReader(input))
+	var rejects []types.ImportReject
+	or.reject = func(r types.ImportReject) error {
+		rejects = append(rejects, r)
+		return nil
+	}
+	or.check = newOrderValidator(merchants).check
+
+	var got []string
+	for {
+		o, err := or.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, o.ID+":"+o.Currency)
+	}
+
+	if strings.Join(got, ",") != "e653f3e14bc4:EUR,20b674c93ea6:GBP" {
+		t.Errorf("Next() orders = %v, want the order's currency or else the merchant's", got)
+	}
+	if len(rejects) != 1 || rejects[0].Line != 4 || rejects[0].Reason != `unsupported currency "XXX"` {
+		t.Errorf("Next() rejects = %+v, want the unsupported currency on line 4", rejects)
+	}
+}
+
+func Test_orderReader_watermark(t *testing.T) {
+	input := `id;merchant_reference;amount;created_at
+33c080831f5b;padberg_group;98.10;2023-01-31
+e653f3e14bc4;padberg_group;102.29;2023-02-01
+20b674c93ea6;padberg_group;433.21;2023-02-01
+056d024481a9;padberg_group;440.45;2023-02-02
+1b2ab4e3c1f4;deckow_gibson;61.74;2023-01-05
+`
+	wm := types.ImportWatermark{MerchantReference: "padberg_group", CreatedAt: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC), OrderIDs: []string{"e653f3e14bc4"}}
+
+	or := newOrderReader(strings.NewReader(input))
+	or.reject = func(r types.ImportReject) error {
+		t.Errorf("Next() rejected %+v, want orders up to the watermark skipped", r)
+		return nil
+	}
+	or.check = func(o *Order) error {
+		if o.MerchantReference == wm.MerchantReference && wm.Covers(o.ID, o.CreatedAt) {
+			return errOrderImported
+		}
+		return nil
+	}
+
+	var got []string
+	for {
+		o, err := or.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, o.ID)
+	}
+
+	if strings.Join(got, ",") != "20b674c93ea6,056d024481a9,1b2ab4e3c1f4" {
+		t.Errorf("Next() orders = %v, want the orders after the watermark", got)
+	}
+}
+
+func Test_parseMerchants_rejects(t *testing.T) {
+	input := `id;reference;email;live_on;disbursement_frequency;minimum_monthly_fee
+86312006-4d7e-45c4-9c28-788f4aa68a62;padberg_group;info@padberg-group.com;2023-02-01;DAILY;0.0
+not-a-uuid;deckow_gibson;info@deckow-gibson.com;2022-12-14;DAILY;30.0
+a616488f-c8b2-45dd-b29f-364d12a20238;romaguera_and_sons;info@romaguera-and-sons.com;14/12/2022;DAILY;15.0
+9b6d2b8a-f06c-4298-8f27-f33545eb5899;rosenbaum_parisian;info@rosenbaum-parisian.com;2022-11-09;HOURLY;15.0
+d1649242-a612-46ba-82d8-225542bb9576;padberg_group;info@padberg-group.com;2023-02-01;DAILY;0.0
+`
+	var rejects []types.ImportReject
+	got, err := parseMerchants(strings.NewReader(input), "", Dialect{}, func(r types.ImportReject) error {
+		rejects = append(rejects, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("parseMerchants() error = %v", err)
+	}
+
+	if len(got) != 1 || got["padberg_group"].ID.String() != "86312006-4d7e-45c4-9c28-788f4aa68a62" {
+		t.Errorf("parseMerchants() = %v, want only the first padberg_group", got)
+	}
+	wantLines := []int{3, 4, 5, 6}
+	if len(rejects) != len(wantLines) {
+		t.Fatalf("parseMerchants() rejects = %+v, want lines %v", rejects, wantLines)
+	}
+	for i, line := range wantLines {
+		if rejects[i].Line != line || rejects[i].File != types.IMPORT_FILE_MERCHANTS {
+			t.Errorf("parseMerchants() reject %d = %+v, want line %d", i, rejects[i], line)
+		}
+	}
+
+	_, err = parseMerchants(strings.NewReader(input), "", Dialect{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("parseMerchants() without a reject func error = %v, want the first invalid line", err)
+	}
+}
+
+func Test_parseMerchants_timezone(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		input  string
+	}{
+		{
+			name: "csv",
+			input: `timezone;id;reference;email;live_on;disbursement_frequency;minimum_monthly_fee
+Atlantic/Canary;86312006-4d7e-45c4-9c28-788f4aa68a62;padberg_group;info@padberg-group.com;2023-02-01;DAILY;0.0
+;d1649242-a612-46ba-82d8-225542bb9576;deckow_gibson;info@deckow-gibson.com;2022-12-14;DAILY;30.0
+Europe/Atlantis;a616488f-c8b2-45dd-b29f-364d12a20238;romaguera_and_sons;info@romaguera-and-sons.com;2022-12-14;DAILY;15.0
+`,
+		},
+		{
+			name:   "jsonl",
+			format: types.IMPORT_FORMAT_JSONL,
+			input: `{"id":"86312006-4d7e-45c4-9c28-788f4aa68a62","reference":"padberg_group","email":"info@padberg-group.com","live_on":"2023-02-01","disbursement_frequency":"DAILY","minimum_monthly_fee":"0.0","timezone":"Atlantic/Canary"}
+{"id":"d1649242-a612-46ba-82d8-225542bb9576","reference":"deckow_gibson","email":"info@deckow-gibson.com","live_on":"2022-12-14","disbursement_frequency":"DAILY","minimum_monthly_fee":30}
+{"id":"a616488f-c8b2-45dd-b29f-364d12a20238","reference":"romaguera_and_sons","email":"info@romaguera-and-sons.com","live_on":"2022-12-14","disbursement_frequency":"DAILY","minimum_monthly_fee":15,"timezone":"Europe/Atlantis"}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rejects []types.ImportReject
+			got, err := parseMerchants(strings.NewReader(tt.input), tt.format, Dialect{}, func(r types.ImportReject) error {
+				rejects = append(rejects, r)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("parseMerchants() error = %v", err)
+			}
+
+			if got["padberg_group"].Timezone != "Atlantic/Canary" || got["deckow_gibson"].Timezone != "" || len(got) != 2 {
+				t.Errorf("parseMerchants() = %+v, want padberg_group in Atlantic/Canary and deckow_gibson in UTC", got)
+			}
+			if len(rejects) != 1 || !strings.Contains(rejects[0].Reason, "unknown timezone") {
+				t.Errorf("parseMerchants() rejects = %+v, want the unknown timezone", rejects)
+			}
+		})
+	}
+}
@@ -17,27 +17,93 @@ type Disburser interface {
 }
 
 type Importer interface {
-	ImportOrders() ([]types.Disbursement, map[string]types.Merchant, []types.Monthly, error)
-	Import(w http.ResponseWriter, r *http.Request)
+	ImportOrders(ctx context.Context, files ImportFiles, observer ImportObserver) (types.ImportStats, error)
+}
+
+// ImportObserver follows a running import. Progress is told the state of the import and the records counted so far, and Reject
+// each record that failed validation and was left out; the import stops when Reject returns an error.
+type ImportObserver interface {
+	Progress(state string, stats types.ImportStats)
+	Reject(r types.ImportReject) error
+}
+
+type ImportJobRunner interface {
+	Submit(ctx context.Context, files ImportFiles) (types.ImportJob, error)
+	Cancel(ctx context.Context, id uuid.UUID) (types.ImportJob, error)
+	Start(ctx context.Context)
+	Imports(w http.ResponseWriter, r *http.Request)
+	ImportJob(w http.ResponseWriter, r *http.Request)
 }
 type OrderProcessor interface {
 	ProcessOrder(logger *slog.Logger, ctx context.Context, repo repo.DisburserRepoRepository, o *Order) error
 	ProcessBatchDistributions([]types.Disbursement) error
 	ProcessBatchMonthly([]types.Monthly) error
+	PostOrder(w http.ResponseWriter, r *http.Request)
+}
+
+type DisbursementRunner interface {
+	Run(ctx context.Context, runDate time.Time) (types.DisbursementRun, error)
+	Schedule(ctx context.Context)
+}
+
+// PayoutProvider sends disbursement group payouts to merchants. Implementations must treat the DisbursementGroupID of the transfer
+// as an idempotency key so a group initiated twice, e.g. when a run is resumed, is only paid once.
+type PayoutProvider interface {
+	InitiateTransfer(ctx context.Context, t types.Transfer) (transactionID string, err error)
+	TransferStatus(ctx context.Context, transactionID string) (types.Transfer, error)
+	CancelTransfer(ctx context.Context, transactionID string) error
+}
+
+type FeeScheduleManager interface {
+	AddFeeSchedule(ctx context.Context, fs types.FeeSchedule) (types.FeeSchedule, error)
+	FeeSchedules(w http.ResponseWriter, r *http.Request)
+}
+
+type Refunder interface {
+	Refund(ctx context.Context, rf types.Refund) (types.Refund, error)
+	Refunds(w http.ResponseWriter, r *http.Request)
+}
+
+type LedgerReader interface {
+	TrialBalance(ctx context.Context) (types.TrialBalance, error)
+	Balances(w http.ResponseWriter, r *http.Request)
+	GetTrialBalance(w http.ResponseWriter, r *http.Request)
+}
+
+// PayoutFrequency is how often the orders of a merchant are paid out, looked up with NewPayoutFrequency from the merchant's
+// DisbursementFrequency. PayoutDate returns the payout date of the orders received on day, the first payout day of the merchant on
+// or after it; both are calendar days in the merchant's timezone at midnight UTC. Orders with the same payout date are paid out
+// together. When OnRequest is true orders are instead paid out once the merchant requests a payout of its accrued balance, and
+// PayoutDate only dates the orders.
+type PayoutFrequency interface {
+	PayoutDate(m types.Merchant, day time.Time) (time.Time, error)
+	OnRequest() bool
+}
+
+type PayoutRequester interface {
+	RequestPayout(ctx context.Context, merchRef, currency string) (types.DisbursementGroup, error)
+	Payouts(w http.ResponseWriter, r *http.Request)
+}
+
+type RiskManager interface {
+	PlaceHold(ctx context.Context, merchRef string, reason string) (types.PayoutHold, error)
+	LiftHold(ctx context.Context, merchRef string, reason string) (types.PayoutHold, error)
+	SetReservePolicy(ctx context.Context, merchRef string, p types.ReservePolicy) (types.ReservePolicy, error)
+	Merchants(w http.ResponseWriter, r *http.Request)
 }
 
 type Seller interface {
 	GetMinMonthlyFee() (int64, error)
-	GetMinMonthlyFeeRemaining() (int64, error)
-	GetNextPayoutDate() (time.Time, error)
+	GetMinMonthlyFeeRemaining(orderFeeTotal int64) (int64, error)
+	GetNextPayoutDate(clock types.Clock) (time.Time, error)
 	CalculateDailyTotalOrders() (int64, error)
 	CalculateWeeklyTotalOrders() (int64, error)
 }
 type Reporter interface {
-	DisbursementsByYear(logger *slog.Logger, repo repo.DisburserRepoRepository, YYYY string) (types.DisbursementReport, error)
+	DisbursementsByYear(logger *slog.Logger, repo repo.DisburserRepoRepository, YYYY, currency string) (types.DisbursementReport, error)
 	DisbursementsByRange(logger *slog.Logger, ctx context.Context, repo repo.DisburserRepoRepository, start time.Time, end time.Time) (Report, error)
 	MerchantDisbursements(logger *slog.Logger, ctx context.Context, repo repo.DisburserRepoRepository, merchantUUID uuid.UUID, start time.Time, end time.Time) (Report, error)
 	NumberMonthlyPaymentsByYear(logger *slog.Logger, YYYY string, disbursements []types.Disbursement) (Report, error)
-	DisbursementReport(logger *slog.Logger, repo repo.DisburserRepoRepository, YYYY string) (types.DisbursementReport, error)
+	DisbursementReport(logger *slog.Logger, repo repo.DisburserRepoRepository, YYYY, currency string) (types.DisbursementReport, error)
 	GetDisbursementReport(w http.ResponseWriter, r *http.Request)
 }
@@ -0,0 +1,74 @@
+package disburse
+
+import (
+	"context"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"log/slog"
+	"net/http"
+)
+
+func NewLedger(logger *slog.Logger, ctx context.Context, repo repo.DisburserRepoRepository) *Ledger {
+	return &Ledger{
+		Logger: logger,
+		Ctx:    ctx,
+		Repo:   repo,
+	}
+}
+
+// TrialBalance derives the balance of every ledger account from its postings and checks the books balance in every currency.
+func (l *Ledger) TrialBalance(ctx context.Context) (types.TrialBalance, error) {
+	balances, err := l.Repo.GetAccountBalances(ctx, "")
+	if err != nil {
+		return types.TrialBalance{}, err
+	}
+
+	unbalanced, err := l.Repo.GetUnbalancedJournalEntries(ctx)
+	if err != nil {
+		return types.TrialBalance{}, err
+	}
+
+	tb := types.NewTrialBalance(balances, unbalanced)
+	if !tb.Balanced {
+		l.Logger.Error("ledger does not balance", "totals", tb.Totals, "unbalanced_entries", len(unbalanced))
+	}
+	return tb, nil
+}
+
+// Balances returns the ledger account balances of the merchant in the merchant_reference query parameter, or of every merchant
+// when it is omitted.
+func (l *Ledger) Balances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	merchRef := r.URL.Query().Get("merchant_reference")
+	balances, err := l.Repo.GetAccountBalances(r.Context(), merchRef)
+	if err != nil {
+		l.Logger.Error("failed to get account balances", "merchant", merchRef, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if balances == nil {
+		balances = []types.AccountBalance{}
+	}
+	writeJSON(w, l.Logger, http.StatusOK, balances)
+}
+
+// GetTrialBalance returns the trial balance of the ledger.
+func (l *Ledger) GetTrialBalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	tb, err := l.TrialBalance(r.Context())
+	if err != nil {
+		l.Logger.Error("failed to get trial balance", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, l.Logger, http.StatusOK, tb)
+}
@@ -0,0 +1,106 @@
+package disburse
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// ledgerRepo is an in-memory stand-in for the repo methods used by the ledger, deriving balances from the posted entries.
+type ledgerRepo struct {
+	repo.DisburserRepoRepository
+	entries []types.JournalEntry
+}
+
+func (lr *ledgerRepo) GetAccountBalances(ctx context.Context, merchRef string) ([]types.AccountBalance, error) {
+	sums := map[[3]string]int64{}
+	var keys [][3]string
+	for _, e := range lr.entries {
+		for _, p := range e.Postings {
+			if merchRef != "" && p.MerchantReference != merchRef {
+				continue
+			}
+			key := [3]string{p.Account, p.MerchantReference, p.Currency}
+			if _, ok := sums[key]; !ok {
+				keys = append(keys, key)
+			}
+			sums[key] += p.Amount
+		}
+	}
+
+	var balances []types.AccountBalance
+	for _, k := range keys {
+		balances = append(balances, types.AccountBalance{Account: k[0], MerchantReference: k[1], Currency: k[2], Balance: sums[k]})
+	}
+	return balances, nil
+}
+
+func (lr *ledgerRepo) GetUnbalancedJournalEntries(ctx context.Context) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	for _, e := range lr.entries {
+		if e.Validate() != nil {
+			ids = append(ids, e.ID)
+		}
+	}
+	return ids, nil
+}
+
+func TestLedger_TrialBalance(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	payoutDate, _ := time.Parse(time.DateOnly, "2023-02-01")
+	groupID, gbpGroupID := uuid.New(), uuid.New()
+	lr := &ledgerRepo{entries: []types.JournalEntry{
+		types.NewOrderEntry(types.Disbursement{DisbursementGroupID: groupID, MerchReference: "padberg_group", OrderID: "056d024481a9", OrderAmount: 10229, OrderFee: 1022, PayoutDate: payoutDate}),
+		types.NewOrderEntry(types.Disbursement{DisbursementGroupID: groupID, MerchReference: "padberg_group", OrderID: "33c080831f5b", OrderAmount: 44045, OrderFee: 2202, PayoutDate: payoutDate}),
+		types.NewRefundEntry(types.Refund{ID: uuid.New(), MerchantReference: "padberg_group", OrderID: "056d024481a9", Amount: 5000, CreatedAt: payoutDate}),
+		types.NewPayoutEntry(groupID, "padberg_group", "EUR", 10229-1022+44045-2202-5000, payoutDate),
+		types.NewMonthlyFeeEntry(types.Monthly{ID: uuid.New(), MerchantReference: "padberg_group", MonthlyFeeDate: payoutDate, DidPayFee: 1, MonthlyFee: 5000, OrderFeeTotal: 3224}),
+		types.NewOrderEntry(types.Disbursement{DisbursementGroupID: gbpGroupID, MerchReference: "padberg_group", OrderID: "20b674c93ea6", OrderAmount: 20000, Currency: "GBP", OrderFee: 1000, PayoutDate: payoutDate}),
+		types.NewPayoutEntry(gbpGroupID, "padberg_group", "GBP", 20000-1000, payoutDate),
+	}}
+	l := NewLedger(logger, context.Background(), lr)
+
+	tb, err := l.TrialBalance(context.Background())
+	if err != nil {
+		t.Fatalf("TrialBalance() error = %v", err)
+	}
+	if !tb.Balanced || len(tb.Totals) != 2 {
+		t.Errorf("TrialBalance() got = %+v, want books balanced in EUR and GBP", tb)
+	}
+	for _, total := range tb.Totals {
+		if total.Debits != total.Credits {
+			t.Errorf("TrialBalance() %s debits = %d, credits = %d, want them equal", total.Currency, total.Debits, total.Credits)
+		}
+	}
+
+	want := map[string]int64{
+		types.ACCOUNT_MERCHANT_PAYABLE + " EUR":       0,
+		types.ACCOUNT_FEE_REVENUE + " EUR":            -5000,
+		types.ACCOUNT_MONTHLY_FEE_RECEIVABLE + " EUR": 1776,
+		types.ACCOUNT_BANK_CLEARING + " EUR":          3224,
+		types.ACCOUNT_MERCHANT_PAYABLE + " GBP":       0,
+		types.ACCOUNT_FEE_REVENUE + " GBP":            -1000,
+		types.ACCOUNT_BANK_CLEARING + " GBP":          1000,
+	}
+	got := map[string]int64{}
+	for _, b := range tb.Accounts {
+		got[b.Account+" "+b.Currency] = b.Balance
+	}
+	for account, balance := range want {
+		if got[account] != balance {
+			t.Errorf("TrialBalance() %s balance = %d, want %d", account, got[account], balance)
+		}
+	}
+
+	lr.entries = append(lr.entries, types.JournalEntry{ID: uuid.New(), Kind: types.ENTRY_ORDER, Reference: "e653f3e14bc4",
+		Postings: []types.Posting{{Account: types.ACCOUNT_BANK_CLEARING, MerchantReference: "padberg_group", Amount: 100}}})
+	tb, err = l.TrialBalance(context.Background())
+	if err != nil || tb.Balanced || len(tb.UnbalancedEntries) != 1 {
+		t.Errorf("TrialBalance() got = %+v, error = %v, want the unbalanced entry reported", tb, err)
+	}
+}
@@ -2,7 +2,6 @@ package disburse
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	"github.com/levtk/sequra/repo"
@@ -14,30 +13,67 @@ import (
 	"github.com/google/uuid"
 )
 
+// DisburserService wires the parts of the service together. Clock is the time every payout date and cut-off of order processing is
+// evaluated at, and Calendar the business days payouts are made on.
 type DisburserService struct {
 	logger       *slog.Logger
 	ctx          context.Context
+	Clock        types.Clock
+	Calendar     *types.Calendar
 	ProcessOrder OrderProcessor
 	Importer     Importer
 	Reporter     Reporter
+	Runner       DisbursementRunner
+	FeeSchedules FeeScheduleManager
+	Refunds      Refunder
+	Payouts      PayoutRequester
+	Risk         RiskManager
+	Ledger       LedgerReader
+	ImportJobs   ImportJobRunner
 	Repo         repo.DisburserRepoRepository
 }
 
-func NewDisburserService(logger *slog.Logger, ctx context.Context, db *sqlx.DB) (*DisburserService, error) {
-	repo, err := repo.NewDisburserRepo(logger, ctx, db)
+// NewDisburserService returns the service on the database db paying out through provider on the business days of calendar. A nil
+// clock is the system clock and a nil calendar has weekends but no holidays.
+func NewDisburserService(logger *slog.Logger, ctx context.Context, db *sqlx.DB, provider PayoutProvider, clock types.Clock, calendar *types.Calendar) (*DisburserService, error) {
+	if clock == nil {
+		clock = types.SystemClock{}
+	}
+	repo, err := repo.NewDisburserRepo(logger, ctx, db, clock)
 	if err != nil {
 		return &DisburserService{}, err
 	}
 
+	if calendar == nil {
+		calendar = &types.Calendar{}
+	}
 	importer := NewImport(logger, ctx, repo)
-	orderProcessor := NewOrderProcessor(logger, ctx, repo)
+	importer.Calendar = calendar
+	orderProcessor := NewOrderProcessor(logger, ctx, repo, clock, calendar)
 	reporter := NewReporter(logger, ctx, repo)
+	runner := NewRunner(logger, ctx, repo, provider, clock)
+	runner.Calendar = calendar
+	feeScheduler := NewFeeScheduler(logger, ctx, repo)
+	refundProcessor := NewRefundProcessor(logger, ctx, repo, clock)
+	payoutRequester := NewPayoutRequester(logger, ctx, repo, clock, calendar)
+	riskControls := NewRiskControls(logger, ctx, repo, clock)
+	ledger := NewLedger(logger, ctx, repo)
+	importJobs := NewImportJobs(logger, ctx, repo, importer)
 	return &DisburserService{
 		logger:       logger,
 		ctx:          ctx,
+		Clock:        clock,
+		Calendar:     calendar,
 		ProcessOrder: orderProcessor,
 		Importer:     importer,
 		Reporter:     reporter,
+		Runner:       runner,
+		FeeSchedules: feeScheduler,
+		Refunds:      refundProcessor,
+		Payouts:      payoutRequester,
+		Risk:         riskControls,
+		Ledger:       ledger,
+		ImportJobs:   importJobs,
 		Repo:         repo,
 	}, nil
 
@@ -56,12 +92,31 @@ func NewReporter(logger *slog.Logger, ctx context.Context, repo repo.DisburserRe
 	}
 }
 
+// Import imports the merchants and orders files. The payout dates of the imported orders are rolled forward to the business days
+// of Calendar.
 type Import struct {
 	Logger            *slog.Logger
 	Ctx               context.Context
 	Repo              *repo.DisburserRepo
 	OrdersFileName    string
 	MerchantsFileName string
+	ChunkSize         int
+	BatchSize         int
+	Calendar          *types.Calendar
+}
+
+// ImportFiles names the merchants and orders files of an import. An empty name stands for the file configured on the Import. Spooled
+// files are uploads written to temporary files, removed once their import job has finished. Incremental imports only take the
+// orders created after the high-water mark of their merchant. The formats of the files are one of the IMPORT_FORMAT constants, or
+// detected from their content when empty. Both files are read in Dialect, the legacy dialect when zero.
+type ImportFiles struct {
+	Merchants       string
+	Orders          string
+	MerchantsFormat string
+	OrdersFormat    string
+	Dialect         Dialect
+	Spooled         bool
+	Incremental     bool
 }
 
 type Order struct {
@@ -69,7 +124,10 @@ type Order struct {
 	MerchantReference string    `json:"merchant_reference,omitempty"`
 	MerchantID        uuid.UUID `json:"merchant_id,omitempty"`
 	Amount            int64     `json:"amount,omitempty"`
+	Currency          string    `json:"currency,omitempty"`
 	CreatedAt         time.Time `json:"created_at,omitempty"`
+	line              int       // line of the order in the imported file, 0 when not read from a file
+	record            string    // record of the order as read from the imported file, for its reject
 	sync.RWMutex
 }
 
@@ -119,17 +177,8 @@ func getOrdersByMerchRef(merchRef string) ([]Order, error) {
 	return []Order{}, nil
 }
 
-func isBeforeCutOffTime() (bool, error) {
-	now := time.Now().UTC()
-	cutOff, err := time.Parse("15:04", types.TIME_CUT_OFF)
-	if err != nil {
-		return false, err
-	}
-	if now.Sub(cutOff) < 0 {
-		return true, nil
-	} else {
-		return false, nil
-	}
+func isBeforeCutOffTime(clock types.Clock) (bool, error) {
+	return types.IsBeforeCutOff(clock.Now())
 }
 
 type Report struct {
@@ -152,15 +201,79 @@ type YearEndSummaryReport struct {
 	AmountOfMonthlyFees int64 `json:"amount_of_monthly_fees" DB:"amount_of_monthly_fees"`
 }
 
+// Runner is the daily disbursement job which closes due disbursement groups and marks them paid. Scheduled runs only happen on the
+// business days of Calendar, and the times the run records are those of Clock.
+type Runner struct {
+	Logger   *slog.Logger
+	Ctx      context.Context
+	Repo     repo.DisburserRepoRepository
+	Provider PayoutProvider
+	Calendar *types.Calendar
+	Clock    types.Clock
+}
+
+// FeeScheduler manages the fee schedules negotiated with merchants.
+type FeeScheduler struct {
+	Logger *slog.Logger
+	Ctx    context.Context
+	Repo   repo.DisburserRepoRepository
+}
+
+// RefundProcessor records refunds of processed orders, dated by Clock.
+type RefundProcessor struct {
+	Logger *slog.Logger
+	Ctx    context.Context
+	Repo   repo.DisburserRepoRepository
+	Clock  types.Clock
+}
+
+// PayoutRequests pays out the accrued balance of ON_DEMAND merchants when they request it, on the business days of Calendar.
+type PayoutRequests struct {
+	Logger   *slog.Logger
+	Ctx      context.Context
+	Repo     repo.DisburserRepoRepository
+	Clock    types.Clock
+	Calendar *types.Calendar
+}
+
+// RiskControls places and lifts payout holds on merchants and sets the part of their payouts held back in reserve.
+type RiskControls struct {
+	Logger *slog.Logger
+	Ctx    context.Context
+	Repo   repo.DisburserRepoRepository
+	Clock  types.Clock
+}
+
+type Ledger struct {
+	Logger *slog.Logger
+	Ctx    context.Context
+	Repo   repo.DisburserRepoRepository
+}
+
+// ImportJobs runs imports in the background one at a time, in the order they were submitted, and records their progress.
+type ImportJobs struct {
+	Logger   *slog.Logger
+	Ctx      context.Context
+	Repo     repo.DisburserRepoRepository
+	Importer Importer
+	queue    chan queuedImport
+	maxBody  int64
+	mu       sync.Mutex
+	cancels  map[uuid.UUID]context.CancelFunc
+}
+
 type OProcessor struct {
 	Order                   *Order
-	disburserRepoRepository *repo.DisburserRepo
+	disburserRepoRepository repo.DisburserRepoRepository
 	logger                  *slog.Logger
 	ctx                     context.Context
+	clock                   types.Clock
+	calendar                *types.Calendar
 }
 
-func NewOrder(id string, merchantReference string, amount int64) *Order {
-	t := time.Now().UTC()
+// NewOrder returns an order received at the current time of clock.
+func NewOrder(clock types.Clock, id string, merchantReference string, amount int64) *Order {
+	t := clock.Now().UTC()
 	return &Order{
 		ID:                id,
 		MerchantReference: merchantReference,
@@ -169,31 +282,30 @@ func NewOrder(id string, merchantReference string, amount int64) *Order {
 	}
 }
 
-func (o *Order) IsBeforeTimeCutOff() (bool, error) {
-	cutoff, err := time.Parse(time.TimeOnly, types.TIME_CUT_OFF)
-	if err != nil {
-		return false, err
-	}
-	now, err := time.Parse(time.TimeOnly, time.Now().UTC().Format(time.TimeOnly))
-	if err != nil {
-		return false, err
-	}
-
-	if now.Before(cutoff) {
-		return true, nil
-	}
-
-	return false, nil
+// IsBeforeTimeCutOff reports whether the order, being processed at the current time of clock, was received before the
+// TIME_CUT_OFF of the day in loc, the merchant's timezone. Imported orders apply the cut-off to their creation time instead, see
+// types.Merchant.CutOffDay.
+func (o *Order) IsBeforeTimeCutOff(clock types.Clock, loc *time.Location) (bool, error) {
+	return types.IsBeforeCutOffIn(clock.Now(), loc)
 }
 
-func (o *Order) CalculateOrderFee() (int64, error) {
+// CalculateOrderFee calculates the order fee under the merchant's fee schedule for the order currency in force when the order was
+// created, so orders placed before a pricing change keep being charged under the old tiers. The schedule used is returned for
+// auditing.
+func (o *Order) CalculateOrderFee(m types.Merchant) (int64, types.FeeSchedule, error) {
 	o.Lock()
-	fee, err := calculateOrderFee(o.Amount)
+	defer o.Unlock()
+	c, err := types.LookupCurrency(o.Currency)
 	if err != nil {
-		return 0, err
+		return 0, types.FeeSchedule{}, err
+	}
+
+	fs := m.FeeScheduleAt(o.CreatedAt, c)
+	fee, err := fs.CalculateFee(types.Money{Amount: o.Amount, Currency: c})
+	if err != nil {
+		return 0, fs, err
 	}
-	o.Unlock()
-	return fee, nil
+	return fee.Amount, fs, nil
 }
 
 func (o *Order) ProcessOrder() error {
@@ -213,27 +325,15 @@ type Disbursement struct {
 	IsPaidOut           bool   `json:"IsPaidOut" DB:"is_paid_out"`
 }
 
+// calculateOrderFee calculates the order fee of an order in the DEFAULT_CURRENCY under the default fee schedule.
 func calculateOrderFee(orderAmt int64) (orderFee int64, err error) {
-	if orderAmt > 0 && orderAmt < 5000 {
-		orderFee = types.RATE_LESS_THAN_50 * orderAmt / 100
-		return orderFee, nil
-	}
-
-	if orderAmt > 5000 && orderAmt < 30000 {
-		orderFee = types.RATE_BETWEEN_50_AND_300 * orderAmt / 100
-		return orderFee, nil
-	}
-
-	if orderAmt > 30000 {
-		orderFee = types.RATE_ABOVE_300 * orderAmt / 1000
-		return orderFee, nil
-	}
-
-	if orderAmt > types.MAX_ORDER {
-		return -1, errors.New("orderamt submitted above max orderamt value permitted")
+	amount, err := types.NewMoney(orderAmt, types.DEFAULT_CURRENCY)
+	if err != nil {
+		return 0, err
 	}
 
-	return orderFee, nil
+	fee, err := types.DefaultFeeSchedule(amount.Currency).CalculateFee(amount)
+	return fee.Amount, err
 }
 
 func getMerchantReferenceFromOrder(o Order) (string, error) {
@@ -13,7 +13,7 @@ import (
 	"time"
 )
 
-func TestMerchant_CalculatePastPayoutDate(t *testing.T) {
+func Test_importedPayoutDate(t *testing.T) {
 	liveOn, err := time.Parse(time.DateOnly, "2022-11-09")
 	orderDate, err := time.Parse(time.DateOnly, "2022-12-08")
 	wantDate, err := time.Parse(time.DateOnly, "2022-12-14")
@@ -48,10 +48,28 @@ func TestMerchant_CalculatePastPayoutDate(t *testing.T) {
 			},
 			args: args{orderDate},
 			want: wantDate},
+		{name: "weekly order before the cut-off on the payout day",
+			fields: fields{
+				Reference:             "deckow_gibson",
+				LiveOn:                liveOn,
+				DisbursementFrequency: "WEEKLY",
+				MinMonthlyFee:         "15.0",
+			},
+			args: args{time.Date(2022, 12, 14, 7, 59, 0, 0, time.UTC)},
+			want: wantDate},
+		{name: "weekly order after the cut-off on the payout day",
+			fields: fields{
+				Reference:             "deckow_gibson",
+				LiveOn:                liveOn,
+				DisbursementFrequency: "WEEKLY",
+				MinMonthlyFee:         "15.0",
+			},
+			args: args{time.Date(2022, 12, 14, 8, 0, 0, 0, time.UTC)},
+			want: wantDate.AddDate(0, 0, 7)},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			m := &types.Merchant{
+			m := types.Merchant{
 				ID:                    tt.fields.ID,
 				Reference:             tt.fields.Reference,
 				Email:                 tt.fields.Email,
@@ -59,8 +77,8 @@ func TestMerchant_CalculatePastPayoutDate(t *testing.T) {
 				DisbursementFrequency: tt.fields.DisbursementFrequency,
 				MinMonthlyFee:         tt.fields.MinMonthlyFee,
 			}
-			if got, _ := m.CalculatePastPayoutDate(tt.args.t); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("CalculatePastPayoutDate() = %v, want %v", got, tt.want)
+			if got, _ := importedPayoutDate(m, tt.args.t); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("importedPayoutDate() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -81,7 +99,12 @@ func TestMerchant_GetMinMonthlyFee(t *testing.T) {
 		want    int64
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{name: "no minimum", fields: fields{Reference: "padberg_group", MinMonthlyFee: "0.0"}, want: 0},
+		{name: "whole euros", fields: fields{Reference: "deckow_gibson", MinMonthlyFee: "30.0"}, want: 3000},
+		{name: "cents", fields: fields{Reference: "deckow_gibson", MinMonthlyFee: "29.99"}, want: 2999},
+		{name: "cents not truncated", fields: fields{Reference: "deckow_gibson", MinMonthlyFee: "0.29"}, want: 29},
+		{name: "sub cent", fields: fields{Reference: "deckow_gibson", MinMonthlyFee: "29.995"}, wantErr: true},
+		{name: "malformed", fields: fields{Reference: "deckow_gibson", MinMonthlyFee: "thirty"}, wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -114,13 +137,22 @@ func TestMerchant_GetMinMonthlyFeeRemaining(t *testing.T) {
 		DisbursementFrequency string
 		MinMonthlyFee         string
 	}
+	type args struct {
+		orderFeeTotal int64
+	}
 	tests := []struct {
 		name    string
 		fields  fields
+		args    args
 		want    int64
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{name: "no minimum", fields: fields{Reference: "padberg_group", MinMonthlyFee: "0.0"}, args: args{orderFeeTotal: 0}, want: 0},
+		{name: "no orders", fields: fields{Reference: "deckow_gibson", MinMonthlyFee: "30.0"}, args: args{orderFeeTotal: 0}, want: 3000},
+		{name: "shortfall", fields: fields{Reference: "deckow_gibson", MinMonthlyFee: "30.0"}, args: args{orderFeeTotal: 2236}, want: 764},
+		{name: "minimum reached", fields: fields{Reference: "deckow_gibson", MinMonthlyFee: "30.0"}, args: args{orderFeeTotal: 3000}, want: 0},
+		{name: "minimum exceeded", fields: fields{Reference: "deckow_gibson", MinMonthlyFee: "30.0"}, args: args{orderFeeTotal: 4512}, want: 0},
+		{name: "malformed", fields: fields{Reference: "deckow_gibson", MinMonthlyFee: ""}, wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -132,7 +164,7 @@ func TestMerchant_GetMinMonthlyFeeRemaining(t *testing.T) {
 				DisbursementFrequency: tt.fields.DisbursementFrequency,
 				MinMonthlyFee:         tt.fields.MinMonthlyFee,
 			}
-			got, err := m.GetMinMonthlyFeeRemaining()
+			got, err := m.GetMinMonthlyFeeRemaining(tt.args.orderFeeTotal)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("GetMinMonthlyFeeRemaining() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -144,6 +176,43 @@ func TestMerchant_GetMinMonthlyFeeRemaining(t *testing.T) {
 	}
 }
 
+func TestMerchant_FeeScheduleAt(t *testing.T) {
+	jan, _ := time.Parse(time.DateOnly, "2023-01-01")
+	mar, _ := time.Parse(time.DateOnly, "2023-03-01")
+	jun, _ := time.Parse(time.DateOnly, "2023-06-01")
+	m := &types.Merchant{
+		Reference: "padberg_group",
+		FeeSchedules: []types.FeeSchedule{
+			{MerchantReference: "padberg_group", Version: 1, EffectiveFrom: jan, EffectiveTo: mar, Tiers: []types.FeeTier{{RateBasisPoints: 200}}},
+			{MerchantReference: "padberg_group", Version: 2, EffectiveFrom: mar, EffectiveTo: jun, Tiers: []types.FeeTier{{RateBasisPoints: 100}}},
+			{MerchantReference: "padberg_group", Currency: "GBP", Version: 3, EffectiveFrom: mar, Tiers: []types.FeeTier{{RateBasisPoints: 300}}},
+		},
+	}
+	tests := []struct {
+		name     string
+		at       time.Time
+		currency string
+		want     int
+	}{
+		{name: "before any schedule uses default", at: jan.Add(-time.Second), want: 0},
+		{name: "start of first window", at: jan, want: 1},
+		{name: "end of first window is exclusive", at: mar, want: 2},
+		{name: "last instant of second window", at: jun.Add(-time.Nanosecond), want: 2},
+		{name: "after closed windows uses default", at: jun, want: 0},
+		{name: "schedule of the order currency", at: jun, currency: "GBP", want: 3},
+		{name: "before the window of the order currency uses default", at: jan, currency: "GBP", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := types.LookupCurrency(tt.currency)
+			got := m.FeeScheduleAt(tt.at, c)
+			if got.Version != tt.want || !types.SameCurrency(got.Currency, c.Code) {
+				t.Errorf("FeeScheduleAt() = %+v, want version %v in %s", got, tt.want, c.Code)
+			}
+		})
+	}
+}
+
 func TestMerchant_GetNextPayoutDate(t *testing.T) {
 	type fields struct {
 		ID                    uuid.UUID
@@ -152,14 +221,25 @@ func TestMerchant_GetNextPayoutDate(t *testing.T) {
 		LiveOn                time.Time
 		DisbursementFrequency string
 		MinMonthlyFee         string
+		Timezone              string
 	}
+	wednesday := time.Date(2022, 11, 9, 0, 0, 0, 0, time.UTC)
 	tests := []struct {
 		name    string
 		fields  fields
+		now     time.Time
 		want    time.Time
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{name: "payout day", fields: fields{LiveOn: wednesday}, now: time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC), want: time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC)},
+		{name: "later the same week", fields: fields{LiveOn: wednesday}, now: time.Date(2023, 1, 30, 7, 0, 0, 0, time.UTC), want: time.Date(2023, 2, 1, 7, 0, 0, 0, time.UTC)},
+		{name: "week wraparound", fields: fields{LiveOn: wednesday}, now: time.Date(2023, 2, 2, 7, 0, 0, 0, time.UTC), want: time.Date(2023, 2, 8, 7, 0, 0, 0, time.UTC)},
+		{name: "month end", fields: fields{LiveOn: wednesday}, now: time.Date(2023, 4, 28, 12, 0, 0, 0, time.UTC), want: time.Date(2023, 5, 3, 12, 0, 0, 0, time.UTC)},
+		{name: "leap day", fields: fields{LiveOn: wednesday}, now: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), want: time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC)},
+		{name: "year end", fields: fields{LiveOn: wednesday}, now: time.Date(2023, 12, 29, 23, 59, 0, 0, time.UTC), want: time.Date(2024, 1, 3, 23, 59, 0, 0, time.UTC)},
+		{name: "payout day in a zone behind UTC", fields: fields{LiveOn: wednesday, Timezone: "America/Mexico_City"}, now: time.Date(2023, 2, 2, 3, 0, 0, 0, time.UTC), want: time.Date(2023, 2, 2, 3, 0, 0, 0, time.UTC)},
+		{name: "day after the payout day in a zone ahead of UTC", fields: fields{LiveOn: wednesday, Timezone: "Europe/Madrid"}, now: time.Date(2023, 2, 1, 23, 30, 0, 0, time.UTC), want: time.Date(2023, 2, 7, 23, 30, 0, 0, time.UTC)},
+		{name: "unknown timezone", fields: fields{LiveOn: wednesday, Timezone: "Europe/Atlantis"}, now: time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC), wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -170,14 +250,15 @@ func TestMerchant_GetNextPayoutDate(t *testing.T) {
 				LiveOn:                tt.fields.LiveOn,
 				DisbursementFrequency: tt.fields.DisbursementFrequency,
 				MinMonthlyFee:         tt.fields.MinMonthlyFee,
+				Timezone:              tt.fields.Timezone,
 			}
-			got, err := m.GetNextPayoutDate()
+			got, err := m.GetNextPayoutDate(types.NewTestClock(tt.now))
 			if (err != nil) != tt.wantErr {
 				t.Errorf("GetNextPayoutDate() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("GetNextPayoutDate() got = %v, want %v", got, tt.want)
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("GetNextPayoutDate() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -263,9 +344,10 @@ func TestMerchant_CalculateWeeklyTotalOrders(t *testing.T) {
 
 func TestNewDisburserService(t *testing.T) {
 	type args struct {
-		logger *slog.Logger
-		ctx    context.Context
-		db     *sqlx.DB
+		logger   *slog.Logger
+		ctx      context.Context
+		db       *sqlx.DB
+		provider PayoutProvider
 	}
 	tests := []struct {
 		name    string
@@ -277,7 +359,7 @@ func TestNewDisburserService(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := NewDisburserService(tt.args.logger, tt.args.ctx, tt.args.db)
+			got, err := NewDisburserService(tt.args.logger, tt.args.ctx, tt.args.db, tt.args.provider, nil, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("NewDisburserService() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -295,16 +377,21 @@ func TestNewOrder(t *testing.T) {
 		merchantReference string
 		amount            int64
 	}
+	now := time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC)
 	tests := []struct {
 		name string
 		args args
 		want *Order
 	}{
-		// TODO: Add test cases.
+		{
+			name: "created at the clock's time",
+			args: args{id: "e653f3e14bc4", merchantReference: "padberg_group", amount: 10229},
+			want: &Order{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: 10229, CreatedAt: now},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := NewOrder(tt.args.id, tt.args.merchantReference, tt.args.amount); !reflect.DeepEqual(got, tt.want) {
+			if got := NewOrder(types.NewTestClock(now), tt.args.id, tt.args.merchantReference, tt.args.amount); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("NewOrder() = %v, want %v", got, tt.want)
 			}
 		})
@@ -339,16 +426,37 @@ func TestOrder_CalculateOrderFee(t *testing.T) {
 		MerchantReference string
 		MerchantID        uuid.UUID
 		Amount            int64
+		Currency          string
 		CreatedAt         time.Time
 		RWMutex           sync.RWMutex
 	}
+	effectiveFrom, _ := time.Parse(time.DateOnly, "2023-01-01")
+	negotiated := types.Merchant{
+		Reference: "padberg_group",
+		FeeSchedules: []types.FeeSchedule{{
+			MerchantReference: "padberg_group",
+			EffectiveFrom:     effectiveFrom,
+			FlatFee:           30,
+			MaxOrder:          5000000,
+			Tiers:             []types.FeeTier{{UpTo: 100000, RateBasisPoints: 200}, {RateBasisPoints: 150}},
+		}},
+	}
 	tests := []struct {
-		name    string
-		fields  fields
-		want    int64
-		wantErr bool
+		name     string
+		fields   fields
+		merchant types.Merchant
+		want     int64
+		wantErr  bool
 	}{
-		// TODO: Add test cases.
+		{name: "default schedule below 50", fields: fields{Amount: 4999}, merchant: types.Merchant{}, want: 499},
+		{name: "default schedule at 50", fields: fields{Amount: 5000}, merchant: types.Merchant{}, want: 250},
+		{name: "default schedule at 300", fields: fields{Amount: 30000}, merchant: types.Merchant{}, want: 750},
+		{name: "default schedule above max order", fields: fields{Amount: types.MAX_ORDER + 1}, merchant: types.Merchant{}, wantErr: true},
+		{name: "negotiated schedule first tier", fields: fields{Amount: 10229, CreatedAt: effectiveFrom}, merchant: negotiated, want: 234},
+		{name: "negotiated schedule last tier", fields: fields{Amount: 2000000, CreatedAt: effectiveFrom.AddDate(0, 1, 0)}, merchant: negotiated, want: 30030},
+		{name: "created before negotiated schedule", fields: fields{Amount: 10229, CreatedAt: effectiveFrom.Add(-time.Second)}, merchant: negotiated, want: 511},
+		{name: "order in another currency than the negotiated schedule", fields: fields{Amount: 10229, Currency: "GBP", CreatedAt: effectiveFrom}, merchant: negotiated, want: 511},
+		{name: "unsupported currency", fields: fields{Amount: 10229, Currency: "XXX"}, merchant: types.Merchant{}, wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -357,10 +465,11 @@ func TestOrder_CalculateOrderFee(t *testing.T) {
 				MerchantReference: tt.fields.MerchantReference,
 				MerchantID:        tt.fields.MerchantID,
 				Amount:            tt.fields.Amount,
+				Currency:          tt.fields.Currency,
 				CreatedAt:         tt.fields.CreatedAt,
 				RWMutex:           tt.fields.RWMutex,
 			}
-			got, err := o.CalculateOrderFee()
+			got, _, err := o.CalculateOrderFee(tt.merchant)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CalculateOrderFee() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -384,10 +493,18 @@ func TestOrder_IsBeforeTimeCutOff(t *testing.T) {
 	tests := []struct {
 		name    string
 		fields  fields
+		now     time.Time
+		loc     *time.Location
 		want    bool
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{name: "midnight", now: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC), want: true},
+		{name: "before the cut-off of a merchant behind UTC", now: time.Date(2023, 2, 1, 13, 0, 0, 0, time.UTC), loc: mustLoadLocation("America/Mexico_City"), want: true},
+		{name: "at the cut-off of a merchant on summer time", now: time.Date(2023, 7, 1, 7, 0, 0, 0, time.UTC), loc: mustLoadLocation("Atlantic/Canary"), want: false},
+		{name: "last instant before the cut-off", now: time.Date(2023, 2, 1, 7, 59, 59, 999999999, time.UTC), want: true},
+		{name: "at the cut-off", now: time.Date(2023, 2, 1, 8, 0, 0, 0, time.UTC), want: false},
+		{name: "before the cut-off in a zone ahead of UTC", now: time.Date(2023, 2, 1, 8, 30, 0, 0, time.FixedZone("CET", 3600)), want: true},
+		{name: "last instant of the year", now: time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC), want: false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -399,7 +516,10 @@ func TestOrder_IsBeforeTimeCutOff(t *testing.T) {
 				CreatedAt:         tt.fields.CreatedAt,
 				RWMutex:           tt.fields.RWMutex,
 			}
-			got, err := o.IsBeforeTimeCutOff()
+			if tt.loc == nil {
+				tt.loc = time.UTC
+			}
+			got, err := o.IsBeforeTimeCutOff(types.NewTestClock(tt.now), tt.loc)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("IsBeforeTimeCutOff() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -490,7 +610,11 @@ func Test_calculateOrderFee(t *testing.T) {
 		wantOrderFee int64
 		wantErr      bool
 	}{
-		// TODO: Add test cases.
+		{name: "less than 50", args: args{orderAmt: 10229 / 3}, wantOrderFee: 340},
+		{name: "between 50 and 300", args: args{orderAmt: 10229}, wantOrderFee: 511},
+		{name: "above 300", args: args{orderAmt: 43321}, wantOrderFee: 1083},
+		{name: "zero amount", args: args{orderAmt: 0}, wantOrderFee: 0},
+		{name: "above max order", args: args{orderAmt: types.MAX_ORDER + 1}, wantOrderFee: -1, wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -585,16 +709,22 @@ func Test_getOrdersByMerchRef(t *testing.T) {
 }
 
 func Test_isBeforeCutOffTime(t *testing.T) {
+	clock := types.NewTestClock(time.Date(2023, 2, 1, 7, 59, 59, 0, time.UTC))
 	tests := []struct {
 		name    string
+		advance time.Duration
 		want    bool
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{name: "a second before the cut-off", want: true},
+		{name: "at the cut-off", advance: time.Second, want: false},
+		{name: "last second of the day", advance: 16*time.Hour - time.Second, want: false},
+		{name: "midnight of the next day", advance: time.Second, want: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := isBeforeCutOffTime()
+			clock.Advance(tt.advance)
+			got, err := isBeforeCutOffTime(clock)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("isBeforeCutOffTime() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -605,3 +735,11 @@ func Test_isBeforeCutOffTime(t *testing.T) {
 		})
 	}
 }
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
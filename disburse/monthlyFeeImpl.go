@@ -0,0 +1,110 @@
+package disburse
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/types"
+	"time"
+)
+
+// closeMonthlyFees returns a Monthly record for every month of the merchant from month up to, but not including, the month of next.
+// The first record carries orderTotal and orderFeeTotal, the order amounts and fees of month; the merchant had no orders in the
+// months after it, so their minimum monthly fee is owed in full.
+func closeMonthlyFees(merchant types.Merchant, month time.Time, next time.Time, orderTotal, orderFeeTotal int64) ([]types.Monthly, error) {
+	minMonthlyFee, err := merchant.GetMinMonthlyFee()
+	if err != nil {
+		return nil, err
+	}
+
+	var monthly []types.Monthly
+	end := types.StartOfMonth(next)
+	for m := types.StartOfMonth(month); m.Before(end); m = m.AddDate(0, 1, 0) {
+		remaining, err := merchant.GetMinMonthlyFeeRemaining(orderFeeTotal)
+		if err != nil {
+			return nil, err
+		}
+
+		didPayFee := 0
+		if remaining > 0 {
+			didPayFee = 1
+		}
+
+		monthly = append(monthly, types.Monthly{
+			ID:                uuid.New(),
+			MerchantReference: merchant.Reference,
+			MerchantID:        merchant.ID,
+			Currency:          types.CurrencyCode(merchant.Currency),
+			MonthlyFeeDate:    m,
+			DidPayFee:         didPayFee,
+			MonthlyFee:        minMonthlyFee,
+			TotalOrderAmt:     orderTotal,
+			OrderFeeTotal:     orderFeeTotal,
+			CreatedAt:         m.AddDate(0, 1, 0),
+			UpdatedAt:         time.Now().UTC(),
+		})
+		orderTotal, orderFeeTotal = 0, 0
+	}
+	return monthly, nil
+}
+
+// deductMonthlyFees deducts the outstanding minimum monthly fees of monthly, oldest first, from a payout of up to payout. The
+// deduction and the disbursement group are recorded on the Monthly records it was taken from and the total deducted is returned.
+// Whatever the payout can not cover stays outstanding for the merchant's next payout.
+func deductMonthlyFees(monthly []types.Monthly, payout int64, groupID uuid.UUID) int64 {
+	var deducted int64
+	for i := range monthly {
+		d := min(monthly[i].FeeOutstanding(), payout-deducted)
+		if d <= 0 {
+			continue
+		}
+		monthly[i].FeeDeducted += d
+		monthly[i].DisbursementGroupID = groupID
+		deducted += d
+	}
+	return deducted
+}
+
+// monthlyFees records the minimum monthly fee of the merchant of the group for every month before the group's payout date not
+// recorded yet, from the month after its latest monthly record, or the month it went live, like the import does with
+// recordedThrough, and returns the merchant's minimum monthly fees still to be deducted. A merchant without a payout in a month
+// still gets the months before it recorded by its next payout. Order fees are counted in the month of their payout date, like the
+// import does, and only those of the orders in the merchant's currency count.
+func (r *Runner) monthlyFees(ctx context.Context, g types.DisbursementGroup) ([]types.Monthly, error) {
+	month := types.StartOfMonth(g.PayoutDate)
+	recordedThrough, err := r.Repo.GetLastMonthlyFeeDate(ctx, g.MerchReference)
+	if err != nil {
+		return nil, err
+	}
+
+	if recordedThrough.Before(month.AddDate(0, -1, 0)) {
+		merch, err := r.Repo.GetMerchantByReferenceID(g.MerchReference)
+		if err != nil {
+			return nil, err
+		}
+
+		first := types.StartOfMonth(merch.LiveOn)
+		if !recordedThrough.IsZero() {
+			first = types.StartOfMonth(recordedThrough).AddDate(0, 1, 0)
+		}
+		for m := first; m.Before(month); m = m.AddDate(0, 1, 0) {
+			orderTotal, orderFeeTotal, err := r.Repo.GetMonthTotals(ctx, g.MerchReference, merch.Currency, m)
+			if err != nil {
+				return nil, err
+			}
+
+			monthly, err := closeMonthlyFees(merch, m, m.AddDate(0, 1, 0), orderTotal, orderFeeTotal)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, mf := range monthly {
+				err = r.Repo.InsertMonthly(mf)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return r.Repo.GetOutstandingMonthlyFees(ctx, g.MerchReference)
+}
@@ -0,0 +1,49 @@
+package disburse
+
+import (
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/types"
+	"testing"
+	"time"
+)
+
+func Test_closeMonthlyFees(t *testing.T) {
+	merchant := types.Merchant{ID: uuid.New(), Reference: "deckow_gibson", DisbursementFrequency: types.WEEKLY, MinMonthlyFee: "30.0"}
+	month, _ := time.Parse(time.DateOnly, "2022-11-09")
+	next, _ := time.Parse(time.DateOnly, "2023-01-04")
+
+	got, err := closeMonthlyFees(merchant, month, next, 14245, 2500)
+	if err != nil {
+		t.Fatalf("closeMonthlyFees() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("closeMonthlyFees() got %d records, want November and December", len(got))
+	}
+
+	nov, dec := got[0], got[1]
+	if nov.MonthlyFeeDate.Format(time.DateOnly) != "2022-11-01" || nov.OrderFeeTotal != 2500 || nov.DidPayFee != 1 || nov.FeeOutstanding() != 500 {
+		t.Errorf("closeMonthlyFees() November = %+v, want a 500 shortfall", nov)
+	}
+	if dec.MonthlyFeeDate.Format(time.DateOnly) != "2022-12-01" || dec.OrderFeeTotal != 0 || dec.FeeOutstanding() != 3000 {
+		t.Errorf("closeMonthlyFees() December = %+v, want the full 3000 minimum for a month without orders", dec)
+	}
+}
+
+func Test_deductMonthlyFees(t *testing.T) {
+	groupID := uuid.New()
+	monthly := []types.Monthly{
+		{ID: uuid.New(), DidPayFee: 1, MonthlyFee: 3000, OrderFeeTotal: 2500},
+		{ID: uuid.New(), DidPayFee: 0, MonthlyFee: 3000, OrderFeeTotal: 4000},
+		{ID: uuid.New(), DidPayFee: 1, MonthlyFee: 3000},
+	}
+
+	if got := deductMonthlyFees(monthly, 1200, groupID); got != 1200 {
+		t.Errorf("deductMonthlyFees() = %d, want the whole 1200 payout", got)
+	}
+	if monthly[0].FeeDeducted != 500 || monthly[1].FeeDeducted != 0 || monthly[2].FeeDeducted != 700 || monthly[2].DisbursementGroupID != groupID {
+		t.Errorf("deductMonthlyFees() records = %+v, want the oldest shortfall deducted first", monthly)
+	}
+	if got := deductMonthlyFees(monthly, 5000, groupID); got != 2300 {
+		t.Errorf("deductMonthlyFees() = %d, want the 2300 still outstanding", got)
+	}
+}
@@ -2,19 +2,25 @@ package disburse
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/levtk/sequra/repo"
 	"github.com/levtk/sequra/types"
 	"log/slog"
+	"net/http"
 	"time"
 )
 
-func NewOrderProcessor(l *slog.Logger, ctx context.Context, disburserRepo *repo.DisburserRepo) *OProcessor {
+func NewOrderProcessor(l *slog.Logger, ctx context.Context, disburserRepo *repo.DisburserRepo, clock types.Clock, calendar *types.Calendar) *OProcessor {
 	op := &OProcessor{
 		logger:                  l,
 		ctx:                     ctx,
 		disburserRepoRepository: disburserRepo,
+		clock:                   clock,
+		calendar:                calendar,
 		Order:                   nil,
 	}
 	return op
@@ -23,113 +29,326 @@ func NewOrderProcessor(l *slog.Logger, ctx context.Context, disburserRepo *repo.
 // ProcessOrder processes an order by performing calculations on fees, order cutoff time, and disbursement frequencies. It then
 // // inserts the resulting disbursement object into the disbursement table. This does not include disbursing payments which is another process.
 func (op *OProcessor) ProcessOrder(logger *slog.Logger, ctx context.Context, disburserRepo repo.DisburserRepoRepository, o *Order) error {
-	op.Order = o
-	of, err := op.Order.CalculateOrderFee()
+	disbursement, err := op.orderDisbursement(logger, ctx, disburserRepo, o)
 	if err != nil {
 		return err
 	}
 
-	ok, err := op.Order.IsBeforeTimeCutOff()
-	if ok && err == nil {
-		o.Lock()
-		merch, err := disburserRepo.GetMerchantByReferenceID(o.MerchantReference)
-		o.Unlock()
-		if err != nil {
-			logger.Error("failed to get merchant by reference id", "error", err.Error())
-			return err
-		}
-		o.Lock()
-		disbursement, err := buildDisbursement(logger, ctx, disburserRepo, o, merch, of)
-		o.Unlock()
-		if err != nil {
-			logger.Error("could not build disbursement", "error", err.Error())
-			return err
-		}
-
-		_, err = disburserRepo.InsertDisbursement(disbursement)
-		if err != nil {
-			logger.Error("failed to insert disbursement", "error", err.Error())
-			return err
-		}
+	_, err = disburserRepo.InsertDisbursement(disbursement)
+	if err != nil {
+		logger.Error("failed to insert disbursement", "error", err.Error())
+		return err
 	}
 	return nil
 }
 
-// buildDisbursement contains the logic to determine if the order is before the cutoff time and whether the merchant is disbursed daily or weekly. It then
-// builds the Disbursement struct filling the required fields.
-func buildDisbursement(logger *slog.Logger, ctx context.Context, disburserRepo repo.DisburserRepoRepository, o *Order, merch types.Merchant, orderFee int64) (types.Disbursement, error) {
-	disbursementID := uuid.New()
-	var pd time.Time
-	var payoutDate time.Time
-	disbursementFreq := merch.DisbursementFrequency
-	switch disbursementFreq {
-	case types.DAILY:
-		ok, err := o.IsBeforeTimeCutOff()
-		if ok && err == nil {
-			pd = time.Now().UTC()
-		}
-		if !ok && err == nil {
-			pd = pd.AddDate(0, 0, 1)
-		}
-		payoutDate = pd
+// orderDisbursement builds the disbursement record of the order without storing it.
+func (op *OProcessor) orderDisbursement(logger *slog.Logger, ctx context.Context, disburserRepo repo.DisburserRepoRepository, o *Order) (types.Disbursement, error) {
+	op.Order = o
+	o.Lock()
+	merch, err := disburserRepo.GetMerchantByReferenceID(o.MerchantReference)
+	if err == nil && o.Currency == "" {
+		o.Currency = types.CurrencyCode(merch.Currency)
+	}
+	o.Unlock()
+	if err != nil {
+		logger.Error("failed to get merchant by reference id", "error", err.Error())
+		return types.Disbursement{}, err
+	}
 
-	case types.WEEKLY:
-		pd, err := merch.GetNextPayoutDate()
-		if err != nil {
-			return types.Disbursement{}, err
-		}
-		payoutDate = pd
+	of, fs, err := op.Order.CalculateOrderFee(merch)
+	if err != nil {
+		return types.Disbursement{}, err
+	}
+	o.Lock()
+	disbursement, err := buildDisbursement(logger, ctx, disburserRepo, op.clock, op.calendar, o, merch, of, fs)
+	o.Unlock()
+	if err != nil {
+		logger.Error("could not build disbursement", "error", err.Error())
+	}
+	return disbursement, err
+}
 
-	default:
-		return types.Disbursement{}, errors.New("merchants disbursement frequency is not supported")
+// buildDisbursement contains the logic to determine if the order is before the cutoff time and the payout date of the merchant's
+// PayoutFrequency. It then builds the Disbursement struct filling the required fields. The cutoff and payout date are evaluated at
+// the current time of clock in the merchant's timezone, the same way imported orders are dated by their creation time, see
+// orderPayoutDate, and the payout date is rolled forward to a business day of calendar. The orders of merchants paid out on request
+// join the group accruing their balance and are only given a rolled payout date once the merchant requests the payout. Orders join
+// the group of their currency.
+func buildDisbursement(logger *slog.Logger, ctx context.Context, disburserRepo repo.DisburserRepoRepository, clock types.Clock, calendar *types.Calendar, o *Order, merch types.Merchant, orderFee int64, fs types.FeeSchedule) (types.Disbursement, error) {
+	disbursementID := uuid.New()
+	freq, err := NewPayoutFrequency(merch.DisbursementFrequency)
+	if err != nil {
+		return types.Disbursement{}, err
+	}
+
+	payoutDate, err := orderPayoutDate(merch, freq, clock.Now())
+	if err != nil {
+		return types.Disbursement{}, err
 	}
 
 	var disbursementGroupID uuid.UUID
-	disbGrpID, err := disburserRepo.GetDisbursementGroupID(ctx, payoutDate, merch.Reference)
-	if err == nil {
-		disbursementGroupID = disbGrpID
+	var disbGrpID uuid.UUID
+	currency := types.CurrencyCode(o.Currency)
+	if freq.OnRequest() {
+		disbGrpID, err = disburserRepo.GetOnRequestGroupID(ctx, merch.Reference, currency)
 	} else {
+		disbGrpID, err = disburserRepo.GetDisbursementGroupID(ctx, payoutDate, merch.Reference, currency)
+	}
+	switch {
+	case err == nil:
+		disbursementGroupID = disbGrpID
+	case errors.Is(err, sql.ErrNoRows): // first order of this payout period opens a new group
+		disbursementGroupID = uuid.New()
+		err = nil
+	default:
 		logger.Error("could not get disbursement group id or create it from disburserRepoRepository", "error", err.Error())
 		return types.Disbursement{}, err
 	}
 
+	rolledPayoutDate := calendar.RollForward(payoutDate)
+	if freq.OnRequest() {
+		rolledPayoutDate = time.Time{}
+	} else {
+		warnPastCalendar(logger, calendar, rolledPayoutDate)
+	}
+
 	return types.Disbursement{
 		RecordUUID:           disbursementID,
 		DisbursementGroupID:  disbursementGroupID,
 		MerchReference:       merch.Reference,
 		OrderID:              o.ID,
+		OrderAmount:          o.Amount,
+		Currency:             currency,
 		OrderFee:             orderFee,
+		FeeScheduleID:        fs.ID,
+		FeeScheduleVersion:   fs.Version,
 		OrderFeeRunningTotal: 0,
 		PayoutDate:           payoutDate,
+		RolledPayoutDate:     rolledPayoutDate,
 		IsPaidOut:            false,
+		OnRequest:            freq.OnRequest(),
 	}, err
 }
 
+// warnPastCalendar logs a warning when day is after the last year the holidays of calendar are known for: the day was rolled
+// forward over weekends only and may still be a holiday, so the holidays file needs the holidays of its year.
+func warnPastCalendar(logger *slog.Logger, calendar *types.Calendar, day time.Time) {
+	if calendar.Covers(day) {
+		return
+	}
+	logger.Warn("payout date past the holidays of the payout calendar, it may fall on a holiday", "calendar", calendar.Name,
+		"payout_date", day.Format(time.DateOnly), "holidays_through", calendar.Through)
+}
+
+// ProcessBatchDistributions stores the disbursement records with bulk inserts in a single transaction, so either all of them are
+// stored or none are.
 func (op *OProcessor) ProcessBatchDistributions(disbursements []types.Disbursement) error {
-	for i := 0; i < len(disbursements); i++ {
-		if disbursements[i].RecordUUID.String() == "" {
+	tx, err := op.disburserRepoRepository.BeginBulk(op.ctx, types.IMPORT_BATCH_SIZE)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	batch := make([]types.Disbursement, 0, len(disbursements))
+	for _, d := range disbursements {
+		if d.RecordUUID == uuid.Nil {
 			continue
 		}
+		batch = append(batch, d)
+	}
 
-		_, err := op.disburserRepoRepository.InsertDisbursement(disbursements[i])
-		if err != nil {
-			op.logger.Error("error inserting disbursement record", "error", err.Error())
-			return err
-		}
+	err = tx.InsertDisbursements(batch)
+	if err != nil {
+		op.logger.Error("error inserting disbursement records", "error", err.Error())
+		return err
 	}
-	return nil
+	return tx.Commit()
 }
 
+// ProcessBatchMonthly stores the monthly records with bulk inserts in a single transaction, so either all of them are stored or
+// none are.
 func (op *OProcessor) ProcessBatchMonthly(monthly []types.Monthly) error {
-	for i := 0; i < len(monthly); i++ {
-		if monthly[i].MerchantReference == "" {
+	tx, err := op.disburserRepoRepository.BeginBulk(op.ctx, types.IMPORT_BATCH_SIZE)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	batch := make([]types.Monthly, 0, len(monthly))
+	for _, m := range monthly {
+		if m.MerchantReference == "" {
 			continue
 		}
+		batch = append(batch, m)
+	}
+
+	err = tx.InsertMonthly(batch)
+	if err != nil {
+		op.logger.Error("failed to insert monthly records", "error", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// orderRequest is the JSON body accepted by PostOrder. Amount is the decimal order amount as sent by checkout, e.g. "102.29",
+// in Currency, the ISO 4217 code of the order currency, which is the merchant's currency when omitted. The amount is parsed exactly
+// and can not have more decimals than the currency. CreatedAt accepts either an RFC3339 timestamp or a YYYY-MM-DD date. When
+// CreatedAt is omitted the time of receipt is used.
+//
+// The payout date of a posted order is derived from the time of receipt, so CreatedAt must lie within maxCreatedAtSkew of it. An
+// order created earlier than that belongs to a payout period that may already be paid out and is sent through the import instead.
+type orderRequest struct {
+	ID                string      `json:"id"`
+	MerchantReference string      `json:"merchant_reference"`
+	Amount            json.Number `json:"amount"`
+	Currency          string      `json:"currency,omitempty"`
+	CreatedAt         string      `json:"created_at,omitempty"`
+}
+
+// maxCreatedAtSkew is how far the created_at of a posted order may be from the time of receipt. It is a day either way so that a
+// YYYY-MM-DD date, which is midnight UTC, is accepted all day in every timezone.
+const maxCreatedAtSkew = 24 * time.Hour
+
+// newOrderFromRequest validates the order request and converts it into an Order ready to be persisted and processed, received at
+// the current time of clock unless the request says when it was created. An order without a currency is in merchantCurrency.
+func newOrderFromRequest(clock types.Clock, req orderRequest, merchantCurrency string) (*Order, error) {
+	if req.ID == "" {
+		return nil, errors.New("id is required")
+	}
+
+	if len(req.ID) > 12 {
+		return nil, fmt.Errorf("id %s exceeds 12 characters", req.ID)
+	}
+
+	if req.MerchantReference == "" {
+		return nil, errors.New("merchant_reference is required")
+	}
 
-		err := op.disburserRepoRepository.InsertMonthly(monthly[i])
+	currency, err := parseCurrency(req.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if currency == "" {
+		currency = types.CurrencyCode(merchantCurrency)
+	}
+
+	amount, err := types.ParseMoney(req.Amount.String(), currency)
+	if errors.Is(err, types.ErrAmountPrecision) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount %q", req.Amount)
+	}
+
+	if amount.Amount <= 0 {
+		return nil, errors.New("amount must be greater than zero")
+	}
+
+	o := NewOrder(clock, req.ID, req.MerchantReference, amount.Amount)
+	o.Currency = currency
+	if req.CreatedAt != "" {
+		createdAt, err := time.Parse(time.RFC3339, req.CreatedAt)
 		if err != nil {
-			op.logger.Error("failed to insert monthly record", "error", err)
+			createdAt, err = time.Parse(time.DateOnly, req.CreatedAt)
+			if err != nil {
+				return nil, fmt.Errorf("invalid created_at %q", req.CreatedAt)
+			}
+		}
+		if skew := createdAt.Sub(clock.Now()).Abs(); skew > maxCreatedAtSkew {
+			return nil, fmt.Errorf("created_at %q is more than %s from the time of receipt, older orders are imported", req.CreatedAt,
+				maxCreatedAtSkew)
 		}
+		o.CreatedAt = createdAt.UTC()
 	}
-	return nil
+
+	return o, nil
+}
+
+// PostOrder is the real-time ingestion endpoint for checkout. It validates the JSON order and persists it to the orders table
+// together with its disbursement record in one transaction, so the disbursement record exists as soon as the request returns. An
+// order whose id is already stored is answered with 200 and the stored order when it is the same order, and with 409 otherwise.
+func (op *OProcessor) PostOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req orderRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		op.logger.Error("failed to decode order request", "error", err)
+		http.Error(w, "malformed order", http.StatusBadRequest)
+		return
+	}
+
+	if req.MerchantReference == "" {
+		http.Error(w, "merchant_reference is required", http.StatusBadRequest)
+		return
+	}
+
+	// the merchant is needed before the amount is parsed, an order without a currency is in the merchant's currency
+	merch, err := op.disburserRepoRepository.GetMerchantByReferenceID(req.MerchantReference)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, fmt.Sprintf("unknown merchant %s", req.MerchantReference), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		op.logger.Error("failed to get merchant by reference id", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	o, err := newOrderFromRequest(op.clock, req, merch.Currency)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	o.MerchantID = merch.ID
+
+	_, _, err = o.CalculateOrderFee(merch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	order := types.Order{
+		ID:                o.ID,
+		MerchantReference: o.MerchantReference,
+		MerchantID:        o.MerchantID,
+		Amount:            o.Amount,
+		Currency:          o.Currency,
+		CreatedAt:         o.CreatedAt,
+	}
+
+	disbursement, err := op.orderDisbursement(op.logger, r.Context(), op.disburserRepoRepository, o)
+	if err != nil {
+		op.logger.Error("failed to process order", "order", o.ID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	stored, err := op.disburserRepoRepository.RecordOrder(r.Context(), order, disbursement)
+	if errors.Is(err, repo.ErrOrderExists) {
+		// a retried order is answered with the stored order, a different order with a taken id is a conflict. An order sent without
+		// created_at is received at a new time on every retry, so only the creation time it was sent with is compared.
+		received := order
+		received.CreatedAt = received.CreatedAt.Truncate(time.Second)
+		if req.CreatedAt == "" {
+			received.CreatedAt = stored.CreatedAt
+		}
+		if !sameOrder(stored, received) {
+			http.Error(w, fmt.Sprintf("order %s already exists", o.ID), http.StatusConflict)
+			return
+		}
+		writeJSON(w, op.logger, http.StatusOK, stored)
+		return
+	}
+	if err != nil {
+		op.logger.Error("failed to record order", "order", o.ID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, op.logger, http.StatusCreated, order)
 }
@@ -0,0 +1,221 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newOrderFromRequest(t *testing.T) {
+	created, _ := time.Parse(time.DateOnly, "2023-02-01")
+	tests := []struct {
+		name          string
+		req           orderRequest
+		currency      string
+		wantAmount    int64
+		wantCurrency  string
+		wantCreatedAt time.Time
+		wantErr       bool
+	}{
+		{name: "success date only", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("102.29"), CreatedAt: "2023-02-01"}, wantAmount: 10229, wantCreatedAt: created},
+		{name: "success timestamp", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("102.29"), CreatedAt: "2023-02-01T00:00:00Z"}, wantAmount: 10229, wantCreatedAt: created},
+		{name: "exact cents", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("29.99"), CreatedAt: "2023-02-01"}, wantAmount: 2999, wantCreatedAt: created},
+		{name: "trailing zeros", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("0.100"), CreatedAt: "2023-02-01"}, wantAmount: 10, wantCreatedAt: created},
+		{name: "merchant currency", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("10.25"), CreatedAt: "2023-02-01"}, currency: "GBP", wantAmount: 1025, wantCurrency: "GBP", wantCreatedAt: created},
+		{name: "order currency", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("10.25"), Currency: "CHF", CreatedAt: "2023-02-01"}, currency: "GBP", wantAmount: 1025, wantCurrency: "CHF", wantCreatedAt: created},
+		{name: "unknown merchant currency", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("10.25")}, currency: "XXX", wantErr: true},
+		{name: "sub cent amount", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("102.295")}, wantErr: true},
+		{name: "exponent amount", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("1e2")}, wantErr: true},
+		{name: "missing id", req: orderRequest{MerchantReference: "padberg_group", Amount: json.Number("102.29")}, wantErr: true},
+		{name: "id too long", req: orderRequest{ID: "e653f3e14bc4ff", MerchantReference: "padberg_group", Amount: json.Number("102.29")}, wantErr: true},
+		{name: "missing merchant reference", req: orderRequest{ID: "e653f3e14bc4", Amount: json.Number("102.29")}, wantErr: true},
+		{name: "zero amount", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("0")}, wantErr: true},
+		{name: "negative amount", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("-10.00")}, wantErr: true},
+		{name: "malformed created_at", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("102.29"), CreatedAt: "01/02/2023"}, wantErr: true},
+		{name: "created_at too old", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("102.29"), CreatedAt: "2023-01-31T09:59:59Z"}, wantErr: true},
+		{name: "created_at in the future", req: orderRequest{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: json.Number("102.29"), CreatedAt: "2023-02-02T10:00:01Z"}, wantErr: true},
+	}
+	clock := types.NewTestClock(time.Date(2023, 2, 1, 10, 0, 0, 0, time.UTC))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newOrderFromRequest(clock, tt.req, tt.currency)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newOrderFromRequest() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Amount != tt.wantAmount {
+				t.Errorf("newOrderFromRequest() amount = %v, want %v", got.Amount, tt.wantAmount)
+			}
+			if tt.wantCurrency != "" && got.Currency != tt.wantCurrency {
+				t.Errorf("newOrderFromRequest() currency = %v, want %v", got.Currency, tt.wantCurrency)
+			}
+			if !got.CreatedAt.Equal(tt.wantCreatedAt) {
+				t.Errorf("newOrderFromRequest() created_at = %v, want %v", got.CreatedAt, tt.wantCreatedAt)
+			}
+		})
+	}
+}
+
+// groupRepo has no open disbursement groups, so every disbursement opens a new one.
+type groupRepo struct {
+	repo.DisburserRepoRepository
+}
+
+func (groupRepo) GetDisbursementGroupID(ctx context.Context, today time.Time, merchRef, currency string) (uuid.UUID, error) {
+	return uuid.UUID{}, sql.ErrNoRows
+}
+
+func (groupRepo) GetOnRequestGroupID(ctx context.Context, merchRef, currency string) (uuid.UUID, error) {
+	return uuid.UUID{}, sql.ErrNoRows
+}
+
+func Test_buildDisbursement(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	daily := types.Merchant{Reference: "padberg_group", DisbursementFrequency: types.DAILY}
+	weekly := types.Merchant{Reference: "rosenbaum_parisian", LiveOn: time.Date(2022, 11, 9, 0, 0, 0, 0, time.UTC), DisbursementFrequency: types.WEEKLY}
+	canary := types.Merchant{Reference: "padberg_group", DisbursementFrequency: types.DAILY, Timezone: "Atlantic/Canary"}
+	mexico := types.Merchant{Reference: "padberg_group", DisbursementFrequency: types.DAILY, Timezone: "America/Mexico_City"}
+	mexicoWeekly := types.Merchant{Reference: "rosenbaum_parisian", LiveOn: time.Date(2022, 11, 9, 0, 0, 0, 0, time.UTC), DisbursementFrequency: types.WEEKLY, Timezone: "America/Mexico_City"}
+	biweekly := types.Merchant{Reference: "rosenbaum_parisian", LiveOn: time.Date(2022, 11, 9, 0, 0, 0, 0, time.UTC), DisbursementFrequency: types.BIWEEKLY}
+	monthly := types.Merchant{Reference: "rosenbaum_parisian", LiveOn: time.Date(2022, 11, 9, 0, 0, 0, 0, time.UTC), DisbursementFrequency: types.MONTHLY, PayoutDay: 31}
+	onDemand := types.Merchant{Reference: "rosenbaum_parisian", LiveOn: time.Date(2022, 11, 9, 0, 0, 0, 0, time.UTC), DisbursementFrequency: types.ON_DEMAND}
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	calendar := types.NewCalendar("TARGET2")
+	calendar.AddHoliday(day(2024, 1, 1), "New Year's Day")
+	tests := []struct {
+		name       string
+		merchant   types.Merchant
+		now        time.Time
+		want       time.Time
+		wantRolled time.Time
+		onRequest  bool
+		wantErr    bool
+	}{
+		{name: "daily before the cut-off", merchant: daily, now: time.Date(2023, 2, 1, 7, 59, 59, 0, time.UTC), want: day(2023, 2, 1)},
+		{name: "daily at the cut-off", merchant: daily, now: time.Date(2023, 2, 1, 8, 0, 0, 0, time.UTC), want: day(2023, 2, 2)},
+		{name: "daily after the cut-off at the month end", merchant: daily, now: time.Date(2023, 2, 28, 9, 0, 0, 0, time.UTC), want: day(2023, 3, 1)},
+		{name: "daily after the cut-off at the year end", merchant: daily, now: time.Date(2023, 12, 31, 9, 0, 0, 0, time.UTC), want: day(2024, 1, 1), wantRolled: day(2024, 1, 2)},
+		{name: "daily after the cut-off on a friday", merchant: daily, now: time.Date(2023, 2, 3, 9, 0, 0, 0, time.UTC), want: day(2023, 2, 4), wantRolled: day(2023, 2, 6)},
+		{name: "weekly before the cut-off on the payout day", merchant: weekly, now: time.Date(2023, 2, 1, 7, 0, 0, 0, time.UTC), want: day(2023, 2, 1)},
+		{name: "weekly after the cut-off on the payout day", merchant: weekly, now: time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC), want: day(2023, 2, 8)},
+		{name: "weekly week wraparound", merchant: weekly, now: time.Date(2023, 2, 4, 9, 0, 0, 0, time.UTC), want: day(2023, 2, 8)},
+		{name: "weekly at the year end", merchant: weekly, now: time.Date(2023, 12, 28, 9, 0, 0, 0, time.UTC), want: day(2024, 1, 3)},
+		{name: "daily after the local cut-off on summer time", merchant: canary, now: time.Date(2023, 7, 5, 7, 30, 0, 0, time.UTC), want: day(2023, 7, 6)},
+		{name: "daily before the local cut-off behind UTC", merchant: mexico, now: time.Date(2023, 2, 1, 13, 0, 0, 0, time.UTC), want: day(2023, 2, 1)},
+		{name: "weekly before the local cut-off on the payout day behind UTC", merchant: mexicoWeekly, now: time.Date(2023, 2, 1, 13, 0, 0, 0, time.UTC), want: day(2023, 2, 1)},
+		{name: "weekly after the local cut-off on the payout day behind UTC", merchant: mexicoWeekly, now: time.Date(2023, 2, 2, 3, 0, 0, 0, time.UTC), want: day(2023, 2, 8)},
+		{name: "biweekly in the off week", merchant: biweekly, now: time.Date(2023, 2, 8, 7, 0, 0, 0, time.UTC), want: day(2023, 2, 15)},
+		{name: "biweekly after the cut-off on the payout day", merchant: biweekly, now: time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC), want: day(2023, 2, 15)},
+		{name: "monthly clamped to the month end", merchant: monthly, now: time.Date(2023, 4, 12, 9, 0, 0, 0, time.UTC), want: day(2023, 4, 30), wantRolled: day(2023, 5, 1)},
+		{name: "monthly after the cut-off on the payout day", merchant: monthly, now: time.Date(2023, 1, 31, 9, 0, 0, 0, time.UTC), want: day(2023, 2, 28)},
+		{name: "on demand", merchant: onDemand, now: time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC), want: day(2023, 2, 2), onRequest: true},
+		{name: "unknown timezone", merchant: types.Merchant{DisbursementFrequency: types.DAILY, Timezone: "Mars/Olympus_Mons"}, now: day(2023, 2, 1), wantErr: true},
+		{name: "unsupported frequency", merchant: types.Merchant{DisbursementFrequency: "HOURLY"}, now: day(2023, 2, 1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := types.NewTestClock(tt.now)
+			o := NewOrder(clock, "e653f3e14bc4", tt.merchant.Reference, 10229)
+			got, err := buildDisbursement(logger, context.Background(), groupRepo{}, clock, calendar, o, tt.merchant, 100, types.DefaultFeeSchedule(types.Currency{Code: "EUR", Exponent: 2}))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildDisbursement() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.PayoutDate.Equal(tt.want) {
+				t.Errorf("buildDisbursement() payout date = %v, want %v", got.PayoutDate, tt.want)
+			}
+			if tt.wantRolled.IsZero() && !tt.onRequest {
+				tt.wantRolled = tt.want
+			}
+			if !tt.wantErr && got.OnRequest != tt.onRequest {
+				t.Errorf("buildDisbursement() on request = %v, want %v", got.OnRequest, tt.onRequest)
+			}
+			if !tt.wantErr && !got.RolledPayoutDate.Equal(tt.wantRolled) {
+				t.Errorf("buildDisbursement() rolled payout date = %v, want %v", got.RolledPayoutDate, tt.wantRolled)
+			}
+
+			// an order created at the time it was posted is dated the same when it is imported
+			imported, err := importedPayoutDate(tt.merchant, tt.now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("importedPayoutDate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !imported.Equal(got.PayoutDate) {
+				t.Errorf("importedPayoutDate() = %v, want %v as for the order posted", imported, got.PayoutDate)
+			}
+		})
+	}
+}
+
+// orderRepo stores the orders recorded through PostOrder with their disbursement records.
+type orderRepo struct {
+	groupRepo
+	merchant      types.Merchant
+	orders        map[string]types.Order
+	disbursements map[string]types.Disbursement
+}
+
+func (r *orderRepo) GetMerchantByReferenceID(merchantReferenceID string) (types.Merchant, error) {
+	if merchantReferenceID != r.merchant.Reference {
+		return types.Merchant{}, sql.ErrNoRows
+	}
+	return r.merchant, nil
+}
+
+func (r *orderRepo) RecordOrder(ctx context.Context, o types.Order, d types.Disbursement) (types.Order, error) {
+	if stored, ok := r.orders[o.ID]; ok {
+		return stored, repo.ErrOrderExists
+	}
+	r.orders[o.ID] = o
+	r.disbursements[o.ID] = d
+	return o, nil
+}
+
+func TestOProcessor_PostOrder(t *testing.T) {
+	merchant := types.Merchant{ID: uuid.New(), Reference: "padberg_group", DisbursementFrequency: types.DAILY, Currency: "EUR"}
+	r := &orderRepo{merchant: merchant, orders: map[string]types.Order{}, disbursements: map[string]types.Disbursement{}}
+	op := &OProcessor{disburserRepoRepository: r, logger: slog.New(slog.NewTextHandler(io.Discard, nil)), ctx: context.Background(),
+		clock: types.NewTestClock(time.Date(2023, 2, 1, 7, 0, 0, 0, time.UTC)), calendar: types.NewCalendar("TARGET2")}
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{name: "new order", body: `{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":"102.29","created_at":"2023-02-01T07:15:00Z"}`, wantCode: http.StatusCreated},
+		{name: "same order again", body: `{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":"102.29","created_at":"2023-02-01T07:15:00Z"}`, wantCode: http.StatusOK},
+		{name: "same order without created_at", body: `{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":"102.290"}`, wantCode: http.StatusOK},
+		{name: "different amount", body: `{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":"10.29","created_at":"2023-02-01T07:15:00Z"}`, wantCode: http.StatusConflict},
+		{name: "different created_at", body: `{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":"102.29","created_at":"2023-02-02"}`, wantCode: http.StatusConflict},
+		{name: "unknown merchant", body: `{"id":"a1b2c3d4e5f6","merchant_reference":"unknown","amount":"102.29"}`, wantCode: http.StatusUnprocessableEntity},
+		{name: "invalid amount", body: `{"id":"a1b2c3d4e5f6","merchant_reference":"padberg_group","amount":"-1"}`, wantCode: http.StatusBadRequest},
+		{name: "stale created_at", body: `{"id":"a1b2c3d4e5f6","merchant_reference":"padberg_group","amount":"102.29","created_at":"2023-01-01"}`, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			op.PostOrder(rec, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantCode {
+				t.Errorf("PostOrder() code = %v, want %v: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+		})
+	}
+	if len(r.orders) != 1 || len(r.disbursements) != 1 {
+		t.Fatalf("PostOrder() stored %d orders and %d disbursements, want 1 of each", len(r.orders), len(r.disbursements))
+	}
+	if d := r.disbursements["e653f3e14bc4"]; d.OrderAmount != 10229 || d.MerchReference != merchant.Reference {
+		t.Errorf("PostOrder() disbursement = %+v, want the order of 102.29 of %s", d, merchant.Reference)
+	}
+}
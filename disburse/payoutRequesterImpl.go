@@ -0,0 +1,127 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"log/slog"
+	"net/http"
+)
+
+var errNothingAccrued = errors.New("no accrued balance")
+
+func NewPayoutRequester(logger *slog.Logger, ctx context.Context, repo repo.DisburserRepoRepository, clock types.Clock, calendar *types.Calendar) *PayoutRequests {
+	return &PayoutRequests{
+		Logger:   logger,
+		Ctx:      ctx,
+		Repo:     repo,
+		Clock:    clock,
+		Calendar: calendar,
+	}
+}
+
+// RequestPayout requests the payout of the balance an ON_DEMAND merchant has accrued in currency, the merchant's currency when
+// empty. The group the orders in currency received so far accrued in becomes due and is paid out like any other group by the
+// disbursement run on the business day of the request, or of the next day when it is made after the TIME_CUT_OFF in the merchant's
+// timezone, with the refunds of its orders taken off. Orders received afterwards accrue in a new group towards the next request.
+func (pr *PayoutRequests) RequestPayout(ctx context.Context, merchRef, currency string) (types.DisbursementGroup, error) {
+	if merchRef == "" {
+		return types.DisbursementGroup{}, fmt.Errorf("%w: merchant_reference is required", errInvalidRequest)
+	}
+
+	currency, err := parseCurrency(currency)
+	if err != nil {
+		return types.DisbursementGroup{}, fmt.Errorf("%w: %w", errInvalidRequest, err)
+	}
+
+	merch, err := pr.Repo.GetMerchantByReferenceID(merchRef)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.DisbursementGroup{}, fmt.Errorf("%w %s", errUnknownMerchant, merchRef)
+	}
+	if err != nil {
+		return types.DisbursementGroup{}, err
+	}
+	if currency == "" {
+		currency = types.CurrencyCode(merch.Currency)
+	}
+
+	freq, err := NewPayoutFrequency(merch.DisbursementFrequency)
+	if err != nil {
+		return types.DisbursementGroup{}, err
+	}
+	if !freq.OnRequest() {
+		return types.DisbursementGroup{}, fmt.Errorf("%w: merchant %s is paid out %s, not on request", errInvalidRequest, merchRef,
+			merch.DisbursementFrequency)
+	}
+
+	loc, err := merch.Location()
+	if err != nil {
+		return types.DisbursementGroup{}, err
+	}
+
+	day := types.DayIn(pr.Clock.Now(), loc)
+	ok, err := types.IsBeforeCutOffIn(pr.Clock.Now(), loc)
+	if err != nil {
+		return types.DisbursementGroup{}, err
+	}
+	if !ok {
+		day = day.AddDate(0, 0, 1)
+	}
+
+	day = pr.Calendar.RollForward(day)
+	warnPastCalendar(pr.Logger, pr.Calendar, day)
+
+	g, err := pr.Repo.RequestPayout(ctx, merchRef, currency, day)
+	if errors.Is(err, sql.ErrNoRows) {
+		return g, fmt.Errorf("%w: merchant %s has no orders in %s waiting to be paid out", errNothingAccrued, merchRef, currency)
+	}
+	if err != nil {
+		return g, err
+	}
+
+	pr.Logger.Info("payout requested", "merchant", merchRef, "currency", currency, "disbursement_group_id", g.ID, "number_of_orders", g.NumberOfOrders,
+		"rolled_payout_date", g.RolledPayoutDate)
+	return g, nil
+}
+
+// payoutRequest is the JSON body accepted by Payouts. Currency is the ISO 4217 code of the balance to pay out, the merchant's
+// currency when omitted.
+type payoutRequest struct {
+	MerchantReference string `json:"merchant_reference"`
+	Currency          string `json:"currency,omitempty"`
+}
+
+// Payouts requests the payout of the accrued balance of the merchant in the JSON body on POST, one currency per request.
+func (pr *PayoutRequests) Payouts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req payoutRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		pr.Logger.Error("failed to decode payout request", "error", err)
+		http.Error(w, "malformed payout request", http.StatusBadRequest)
+		return
+	}
+
+	g, err := pr.RequestPayout(r.Context(), req.MerchantReference, req.Currency)
+	switch {
+	case errors.Is(err, errUnknownMerchant):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errInvalidRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errNothingAccrued):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		pr.Logger.Error("failed to request payout", "merchant", req.MerchantReference, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		writeJSON(w, pr.Logger, http.StatusCreated, g)
+	}
+}
@@ -0,0 +1,161 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// payoutRepo is an in-memory stand-in for the repo methods used by the payout requester. Merchants in accrued have orders waiting to
+// be paid out.
+type payoutRepo struct {
+	repo.DisburserRepoRepository
+	merchants map[string]types.Merchant
+	accrued   map[string]bool
+	rolled    time.Time
+}
+
+func (pr *payoutRepo) GetMerchantByReferenceID(merchRef string) (types.Merchant, error) {
+	m, ok := pr.merchants[merchRef]
+	if !ok {
+		return m, sql.ErrNoRows
+	}
+	return m, nil
+}
+
+func (pr *payoutRepo) RequestPayout(ctx context.Context, merchRef, currency string, rolledPayoutDate time.Time) (types.DisbursementGroup, error) {
+	if !pr.accrued[merchRef] {
+		return types.DisbursementGroup{}, sql.ErrNoRows
+	}
+	pr.accrued[merchRef] = false
+	pr.rolled = rolledPayoutDate
+	return types.DisbursementGroup{ID: uuid.New(), MerchReference: merchRef, Currency: currency, RolledPayoutDate: rolledPayoutDate, NumberOfOrders: 2}, nil
+}
+
+// accrualRepo is an in-memory stand-in for the repo methods used by refunds, payout requests and the disbursement run of an ON_DEMAND
+// merchant. The orders in accrued are waiting for a payout request in their accrual group.
+type accrualRepo struct {
+	*runRepo
+	refunds *refundRepo
+	accrued types.DisbursementGroup
+}
+
+func (ar *accrualRepo) RecordRefund(ctx context.Context, orderID string, build repo.RefundBuilder) (types.Refund, error) {
+	refund, err := ar.refunds.RecordRefund(ctx, orderID, build)
+	ar.adjustments = ar.refunds.adjustments
+	return refund, err
+}
+
+func (ar *accrualRepo) GetMerchantByReferenceID(merchRef string) (types.Merchant, error) {
+	return types.Merchant{Reference: merchRef, DisbursementFrequency: types.ON_DEMAND, MinMonthlyFee: "0.0"}, nil
+}
+
+func (ar *accrualRepo) RequestPayout(ctx context.Context, merchRef, currency string, rolledPayoutDate time.Time) (types.DisbursementGroup, error) {
+	g := ar.accrued
+	g.RolledPayoutDate = rolledPayoutDate
+	ar.groups = append(ar.groups, g)
+	return g, nil
+}
+
+func TestPayoutRequests_RequestPayout(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	calendar := types.NewCalendar("TARGET2")
+	calendar.AddHoliday(day(2023, 5, 1), "Labour Day")
+	merchants := map[string]types.Merchant{
+		"deckow_gibson": {Reference: "deckow_gibson", DisbursementFrequency: types.ON_DEMAND},
+		"mexico_gibson": {Reference: "mexico_gibson", DisbursementFrequency: types.ON_DEMAND, Timezone: "America/Mexico_City"},
+		"padberg_group": {Reference: "padberg_group", DisbursementFrequency: types.DAILY},
+	}
+
+	tests := []struct {
+		name       string
+		merchRef   string
+		currency   string
+		accrued    bool
+		now        time.Time
+		wantRolled time.Time
+		wantErr    error
+	}{
+		{name: "before the cut-off", merchRef: "deckow_gibson", accrued: true, now: time.Date(2023, 2, 1, 7, 0, 0, 0, time.UTC), wantRolled: day(2023, 2, 1)},
+		{name: "after the cut-off on a friday", merchRef: "deckow_gibson", accrued: true, now: time.Date(2023, 2, 3, 9, 0, 0, 0, time.UTC), wantRolled: day(2023, 2, 6)},
+		{name: "before the cut-off on a holiday", merchRef: "deckow_gibson", accrued: true, now: time.Date(2023, 5, 1, 7, 0, 0, 0, time.UTC), wantRolled: day(2023, 5, 2)},
+		{name: "local day behind UTC", merchRef: "mexico_gibson", accrued: true, now: time.Date(2023, 2, 2, 5, 0, 0, 0, time.UTC), wantRolled: day(2023, 2, 2)},
+		{name: "nothing accrued", merchRef: "deckow_gibson", now: time.Date(2023, 2, 1, 7, 0, 0, 0, time.UTC), wantErr: errNothingAccrued},
+		{name: "not paid out on request", merchRef: "padberg_group", accrued: true, now: time.Date(2023, 2, 1, 7, 0, 0, 0, time.UTC), wantErr: errInvalidRequest},
+		{name: "unknown merchant", merchRef: "rosenbaum_parisian", now: time.Date(2023, 2, 1, 7, 0, 0, 0, time.UTC), wantErr: errUnknownMerchant},
+		{name: "missing merchant reference", now: time.Date(2023, 2, 1, 7, 0, 0, 0, time.UTC), wantErr: errInvalidRequest},
+		{name: "balance in another currency", merchRef: "deckow_gibson", currency: "gbp", accrued: true, now: time.Date(2023, 2, 1, 7, 0, 0, 0, time.UTC), wantRolled: day(2023, 2, 1)},
+		{name: "unsupported currency", merchRef: "deckow_gibson", currency: "XXX", accrued: true, now: time.Date(2023, 2, 1, 7, 0, 0, 0, time.UTC), wantErr: errInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr := &payoutRepo{merchants: merchants, accrued: map[string]bool{tt.merchRef: tt.accrued}}
+			requester := NewPayoutRequester(logger, context.Background(), pr, types.NewTestClock(tt.now), calendar)
+			got, err := requester.RequestPayout(context.Background(), tt.merchRef, tt.currency)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RequestPayout() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if !got.RolledPayoutDate.Equal(tt.wantRolled) || !pr.rolled.Equal(tt.wantRolled) {
+				t.Errorf("RequestPayout() rolled payout date = %v, want %v", got.RolledPayoutDate, tt.wantRolled)
+			}
+			if got.ID == uuid.Nil || got.MerchReference != tt.merchRef {
+				t.Errorf("RequestPayout() = %+v, want a new group of %s", got, tt.merchRef)
+			}
+			if wantCurrency := strings.ToUpper(types.CurrencyCode(tt.currency)); got.Currency != wantCurrency {
+				t.Errorf("RequestPayout() currency = %s, want %s", got.Currency, wantCurrency)
+			}
+		})
+	}
+}
+
+func TestPayoutRequests_RequestPayout_refundedBeforeRequest(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	accrual := uuid.New()
+	created := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+	ar := &accrualRepo{
+		runRepo: newRunRepo(),
+		refunds: &refundRepo{disbursements: map[string]types.Disbursement{
+			"056d024481a9": {DisbursementGroupID: accrual, MerchReference: "deckow_gibson", OrderID: "056d024481a9", OrderAmount: 10000, OnRequest: true},
+		}},
+		accrued: types.DisbursementGroup{ID: accrual, MerchReference: "deckow_gibson", PayoutDate: created, OrderTotal: 10000, OrderFeeTotal: 100, PayoutTotal: 9900},
+	}
+
+	_, err := NewRefundProcessor(logger, context.Background(), ar, types.SystemClock{}).Refund(context.Background(), types.Refund{OrderID: "056d024481a9", Amount: 2500})
+	if err != nil {
+		t.Fatalf("Refund() error = %v", err)
+	}
+
+	requester := NewPayoutRequester(logger, context.Background(), ar, types.NewTestClock(time.Date(2023, 2, 6, 7, 0, 0, 0, time.UTC)), types.NewCalendar("TARGET2"))
+	g, err := requester.RequestPayout(context.Background(), "deckow_gibson", "")
+	if err != nil {
+		t.Fatalf("RequestPayout() error = %v", err)
+	}
+	if g.ID != accrual {
+		t.Errorf("RequestPayout() group = %s, want the accrual group %s the refund is bound to", g.ID, accrual)
+	}
+
+	r := NewRunner(logger, context.Background(), ar, NewFakeBank(filepath.Join(t.TempDir(), "fakebank.json")), types.SystemClock{})
+	_, err = r.Run(context.Background(), g.RolledPayoutDate)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	paid := ar.paid[accrual]
+	if paid.AdjustmentTotal != -2500 || paid.PayoutTotal != 7400 {
+		t.Errorf("Run() paid group %+v, want the refund of 2500 taken off the requested payout", paid)
+	}
+}
@@ -0,0 +1,180 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"log/slog"
+	"net/http"
+)
+
+var errUnknownOrder = errors.New("unknown order")
+
+func NewRefundProcessor(logger *slog.Logger, ctx context.Context, repo repo.DisburserRepoRepository, clock types.Clock) *RefundProcessor {
+	return &RefundProcessor{
+		Logger: logger,
+		Ctx:    ctx,
+		Repo:   repo,
+		Clock:  clock,
+	}
+}
+
+// Refund records a full or partial refund of a processed order. The refund is taken off the merchant's payout through a negative
+// adjustment: while the order's disbursement group is still open the adjustment is applied to that group, once the group has been
+// paid out it is left pending and carried into the merchant's next payout in the order currency. The order fee is not refunded.
+// The refunds of an order, which are in the order currency, can never add up to more than the order amount, which for disbursement
+// records written without one is the amount of the stored order. The refund is built while the repo holds the order's disbursement
+// record, so concurrent refunds and disbursement runs see each other, see repo.DisburserRepo.RecordRefund.
+func (rp *RefundProcessor) Refund(ctx context.Context, rf types.Refund) (types.Refund, error) {
+	if rf.OrderID == "" {
+		return rf, fmt.Errorf("%w: order_id is required", errInvalidRequest)
+	}
+
+	if rf.Amount <= 0 {
+		return rf, fmt.Errorf("%w: amount must be greater than zero", errInvalidRequest)
+	}
+
+	var adj types.Adjustment
+	var paidOut bool
+	recorded, err := rp.Repo.RecordRefund(ctx, rf.OrderID, func(d types.Disbursement, refunds []types.Refund) (types.Refund, types.Adjustment, error) {
+		var refunded int64
+		for _, prev := range refunds {
+			refunded += prev.Amount
+		}
+
+		if refunded+rf.Amount > d.OrderAmount {
+			c, err := types.LookupCurrency(d.Currency)
+			if err != nil {
+				return rf, adj, err
+			}
+			return rf, adj, fmt.Errorf("%w: refund of %s exceeds the %s left to refund on order %s", errInvalidRequest,
+				types.Money{Amount: rf.Amount, Currency: c}, types.Money{Amount: d.OrderAmount - refunded, Currency: c}, rf.OrderID)
+		}
+
+		rf.ID = uuid.New()
+		rf.MerchantReference = d.MerchReference
+		rf.Currency = types.CurrencyCode(d.Currency)
+		rf.CreatedAt = rp.Clock.Now()
+
+		adj = types.Adjustment{
+			ID:                uuid.New(),
+			MerchantReference: d.MerchReference,
+			Kind:              types.ADJUSTMENT_REFUND,
+			SourceID:          rf.ID,
+			Amount:            -rf.Amount,
+			Currency:          rf.Currency,
+			Reason:            fmt.Sprintf("refund of order %s", rf.OrderID),
+			CreatedAt:         rf.CreatedAt,
+		}
+		if !d.IsPaidOut {
+			adj.DisbursementGroupID = d.DisbursementGroupID
+		}
+		rf.AdjustmentID = adj.ID
+		paidOut = d.IsPaidOut
+		return rf, adj, nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return rf, fmt.Errorf("%w %s", errUnknownOrder, rf.OrderID)
+	}
+	if err != nil {
+		return rf, err
+	}
+
+	rp.Logger.Info("refund recorded", "order_id", recorded.OrderID, "amount", recorded.Amount, "merchant", recorded.MerchantReference,
+		"disbursement_group_id", adj.DisbursementGroupID, "carried_forward", paidOut)
+	return recorded, nil
+}
+
+// refundRequest is the JSON body accepted by Refunds. Amount is the decimal amount refunded in the order currency, e.g. "10.50".
+type refundRequest struct {
+	OrderID string      `json:"order_id"`
+	Amount  json.Number `json:"amount"`
+	Reason  string      `json:"reason,omitempty"`
+}
+
+// refundFromRequest converts the refund request into a Refund of its order, with the amount parsed exactly in the order currency:
+// an amount with more decimals than the currency has is refused.
+func (rp *RefundProcessor) refundFromRequest(ctx context.Context, req refundRequest) (types.Refund, error) {
+	rf := types.Refund{OrderID: req.OrderID, Reason: req.Reason}
+	if rf.OrderID == "" {
+		return rf, fmt.Errorf("%w: order_id is required", errInvalidRequest)
+	}
+
+	d, err := rp.Repo.GetDisbursementByOrderID(ctx, rf.OrderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rf, fmt.Errorf("%w %s", errUnknownOrder, rf.OrderID)
+	}
+	if err != nil {
+		return rf, err
+	}
+
+	amount, err := types.ParseMoney(req.Amount.String(), d.Currency)
+	if errors.Is(err, types.ErrAmountPrecision) {
+		return rf, fmt.Errorf("%w: %w", errInvalidRequest, err)
+	}
+	if err != nil {
+		return rf, fmt.Errorf("%w: invalid amount %q", errInvalidRequest, req.Amount)
+	}
+	rf.Amount = amount.Amount
+	return rf, nil
+}
+
+// Refunds lists the refunds of the order in the order_id query parameter on GET and records a refund from the JSON body on POST.
+func (rp *RefundProcessor) Refunds(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		orderID := r.URL.Query().Get("order_id")
+		if orderID == "" {
+			http.Error(w, "order_id is required", http.StatusBadRequest)
+			return
+		}
+
+		refunds, err := rp.Repo.GetRefundsByOrderID(r.Context(), orderID)
+		if err != nil {
+			rp.Logger.Error("failed to get refunds", "order_id", orderID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if refunds == nil {
+			refunds = []types.Refund{}
+		}
+		writeJSON(w, rp.Logger, http.StatusOK, refunds)
+
+	case http.MethodPost:
+		var req refundRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			rp.Logger.Error("failed to decode refund request", "error", err)
+			http.Error(w, "malformed refund", http.StatusBadRequest)
+			return
+		}
+
+		rf, err := rp.refundFromRequest(r.Context(), req)
+		if err == nil {
+			rf, err = rp.Refund(r.Context(), rf)
+		}
+		if errors.Is(err, errUnknownOrder) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errInvalidRequest) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			rp.Logger.Error("failed to record refund", "order_id", req.OrderID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, rp.Logger, http.StatusCreated, rf)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
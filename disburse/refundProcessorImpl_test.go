@@ -0,0 +1,184 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// refundRepo is an in-memory stand-in for the repo methods used by the refund processor.
+type refundRepo struct {
+	repo.DisburserRepoRepository
+	mu            sync.Mutex
+	disbursements map[string]types.Disbursement
+	refunds       []types.Refund
+	adjustments   []types.Adjustment
+}
+
+func (rr *refundRepo) GetDisbursementByOrderID(ctx context.Context, orderID string) (types.Disbursement, error) {
+	d, ok := rr.disbursements[orderID]
+	if !ok {
+		return d, sql.ErrNoRows
+	}
+	return d, nil
+}
+
+func (rr *refundRepo) GetRefundsByOrderID(ctx context.Context, orderID string) ([]types.Refund, error) {
+	var refunds []types.Refund
+	for _, rf := range rr.refunds {
+		if rf.OrderID == orderID {
+			refunds = append(refunds, rf)
+		}
+	}
+	return refunds, nil
+}
+
+// RecordRefund builds the refund holding mu, the lock the repo takes on the order's disbursement record.
+func (rr *refundRepo) RecordRefund(ctx context.Context, orderID string, build repo.RefundBuilder) (types.Refund, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	d, err := rr.GetDisbursementByOrderID(ctx, orderID)
+	if err != nil {
+		return types.Refund{}, err
+	}
+
+	refunds, err := rr.GetRefundsByOrderID(ctx, orderID)
+	if err != nil {
+		return types.Refund{}, err
+	}
+
+	refund, adj, err := build(d, refunds)
+	if err != nil {
+		return refund, err
+	}
+	rr.refunds = append(rr.refunds, refund)
+	rr.adjustments = append(rr.adjustments, adj)
+	return refund, nil
+}
+
+func TestRefundProcessor_Refund(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	openGroup := uuid.New()
+	rr := &refundRepo{disbursements: map[string]types.Disbursement{
+		"056d024481a9": {DisbursementGroupID: openGroup, MerchReference: "padberg_group", OrderID: "056d024481a9", OrderAmount: 10229},
+		"33c080831f5b": {DisbursementGroupID: uuid.New(), MerchReference: "padberg_group", OrderID: "33c080831f5b", OrderAmount: 5000, IsPaidOut: true},
+	}}
+	clock := types.NewTestClock(time.Date(2023, 2, 1, 10, 30, 0, 0, time.UTC))
+	rp := NewRefundProcessor(logger, context.Background(), rr, clock)
+
+	tests := []struct {
+		name      string
+		rf        types.Refund
+		wantGroup uuid.UUID
+		wantErr   error
+	}{
+		{name: "partial refund of open group", rf: types.Refund{OrderID: "056d024481a9", Amount: 5000}, wantGroup: openGroup},
+		{name: "remainder of open group", rf: types.Refund{OrderID: "056d024481a9", Amount: 5229}, wantGroup: openGroup},
+		{name: "exceeds order amount", rf: types.Refund{OrderID: "056d024481a9", Amount: 1}, wantErr: errInvalidRequest},
+		{name: "paid group carried forward", rf: types.Refund{OrderID: "33c080831f5b", Amount: 5000}, wantGroup: uuid.Nil},
+		{name: "unknown order", rf: types.Refund{OrderID: "000000000000", Amount: 100}, wantErr: errUnknownOrder},
+		{name: "zero amount", rf: types.Refund{OrderID: "33c080831f5b"}, wantErr: errInvalidRequest},
+		{name: "missing order id", rf: types.Refund{Amount: 100}, wantErr: errInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rp.Refund(context.Background(), tt.rf)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Refund() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			adj := rr.adjustments[len(rr.adjustments)-1]
+			if adj.ID != got.AdjustmentID || adj.Amount != -tt.rf.Amount || adj.DisbursementGroupID != tt.wantGroup || adj.Kind != types.ADJUSTMENT_REFUND {
+				t.Errorf("Refund() adjustment = %+v, want %d against group %s", adj, -tt.rf.Amount, tt.wantGroup)
+			}
+			if !got.CreatedAt.Equal(clock.Now()) || !adj.CreatedAt.Equal(clock.Now()) {
+				t.Errorf("Refund() created the refund at %v and its adjustment at %v, want %v", got.CreatedAt, adj.CreatedAt, clock.Now())
+			}
+		})
+	}
+}
+
+func TestRefundProcessor_Refund_concurrent(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rr := &refundRepo{disbursements: map[string]types.Disbursement{
+		"056d024481a9": {DisbursementGroupID: uuid.New(), MerchReference: "padberg_group", OrderID: "056d024481a9", OrderAmount: 10229},
+	}}
+	rp := NewRefundProcessor(logger, context.Background(), rr, types.SystemClock{})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := rp.Refund(context.Background(), types.Refund{OrderID: "056d024481a9", Amount: 3000})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var refused int
+	for err := range errs {
+		if errors.Is(err, errInvalidRequest) {
+			refused++
+		} else if err != nil {
+			t.Fatalf("Refund() error = %v", err)
+		}
+	}
+
+	var refunded int64
+	for _, rf := range rr.refunds {
+		refunded += rf.Amount
+	}
+	if len(rr.refunds) != 3 || refused != 5 || refunded > 10229 {
+		t.Errorf("Refund() recorded %d refunds of %d in total and refused %d, want 3 refunds within the order amount", len(rr.refunds), refunded, refused)
+	}
+}
+
+func TestRefundProcessor_refundFromRequest(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rr := &refundRepo{disbursements: map[string]types.Disbursement{
+		"056d024481a9": {MerchReference: "padberg_group", OrderID: "056d024481a9", OrderAmount: 10229, Currency: "EUR"},
+		"33c080831f5b": {MerchReference: "padberg_group", OrderID: "33c080831f5b", OrderAmount: 5000, Currency: "GBP"},
+	}}
+	rp := NewRefundProcessor(logger, context.Background(), rr, types.SystemClock{})
+
+	tests := []struct {
+		name       string
+		req        refundRequest
+		wantAmount int64
+		wantErr    error
+	}{
+		{name: "cents", req: refundRequest{OrderID: "056d024481a9", Amount: "10.50"}, wantAmount: 1050},
+		{name: "order currency", req: refundRequest{OrderID: "33c080831f5b", Amount: "29.99"}, wantAmount: 2999},
+		{name: "trailing zeros", req: refundRequest{OrderID: "33c080831f5b", Amount: "0.100"}, wantAmount: 10},
+		{name: "more decimals than the currency", req: refundRequest{OrderID: "056d024481a9", Amount: "10.505"}, wantErr: errInvalidRequest},
+		{name: "malformed amount", req: refundRequest{OrderID: "056d024481a9", Amount: "1e2"}, wantErr: errInvalidRequest},
+		{name: "unknown order", req: refundRequest{OrderID: "000000000000", Amount: "1.00"}, wantErr: errUnknownOrder},
+		{name: "missing order id", req: refundRequest{Amount: "1.00"}, wantErr: errInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rp.refundFromRequest(context.Background(), tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("refundFromRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (got.Amount != tt.wantAmount || got.OrderID != tt.req.OrderID) {
+				t.Errorf("refundFromRequest() = %+v, want %d of order %s", got, tt.wantAmount, tt.req.OrderID)
+			}
+		})
+	}
+}
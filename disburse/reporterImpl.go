@@ -14,15 +14,16 @@ import (
 
 // DisbursementsByYear meets the requirements outlined in the system requirement for calculating the total number of disbursements,
 // amount disbursed to merchants, amount of order fees, number of minimum monthly fees charged, and total amount in monthly fees charged.
-func (r *Report) DisbursementsByYear(logger *slog.Logger, repo repo.DisburserRepoRepository, YYYY string) (types.DisbursementReport, error) {
+// Amounts are only added up within a currency, so the report covers the disbursements in currency.
+func (r *Report) DisbursementsByYear(logger *slog.Logger, repo repo.DisburserRepoRepository, YYYY, currency string) (types.DisbursementReport, error) {
 	disbursementReport := types.DisbursementReport{}
-	numMonthlyFeesCharged, amtOfMonthlyFeeCharged, amtOrderFees, err := repo.GetMonthlyFeesPaidByYear(YYYY)
+	numMonthlyFeesCharged, amtOfMonthlyFeeCharged, amtOrderFees, err := repo.GetMonthlyFeesPaidByYear(YYYY, currency)
 	if err != nil {
 		logger.Error("failed to get monthly fees paid by year", "error", err)
 		return disbursementReport, err
 	}
 
-	disprpt, err := repo.GetTotalCommissionsAndPayoutByYear(YYYY)
+	disprpt, err := repo.GetTotalCommissionsAndPayoutByYear(YYYY, currency)
 	if err != nil {
 		logger.Error("failed to get total commissions and payouts by year", "error", err)
 		return types.DisbursementReport{}, err
@@ -54,15 +55,15 @@ func (r *Report) NumberMonthlyPaymentsByYear(logger *slog.Logger, YYYY string, d
 	return Report{}, errors.New("not implemented")
 }
 
-func (r *Report) DisbursementReport(logger *slog.Logger, repo repo.DisburserRepoRepository, YYYY string) (types.DisbursementReport, error) {
+func (r *Report) DisbursementReport(logger *slog.Logger, repo repo.DisburserRepoRepository, YYYY, currency string) (types.DisbursementReport, error) {
 	disbursementReport := types.DisbursementReport{}
-	numMonthlyFeesCharged, amtOfMonthlyFeeCharged, _, err := repo.GetMonthlyFeesPaidByYear(YYYY)
+	numMonthlyFeesCharged, amtOfMonthlyFeeCharged, _, err := repo.GetMonthlyFeesPaidByYear(YYYY, currency)
 	if err != nil {
 		logger.Error("failed to get monthly fees paid by year", "error", err)
 		return disbursementReport, err
 	}
 
-	disprpt, err := repo.GetTotalCommissionsAndPayoutByYear(YYYY)
+	disprpt, err := repo.GetTotalCommissionsAndPayoutByYear(YYYY, currency)
 	if err != nil {
 		logger.Error("failed to get total commissions and payouts by year", "error", err)
 		return types.DisbursementReport{}, err
@@ -76,8 +77,9 @@ func (r *Report) DisbursementReport(logger *slog.Logger, repo repo.DisburserRepo
 
 func (r *Report) GetDisbursementReport(w http.ResponseWriter, req *http.Request) {
 	reportRequest := struct {
-		Name string
-		YYYY string
+		Name     string
+		YYYY     string
+		Currency string
 	}{}
 
 	err := json.NewDecoder(req.Body).Decode(&reportRequest)
@@ -85,7 +87,7 @@ func (r *Report) GetDisbursementReport(w http.ResponseWriter, req *http.Request)
 		r.Logger.Error("failed to decode report request from http request", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 	}
-	report, err := r.DisbursementReport(r.Logger, r.Repo, reportRequest.YYYY)
+	report, err := r.DisbursementReport(r.Logger, r.Repo, reportRequest.YYYY, reportRequest.Currency)
 	if err != nil {
 		r.Logger.Error("failed to get disbursement report from repo", "error", err)
 	}
@@ -0,0 +1,230 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	errAlreadyOnHold = errors.New("merchant is already on hold")
+	errNotOnHold     = errors.New("merchant is not on hold")
+)
+
+func NewRiskControls(logger *slog.Logger, ctx context.Context, repo repo.DisburserRepoRepository, clock types.Clock) *RiskControls {
+	return &RiskControls{
+		Logger: logger,
+		Ctx:    ctx,
+		Repo:   repo,
+		Clock:  clock,
+	}
+}
+
+// PlaceHold freezes the payouts of the merchant for reason until the hold is lifted, see types.PayoutHold. A merchant can only have
+// one hold in place.
+func (rc *RiskControls) PlaceHold(ctx context.Context, merchRef string, reason string) (types.PayoutHold, error) {
+	merch, err := rc.merchant(merchRef, reason)
+	if err != nil {
+		return types.PayoutHold{}, err
+	}
+	if merch.Hold != nil {
+		return *merch.Hold, fmt.Errorf("%w since %s: %s", errAlreadyOnHold, merch.Hold.PlacedAt.Format(time.DateTime), merch.Hold.Reason)
+	}
+
+	hold := types.PayoutHold{
+		ID:                uuid.New(),
+		MerchantReference: merchRef,
+		Reason:            strings.TrimSpace(reason),
+		PlacedAt:          rc.Clock.Now().UTC(),
+	}
+	err = rc.Repo.PlacePayoutHold(ctx, hold)
+	if errors.Is(err, repo.ErrHoldInPlace) { // placed by a concurrent request
+		return hold, fmt.Errorf("%w %s", errAlreadyOnHold, merchRef)
+	}
+	if err != nil {
+		return hold, err
+	}
+
+	rc.Logger.Info("payout hold placed", "merchant", merchRef, "hold_id", hold.ID, "reason", hold.Reason)
+	return hold, nil
+}
+
+// LiftHold lifts the hold in place on the merchant for reason. The groups and reserves it held back are paid out by the next
+// disbursement run.
+func (rc *RiskControls) LiftHold(ctx context.Context, merchRef string, reason string) (types.PayoutHold, error) {
+	merch, err := rc.merchant(merchRef, reason)
+	if err != nil {
+		return types.PayoutHold{}, err
+	}
+	if merch.Hold == nil {
+		return types.PayoutHold{}, fmt.Errorf("%w %s", errNotOnHold, merchRef)
+	}
+
+	hold := *merch.Hold
+	hold.LiftedAt = rc.Clock.Now().UTC()
+	hold.LiftReason = strings.TrimSpace(reason)
+	err = rc.Repo.LiftPayoutHold(ctx, hold)
+	if errors.Is(err, sql.ErrNoRows) { // lifted by a concurrent request
+		return hold, fmt.Errorf("%w %s", errNotOnHold, merchRef)
+	}
+	if err != nil {
+		return hold, err
+	}
+
+	rc.Logger.Info("payout hold lifted", "merchant", merchRef, "hold_id", hold.ID, "reason", hold.LiftReason)
+	return hold, nil
+}
+
+// SetReservePolicy replaces the reserve policy of the merchant. Payouts already made keep the reserves held back from them.
+func (rc *RiskControls) SetReservePolicy(ctx context.Context, merchRef string, p types.ReservePolicy) (types.ReservePolicy, error) {
+	err := p.Validate()
+	if err != nil {
+		return p, fmt.Errorf("%w: %w", errInvalidRequest, err)
+	}
+
+	err = rc.Repo.SetReservePolicy(ctx, merchRef, p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, fmt.Errorf("%w %s", errUnknownMerchant, merchRef)
+	}
+	if err != nil {
+		return p, err
+	}
+
+	rc.Logger.Info("reserve policy set", "merchant", merchRef, "rate_basis_points", p.RateBasisPoints, "days", p.Days)
+	return p, nil
+}
+
+// merchant returns the merchant a hold is placed on or lifted from for reason, which is required.
+func (rc *RiskControls) merchant(merchRef string, reason string) (types.Merchant, error) {
+	if strings.TrimSpace(reason) == "" {
+		return types.Merchant{}, fmt.Errorf("%w: reason is required", errInvalidRequest)
+	}
+
+	merch, err := rc.Repo.GetMerchantByReferenceID(merchRef)
+	if errors.Is(err, sql.ErrNoRows) {
+		return merch, fmt.Errorf("%w %s", errUnknownMerchant, merchRef)
+	}
+	return merch, err
+}
+
+// holdRequest is the JSON body accepted when a hold is placed or lifted.
+type holdRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Merchants serves the risk controls of the merchant in the path, /merchants/{reference}/hold and /merchants/{reference}/reserve.
+// The hold is listed, with the holds lifted before it, on GET, placed on POST and lifted on DELETE, each with the reason in the JSON
+// body. The reserve policy is returned on GET and replaced from the JSON body on PUT.
+func (rc *RiskControls) Merchants(w http.ResponseWriter, r *http.Request) {
+	merchRef, control, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/merchants/"), "/")
+	if merchRef == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch control {
+	case "hold":
+		rc.hold(w, r, merchRef)
+	case "reserve":
+		rc.reserve(w, r, merchRef)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (rc *RiskControls) hold(w http.ResponseWriter, r *http.Request, merchRef string) {
+	switch r.Method {
+	case http.MethodGet:
+		holds, err := rc.Repo.GetPayoutHolds(r.Context(), merchRef)
+		if err != nil {
+			rc.Logger.Error("failed to get payout holds", "merchant", merchRef, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if holds == nil {
+			holds = []types.PayoutHold{}
+		}
+		writeJSON(w, rc.Logger, http.StatusOK, holds)
+
+	case http.MethodPost, http.MethodDelete:
+		var req holdRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			rc.Logger.Error("failed to decode hold request", "error", err)
+			http.Error(w, "malformed hold request", http.StatusBadRequest)
+			return
+		}
+
+		status := http.StatusCreated
+		var hold types.PayoutHold
+		if r.Method == http.MethodPost {
+			hold, err = rc.PlaceHold(r.Context(), merchRef, req.Reason)
+		} else {
+			status = http.StatusOK
+			hold, err = rc.LiftHold(r.Context(), merchRef, req.Reason)
+		}
+		rc.writeResult(w, merchRef, status, hold, err)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (rc *RiskControls) reserve(w http.ResponseWriter, r *http.Request, merchRef string) {
+	switch r.Method {
+	case http.MethodGet:
+		merch, err := rc.Repo.GetMerchantByReferenceID(merchRef)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, fmt.Sprintf("%s %s", errUnknownMerchant, merchRef), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			rc.Logger.Error("failed to get merchant", "merchant", merchRef, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, rc.Logger, http.StatusOK, merch.Reserve)
+
+	case http.MethodPut:
+		var p types.ReservePolicy
+		err := json.NewDecoder(r.Body).Decode(&p)
+		if err != nil {
+			rc.Logger.Error("failed to decode reserve policy", "error", err)
+			http.Error(w, "malformed reserve policy", http.StatusBadRequest)
+			return
+		}
+
+		p, err = rc.SetReservePolicy(r.Context(), merchRef, p)
+		rc.writeResult(w, merchRef, http.StatusOK, p, err)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// writeResult writes v with status, or the status of err when it is not nil.
+func (rc *RiskControls) writeResult(w http.ResponseWriter, merchRef string, status int, v any, err error) {
+	switch {
+	case errors.Is(err, errUnknownMerchant):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errInvalidRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errAlreadyOnHold), errors.Is(err, errNotOnHold):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		rc.Logger.Error("failed to update risk controls", "merchant", merchRef, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		writeJSON(w, rc.Logger, status, v)
+	}
+}
@@ -0,0 +1,156 @@
+package disburse
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/levtk/sequra/repo"
+	"github.com/levtk/sequra/types"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// riskRepo is an in-memory stand-in for the repo methods used by the risk controls.
+type riskRepo struct {
+	repo.DisburserRepoRepository
+	merchants map[string]types.Merchant
+	holds     []types.PayoutHold
+}
+
+func (rr *riskRepo) GetMerchantByReferenceID(merchRef string) (types.Merchant, error) {
+	m, ok := rr.merchants[merchRef]
+	if !ok {
+		return m, sql.ErrNoRows
+	}
+	for i := range rr.holds {
+		if rr.holds[i].MerchantReference == merchRef && rr.holds[i].LiftedAt.IsZero() {
+			hold := rr.holds[i]
+			m.Hold = &hold
+		}
+	}
+	return m, nil
+}
+
+func (rr *riskRepo) GetPayoutHolds(ctx context.Context, merchRef string) ([]types.PayoutHold, error) {
+	var holds []types.PayoutHold
+	for _, h := range rr.holds {
+		if h.MerchantReference == merchRef {
+			holds = append(holds, h)
+		}
+	}
+	return holds, nil
+}
+
+// PlacePayoutHold refuses a second hold in place on a merchant, as the unique key of PAYOUT_HOLDS does.
+func (rr *riskRepo) PlacePayoutHold(ctx context.Context, hold types.PayoutHold) error {
+	for _, h := range rr.holds {
+		if h.MerchantReference == hold.MerchantReference && h.LiftedAt.IsZero() {
+			return repo.ErrHoldInPlace
+		}
+	}
+	rr.holds = append(rr.holds, hold)
+	return nil
+}
+
+func (rr *riskRepo) LiftPayoutHold(ctx context.Context, hold types.PayoutHold) error {
+	for i := range rr.holds {
+		if rr.holds[i].ID == hold.ID && rr.holds[i].LiftedAt.IsZero() {
+			rr.holds[i] = hold
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (rr *riskRepo) SetReservePolicy(ctx context.Context, merchRef string, p types.ReservePolicy) error {
+	m, ok := rr.merchants[merchRef]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	m.Reserve = p
+	rr.merchants[merchRef] = m
+	return nil
+}
+
+// staleRiskRepo reads the merchants without their holds, as a request does that read the merchant before a concurrent request
+// placed its hold.
+type staleRiskRepo struct {
+	*riskRepo
+}
+
+func (sr staleRiskRepo) GetMerchantByReferenceID(merchRef string) (types.Merchant, error) {
+	m, ok := sr.merchants[merchRef]
+	if !ok {
+		return m, sql.ErrNoRows
+	}
+	return m, nil
+}
+
+func TestRiskControls_PlaceHold_concurrent(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rr := &riskRepo{merchants: map[string]types.Merchant{"padberg_group": {Reference: "padberg_group"}}}
+	rc := NewRiskControls(logger, context.Background(), staleRiskRepo{rr}, types.NewTestClock(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC)))
+
+	_, err := rc.PlaceHold(context.Background(), "padberg_group", "fraud review")
+	if err != nil {
+		t.Fatalf("PlaceHold() error = %v", err)
+	}
+	_, err = rc.PlaceHold(context.Background(), "padberg_group", "chargebacks")
+	if !errors.Is(err, errAlreadyOnHold) {
+		t.Errorf("PlaceHold() error = %v, want %v", err, errAlreadyOnHold)
+	}
+	if len(rr.holds) != 1 || rr.holds[0].Reason != "fraud review" {
+		t.Errorf("PlaceHold() recorded holds %+v, want only the first hold", rr.holds)
+	}
+}
+
+func TestRiskControls_Merchants(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rr := &riskRepo{merchants: map[string]types.Merchant{"padberg_group": {Reference: "padberg_group"}}}
+	rc := NewRiskControls(logger, context.Background(), rr, types.NewTestClock(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC)))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{name: "place hold", method: http.MethodPost, path: "/merchants/padberg_group/hold", body: `{"reason": "fraud review"}`, wantStatus: http.StatusCreated},
+		{name: "place hold twice", method: http.MethodPost, path: "/merchants/padberg_group/hold", body: `{"reason": "chargebacks"}`, wantStatus: http.StatusConflict},
+		{name: "lift hold without a reason", method: http.MethodDelete, path: "/merchants/padberg_group/hold", body: `{"reason": " "}`, wantStatus: http.StatusBadRequest},
+		{name: "lift hold", method: http.MethodDelete, path: "/merchants/padberg_group/hold", body: `{"reason": "review passed"}`, wantStatus: http.StatusOK},
+		{name: "lift hold twice", method: http.MethodDelete, path: "/merchants/padberg_group/hold", body: `{"reason": "review passed"}`, wantStatus: http.StatusConflict},
+		{name: "list holds", method: http.MethodGet, path: "/merchants/padberg_group/hold", wantStatus: http.StatusOK},
+		{name: "hold of unknown merchant", method: http.MethodPost, path: "/merchants/deckow_gibson/hold", body: `{"reason": "fraud review"}`, wantStatus: http.StatusNotFound},
+		{name: "malformed hold", method: http.MethodPost, path: "/merchants/padberg_group/hold", body: `reason`, wantStatus: http.StatusBadRequest},
+		{name: "set reserve", method: http.MethodPut, path: "/merchants/padberg_group/reserve", body: `{"rate_basis_points": 1000, "days": 90}`, wantStatus: http.StatusOK},
+		{name: "reserve over 100%", method: http.MethodPut, path: "/merchants/padberg_group/reserve", body: `{"rate_basis_points": 10001, "days": 90}`, wantStatus: http.StatusBadRequest},
+		{name: "reserve without days", method: http.MethodPut, path: "/merchants/padberg_group/reserve", body: `{"rate_basis_points": 1000}`, wantStatus: http.StatusBadRequest},
+		{name: "reserve of unknown merchant", method: http.MethodPut, path: "/merchants/deckow_gibson/reserve", body: `{"rate_basis_points": 1000, "days": 90}`, wantStatus: http.StatusNotFound},
+		{name: "get reserve", method: http.MethodGet, path: "/merchants/padberg_group/reserve", wantStatus: http.StatusOK},
+		{name: "unknown control", method: http.MethodGet, path: "/merchants/padberg_group/limits", wantStatus: http.StatusNotFound},
+		{name: "method not allowed", method: http.MethodPatch, path: "/merchants/padberg_group/hold", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			rc.Merchants(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("Merchants() status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+
+	if len(rr.holds) != 1 || rr.holds[0].Reason != "fraud review" || rr.holds[0].LiftReason != "review passed" || rr.holds[0].LiftedAt.IsZero() {
+		t.Errorf("Merchants() recorded holds %+v, want one hold placed and lifted with their reasons", rr.holds)
+	}
+	if p := rr.merchants["padberg_group"].Reserve; p.RateBasisPoints != 1000 || p.Days != 90 {
+		t.Errorf("Merchants() reserve policy = %+v, want 10%% for 90 days", p)
+	}
+}
@@ -0,0 +1,242 @@
+package disburse
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// sortOrders returns the orders of src sorted by compare, e.g. compareOrdersByMerchant. Orders are sorted in memory in chunks of
+// chunkSize; when src holds more than one chunk every sorted chunk is spilled to a temporary file in dir and the chunks are merged as
+// they are read back, so no more than chunkSize orders are held in memory whatever the size of src. The returned func closes and
+// removes the temporary files and must be called once the sorted orders have been read.
+func sortOrders(src orderSource, compare func(a, b *Order) int, chunkSize int, dir string) (orderSource, func() error, error) {
+	if chunkSize <= 0 {
+		return nil, nil, fmt.Errorf("invalid sort chunk size %d", chunkSize)
+	}
+
+	var files []*os.File
+	cleanup := func() error {
+		var errs []error
+		for _, f := range files {
+			errs = append(errs, f.Close(), os.Remove(f.Name()))
+		}
+		return errors.Join(errs...)
+	}
+
+	chunk := make(Orders, 0, min(chunkSize, 4096))
+	for {
+		o, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, errors.Join(err, cleanup())
+		}
+
+		chunk = append(chunk, o)
+		if len(chunk) == chunkSize {
+			f, err := spillOrders(chunk, compare, dir)
+			if err != nil {
+				return nil, nil, errors.Join(err, cleanup())
+			}
+			files = append(files, f)
+			chunk = chunk[:0]
+		}
+	}
+
+	if len(files) == 0 {
+		slices.SortFunc(chunk, compare)
+		return &orderSlice{orders: chunk}, cleanup, nil
+	}
+
+	if len(chunk) > 0 {
+		f, err := spillOrders(chunk, compare, dir)
+		if err != nil {
+			return nil, nil, errors.Join(err, cleanup())
+		}
+		files = append(files, f)
+	}
+
+	m := &orderMerge{compare: compare}
+	for i, f := range files {
+		_, err := f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, nil, errors.Join(err, cleanup())
+		}
+
+		r := newSpillReader(f)
+		o, err := r.Next()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, nil, errors.Join(err, cleanup())
+		}
+		m.heads = append(m.heads, mergeHead{order: o, src: r, chunk: i})
+	}
+	heap.Init(m)
+	return m, cleanup, nil
+}
+
+// compareOrdersByMerchant orders orders by merchant and creation date, the order their disbursement records are built in.
+func compareOrdersByMerchant(a, b *Order) int {
+	if n := cmp.Compare(a.MerchantReference, b.MerchantReference); n != 0 {
+		return n
+	}
+	return a.CreatedAt.Compare(b.CreatedAt)
+}
+
+// compareOrdersByID orders orders by id and then by their line in the imported file, so the orders repeating an id follow the
+// first order with the id.
+func compareOrdersByID(a, b *Order) int {
+	if n := cmp.Compare(a.ID, b.ID); n != 0 {
+		return n
+	}
+	return cmp.Compare(a.line, b.line)
+}
+
+// spillOrders sorts the chunk by compare and writes it to a new temporary file in dir.
+func spillOrders(chunk Orders, compare func(a, b *Order) int, dir string) (*os.File, error) {
+	slices.SortFunc(chunk, compare)
+	f, err := os.CreateTemp(dir, "orders-*.csv")
+	if err != nil {
+		return nil, err
+	}
+
+	bw := bufio.NewWriter(f)
+	w := csv.NewWriter(bw)
+	w.Comma = ';'
+	for _, o := range chunk {
+		err = w.Write([]string{o.ID, o.MerchantReference, strconv.FormatInt(o.Amount, 10), o.CreatedAt.Format(time.RFC3339Nano), o.Currency,
+			strconv.Itoa(o.line), o.record})
+		if err != nil {
+			break
+		}
+	}
+	w.Flush()
+	err = errors.Join(err, w.Error(), bw.Flush())
+	if err != nil {
+		return nil, errors.Join(err, f.Close(), os.Remove(f.Name()))
+	}
+	return f, nil
+}
+
+// spillReader reads back the orders of a chunk written by spillOrders.
+type spillReader struct {
+	r *csv.Reader
+}
+
+func newSpillReader(r io.Reader) *spillReader {
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.Comma = ';'
+	cr.FieldsPerRecord = 7
+	cr.ReuseRecord = true
+	return &spillReader{r: cr}
+}
+
+func (sr *spillReader) Next() (*Order, error) {
+	rec, err := sr.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := strconv.ParseInt(rec[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, rec[3])
+	if err != nil {
+		return nil, err
+	}
+
+	line, err := strconv.Atoi(rec[5])
+	if err != nil {
+		return nil, err
+	}
+	return &Order{ID: rec[0], MerchantReference: rec[1], Amount: amount, Currency: rec[4], CreatedAt: createdAt, line: line, record: rec[6]}, nil
+}
+
+// orderSlice yields the orders of a slice, skipping nil entries.
+type orderSlice struct {
+	orders Orders
+	next   int
+}
+
+func (s *orderSlice) Next() (*Order, error) {
+	for s.next < len(s.orders) {
+		o := s.orders[s.next]
+		s.next++
+		if o != nil {
+			return o, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+type mergeHead struct {
+	order *Order
+	src   orderSource
+	chunk int
+}
+
+// orderMerge merges order sources sorted by compare into a single sorted source. It implements heap.Interface over the next order
+// of each source; orders that compare equal keep the order of their chunks.
+type orderMerge struct {
+	heads   []mergeHead
+	compare func(a, b *Order) int
+}
+
+func (m *orderMerge) Len() int {
+	return len(m.heads)
+}
+
+func (m *orderMerge) Less(i, j int) bool {
+	a, b := m.heads[i], m.heads[j]
+	if n := m.compare(a.order, b.order); n != 0 {
+		return n < 0
+	}
+	return a.chunk < b.chunk
+}
+
+func (m *orderMerge) Swap(i, j int) {
+	m.heads[i], m.heads[j] = m.heads[j], m.heads[i]
+}
+
+func (m *orderMerge) Push(x any) {
+	m.heads = append(m.heads, x.(mergeHead))
+}
+
+func (m *orderMerge) Pop() any {
+	last := m.heads[len(m.heads)-1]
+	m.heads = m.heads[:len(m.heads)-1]
+	return last
+}
+
+func (m *orderMerge) Next() (*Order, error) {
+	if len(m.heads) == 0 {
+		return nil, io.EOF
+	}
+
+	o := m.heads[0].order
+	next, err := m.heads[0].src.Next()
+	switch {
+	case err == io.EOF:
+		heap.Pop(m)
+	case err != nil:
+		return nil, err
+	default:
+		m.heads[0].order = next
+		heap.Fix(m, 0)
+	}
+	return o, nil
+}
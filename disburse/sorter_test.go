@@ -0,0 +1,143 @@
+package disburse
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_sortOrders(t *testing.T) {
+	input := `id;merchant_reference;amount;created_at
+e653f3e14bc4;padberg_group;102.29;2023-02-01
+20b674c93ea6;deckow_gibson;433.21;2023-01-03
+056d024481a9;padberg_group;440.45;2023-01-05
+33c080831f5b;deckow_gibson;98.10;2023-01-01
+1b2ab4e3c1f4;padberg_group;61.74;2023-01-05
+`
+	want := []string{"33c080831f5b", "20b674c93ea6", "056d024481a9", "1b2ab4e3c1f4", "e653f3e14bc4"}
+
+	tests := []struct {
+		name      string
+		chunkSize int
+		wantFiles int
+	}{
+		{name: "sorts in memory when the orders fit in one chunk", chunkSize: 10, wantFiles: 0},
+		{name: "merges chunks spilled to temporary files", chunkSize: 2, wantFiles: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, cleanup, err := sortOrders(newOrderReader(strings.NewReader(input)), compareOrdersByMerchant, tt.chunkSize, dir)
+			if err != nil {
+				t.Fatalf("sortOrders() error = %v", err)
+			}
+
+			files, _ := filepath.Glob(filepath.Join(dir, "orders-*.csv"))
+			if len(files) != tt.wantFiles {
+				t.Errorf("sortOrders() spilled %d chunks, want %d", len(files), tt.wantFiles)
+			}
+
+			var got []string
+			var prev *Order
+			for {
+				o, err := src.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Next() error = %v", err)
+				}
+				if prev != nil && prev.MerchantReference == o.MerchantReference && o.CreatedAt.Before(prev.CreatedAt) {
+					t.Errorf("Next() order %s created before %s", o.ID, prev.ID)
+				}
+				got = append(got, o.ID)
+				prev = o
+			}
+
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("sortOrders() got = %v, want %v", got, want)
+			}
+			if prev.Amount != 10229 || !prev.CreatedAt.Equal(time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)) {
+				t.Errorf("sortOrders() last order = %+v, want amount and creation date kept", prev)
+			}
+
+			err = cleanup()
+			if err != nil {
+				t.Errorf("cleanup() error = %v", err)
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 0 {
+				t.Errorf("cleanup() left %d files behind", len(entries))
+			}
+		})
+	}
+}
+
+func Test_uniqueOrders(t *testing.T) {
+	input := `id;merchant_reference;amount;created_at
+e653f3e14bc4;padberg_group;102.29;2023-02-01
+20b674c93ea6;deckow_gibson;433.21;2023-01-03
+056d024481a9;padberg_group;440.45;2023-01-05
+e653f3e14bc4;deckow_gibson;98.10;2023-01-01
+1b2ab4e3c1f4;padberg_group;61.74;2023-01-05
+20b674c93ea6;deckow_gibson;433.21;2023-01-03
+e653f3e14bc4;padberg_group;102.29;2023-03-01
+`
+	tests := []struct {
+		name      string
+		chunkSize int
+	}{
+		{name: "in memory", chunkSize: 10},
+		{name: "repeated ids in different chunks", chunkSize: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			byID, cleanup, err := sortOrders(newOrderReader(strings.NewReader(input)), compareOrdersByID, tt.chunkSize, t.TempDir())
+			if err != nil {
+				t.Fatalf("sortOrders() error = %v", err)
+			}
+			defer cleanup()
+
+			var rejected []string
+			reject := func(o *Order, cause error) error {
+				rejected = append(rejected, fmt.Sprintf("%d %s %s", o.line, o.record, cause))
+				return nil
+			}
+			var accepted int
+			src := &uniqueOrders{src: byID, reject: reject, accept: func(o *Order) { accepted++ }}
+
+			var got []string
+			for {
+				o, err := src.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Next() error = %v", err)
+				}
+				got = append(got, fmt.Sprintf("%s %d", o.ID, o.line))
+			}
+
+			want := []string{"056d024481a9 4", "1b2ab4e3c1f4 6", "20b674c93ea6 3", "e653f3e14bc4 2"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Next() got = %v, want %v", got, want)
+			}
+			if accepted != len(want) {
+				t.Errorf("Next() accepted %d orders, want %d", accepted, len(want))
+			}
+			wantRejected := []string{
+				"7 20b674c93ea6;deckow_gibson;433.21;2023-01-03 duplicate order id 20b674c93ea6",
+				"5 e653f3e14bc4;deckow_gibson;98.10;2023-01-01 duplicate order id e653f3e14bc4",
+				"8 e653f3e14bc4;padberg_group;102.29;2023-03-01 duplicate order id e653f3e14bc4",
+			}
+			if !reflect.DeepEqual(rejected, wantRejected) {
+				t.Errorf("Next() rejected = %v, want %v", rejected, wantRejected)
+			}
+		})
+	}
+}
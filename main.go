@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	d "github.com/levtk/sequra/disburse"
+	"github.com/levtk/sequra/types"
 	"github.com/spf13/viper"
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 )
 
 func main() {
@@ -22,6 +25,9 @@ func main() {
 	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
 
 	viper.SetConfigFile(".env")
+	viper.SetDefault("FAKE_BANK_FILE", "fakebank.json")
+	viper.SetDefault("HOLIDAYS_FILE", types.HOLIDAYS_FILENAME)
+	viper.SetDefault("PAYOUT_CALENDARS", types.PAYOUT_CALENDARS)
 	err = viper.ReadInConfig()
 	if err != nil {
 		logger.Error("failed to read config file", "error", err.Error())
@@ -34,18 +40,79 @@ func main() {
 		logger.Error("failed to connect to db", err.Error())
 	}
 
-	DisburserService, err := d.NewDisburserService(logger, ctx, db)
+	var provider d.PayoutProvider
+	switch viper.GetString("PAYOUT_PROVIDER") {
+	case "fake", "":
+		fakeBank := d.NewFakeBank(viper.GetString("FAKE_BANK_FILE"))
+		fakeBank.Delay = viper.GetDuration("FAKE_BANK_DELAY")
+		fakeBank.SettleAfter = viper.GetDuration("FAKE_BANK_SETTLE_AFTER")
+		fakeBank.FailEvery = viper.GetInt("FAKE_BANK_FAIL_EVERY")
+		provider = fakeBank
+		logger.Info("using the fake bank payout provider", "file", fakeBank.FileName)
+	default:
+		logger.Error("unsupported payout provider", "provider", viper.GetString("PAYOUT_PROVIDER"))
+		return
+	}
+
+	calendar, err := payoutCalendar(viper.GetString("HOLIDAYS_FILE"), viper.GetString("PAYOUT_CALENDARS"))
+	if err != nil {
+		logger.Error("failed to load the payout calendar", "file", viper.GetString("HOLIDAYS_FILE"), "error", err.Error())
+		return
+	}
+	logger.Info("paying out on the business days of", "calendar", calendar.Name, "holidays", len(calendar.Holidays),
+		"holidays_through", calendar.Through)
+
+	DisburserService, err := d.NewDisburserService(logger, ctx, db, provider, types.SystemClock{}, calendar)
 	if err != nil {
 		logger.Error("failed to instantiate the disburser service on ", "hostname", hostname, "error", err.Error())
 	}
 
+	go DisburserService.Runner.Schedule(ctx)
+	go DisburserService.ImportJobs.Start(ctx)
+
 	r := http.NewServeMux()
 
 	r.HandleFunc("/disbursement", DisburserService.Reporter.GetDisbursementReport)
-	r.HandleFunc("/import", DisburserService.Importer.Import)
+	r.HandleFunc("/imports", DisburserService.ImportJobs.Imports)
+	r.HandleFunc("/imports/", DisburserService.ImportJobs.ImportJob)
+	r.HandleFunc("/orders", DisburserService.ProcessOrder.PostOrder)
+	r.HandleFunc("/fee-schedules", DisburserService.FeeSchedules.FeeSchedules)
+	r.HandleFunc("/refunds", DisburserService.Refunds.Refunds)
+	r.HandleFunc("/payouts", DisburserService.Payouts.Payouts)
+	r.HandleFunc("/merchants/", DisburserService.Risk.Merchants)
+	r.HandleFunc("/ledger/balances", DisburserService.Ledger.Balances)
+	r.HandleFunc("/ledger/trial-balance", DisburserService.Ledger.GetTrialBalance)
 
 	err = http.ListenAndServe(":8080", r)
 	if err != nil {
 		logger.Error("failed to launch http server on port 8080", "error", err)
 	}
 }
+
+// payoutCalendar combines the calendars named in the comma separated list names from the holidays file fileName.
+func payoutCalendar(fileName string, names string) (*types.Calendar, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	calendars, err := types.LoadCalendars(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var payout []*types.Calendar
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		c, ok := calendars[name]
+		if !ok {
+			return nil, fmt.Errorf("calendar %s is not in %s", name, fileName)
+		}
+		payout = append(payout, c)
+	}
+	return types.CombineCalendars(strings.ToUpper(strings.ReplaceAll(names, " ", "")), payout...), nil
+}
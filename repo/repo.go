@@ -3,40 +3,219 @@ package repo
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/levtk/sequra/reports"
 	"github.com/levtk/sequra/types"
 	"log/slog"
+	"strings"
 	"time"
 )
 
 const (
-	insertMerchant = `INSERT INTO MERCHANTS (id, reference, email, live_on, disbursement_frequency, minimum_monthly_fee) VALUES (
-                    ?,?,?,?,?,?);`
+	insertMerchant = `INSERT INTO MERCHANTS (id, reference, email, live_on, disbursement_frequency, minimum_monthly_fee, currency, timezone, payout_day) VALUES (
+                    ?,?,?,?,?,?,?,?,?);`
 
 	getOrdersByMerchantReferenceID = `SELECT * FROM ORDERS WHERE merchant_reference=?;`
 
-	getMerchantByReferenceID = `SELECT * FROM MERCHANTS WHERE reference=?;`
+	getMerchantByReferenceID = `SELECT id, reference, email, live_on, disbursement_frequency, minimum_monthly_fee, currency, timezone, payout_day, reserve_rate_basis_points, reserve_days FROM MERCHANTS WHERE reference=?;`
 
-	insertOrder = `INSERT INTO ORDERS(id, merchant_reference, merchant_id, amount, created_at) VALUES(?,?,?,?,?);`
+	insertOrder = `INSERT INTO ORDERS(id, merchant_reference, merchant_id, amount, currency, created_at) VALUES(?,?,?,?,?,?);`
 
-	insertDisbursement = `INSERT INTO DISBURSEMENT(record_uuid, disbursement_group_id, merchReference, order_id, order_fee, order_fee_running_total, payout_date, payout_running_total, payout_total, is_paid_out)
-	VALUES (?,?,?,?,?,?,?,?,?,?);`
+	getOrderByID = `SELECT id, merchant_reference, merchant_id, amount, currency, created_at FROM ORDERS WHERE id=?;`
 
-	getDisbursementGroupID = `SELECT disbursement_group_id FROM DISBURSEMENT WHERE payout_date=? AND merchReference=?;`
+	insertDisbursement = `INSERT INTO DISBURSEMENT(record_uuid, disbursement_group_id, merchReference, order_id, order_amount, currency, order_fee, fee_schedule_id, fee_schedule_version, payout_date, rolled_payout_date, payout_total, monthly_fee_deduction, is_paid_out, on_request)
+	VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);`
 
-	getNumberOfDisbursementsByYear = `SELECT COUNT(*) FROM (SELECT * FROM DISBURSEMENT WHERE is_paid_out=1 AND payout_date LIKE ?) AS d;`
+	getDisbursementGroupID = `SELECT disbursement_group_id FROM DISBURSEMENT WHERE payout_date=? AND merchReference=? AND currency=? AND on_request = 0 AND is_paid_out = 0 LIMIT 1;`
 
-	getTotalCommissionAndTotalPayoutByYear = `SELECT  COUNT(*) AS number_of_disbursements, SUM(DISBURSEMENT.payout_total) AS amt_disbursed_to_merchants, SUM(DISBURSEMENT.order_fee_running_total) AS amount_of_order_fees FROM DISBURSEMENT WHERE is_paid_out = TRUE AND payout_date LIKE ?;`
+	getOnRequestGroupID = `SELECT disbursement_group_id FROM DISBURSEMENT WHERE merchReference = ? AND currency = ? AND on_request = 1 AND is_paid_out = 0 LIMIT 1;`
 
-	insertMonthly = `INSERT INTO MONTHLY(id, merchant_id, merchant_reference, monthly_fee_date, did_pay_fee, 
-                    monthly_fee, total_order_amt, order_fee_total, createdAt, updatedAt) VALUES (?,?,?,?,?,?,?,?,?,?);`
+	requestPayout = `UPDATE DISBURSEMENT SET disbursement_group_id = ?, rolled_payout_date = ?, on_request = 0 WHERE merchReference = ? AND currency = ? AND on_request = 1 AND is_paid_out = 0;`
+
+	requestPayoutAdjustments = `UPDATE ADJUSTMENTS SET disbursement_group_id = ? WHERE applied_at IS NULL AND disbursement_group_id IN (
+	SELECT disbursement_group_id FROM DISBURSEMENT WHERE merchReference = ? AND currency = ? AND on_request = 1 AND is_paid_out = 0);`
+
+	getRequestedPayout = `SELECT MIN(payout_date), COUNT(*), COALESCE(SUM(order_amount), 0), SUM(order_fee) FROM DISBURSEMENT WHERE disbursement_group_id = ?;`
+
+	getActivePayoutHold = `SELECT id, merchant_reference, reason, placed_at FROM PAYOUT_HOLDS WHERE merchant_reference = ? AND lifted_at IS NULL ORDER BY placed_at DESC LIMIT 1;`
+
+	getPayoutHolds = `SELECT id, merchant_reference, reason, placed_at, COALESCE(lifted_at, ''), COALESCE(lift_reason, '') FROM PAYOUT_HOLDS WHERE merchant_reference = ? ORDER BY placed_at;`
+
+	insertPayoutHold = `INSERT INTO PAYOUT_HOLDS(id, merchant_reference, reason, placed_at) VALUES (?,?,?,?);`
+
+	liftPayoutHold = `UPDATE PAYOUT_HOLDS SET lifted_at = ?, lift_reason = ? WHERE id = ? AND lifted_at IS NULL;`
+
+	setReservePolicy = `UPDATE MERCHANTS SET reserve_rate_basis_points = ?, reserve_days = ? WHERE reference = ?;`
+
+	insertReserve = `INSERT INTO RESERVES(id, merchant_reference, disbursement_group_id, amount, currency, release_date, created_at) VALUES (?,?,?,?,?,?,?);`
+
+	getDueReserves = `SELECT id, merchant_reference, disbursement_group_id, amount, currency, release_date, created_at FROM RESERVES WHERE released_at IS NULL AND release_date <= ? ORDER BY release_date, created_at;`
+
+	releaseReserve = `UPDATE RESERVES SET transaction_id = ?, released_at = ? WHERE id = ? AND released_at IS NULL;`
+
+	getNumberOfDisbursementsByYear = `SELECT COUNT(DISTINCT disbursement_group_id) FROM DISBURSEMENT WHERE is_paid_out=1 AND payout_date LIKE ?;`
+
+	getTotalCommissionAndTotalPayoutByYear = `SELECT  COUNT(DISTINCT DISBURSEMENT.disbursement_group_id) AS number_of_disbursements, SUM(DISBURSEMENT.payout_total) AS amt_disbursed_to_merchants, SUM(DISBURSEMENT.order_fee) AS amount_of_order_fees FROM DISBURSEMENT WHERE is_paid_out = TRUE AND payout_date LIKE ? AND currency = ?;`
+
+	insertMonthly = `INSERT INTO MONTHLY(id, merchant_id, merchant_reference, currency, monthly_fee_date, did_pay_fee, 
+                    monthly_fee, total_order_amt, order_fee_total, fee_deducted, disbursement_group_id, createdAt, updatedAt) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?);`
 
 	getMonthlyFeeTotalsByYear = `SELECT COUNT(*) as count, SUM(monthly_fee) AS total_monthly_fees, SUM(order_fee_total) AS total_order_fees, SUM(amt_monthly_fee_paid) AS total_monthly_fees_paid FROM MONTHLY
-										WHERE createdAt LIKE ? AND did_pay_fee = TRUE;`
+										WHERE createdAt LIKE ? AND currency = ? AND did_pay_fee = TRUE;`
+
+	getDueDisbursementGroups = `SELECT disbursement_group_id, merchReference, currency, MIN(payout_date), MIN(COALESCE(rolled_payout_date, payout_date)), COUNT(*), COALESCE(SUM(order_amount), 0), SUM(order_fee) FROM DISBURSEMENT
+										WHERE is_paid_out = 0 AND on_request = 0 GROUP BY disbursement_group_id, merchReference, currency HAVING MIN(COALESCE(rolled_payout_date, payout_date)) < ?;`
+
+	markDisbursementGroupPaid = `UPDATE DISBURSEMENT SET is_paid_out = 1, transaction_id = ? WHERE disbursement_group_id = ?;`
+
+	getClosingDisbursementRecord = `SELECT d.record_uuid FROM DISBURSEMENT d LEFT JOIN ORDERS o ON o.id = d.order_id WHERE d.disbursement_group_id = ?
+										ORDER BY d.createdAt DESC, o.created_at DESC, d.order_id DESC LIMIT 1;`
+
+	setDisbursementPayoutTotal = `UPDATE DISBURSEMENT SET payout_total = ?, monthly_fee_deduction = ? WHERE record_uuid = ?;`
+
+	insertDisbursementGroup = `INSERT INTO DISBURSEMENT_GROUP(id, run_id, merchReference, currency, payout_date, rolled_payout_date, number_of_orders, order_total, order_fee_total, adjustment_total, monthly_fee_deduction, reserve_amount, payout_total, transaction_id, paid_at)
+	VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);`
+
+	insertDisbursementRun = `INSERT INTO DISBURSEMENT_RUN(id, run_date, status, groups_paid, groups_failed, groups_held, reserves_paid, payout_total, order_fee_total, totals, started_at) VALUES (?,?,?,?,?,?,?,?,?,?,?);`
+
+	updateDisbursementRun = `UPDATE DISBURSEMENT_RUN SET status = ?, groups_paid = ?, groups_failed = ?, groups_held = ?, reserves_paid = ?, payout_total = ?, order_fee_total = ?, totals = ?, completed_at = ? WHERE id = ?;`
+
+	insertFeeSchedule = `INSERT INTO FEE_SCHEDULE(id, merchant_reference, currency, version, effective_from, effective_to, flat_fee, max_order, tiers, created_at) VALUES (?,?,?,?,?,?,?,?,?,?);`
+
+	getLatestFeeScheduleVersion = `SELECT COALESCE(MAX(version), 0) FROM FEE_SCHEDULE WHERE merchant_reference = ?;`
+
+	closeFeeSchedules = `UPDATE FEE_SCHEDULE SET effective_to = ? WHERE merchant_reference = ? AND currency = ? AND effective_from < ? AND (effective_to IS NULL OR effective_to > ?);`
+
+	getFeeSchedulesByMerchantReference = `SELECT id, merchant_reference, currency, version, effective_from, effective_to, flat_fee, max_order, tiers FROM FEE_SCHEDULE WHERE merchant_reference = ? ORDER BY effective_from;`
+
+	getFeeSchedules = `SELECT id, merchant_reference, currency, version, effective_from, effective_to, flat_fee, max_order, tiers FROM FEE_SCHEDULE ORDER BY merchant_reference, effective_from;`
+
+	getDisbursementRunByDate = `SELECT id, run_date, status, groups_paid, groups_failed, groups_held, reserves_paid, payout_total, order_fee_total, COALESCE(totals, ''), started_at FROM DISBURSEMENT_RUN WHERE run_date = ?;`
+
+	// getDisbursementByOrderID and lockDisbursementByOrderID take the order amount from ORDERS when the disbursement record was
+	// written before DISBURSEMENT had an order_amount, so the refunds of those orders are still bounded by the amount of the order.
+	getDisbursementByOrderID = `SELECT d.record_uuid, d.disbursement_group_id, d.merchReference, d.order_id, COALESCE(d.order_amount, o.amount, 0), d.currency, d.order_fee, d.payout_date, d.is_paid_out
+										FROM DISBURSEMENT d LEFT JOIN ORDERS o ON o.id = d.order_id WHERE d.order_id = ?;`
+
+	lockDisbursementByOrderID = `SELECT d.record_uuid, d.disbursement_group_id, d.merchReference, d.order_id, COALESCE(d.order_amount, o.amount, 0), d.currency, d.order_fee, d.payout_date, d.is_paid_out
+										FROM DISBURSEMENT d LEFT JOIN ORDERS o ON o.id = d.order_id WHERE d.order_id = ? FOR UPDATE;`
+
+	getRefundsByOrderID = `SELECT id, order_id, merchant_reference, amount, currency, reason, adjustment_id, created_at FROM REFUNDS WHERE order_id = ? ORDER BY created_at;`
+
+	insertRefund = `INSERT INTO REFUNDS(id, order_id, merchant_reference, amount, currency, reason, adjustment_id, created_at) VALUES (?,?,?,?,?,?,?,?);`
+
+	insertAdjustment = `INSERT INTO ADJUSTMENTS(id, merchant_reference, disbursement_group_id, kind, source_id, amount, currency, reason, created_at) VALUES (?,?,?,?,?,?,?,?,?);`
+
+	getAdjustmentsForGroup = `SELECT id, merchant_reference, disbursement_group_id, kind, source_id, amount, currency, reason, created_at FROM ADJUSTMENTS
+										WHERE merchant_reference = ? AND currency = ? AND applied_at IS NULL AND (disbursement_group_id = ? OR disbursement_group_id IS NULL) ORDER BY created_at;`
+
+	applyAdjustment = `UPDATE ADJUSTMENTS SET disbursement_group_id = ?, applied_at = ? WHERE id = ?;`
+
+	releaseAdjustments = `UPDATE ADJUSTMENTS SET disbursement_group_id = NULL WHERE disbursement_group_id = ? AND applied_at IS NULL;`
+
+	journalEntryExists = `SELECT COUNT(*) FROM JOURNAL_ENTRY WHERE kind = ? AND reference = ?;`
+
+	insertJournalEntry = `INSERT INTO JOURNAL_ENTRY(id, kind, reference, merchant_reference, effective_date, created_at) VALUES (?,?,?,?,?,?);`
+
+	insertPosting = `INSERT INTO LEDGER_POSTING(id, entry_id, account, merchant_reference, currency, amount) VALUES (?,?,?,?,?,?);`
+
+	getAccountBalances = `SELECT account, merchant_reference, currency, SUM(amount) FROM LEDGER_POSTING GROUP BY account, merchant_reference, currency ORDER BY account, merchant_reference, currency;`
+
+	getAccountBalancesByMerchant = `SELECT account, merchant_reference, currency, SUM(amount) FROM LEDGER_POSTING WHERE merchant_reference = ? GROUP BY account, merchant_reference, currency ORDER BY account, currency;`
+
+	getUnbalancedJournalEntries = `SELECT entry_id FROM LEDGER_POSTING GROUP BY entry_id HAVING SUM(amount) <> 0;`
+
+	getMonthTotals = `SELECT COALESCE(SUM(order_amount), 0), COALESCE(SUM(order_fee), 0) FROM DISBURSEMENT WHERE merchReference = ? AND currency = ? AND payout_date >= ? AND payout_date < ?;`
+
+	getOutstandingMonthlyFees = `SELECT id, merchant_id, merchant_reference, currency, monthly_fee_date, did_pay_fee, monthly_fee, total_order_amt, order_fee_total, COALESCE(fee_deducted, 0) FROM MONTHLY
+										WHERE merchant_reference = ? AND did_pay_fee = 1 AND COALESCE(fee_deducted, 0) < monthly_fee - order_fee_total ORDER BY monthly_fee_date;`
+
+	setMonthlyFeeDeducted = `UPDATE MONTHLY SET fee_deducted = ?, disbursement_group_id = ?, updatedAt = ? WHERE id = ?;`
+
+	bulkUpsertMerchants = `INSERT INTO MERCHANTS (id, reference, email, live_on, disbursement_frequency, minimum_monthly_fee, currency, timezone, payout_day) VALUES `
+
+	upsertMerchantsOnDuplicate = ` ON DUPLICATE KEY UPDATE reference = VALUES(reference), email = VALUES(email), live_on = VALUES(live_on),
+										disbursement_frequency = VALUES(disbursement_frequency), minimum_monthly_fee = VALUES(minimum_monthly_fee),
+										currency = VALUES(currency), timezone = VALUES(timezone), payout_day = VALUES(payout_day)`
+
+	bulkInsertOrders = `INSERT INTO ORDERS(id, merchant_reference, merchant_id, amount, currency, created_at) VALUES `
+
+	upsertOrdersOnDuplicate = ` ON DUPLICATE KEY UPDATE merchant_reference = VALUES(merchant_reference), merchant_id = VALUES(merchant_id), amount = VALUES(amount), currency = VALUES(currency), created_at = VALUES(created_at)`
+
+	bulkInsertDisbursements = `INSERT INTO DISBURSEMENT(record_uuid, disbursement_group_id, merchReference, order_id, order_amount, currency, order_fee, fee_schedule_id, fee_schedule_version, payout_date, rolled_payout_date, payout_total, monthly_fee_deduction, is_paid_out, on_request, imported) VALUES `
+
+	bulkInsertMonthly = `INSERT INTO MONTHLY(id, merchant_id, merchant_reference, currency, monthly_fee_date, did_pay_fee, monthly_fee, total_order_amt, order_fee_total, fee_deducted, disbursement_group_id, createdAt, updatedAt, imported) VALUES `
+
+	bulkInsertJournalEntries = `INSERT INTO JOURNAL_ENTRY(id, kind, reference, merchant_reference, effective_date, created_at, imported) VALUES `
+
+	bulkInsertPostings = `INSERT INTO LEDGER_POSTING(id, entry_id, account, merchant_reference, currency, amount) VALUES `
+
+	getPostedJournalEntries = `SELECT kind, reference FROM JOURNAL_ENTRY WHERE (kind, reference) IN `
+
+	getMerchants = `SELECT id, reference, email, live_on, disbursement_frequency, minimum_monthly_fee, currency, timezone, payout_day, reserve_rate_basis_points, reserve_days FROM MERCHANTS;`
+
+	getStoredOrders = `SELECT id, merchant_reference, merchant_id, amount, currency, created_at FROM ORDERS WHERE merchant_reference = ?;`
+
+	countPaidOutImports = `SELECT (SELECT COUNT(*) FROM DISBURSEMENT WHERE merchReference = ? AND imported = 1 AND transaction_id IS NOT NULL)
+										+ (SELECT COUNT(*) FROM MONTHLY WHERE merchant_reference = ? AND imported = 1 AND disbursement_group_id IN (SELECT id FROM DISBURSEMENT_GROUP));`
+
+	deleteImportedPostings = `DELETE FROM LEDGER_POSTING WHERE entry_id IN (SELECT id FROM JOURNAL_ENTRY WHERE merchant_reference = ? AND imported = 1);`
+
+	deleteImportedJournalEntries = `DELETE FROM JOURNAL_ENTRY WHERE merchant_reference = ? AND imported = 1;`
+
+	releaseImportedAdjustments = `UPDATE ADJUSTMENTS SET disbursement_group_id = NULL WHERE applied_at IS NULL AND disbursement_group_id IN (
+	SELECT disbursement_group_id FROM DISBURSEMENT WHERE merchReference = ? AND imported = 1);`
+
+	deleteImportedDisbursements = `DELETE FROM DISBURSEMENT WHERE merchReference = ? AND imported = 1;`
+
+	deleteRemovedOrders = `DELETE FROM ORDERS WHERE merchant_reference = ? AND NOT EXISTS (SELECT 1 FROM DISBURSEMENT WHERE order_id = ORDERS.id)
+	AND NOT EXISTS (SELECT 1 FROM REFUNDS WHERE order_id = ORDERS.id);`
+
+	deleteImportedMonthly = `DELETE FROM MONTHLY WHERE merchant_reference = ? AND imported = 1;`
+
+	getImportDigests = `SELECT merchant_reference, digest FROM IMPORT_DIGESTS;`
+
+	clearImportDigest = `DELETE FROM IMPORT_DIGESTS WHERE merchant_reference = ?;`
+
+	getImportWatermarks = `SELECT merchant_reference, created_at, order_ids FROM IMPORT_WATERMARKS;`
+
+	setImportWatermark = `INSERT INTO IMPORT_WATERMARKS(merchant_reference, created_at, order_ids, updated_at) VALUES (?,?,?,?)
+										ON DUPLICATE KEY UPDATE created_at = VALUES(created_at), order_ids = VALUES(order_ids), updated_at = VALUES(updated_at);`
+
+	getOpenImportedGroups = `SELECT g.record_uuid, g.disbursement_group_id, g.merchReference, g.order_id, COALESCE(g.order_amount, 0), g.currency, g.order_fee, g.fee_schedule_id, g.fee_schedule_version,
+										-SUM(COALESCE(fee.amount, 0)) OVER (PARTITION BY g.disbursement_group_id ORDER BY o.created_at, g.order_id), g.payout_date, COALESCE(g.rolled_payout_date, g.payout_date), -SUM(COALESCE(payable.amount, 0)) OVER (PARTITION BY g.disbursement_group_id ORDER BY o.created_at, g.order_id), g.on_request FROM DISBURSEMENT g
+										LEFT JOIN JOURNAL_ENTRY e ON e.kind = 'ORDER' AND e.reference = g.order_id
+										LEFT JOIN LEDGER_POSTING fee ON fee.entry_id = e.id AND fee.account = 'FEE_REVENUE'
+										LEFT JOIN LEDGER_POSTING payable ON payable.entry_id = e.id AND payable.account = 'MERCHANT_PAYABLE'
+										LEFT JOIN ORDERS o ON o.id = g.order_id
+										WHERE g.is_paid_out = 0 AND g.disbursement_group_id IN (SELECT d.disbursement_group_id FROM DISBURSEMENT d
+										WHERE d.merchReference = ? AND d.imported = 1 AND d.payout_date = (SELECT MAX(l.payout_date) FROM DISBURSEMENT l
+										WHERE l.merchReference = d.merchReference AND l.currency = d.currency AND l.imported = 1))
+										ORDER BY g.currency, g.disbursement_group_id, o.created_at, g.order_id;`
+
+	getLastMonthlyFeeDate = `SELECT MAX(monthly_fee_date) FROM MONTHLY WHERE merchant_reference = ?;`
+
+	upsertDisbursementsOnDuplicate = ` ON DUPLICATE KEY UPDATE payout_total = VALUES(payout_total), monthly_fee_deduction = VALUES(monthly_fee_deduction), is_paid_out = VALUES(is_paid_out)`
+
+	setImportDigest = `INSERT INTO IMPORT_DIGESTS(merchant_reference, digest, updated_at) VALUES (?,?,?) ON DUPLICATE KEY UPDATE digest = VALUES(digest), updated_at = VALUES(updated_at);`
+
+	insertImportJob = `INSERT INTO IMPORT_JOBS(id, state, rows_processed, rows_rejected, error, stats, created_at) VALUES (?,?,?,?,?,?,?);`
+
+	updateImportJob = `UPDATE IMPORT_JOBS SET state = ?, rows_processed = ?, rows_rejected = ?, error = ?, stats = ?, started_at = ?, completed_at = ? WHERE id = ?;`
+
+	getImportJob = `SELECT id, state, rows_processed, rows_rejected, COALESCE(error, ''), COALESCE(stats, ''), created_at, started_at, completed_at FROM IMPORT_JOBS WHERE id = ?;`
+
+	getImportJobs = `SELECT id, state, rows_processed, rows_rejected, COALESCE(error, ''), COALESCE(stats, ''), created_at, started_at, completed_at FROM IMPORT_JOBS ORDER BY created_at DESC LIMIT ?;`
+
+	bulkInsertImportRejects = `INSERT INTO IMPORT_REJECTS(job_id, file, line, record, reason) VALUES `
+
+	getImportRejects = `SELECT job_id, file, line, COALESCE(record, ''), reason FROM IMPORT_REJECTS WHERE job_id = ? ORDER BY file, line;`
+
+	failUnfinishedImportJobs = `UPDATE IMPORT_JOBS SET state = ?, error = ?, completed_at = ? WHERE state NOT IN (?,?,?);`
 )
 
 type DisburserRepoRepository interface {
@@ -45,14 +224,52 @@ type DisburserRepoRepository interface {
 	GetMerchantDisbursementsByRange(logger slog.Logger, merchantUUID uuid.UUID, start time.Time, end time.Time) (reports.Report, error)
 	GetMerchant(merchantUUID uuid.UUID) (types.Merchant, error)
 	GetMerchantByReferenceID(merchantReferenceID string) (types.Merchant, error)
-	GetDisbursementGroupID(ctx context.Context, today time.Time, merchRef string) (uuid.UUID, error)
+	GetDisbursementGroupID(ctx context.Context, today time.Time, merchRef, currency string) (uuid.UUID, error)
+	GetOnRequestGroupID(ctx context.Context, merchRef, currency string) (uuid.UUID, error)
+	RequestPayout(ctx context.Context, merchRef, currency string, rolledPayoutDate time.Time) (types.DisbursementGroup, error)
+	GetPayoutHolds(ctx context.Context, merchRef string) ([]types.PayoutHold, error)
+	PlacePayoutHold(ctx context.Context, hold types.PayoutHold) error
+	LiftPayoutHold(ctx context.Context, hold types.PayoutHold) error
+	SetReservePolicy(ctx context.Context, merchRef string, p types.ReservePolicy) error
+	GetDueReserves(ctx context.Context, runDate time.Time) ([]types.Reserve, error)
+	ReleaseReserve(ctx context.Context, r types.Reserve) error
 	InsertOrder(order types.Order) error
+	RecordOrder(ctx context.Context, o types.Order, d types.Disbursement) (types.Order, error)
 	InsertDisbursement(disbursement types.Disbursement) (lastInsertID int64, err error)
 	InsertMerchant(m types.Merchant) error
 	GetNumberOfDisbursementsByYear(yyyy string) (int64, error)
-	GetTotalCommissionsAndPayoutByYear(yyyy string) (types.DisbursementReport, error)
+	GetTotalCommissionsAndPayoutByYear(yyyy, currency string) (types.DisbursementReport, error)
 	InsertMonthly(m types.Monthly) error
-	GetMonthlyFeesPaidByYear(YYYY string) (count, totalMonthlyFees, totalOrderFees sql.NullInt64, err error)
+	GetMonthlyFeesPaidByYear(YYYY, currency string) (count, totalMonthlyFees, totalOrderFees sql.NullInt64, err error)
+	GetDueDisbursementGroups(ctx context.Context, runDate time.Time) ([]types.DisbursementGroup, error)
+	PayDisbursementGroup(ctx context.Context, g types.DisbursementGroup) error
+	GetDisbursementRunByDate(ctx context.Context, runDate time.Time) (types.DisbursementRun, error)
+	InsertDisbursementRun(ctx context.Context, run types.DisbursementRun) error
+	UpdateDisbursementRun(ctx context.Context, run types.DisbursementRun) error
+	InsertFeeSchedule(ctx context.Context, fs types.FeeSchedule) (types.FeeSchedule, error)
+	GetFeeSchedulesByMerchantReference(ctx context.Context, merchRef string) ([]types.FeeSchedule, error)
+	GetFeeSchedules(ctx context.Context) (map[string][]types.FeeSchedule, error)
+	GetDisbursementByOrderID(ctx context.Context, orderID string) (types.Disbursement, error)
+	GetRefundsByOrderID(ctx context.Context, orderID string) ([]types.Refund, error)
+	RecordRefund(ctx context.Context, orderID string, build RefundBuilder) (types.Refund, error)
+	GetAdjustmentsForGroup(ctx context.Context, merchRef, currency string, groupID uuid.UUID) ([]types.Adjustment, error)
+	GetAccountBalances(ctx context.Context, merchRef string) ([]types.AccountBalance, error)
+	GetUnbalancedJournalEntries(ctx context.Context) ([]uuid.UUID, error)
+	GetMonthTotals(ctx context.Context, merchRef, currency string, month time.Time) (orderTotal, orderFeeTotal int64, err error)
+	GetOutstandingMonthlyFees(ctx context.Context, merchRef string) ([]types.Monthly, error)
+	BeginBulk(ctx context.Context, batchSize int) (*BulkTx, error)
+	GetMerchants(ctx context.Context) (map[uuid.UUID]types.Merchant, error)
+	GetImportDigests(ctx context.Context) (map[string]string, error)
+	GetImportWatermarks(ctx context.Context) (map[string]types.ImportWatermark, error)
+	GetOpenImportedGroups(ctx context.Context, merchRef string) ([]types.Disbursement, error)
+	GetLastMonthlyFeeDate(ctx context.Context, merchRef string) (time.Time, error)
+	InsertImportJob(ctx context.Context, job types.ImportJob) error
+	UpdateImportJob(ctx context.Context, job types.ImportJob) error
+	GetImportJob(ctx context.Context, id uuid.UUID) (types.ImportJob, error)
+	GetImportJobs(ctx context.Context, limit int) ([]types.ImportJob, error)
+	FailUnfinishedImportJobs(ctx context.Context, reason string, at time.Time) (int64, error)
+	InsertImportRejects(ctx context.Context, rejects []types.ImportReject) error
+	GetImportRejects(ctx context.Context, jobID uuid.UUID) ([]types.ImportReject, error)
 }
 
 type DisburserRepo struct {
@@ -71,9 +288,65 @@ type DisburserRepo struct {
 	createMerchantsTable                   *sql.Stmt
 	insMonthly                             *sql.Stmt
 	getMonthlyFeesPaidByYear               *sql.Stmt
+	getDueDisbursementGroups               *sql.Stmt
+	markDisbursementGroupPaid              *sql.Stmt
+	getClosingDisbursementRecord           *sql.Stmt
+	setDisbursementPayoutTotal             *sql.Stmt
+	insertDisbursementGroup                *sql.Stmt
+	insertDisbursementRun                  *sql.Stmt
+	updateDisbursementRun                  *sql.Stmt
+	getDisbursementRunByDate               *sql.Stmt
+	insertFeeSchedule                      *sql.Stmt
+	getLatestFeeScheduleVersion            *sql.Stmt
+	closeFeeSchedules                      *sql.Stmt
+	getFeeSchedulesByMerchantReference     *sql.Stmt
+	getFeeSchedules                        *sql.Stmt
+	getDisbursementByOrderID               *sql.Stmt
+	getRefundsByOrderID                    *sql.Stmt
+	insertRefund                           *sql.Stmt
+	insertAdjustment                       *sql.Stmt
+	getAdjustmentsForGroup                 *sql.Stmt
+	applyAdjustment                        *sql.Stmt
+	releaseAdjustments                     *sql.Stmt
+	journalEntryExists                     *sql.Stmt
+	insertJournalEntry                     *sql.Stmt
+	insertPosting                          *sql.Stmt
+	getAccountBalances                     *sql.Stmt
+	getAccountBalancesByMerchant           *sql.Stmt
+	getUnbalancedJournalEntries            *sql.Stmt
+	getMonthTotals                         *sql.Stmt
+	getOutstandingMonthlyFees              *sql.Stmt
+	setMonthlyFeeDeducted                  *sql.Stmt
+	insertImportJob                        *sql.Stmt
+	updateImportJob                        *sql.Stmt
+	getImportJob                           *sql.Stmt
+	getImportJobs                          *sql.Stmt
+	failUnfinishedImportJobs               *sql.Stmt
+	getImportRejects                       *sql.Stmt
+	getMerchants                           *sql.Stmt
+	getImportDigests                       *sql.Stmt
+	getImportWatermarks                    *sql.Stmt
+	getOpenImportedGroups                  *sql.Stmt
+	getLastMonthlyFeeDate                  *sql.Stmt
+	getOnRequestGroupID                    *sql.Stmt
+	requestPayout                          *sql.Stmt
+	getRequestedPayout                     *sql.Stmt
+	getActivePayoutHold                    *sql.Stmt
+	getPayoutHolds                         *sql.Stmt
+	insertPayoutHold                       *sql.Stmt
+	liftPayoutHold                         *sql.Stmt
+	setReservePolicy                       *sql.Stmt
+	insertReserve                          *sql.Stmt
+	getDueReserves                         *sql.Stmt
+	releaseReserve                         *sql.Stmt
+	requestPayoutAdjustments               *sql.Stmt
+	lockDisbursementByOrderID              *sql.Stmt
+	getOrderByID                           *sql.Stmt
+	clock                                  types.Clock
 }
 
-func NewDisburserRepo(l *slog.Logger, ctx context.Context, db *sqlx.DB) (*DisburserRepo, error) {
+// NewDisburserRepo prepares the statements of the repo on db. Journal entries are posted at the current time of clock.
+func NewDisburserRepo(l *slog.Logger, ctx context.Context, db *sqlx.DB, clock types.Clock) (*DisburserRepo, error) {
 	insOrderStmt, err := db.Prepare(insertOrder)
 	if err != nil {
 		return &DisburserRepo{}, err
@@ -124,164 +397,1964 @@ func NewDisburserRepo(l *slog.Logger, ctx context.Context, db *sqlx.DB) (*Disbur
 		return &DisburserRepo{}, err
 	}
 
-	return &DisburserRepo{
-		db:                                     db,
-		ctx:                                    ctx,
-		logger:                                 l,
-		insertOrder:                            insOrderStmt,
-		insertDisbursement:                     insDisbursementStmt,
-		insertMerchant:                         insertMerchantStmt,
-		getOrdersByMerchantReferenceID:         getOrdersByMerchRefID,
-		getMerchantByRefID:                     getMerchantByRefID,
-		getDisbursementGroupID:                 getDisburseGroupID,
-		getNumberOfDisbursementsByYear:         getNumDisbursementsByYear,
-		getTotalCommissionAndTotalPayoutByYear: getTotalCommAndPayoutByYear,
-		insMonthly:                             insertMonthlyStmt,
-		getMonthlyFeesPaidByYear:               getMonthlyFeesPaidByYearStmt,
-	}, nil
-}
+	getDueDisbursementGroupsStmt, err := db.Prepare(getDueDisbursementGroups)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
 
-func (dr *DisburserRepo) GetOrdersByMerchantUUID(merchantUUID uuid.UUID) ([]types.Order, error) {
-	//TODO Implement
-	return []types.Order{}, errors.New("not implemented")
-}
+	markDisbursementGroupPaidStmt, err := db.Prepare(markDisbursementGroupPaid)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
 
-func (dr *DisburserRepo) GetOrdersByMerchantReferenceID(ctx context.Context, merchRef string) ([]types.Order, error) {
-	var orders []types.Order
-	rows, err := dr.getOrdersByMerchantReferenceID.QueryContext(ctx)
+	getClosingDisbursementRecordStmt, err := db.Prepare(getClosingDisbursementRecord)
 	if err != nil {
-		return nil, err
+		return &DisburserRepo{}, err
 	}
 
-	counter := 0
-	for rows.Next() {
-		err = rows.Scan(orders[counter])
-		if err != nil {
-			return nil, err
-		}
-		counter++
+	setDisbursementPayoutTotalStmt, err := db.Prepare(setDisbursementPayoutTotal)
+	if err != nil {
+		return &DisburserRepo{}, err
 	}
-	return orders, nil
-}
-func (dr *DisburserRepo) GetMerchantDisbursementsByRange(logger slog.Logger, merchantUUID uuid.UUID, start time.Time, end time.Time) (reports.Report, error) {
-	//TODO Implement
-	return reports.Report{}, errors.New("not implemented")
-}
 
-func (dr *DisburserRepo) GetMerchant(merchantUUID uuid.UUID) (types.Merchant, error) {
-	//TODO Implemement
-	return types.Merchant{}, errors.New("not implemented")
-}
+	insertDisbursementGroupStmt, err := db.Prepare(insertDisbursementGroup)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
 
-func (dr *DisburserRepo) GetMerchantByReferenceID(merchantReferenceID string) (types.Merchant, error) {
-	var liveOn string
-	m := &types.Merchant{}
+	insertDisbursementRunStmt, err := db.Prepare(insertDisbursementRun)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
 
-	err := dr.getMerchantByRefID.QueryRow(merchantReferenceID).Scan(&m.ID, &m.Reference, &m.Email, &liveOn, &m.DisbursementFrequency, &m.MinMonthlyFee)
+	updateDisbursementRunStmt, err := db.Prepare(updateDisbursementRun)
 	if err != nil {
-		return *m, err
+		return &DisburserRepo{}, err
 	}
-	m.LiveOn, err = time.Parse("2006-01-02 15:04:05+00:00", liveOn)
+
+	getDisbursementRunByDateStmt, err := db.Prepare(getDisbursementRunByDate)
 	if err != nil {
-		return *m, err
+		return &DisburserRepo{}, err
 	}
-	return *m, nil
-}
 
-// GetDisbursementGroupID returns the row with groupID if exists or err which should be ErrNoRows which tells us we need to create the groupID
-func (dr *DisburserRepo) GetDisbursementGroupID(ctx context.Context, today time.Time, merchRef string) (uuid.UUID, error) {
-	var refId uuid.UUID
-	t := today.Format(time.DateOnly)
-	row := dr.getDisbursementGroupID.QueryRowContext(ctx, t, merchRef)
-	err := row.Err()
+	insertFeeScheduleStmt, err := db.Prepare(insertFeeSchedule)
 	if err != nil {
-		return uuid.UUID{}, err
+		return &DisburserRepo{}, err
 	}
 
-	err = row.Scan(refId)
-	if errors.Is(err, sql.ErrNoRows) {
-		return uuid.UUID{}, err
+	getLatestFeeScheduleVersionStmt, err := db.Prepare(getLatestFeeScheduleVersion)
+	if err != nil {
+		return &DisburserRepo{}, err
 	}
 
-	return refId, nil
-}
+	closeFeeSchedulesStmt, err := db.Prepare(closeFeeSchedules)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
 
-// GetNumberOfDisbursementsByYear takes the year format of YYYY as a string and returns the number of disbursements for that year or an error.
-func (dr *DisburserRepo) GetNumberOfDisbursementsByYear(yyyy string) (int64, error) {
-	var n int64
-	row := dr.getNumberOfDisbursementsByYear.QueryRow(yyyy)
-	err := row.Scan(n)
+	getFeeSchedulesByMerchRefStmt, err := db.Prepare(getFeeSchedulesByMerchantReference)
 	if err != nil {
-		return 0, err
+		return &DisburserRepo{}, err
 	}
-	return n, nil
-}
 
-func (dr *DisburserRepo) GetTotalCommissionsAndPayoutByYear(yyyy string) (types.DisbursementReport, error) {
-	disrpt := types.DisbursementReport{}
-	row := dr.getTotalCommissionAndTotalPayoutByYear.QueryRow(yyyy)
-	err := row.Scan(&disrpt.NumberOfDisbursements, &disrpt.AmountDisbursedToMerchants, &disrpt.AmountOfOrderFees)
+	getFeeSchedulesStmt, err := db.Prepare(getFeeSchedules)
 	if err != nil {
-		return disrpt, err
+		return &DisburserRepo{}, err
 	}
 
-	return disrpt, nil
-}
+	getDisbursementByOrderIDStmt, err := db.Prepare(getDisbursementByOrderID)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
 
-func (dr *DisburserRepo) InsertOrder(o types.Order) error {
-	_, err := dr.insertOrder.Exec(o.ID, o.MerchantReference, o.Amount, o.CreatedAt)
+	getRefundsByOrderIDStmt, err := db.Prepare(getRefundsByOrderID)
 	if err != nil {
-		return err
+		return &DisburserRepo{}, err
 	}
-	return nil
-}
 
-func (dr *DisburserRepo) InsertDisbursement(d types.Disbursement) (lastInsertID int64, err error) {
-	res, err := dr.insertDisbursement.Exec(d.RecordUUID, d.DisbursementGroupID, d.MerchReference, d.OrderID, d.OrderFee, d.OrderFeeRunningTotal, d.PayoutDate, d.PayoutRunningTotal, d.PayoutTotal, d.IsPaidOut)
+	insertRefundStmt, err := db.Prepare(insertRefund)
 	if err != nil {
-		return 0, err
+		return &DisburserRepo{}, err
 	}
 
-	lID, err := res.LastInsertId()
+	insertAdjustmentStmt, err := db.Prepare(insertAdjustment)
 	if err != nil {
-		return 0, err
+		return &DisburserRepo{}, err
 	}
-	return lID, nil
-}
 
-func (dr *DisburserRepo) InsertMerchant(m types.Merchant) error {
-	_, err := dr.insertMerchant.Exec(m.ID, m.Reference, m.Email, m.LiveOn, m.DisbursementFrequency, m.MinMonthlyFee)
+	getAdjustmentsForGroupStmt, err := db.Prepare(getAdjustmentsForGroup)
 	if err != nil {
-		return err
+		return &DisburserRepo{}, err
 	}
-	return nil
-}
 
-func (dr *DisburserRepo) InsertMonthly(m types.Monthly) error {
-	id := m.ID.String()
-	merchID := m.MerchantID.String()
-	monDate := m.MonthlyFeeDate
-	createdAt := m.CreatedAt
-	_, err := dr.insMonthly.Exec(id, merchID, m.MerchantReference, monDate, m.DidPayFee, m.MonthlyFee, m.TotalOrderAmt, m.OrderFeeTotal, createdAt, time.Now().UTC().Format(time.DateTime))
+	applyAdjustmentStmt, err := db.Prepare(applyAdjustment)
 	if err != nil {
-		dr.logger.Info("failed to insert", "monthly", m)
-		return err
+		return &DisburserRepo{}, err
 	}
-	return nil
-}
 
-func (dr *DisburserRepo) GetMonthlyFeesPaidByYear(YYYY string) (count, totalMonthlyFees, totalOrderFees sql.NullInt64, err error) {
-	dest := &struct {
-		count                sql.NullInt64
-		totalMonthlyFees     sql.NullInt64
-		totalOrderFees       sql.NullInt64
-		totalMonthlyFeesPaid sql.NullInt64
-	}{}
-	row := dr.getMonthlyFeesPaidByYear.QueryRow(YYYY)
-	err = row.Scan(&dest.count, &dest.totalMonthlyFees, &dest.totalOrderFees, &dest.totalMonthlyFeesPaid)
+	releaseAdjustmentsStmt, err := db.Prepare(releaseAdjustments)
 	if err != nil {
-		dr.logger.Error("failed to get monthly fees paid by year")
-		return sql.NullInt64{}, sql.NullInt64{}, sql.NullInt64{}, err
+		return &DisburserRepo{}, err
 	}
-	return dest.count, dest.totalMonthlyFees, dest.totalOrderFees, nil
+
+	journalEntryExistsStmt, err := db.Prepare(journalEntryExists)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	insertJournalEntryStmt, err := db.Prepare(insertJournalEntry)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	insertPostingStmt, err := db.Prepare(insertPosting)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getAccountBalancesStmt, err := db.Prepare(getAccountBalances)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getAccountBalancesByMerchantStmt, err := db.Prepare(getAccountBalancesByMerchant)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getUnbalancedJournalEntriesStmt, err := db.Prepare(getUnbalancedJournalEntries)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getMonthTotalsStmt, err := db.Prepare(getMonthTotals)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getOutstandingMonthlyFeesStmt, err := db.Prepare(getOutstandingMonthlyFees)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	setMonthlyFeeDeductedStmt, err := db.Prepare(setMonthlyFeeDeducted)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	insertImportJobStmt, err := db.Prepare(insertImportJob)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	updateImportJobStmt, err := db.Prepare(updateImportJob)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getImportJobStmt, err := db.Prepare(getImportJob)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getImportJobsStmt, err := db.Prepare(getImportJobs)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	failUnfinishedImportJobsStmt, err := db.Prepare(failUnfinishedImportJobs)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getImportRejectsStmt, err := db.Prepare(getImportRejects)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getMerchantsStmt, err := db.Prepare(getMerchants)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getImportDigestsStmt, err := db.Prepare(getImportDigests)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getImportWatermarksStmt, err := db.Prepare(getImportWatermarks)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getOpenImportedGroupsStmt, err := db.Prepare(getOpenImportedGroups)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getLastMonthlyFeeDateStmt, err := db.Prepare(getLastMonthlyFeeDate)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getOnRequestGroupIDStmt, err := db.Prepare(getOnRequestGroupID)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	requestPayoutStmt, err := db.Prepare(requestPayout)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getRequestedPayoutStmt, err := db.Prepare(getRequestedPayout)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getActivePayoutHoldStmt, err := db.Prepare(getActivePayoutHold)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getPayoutHoldsStmt, err := db.Prepare(getPayoutHolds)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	insertPayoutHoldStmt, err := db.Prepare(insertPayoutHold)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	liftPayoutHoldStmt, err := db.Prepare(liftPayoutHold)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	setReservePolicyStmt, err := db.Prepare(setReservePolicy)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	insertReserveStmt, err := db.Prepare(insertReserve)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getDueReservesStmt, err := db.Prepare(getDueReserves)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	releaseReserveStmt, err := db.Prepare(releaseReserve)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	requestPayoutAdjustmentsStmt, err := db.Prepare(requestPayoutAdjustments)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	lockDisbursementByOrderIDStmt, err := db.Prepare(lockDisbursementByOrderID)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	getOrderByIDStmt, err := db.Prepare(getOrderByID)
+	if err != nil {
+		return &DisburserRepo{}, err
+	}
+
+	return &DisburserRepo{
+		db:                                     db,
+		ctx:                                    ctx,
+		logger:                                 l,
+		clock:                                  clock,
+		insertOrder:                            insOrderStmt,
+		insertDisbursement:                     insDisbursementStmt,
+		insertMerchant:                         insertMerchantStmt,
+		getOrdersByMerchantReferenceID:         getOrdersByMerchRefID,
+		getMerchantByRefID:                     getMerchantByRefID,
+		getDisbursementGroupID:                 getDisburseGroupID,
+		getNumberOfDisbursementsByYear:         getNumDisbursementsByYear,
+		getTotalCommissionAndTotalPayoutByYear: getTotalCommAndPayoutByYear,
+		insMonthly:                             insertMonthlyStmt,
+		getMonthlyFeesPaidByYear:               getMonthlyFeesPaidByYearStmt,
+		getDueDisbursementGroups:               getDueDisbursementGroupsStmt,
+		markDisbursementGroupPaid:              markDisbursementGroupPaidStmt,
+		getClosingDisbursementRecord:           getClosingDisbursementRecordStmt,
+		setDisbursementPayoutTotal:             setDisbursementPayoutTotalStmt,
+		insertDisbursementGroup:                insertDisbursementGroupStmt,
+		insertDisbursementRun:                  insertDisbursementRunStmt,
+		updateDisbursementRun:                  updateDisbursementRunStmt,
+		getDisbursementRunByDate:               getDisbursementRunByDateStmt,
+		insertFeeSchedule:                      insertFeeScheduleStmt,
+		getLatestFeeScheduleVersion:            getLatestFeeScheduleVersionStmt,
+		closeFeeSchedules:                      closeFeeSchedulesStmt,
+		getFeeSchedulesByMerchantReference:     getFeeSchedulesByMerchRefStmt,
+		getFeeSchedules:                        getFeeSchedulesStmt,
+		getDisbursementByOrderID:               getDisbursementByOrderIDStmt,
+		getRefundsByOrderID:                    getRefundsByOrderIDStmt,
+		insertRefund:                           insertRefundStmt,
+		insertAdjustment:                       insertAdjustmentStmt,
+		getAdjustmentsForGroup:                 getAdjustmentsForGroupStmt,
+		applyAdjustment:                        applyAdjustmentStmt,
+		releaseAdjustments:                     releaseAdjustmentsStmt,
+		journalEntryExists:                     journalEntryExistsStmt,
+		insertJournalEntry:                     insertJournalEntryStmt,
+		insertPosting:                          insertPostingStmt,
+		getAccountBalances:                     getAccountBalancesStmt,
+		getAccountBalancesByMerchant:           getAccountBalancesByMerchantStmt,
+		getUnbalancedJournalEntries:            getUnbalancedJournalEntriesStmt,
+		getMonthTotals:                         getMonthTotalsStmt,
+		getOutstandingMonthlyFees:              getOutstandingMonthlyFeesStmt,
+		setMonthlyFeeDeducted:                  setMonthlyFeeDeductedStmt,
+		insertImportJob:                        insertImportJobStmt,
+		updateImportJob:                        updateImportJobStmt,
+		getImportJob:                           getImportJobStmt,
+		getImportJobs:                          getImportJobsStmt,
+		failUnfinishedImportJobs:               failUnfinishedImportJobsStmt,
+		getImportRejects:                       getImportRejectsStmt,
+		getMerchants:                           getMerchantsStmt,
+		getImportDigests:                       getImportDigestsStmt,
+		getImportWatermarks:                    getImportWatermarksStmt,
+		getOpenImportedGroups:                  getOpenImportedGroupsStmt,
+		getLastMonthlyFeeDate:                  getLastMonthlyFeeDateStmt,
+		getOnRequestGroupID:                    getOnRequestGroupIDStmt,
+		requestPayout:                          requestPayoutStmt,
+		getRequestedPayout:                     getRequestedPayoutStmt,
+		getActivePayoutHold:                    getActivePayoutHoldStmt,
+		getPayoutHolds:                         getPayoutHoldsStmt,
+		insertPayoutHold:                       insertPayoutHoldStmt,
+		liftPayoutHold:                         liftPayoutHoldStmt,
+		setReservePolicy:                       setReservePolicyStmt,
+		insertReserve:                          insertReserveStmt,
+		getDueReserves:                         getDueReservesStmt,
+		releaseReserve:                         releaseReserveStmt,
+		requestPayoutAdjustments:               requestPayoutAdjustmentsStmt,
+		lockDisbursementByOrderID:              lockDisbursementByOrderIDStmt,
+		getOrderByID:                           getOrderByIDStmt,
+	}, nil
+}
+
+func (dr *DisburserRepo) GetOrdersByMerchantUUID(merchantUUID uuid.UUID) ([]types.Order, error) {
+	//TODO Implement
+	return []types.Order{}, errors.New("not implemented")
+}
+
+func (dr *DisburserRepo) GetOrdersByMerchantReferenceID(ctx context.Context, merchRef string) ([]types.Order, error) {
+	var orders []types.Order
+	rows, err := dr.getOrdersByMerchantReferenceID.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := 0
+	for rows.Next() {
+		err = rows.Scan(orders[counter])
+		if err != nil {
+			return nil, err
+		}
+		counter++
+	}
+	return orders, nil
+}
+func (dr *DisburserRepo) GetMerchantDisbursementsByRange(logger slog.Logger, merchantUUID uuid.UUID, start time.Time, end time.Time) (reports.Report, error) {
+	//TODO Implement
+	return reports.Report{}, errors.New("not implemented")
+}
+
+func (dr *DisburserRepo) GetMerchant(merchantUUID uuid.UUID) (types.Merchant, error) {
+	//TODO Implemement
+	return types.Merchant{}, errors.New("not implemented")
+}
+
+func (dr *DisburserRepo) GetMerchantByReferenceID(merchantReferenceID string) (types.Merchant, error) {
+	var liveOn string
+	m := &types.Merchant{}
+
+	err := dr.getMerchantByRefID.QueryRow(merchantReferenceID).Scan(&m.ID, &m.Reference, &m.Email, &liveOn, &m.DisbursementFrequency, &m.MinMonthlyFee, &m.Currency, &m.Timezone, &m.PayoutDay, &m.Reserve.RateBasisPoints, &m.Reserve.Days)
+	if err != nil {
+		return *m, err
+	}
+	m.LiveOn, err = time.Parse("2006-01-02 15:04:05+00:00", liveOn)
+	if err != nil {
+		return *m, err
+	}
+
+	m.FeeSchedules, err = dr.GetFeeSchedulesByMerchantReference(dr.ctx, m.Reference)
+	if err != nil {
+		return *m, err
+	}
+
+	m.Hold, err = dr.getActiveHold(dr.ctx, m.Reference)
+	if err != nil {
+		return *m, err
+	}
+	return *m, nil
+}
+
+// getActiveHold returns the payout hold in place on the merchant, nil when there is none.
+func (dr *DisburserRepo) getActiveHold(ctx context.Context, merchRef string) (*types.PayoutHold, error) {
+	var h types.PayoutHold
+	var placedAt string
+	err := dr.getActivePayoutHold.QueryRowContext(ctx, merchRef).Scan(&h.ID, &h.MerchantReference, &h.Reason, &placedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	h.PlacedAt, err = parseDBTime(placedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// GetPayoutHolds returns the payout holds placed on the merchant, lifted or not, oldest first.
+func (dr *DisburserRepo) GetPayoutHolds(ctx context.Context, merchRef string) ([]types.PayoutHold, error) {
+	rows, err := dr.getPayoutHolds.QueryContext(ctx, merchRef)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var holds []types.PayoutHold
+	for rows.Next() {
+		var h types.PayoutHold
+		var placedAt, liftedAt string
+		err = rows.Scan(&h.ID, &h.MerchantReference, &h.Reason, &placedAt, &liftedAt, &h.LiftReason)
+		if err != nil {
+			return nil, err
+		}
+
+		h.PlacedAt, err = parseDBTime(placedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if liftedAt != "" {
+			h.LiftedAt, err = parseDBTime(liftedAt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+// ErrHoldInPlace is returned by PlacePayoutHold when the merchant already has a payout hold in place.
+var ErrHoldInPlace = errors.New("payout hold already in place")
+
+// PlacePayoutHold records the payout hold placed on its merchant. The unique key on the merchant reference of the holds in place
+// keeps concurrent requests from placing a second hold, which is refused with ErrHoldInPlace.
+func (dr *DisburserRepo) PlacePayoutHold(ctx context.Context, hold types.PayoutHold) error {
+	_, err := dr.insertPayoutHold.ExecContext(ctx, hold.ID, hold.MerchantReference, hold.Reason, hold.PlacedAt.UTC().Format(time.DateTime))
+	if isDuplicateKey(err) {
+		return ErrHoldInPlace
+	}
+	return err
+}
+
+// LiftPayoutHold records the hold as lifted at its LiftedAt for its LiftReason. It returns sql.ErrNoRows when the hold is not in
+// place.
+func (dr *DisburserRepo) LiftPayoutHold(ctx context.Context, hold types.PayoutHold) error {
+	res, err := dr.liftPayoutHold.ExecContext(ctx, hold.LiftedAt.UTC().Format(time.DateTime), hold.LiftReason, hold.ID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetReservePolicy replaces the reserve policy of the merchant. It returns sql.ErrNoRows when there is no such merchant.
+func (dr *DisburserRepo) SetReservePolicy(ctx context.Context, merchRef string, p types.ReservePolicy) error {
+	res, err := dr.setReservePolicy.ExecContext(ctx, p.RateBasisPoints, p.Days, merchRef)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetDueReserves returns the reserves not released yet whose release date is on or before runDate.
+func (dr *DisburserRepo) GetDueReserves(ctx context.Context, runDate time.Time) ([]types.Reserve, error) {
+	rows, err := dr.getDueReserves.QueryContext(ctx, runDate.UTC().Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reserves []types.Reserve
+	for rows.Next() {
+		var r types.Reserve
+		var releaseDate, createdAt string
+		err = rows.Scan(&r.ID, &r.MerchantReference, &r.DisbursementGroupID, &r.Amount, &r.Currency, &releaseDate, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		r.ReleaseDate, err = parseDBTime(releaseDate)
+		if err != nil {
+			return nil, err
+		}
+
+		r.CreatedAt, err = parseDBTime(createdAt)
+		if err != nil {
+			return nil, err
+		}
+		reserves = append(reserves, r)
+	}
+	return reserves, rows.Err()
+}
+
+// ReleaseReserve records the reserve as released at its ReleasedAt with the transfer TransactionID and posts the release to the
+// ledger in one transaction. A reserve already released is left as it is.
+func (dr *DisburserRepo) ReleaseReserve(ctx context.Context, r types.Reserve) error {
+	tx, err := dr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var txID any
+	if r.TransactionID != "" {
+		txID = r.TransactionID
+	}
+
+	res, err := tx.StmtContext(ctx, dr.releaseReserve).ExecContext(ctx, txID, r.ReleasedAt.UTC().Format(time.DateTime), r.ID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+
+	err = dr.postJournalEntry(ctx, tx, types.NewReserveReleaseEntry(r))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetDisbursementGroupID returns the row with groupID if exists or err which should be ErrNoRows which tells us we need to create the groupID.
+// The merchant has a group per payout date and currency. Only groups not paid out yet are returned: an order dated on a payout date
+// whose group the disbursement run has already paid opens a new group, paid out by the next run.
+func (dr *DisburserRepo) GetDisbursementGroupID(ctx context.Context, today time.Time, merchRef, currency string) (uuid.UUID, error) {
+	var refId uuid.UUID
+	t := today.Format(time.DateOnly)
+	row := dr.getDisbursementGroupID.QueryRowContext(ctx, t, merchRef, types.CurrencyCode(currency))
+	err := row.Err()
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	err = row.Scan(&refId)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	return refId, nil
+}
+
+// GetOnRequestGroupID returns the id of the disbursement group the orders of the merchant in currency accrue in until it requests a
+// payout, or sql.ErrNoRows when it has no accrued orders in currency and the next order opens a new group.
+func (dr *DisburserRepo) GetOnRequestGroupID(ctx context.Context, merchRef, currency string) (uuid.UUID, error) {
+	var groupID uuid.UUID
+	err := dr.getOnRequestGroupID.QueryRowContext(ctx, merchRef, types.CurrencyCode(currency)).Scan(&groupID)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	return groupID, nil
+}
+
+// RequestPayout makes the disbursement group the merchant has accrued its orders in currency in due on rolledPayoutDate, so they are
+// paid out by the disbursement run of that day. The group keeps its id, and the refunds recorded against it while the orders accrued
+// are applied to its payout. The group is returned with the totals of its orders, which are only final once the run applies
+// adjustments and minimum monthly fees. It returns sql.ErrNoRows when the merchant has no accrued orders in currency.
+func (dr *DisburserRepo) RequestPayout(ctx context.Context, merchRef, currency string, rolledPayoutDate time.Time) (types.DisbursementGroup, error) {
+	currency = types.CurrencyCode(currency)
+	g := types.DisbursementGroup{MerchReference: merchRef, Currency: currency, RolledPayoutDate: types.StartOfDay(rolledPayoutDate)}
+	tx, err := dr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return g, err
+	}
+	defer tx.Rollback()
+
+	err = tx.StmtContext(ctx, dr.getOnRequestGroupID).QueryRowContext(ctx, merchRef, currency).Scan(&g.ID)
+	if err != nil {
+		return g, err
+	}
+	groupID := g.ID
+
+	// adjustments bound to the accrued orders follow them, should they have accrued in more than one group
+	_, err = tx.StmtContext(ctx, dr.requestPayoutAdjustments).ExecContext(ctx, groupID, merchRef, currency)
+	if err != nil {
+		return g, err
+	}
+
+	res, err := tx.StmtContext(ctx, dr.requestPayout).ExecContext(ctx, groupID, nullDate(rolledPayoutDate), merchRef, currency)
+	if err != nil {
+		return g, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return g, err
+	}
+	if n == 0 {
+		return g, sql.ErrNoRows
+	}
+
+	var payoutDate string
+	err = tx.StmtContext(ctx, dr.getRequestedPayout).QueryRowContext(ctx, groupID).Scan(&payoutDate, &g.NumberOfOrders, &g.OrderTotal, &g.OrderFeeTotal)
+	if err != nil {
+		return g, err
+	}
+
+	g.PayoutDate, err = parseDBTime(payoutDate)
+	if err != nil {
+		return g, err
+	}
+	g.PayoutTotal = g.OrderTotal - g.OrderFeeTotal
+	return g, tx.Commit()
+}
+
+// GetNumberOfDisbursementsByYear takes the year format of YYYY as a string and returns the number of disbursements for that year or an error.
+func (dr *DisburserRepo) GetNumberOfDisbursementsByYear(yyyy string) (int64, error) {
+	var n int64
+	row := dr.getNumberOfDisbursementsByYear.QueryRow(yyyy)
+	err := row.Scan(n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (dr *DisburserRepo) GetTotalCommissionsAndPayoutByYear(yyyy, currency string) (types.DisbursementReport, error) {
+	disrpt := types.DisbursementReport{Currency: types.CurrencyCode(currency)}
+	row := dr.getTotalCommissionAndTotalPayoutByYear.QueryRow(yyyy, disrpt.Currency)
+	err := row.Scan(&disrpt.NumberOfDisbursements, &disrpt.AmountDisbursedToMerchants, &disrpt.AmountOfOrderFees)
+	if err != nil {
+		return disrpt, err
+	}
+
+	return disrpt, nil
+}
+
+func (dr *DisburserRepo) InsertOrder(o types.Order) error {
+	_, err := dr.insertOrder.Exec(o.ID, o.MerchantReference, o.MerchantID, o.Amount, types.CurrencyCode(o.Currency), o.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ErrOrderExists is returned by RecordOrder when an order with the id of the order is already stored.
+var ErrOrderExists = errors.New("order already exists")
+
+// RecordOrder stores the order and its disbursement record and posts the order to the ledger in a single transaction, so an order is
+// never stored without its disbursement. When an order with the id is already stored nothing is stored and the stored order is
+// returned with ErrOrderExists.
+func (dr *DisburserRepo) RecordOrder(ctx context.Context, o types.Order, d types.Disbursement) (types.Order, error) {
+	tx, err := dr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return o, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.StmtContext(ctx, dr.insertOrder).ExecContext(ctx, o.ID, o.MerchantReference, o.MerchantID, o.Amount, types.CurrencyCode(o.Currency), o.CreatedAt)
+	if isDuplicateKey(err) {
+		tx.Rollback()
+		stored, err := dr.getOrder(ctx, o.ID)
+		if err != nil {
+			return o, err
+		}
+		return stored, ErrOrderExists
+	}
+	if err != nil {
+		return o, err
+	}
+
+	_, err = dr.insertDisbursementTx(ctx, tx, d)
+	if err != nil {
+		return o, err
+	}
+	return o, tx.Commit()
+}
+
+func (dr *DisburserRepo) getOrder(ctx context.Context, id string) (types.Order, error) {
+	var o types.Order
+	var createdAt sql.NullString
+	err := dr.getOrderByID.QueryRowContext(ctx, id).Scan(&o.ID, &o.MerchantReference, &o.MerchantID, &o.Amount, &o.Currency, &createdAt)
+	if err != nil {
+		return o, err
+	}
+
+	if createdAt.Valid {
+		o.CreatedAt, err = parseDBTime(createdAt.String)
+	}
+	return o, err
+}
+
+// isDuplicateKey reports whether err is the error of an insert violating a primary or unique key.
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// InsertDisbursement stores the disbursement record and posts its order to the ledger in a single transaction. The closing record of
+// a group that was already paid out when it was imported also posts the payout of the group and the minimum monthly fees deducted
+// from it.
+func (dr *DisburserRepo) InsertDisbursement(d types.Disbursement) (lastInsertID int64, err error) {
+	tx, err := dr.db.BeginTx(dr.ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := dr.insertDisbursementTx(dr.ctx, tx, d)
+	if err != nil {
+		return 0, err
+	}
+
+	lID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return lID, tx.Commit()
+}
+
+func (dr *DisburserRepo) insertDisbursementTx(ctx context.Context, tx *sql.Tx, d types.Disbursement) (sql.Result, error) {
+	res, err := tx.StmtContext(ctx, dr.insertDisbursement).ExecContext(ctx, d.RecordUUID, d.DisbursementGroupID, d.MerchReference, d.OrderID, d.OrderAmount, types.CurrencyCode(d.Currency), d.OrderFee, d.FeeScheduleID, d.FeeScheduleVersion, d.PayoutDate, nullDate(d.RolledPayoutDate), d.PayoutTotal, d.MonthlyFeeDeduction, d.IsPaidOut, d.OnRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	err = dr.postJournalEntry(ctx, tx, types.NewOrderEntry(d))
+	if err != nil {
+		return nil, err
+	}
+
+	if d.IsPaidOut && d.PayoutTotal > 0 {
+		err = dr.postJournalEntry(ctx, tx, types.NewPayoutEntry(d.DisbursementGroupID, d.MerchReference, d.Currency, d.PayoutTotal, d.PayoutDate))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if d.IsPaidOut && d.MonthlyFeeDeduction > 0 {
+		err = dr.postJournalEntry(ctx, tx, types.NewMonthlyFeeDeductionEntry(d.DisbursementGroupID, d.MerchReference, d.Currency, d.MonthlyFeeDeduction, d.PayoutDate))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+func (dr *DisburserRepo) InsertMerchant(m types.Merchant) error {
+	_, err := dr.insertMerchant.Exec(m.ID, m.Reference, m.Email, m.LiveOn, m.DisbursementFrequency, m.MinMonthlyFee, types.CurrencyCode(m.Currency), m.Timezone, m.PayoutDay)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dr *DisburserRepo) InsertMonthly(m types.Monthly) error {
+	id := m.ID.String()
+	merchID := m.MerchantID.String()
+	monDate := m.MonthlyFeeDate
+	createdAt := m.CreatedAt
+	tx, err := dr.db.BeginTx(dr.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	groupID := uuid.NullUUID{UUID: m.DisbursementGroupID, Valid: m.DisbursementGroupID != uuid.Nil}
+	_, err = tx.StmtContext(dr.ctx, dr.insMonthly).Exec(id, merchID, m.MerchantReference, types.CurrencyCode(m.Currency), monDate, m.DidPayFee, m.MonthlyFee, m.TotalOrderAmt, m.OrderFeeTotal, m.FeeDeducted, groupID, createdAt, time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		dr.logger.Info("failed to insert", "monthly", m)
+		return err
+	}
+
+	err = dr.postJournalEntry(dr.ctx, tx, types.NewMonthlyFeeEntry(m))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (dr *DisburserRepo) GetMonthlyFeesPaidByYear(YYYY, currency string) (count, totalMonthlyFees, totalOrderFees sql.NullInt64, err error) {
+	dest := &struct {
+		count                sql.NullInt64
+		totalMonthlyFees     sql.NullInt64
+		totalOrderFees       sql.NullInt64
+		totalMonthlyFeesPaid sql.NullInt64
+	}{}
+	row := dr.getMonthlyFeesPaidByYear.QueryRow(YYYY, types.CurrencyCode(currency))
+	err = row.Scan(&dest.count, &dest.totalMonthlyFees, &dest.totalOrderFees, &dest.totalMonthlyFeesPaid)
+	if err != nil {
+		dr.logger.Error("failed to get monthly fees paid by year")
+		return sql.NullInt64{}, sql.NullInt64{}, sql.NullInt64{}, err
+	}
+	return dest.count, dest.totalMonthlyFees, dest.totalOrderFees, nil
+}
+
+// GetDueDisbursementGroups returns every disbursement group that has not been paid out and whose payout date, rolled forward to a
+// business day, is on or before runDate, with the order and fee totals of the group already summed. Records written before payout
+// dates were rolled are due on their payout date.
+func (dr *DisburserRepo) GetDueDisbursementGroups(ctx context.Context, runDate time.Time) ([]types.DisbursementGroup, error) {
+	var groups []types.DisbursementGroup
+	before := runDate.UTC().AddDate(0, 0, 1).Format(time.DateOnly)
+	rows, err := dr.getDueDisbursementGroups.QueryContext(ctx, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var g types.DisbursementGroup
+		var payoutDate, rolledPayoutDate string
+		err = rows.Scan(&g.ID, &g.MerchReference, &g.Currency, &payoutDate, &rolledPayoutDate, &g.NumberOfOrders, &g.OrderTotal, &g.OrderFeeTotal)
+		if err != nil {
+			return nil, err
+		}
+
+		g.PayoutDate, err = parseDBTime(payoutDate)
+		if err != nil {
+			return nil, err
+		}
+
+		g.RolledPayoutDate, err = parseDBTime(rolledPayoutDate)
+		if err != nil {
+			return nil, err
+		}
+		g.PayoutTotal = g.OrderTotal - g.OrderFeeTotal
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// PayDisbursementGroup marks every disbursement record of the group as paid, stores the payout total on the closing record of the
+// group, marks the adjustments of the group applied, records the minimum monthly fees deducted from it, posts the payout and the
+// deduction to the ledger, stores its carry forward adjustment if any and writes the DISBURSEMENT_GROUP record in a single
+// transaction.
+func (dr *DisburserRepo) PayDisbursementGroup(ctx context.Context, g types.DisbursementGroup) error {
+	tx, err := dr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var txID any
+	if g.TransactionID != "" {
+		txID = g.TransactionID
+	}
+
+	_, err = tx.StmtContext(ctx, dr.markDisbursementGroupPaid).ExecContext(ctx, txID, g.ID)
+	if err != nil {
+		return err
+	}
+
+	var closingRecord uuid.UUID
+	err = tx.StmtContext(ctx, dr.getClosingDisbursementRecord).QueryRowContext(ctx, g.ID).Scan(&closingRecord)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.StmtContext(ctx, dr.setDisbursementPayoutTotal).ExecContext(ctx, g.PayoutTotal, g.MonthlyFeeDeduction, closingRecord)
+	if err != nil {
+		return err
+	}
+
+	paidAt := g.PaidAt.UTC().Format(time.DateTime)
+	for _, adj := range g.Adjustments {
+		_, err = tx.StmtContext(ctx, dr.applyAdjustment).ExecContext(ctx, g.ID, paidAt, adj.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// adjustments recorded against the group after its payout was calculated go back to pending for the next payout
+	_, err = tx.StmtContext(ctx, dr.releaseAdjustments).ExecContext(ctx, g.ID)
+	if err != nil {
+		return err
+	}
+
+	err = dr.postJournalEntry(ctx, tx, types.NewPayoutEntry(g.ID, g.MerchReference, g.Currency, g.PayoutTotal, g.PayoutDate))
+	if err != nil {
+		return err
+	}
+
+	for _, m := range g.MonthlyFees {
+		if m.DisbursementGroupID != g.ID {
+			continue
+		}
+		_, err = tx.StmtContext(ctx, dr.setMonthlyFeeDeducted).ExecContext(ctx, m.FeeDeducted, g.ID, paidAt, m.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dr.postJournalEntry(ctx, tx, types.NewMonthlyFeeDeductionEntry(g.ID, g.MerchReference, g.Currency, g.MonthlyFeeDeduction, g.PayoutDate))
+	if err != nil {
+		return err
+	}
+
+	if g.CarryForward != nil {
+		err = insertAdjustmentTx(ctx, tx.StmtContext(ctx, dr.insertAdjustment), *g.CarryForward)
+		if err != nil {
+			return err
+		}
+	}
+
+	if g.Reserve != nil {
+		r := g.Reserve
+		_, err = tx.StmtContext(ctx, dr.insertReserve).ExecContext(ctx, r.ID, r.MerchantReference, r.DisbursementGroupID, r.Amount, types.CurrencyCode(r.Currency),
+			r.ReleaseDate.UTC().Format(time.DateOnly), r.CreatedAt.UTC().Format(time.DateTime))
+		if err != nil {
+			return err
+		}
+
+		err = dr.postJournalEntry(ctx, tx, types.NewReserveEntry(*r))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.StmtContext(ctx, dr.insertDisbursementGroup).ExecContext(ctx, g.ID, g.RunID, g.MerchReference, types.CurrencyCode(g.Currency), g.PayoutDate.Format(time.DateOnly),
+		nullDate(g.RolledPayoutDate), g.NumberOfOrders, g.OrderTotal, g.OrderFeeTotal, g.AdjustmentTotal, g.MonthlyFeeDeduction, g.ReserveAmount, g.PayoutTotal, txID, paidAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetDisbursementRunByDate returns the disbursement run for runDate or sql.ErrNoRows if the job has not been started for that day.
+func (dr *DisburserRepo) GetDisbursementRunByDate(ctx context.Context, runDate time.Time) (types.DisbursementRun, error) {
+	var run types.DisbursementRun
+	var rd, totals, startedAt string
+	err := dr.getDisbursementRunByDate.QueryRowContext(ctx, runDate.UTC().Format(time.DateOnly)).Scan(&run.ID, &rd, &run.Status,
+		&run.GroupsPaid, &run.GroupsFailed, &run.GroupsHeld, &run.ReservesPaid, &run.PayoutTotal, &run.OrderFeeTotal, &totals, &startedAt)
+	if err != nil {
+		return run, err
+	}
+
+	if totals != "" {
+		err = json.Unmarshal([]byte(totals), &run.Totals)
+		if err != nil {
+			return run, err
+		}
+	}
+
+	run.RunDate, err = parseDBTime(rd)
+	if err != nil {
+		return run, err
+	}
+
+	run.StartedAt, err = parseDBTime(startedAt)
+	if err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+func (dr *DisburserRepo) InsertDisbursementRun(ctx context.Context, run types.DisbursementRun) error {
+	totals, err := json.Marshal(run.Totals)
+	if err != nil {
+		return err
+	}
+
+	_, err = dr.insertDisbursementRun.ExecContext(ctx, run.ID, run.RunDate.UTC().Format(time.DateOnly), run.Status, run.GroupsPaid,
+		run.GroupsFailed, run.GroupsHeld, run.ReservesPaid, run.PayoutTotal, run.OrderFeeTotal, string(totals), run.StartedAt.UTC().Format(time.DateTime))
+	return err
+}
+
+func (dr *DisburserRepo) UpdateDisbursementRun(ctx context.Context, run types.DisbursementRun) error {
+	totals, err := json.Marshal(run.Totals)
+	if err != nil {
+		return err
+	}
+
+	_, err = dr.updateDisbursementRun.ExecContext(ctx, run.Status, run.GroupsPaid, run.GroupsFailed, run.GroupsHeld, run.ReservesPaid, run.PayoutTotal, run.OrderFeeTotal,
+		string(totals), run.CompletedAt.UTC().Format(time.DateTime), run.ID)
+	return err
+}
+
+// InsertFeeSchedule stores fs as the next version of the merchant's fee schedule and returns it with its version number. Any
+// earlier schedule in the currency of fs whose window extends past fs.EffectiveFrom is closed at fs.EffectiveFrom so the windows
+// never overlap.
+func (dr *DisburserRepo) InsertFeeSchedule(ctx context.Context, fs types.FeeSchedule) (types.FeeSchedule, error) {
+	tiers, err := json.Marshal(fs.Tiers)
+	if err != nil {
+		return fs, err
+	}
+
+	tx, err := dr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fs, err
+	}
+	defer tx.Rollback()
+
+	var latest int
+	err = tx.StmtContext(ctx, dr.getLatestFeeScheduleVersion).QueryRowContext(ctx, fs.MerchantReference).Scan(&latest)
+	if err != nil {
+		return fs, err
+	}
+	fs.Version = latest + 1
+	fs.Currency = types.CurrencyCode(fs.Currency)
+
+	effectiveFrom := fs.EffectiveFrom.UTC().Format(time.DateTime)
+	_, err = tx.StmtContext(ctx, dr.closeFeeSchedules).ExecContext(ctx, effectiveFrom, fs.MerchantReference, fs.Currency, effectiveFrom, effectiveFrom)
+	if err != nil {
+		return fs, err
+	}
+
+	var effectiveTo any
+	if !fs.EffectiveTo.IsZero() {
+		effectiveTo = fs.EffectiveTo.UTC().Format(time.DateTime)
+	}
+
+	_, err = tx.StmtContext(ctx, dr.insertFeeSchedule).ExecContext(ctx, fs.ID, fs.MerchantReference, fs.Currency, fs.Version, effectiveFrom, effectiveTo,
+		fs.FlatFee, fs.MaxOrder, string(tiers), time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		return fs, err
+	}
+	return fs, tx.Commit()
+}
+
+// GetFeeSchedulesByMerchantReference returns the merchant's fee schedules ordered by effective date. A merchant without negotiated
+// pricing has no fee schedules.
+func (dr *DisburserRepo) GetFeeSchedulesByMerchantReference(ctx context.Context, merchRef string) ([]types.FeeSchedule, error) {
+	rows, err := dr.getFeeSchedulesByMerchantReference.QueryContext(ctx, merchRef)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []types.FeeSchedule
+	for rows.Next() {
+		fs, err := scanFeeSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, fs)
+	}
+	return schedules, rows.Err()
+}
+
+// GetFeeSchedules returns every fee schedule keyed by merchant reference for the import.
+func (dr *DisburserRepo) GetFeeSchedules(ctx context.Context) (map[string][]types.FeeSchedule, error) {
+	rows, err := dr.getFeeSchedules.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := map[string][]types.FeeSchedule{}
+	for rows.Next() {
+		fs, err := scanFeeSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules[fs.MerchantReference] = append(schedules[fs.MerchantReference], fs)
+	}
+	return schedules, rows.Err()
+}
+
+func scanFeeSchedule(rows *sql.Rows) (types.FeeSchedule, error) {
+	var fs types.FeeSchedule
+	var effectiveFrom, tiers string
+	var effectiveTo sql.NullString
+	err := rows.Scan(&fs.ID, &fs.MerchantReference, &fs.Currency, &fs.Version, &effectiveFrom, &effectiveTo, &fs.FlatFee, &fs.MaxOrder, &tiers)
+	if err != nil {
+		return fs, err
+	}
+
+	fs.EffectiveFrom, err = parseDBTime(effectiveFrom)
+	if err != nil {
+		return fs, err
+	}
+
+	if effectiveTo.Valid {
+		fs.EffectiveTo, err = parseDBTime(effectiveTo.String)
+		if err != nil {
+			return fs, err
+		}
+	}
+
+	err = json.Unmarshal([]byte(tiers), &fs.Tiers)
+	return fs, err
+}
+
+// GetDisbursementByOrderID returns the disbursement record of the order or sql.ErrNoRows if the order has not been processed.
+func (dr *DisburserRepo) GetDisbursementByOrderID(ctx context.Context, orderID string) (types.Disbursement, error) {
+	return scanOrderDisbursement(dr.getDisbursementByOrderID.QueryRowContext(ctx, orderID))
+}
+
+func scanOrderDisbursement(row *sql.Row) (types.Disbursement, error) {
+	var d types.Disbursement
+	var payoutDate string
+	err := row.Scan(&d.RecordUUID, &d.DisbursementGroupID, &d.MerchReference, &d.OrderID, &d.OrderAmount, &d.Currency, &d.OrderFee,
+		&payoutDate, &d.IsPaidOut)
+	if err != nil {
+		return d, err
+	}
+
+	d.PayoutDate, err = parseDBTime(payoutDate)
+	return d, err
+}
+
+func (dr *DisburserRepo) GetRefundsByOrderID(ctx context.Context, orderID string) ([]types.Refund, error) {
+	rows, err := dr.getRefundsByOrderID.QueryContext(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRefunds(rows)
+}
+
+func scanRefunds(rows *sql.Rows) ([]types.Refund, error) {
+	defer rows.Close()
+
+	var refunds []types.Refund
+	for rows.Next() {
+		var rf types.Refund
+		var reason sql.NullString
+		var createdAt string
+		err := rows.Scan(&rf.ID, &rf.OrderID, &rf.MerchantReference, &rf.Amount, &rf.Currency, &reason, &rf.AdjustmentID, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		rf.Reason = reason.String
+		rf.CreatedAt, err = parseDBTime(createdAt)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, rf)
+	}
+	return refunds, rows.Err()
+}
+
+// RefundBuilder builds the refund of an order and the adjustment that takes it off the merchant's payout from the order's
+// disbursement record d and the refunds already recorded for the order, or returns an error to record nothing.
+type RefundBuilder func(d types.Disbursement, refunds []types.Refund) (types.Refund, types.Adjustment, error)
+
+// RecordRefund stores the refund of the order built by build together with its adjustment and posts it to the ledger in a single
+// transaction. The disbursement record of the order is locked before its refunds are read, so concurrent refunds of the order are
+// built one after the other and a disbursement run paying the order's group waits for the refund, or the refund for the run. It
+// returns sql.ErrNoRows when the order has not been processed.
+func (dr *DisburserRepo) RecordRefund(ctx context.Context, orderID string, build RefundBuilder) (types.Refund, error) {
+	tx, err := dr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return types.Refund{}, err
+	}
+	defer tx.Rollback()
+
+	d, err := scanOrderDisbursement(tx.StmtContext(ctx, dr.lockDisbursementByOrderID).QueryRowContext(ctx, orderID))
+	if err != nil {
+		return types.Refund{}, err
+	}
+
+	rows, err := tx.StmtContext(ctx, dr.getRefundsByOrderID).QueryContext(ctx, orderID)
+	if err != nil {
+		return types.Refund{}, err
+	}
+	refunds, err := scanRefunds(rows)
+	if err != nil {
+		return types.Refund{}, err
+	}
+
+	refund, adj, err := build(d, refunds)
+	if err != nil {
+		return refund, err
+	}
+
+	err = insertAdjustmentTx(ctx, tx.StmtContext(ctx, dr.insertAdjustment), adj)
+	if err != nil {
+		return refund, err
+	}
+
+	_, err = tx.StmtContext(ctx, dr.insertRefund).ExecContext(ctx, refund.ID, refund.OrderID, refund.MerchantReference, refund.Amount, types.CurrencyCode(refund.Currency),
+		refund.Reason, refund.AdjustmentID, refund.CreatedAt.UTC().Format(time.DateTime))
+	if err != nil {
+		return refund, err
+	}
+
+	err = dr.postJournalEntry(ctx, tx, types.NewRefundEntry(refund))
+	if err != nil {
+		return refund, err
+	}
+
+	return refund, tx.Commit()
+}
+
+// GetAdjustmentsForGroup returns the adjustments not yet applied that belong in the payout of the group, i.e. the ones recorded
+// against the group and the pending ones of the merchant in currency carried from earlier payouts.
+func (dr *DisburserRepo) GetAdjustmentsForGroup(ctx context.Context, merchRef, currency string, groupID uuid.UUID) ([]types.Adjustment, error) {
+	var adjustments []types.Adjustment
+	rows, err := dr.getAdjustmentsForGroup.QueryContext(ctx, merchRef, types.CurrencyCode(currency), groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var adj types.Adjustment
+		var groupID uuid.NullUUID
+		var reason sql.NullString
+		var createdAt string
+		err = rows.Scan(&adj.ID, &adj.MerchantReference, &groupID, &adj.Kind, &adj.SourceID, &adj.Amount, &adj.Currency, &reason, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		adj.DisbursementGroupID = groupID.UUID
+		adj.Reason = reason.String
+		adj.CreatedAt, err = parseDBTime(createdAt)
+		if err != nil {
+			return nil, err
+		}
+		adjustments = append(adjustments, adj)
+	}
+	return adjustments, rows.Err()
+}
+
+// insertAdjustmentTx inserts adj with stmt, storing a nil DisbursementGroupID as NULL so the adjustment is pending.
+func insertAdjustmentTx(ctx context.Context, stmt *sql.Stmt, adj types.Adjustment) error {
+	groupID := uuid.NullUUID{UUID: adj.DisbursementGroupID, Valid: adj.DisbursementGroupID != uuid.Nil}
+	_, err := stmt.ExecContext(ctx, adj.ID, adj.MerchantReference, groupID, adj.Kind, adj.SourceID, adj.Amount, types.CurrencyCode(adj.Currency), adj.Reason,
+		adj.CreatedAt.UTC().Format(time.DateTime))
+	return err
+}
+
+// postJournalEntry validates e and writes it with its postings in tx, unless the event it records has already been posted or it
+// has no postings. The entry is created at the current time of the repo's clock.
+func (dr *DisburserRepo) postJournalEntry(ctx context.Context, tx *sql.Tx, e types.JournalEntry) error {
+	if len(e.Postings) == 0 {
+		return nil
+	}
+
+	err := e.Validate()
+	if err != nil {
+		return err
+	}
+
+	var posted int
+	err = tx.StmtContext(ctx, dr.journalEntryExists).QueryRowContext(ctx, e.Kind, e.Reference).Scan(&posted)
+	if err != nil {
+		return err
+	}
+	if posted > 0 {
+		return nil
+	}
+
+	e.CreatedAt = dr.clock.Now()
+	_, err = tx.StmtContext(ctx, dr.insertJournalEntry).ExecContext(ctx, e.ID, e.Kind, e.Reference, e.MerchantReference,
+		e.EffectiveDate.Format(time.DateOnly), e.CreatedAt.Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+
+	insertPosting := tx.StmtContext(ctx, dr.insertPosting)
+	for _, p := range e.Postings {
+		_, err = insertPosting.ExecContext(ctx, p.ID, p.EntryID, p.Account, p.MerchantReference, types.CurrencyCode(p.Currency), p.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAccountBalances sums the ledger postings per account and merchant, for every merchant when merchRef is empty.
+func (dr *DisburserRepo) GetAccountBalances(ctx context.Context, merchRef string) ([]types.AccountBalance, error) {
+	var rows *sql.Rows
+	var err error
+	if merchRef == "" {
+		rows, err = dr.getAccountBalances.QueryContext(ctx)
+	} else {
+		rows, err = dr.getAccountBalancesByMerchant.QueryContext(ctx, merchRef)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var balances []types.AccountBalance
+	for rows.Next() {
+		var b types.AccountBalance
+		err = rows.Scan(&b.Account, &b.MerchantReference, &b.Currency, &b.Balance)
+		if err != nil {
+			return nil, err
+		}
+		balances = append(balances, b)
+	}
+	return balances, rows.Err()
+}
+
+// GetUnbalancedJournalEntries returns the ids of the journal entries whose postings do not sum to zero.
+func (dr *DisburserRepo) GetUnbalancedJournalEntries(ctx context.Context) ([]uuid.UUID, error) {
+	rows, err := dr.getUnbalancedJournalEntries.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetMonthTotals sums the order amounts and order fees of the merchant's disbursements in currency with a payout date in the month
+// starting at month.
+func (dr *DisburserRepo) GetMonthTotals(ctx context.Context, merchRef, currency string, month time.Time) (orderTotal, orderFeeTotal int64, err error) {
+	from := month.UTC().Format(time.DateOnly)
+	to := month.UTC().AddDate(0, 1, 0).Format(time.DateOnly)
+	err = dr.getMonthTotals.QueryRowContext(ctx, merchRef, types.CurrencyCode(currency), from, to).Scan(&orderTotal, &orderFeeTotal)
+	return orderTotal, orderFeeTotal, err
+}
+
+// GetOutstandingMonthlyFees returns the merchant's monthly records with a minimum monthly fee shortfall that has not been fully
+// deducted from a payout yet, oldest first.
+func (dr *DisburserRepo) GetOutstandingMonthlyFees(ctx context.Context, merchRef string) ([]types.Monthly, error) {
+	rows, err := dr.getOutstandingMonthlyFees.QueryContext(ctx, merchRef)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var monthly []types.Monthly
+	for rows.Next() {
+		var m types.Monthly
+		var feeDate string
+		err = rows.Scan(&m.ID, &m.MerchantID, &m.MerchantReference, &m.Currency, &feeDate, &m.DidPayFee, &m.MonthlyFee, &m.TotalOrderAmt,
+			&m.OrderFeeTotal, &m.FeeDeducted)
+		if err != nil {
+			return nil, err
+		}
+
+		m.MonthlyFeeDate, err = parseDBTime(feeDate)
+		if err != nil {
+			return nil, err
+		}
+		monthly = append(monthly, m)
+	}
+	return monthly, rows.Err()
+}
+
+func (dr *DisburserRepo) InsertImportJob(ctx context.Context, job types.ImportJob) error {
+	stats, err := json.Marshal(job.Stats)
+	if err != nil {
+		return err
+	}
+
+	_, err = dr.insertImportJob.ExecContext(ctx, job.ID, job.State, job.RowsProcessed, job.RowsRejected, job.Error, string(stats),
+		job.CreatedAt.UTC().Format(time.DateTime))
+	return err
+}
+
+func (dr *DisburserRepo) UpdateImportJob(ctx context.Context, job types.ImportJob) error {
+	stats, err := json.Marshal(job.Stats)
+	if err != nil {
+		return err
+	}
+
+	_, err = dr.updateImportJob.ExecContext(ctx, job.State, job.RowsProcessed, job.RowsRejected, job.Error, string(stats),
+		nullDateTime(job.StartedAt), nullDateTime(job.CompletedAt), job.ID)
+	return err
+}
+
+func (dr *DisburserRepo) GetImportJob(ctx context.Context, id uuid.UUID) (types.ImportJob, error) {
+	return scanImportJob(dr.getImportJob.QueryRowContext(ctx, id))
+}
+
+// GetImportJobs returns the latest limit import jobs, newest first.
+func (dr *DisburserRepo) GetImportJobs(ctx context.Context, limit int) ([]types.ImportJob, error) {
+	rows, err := dr.getImportJobs.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []types.ImportJob
+	for rows.Next() {
+		job, err := scanImportJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// FailUnfinishedImportJobs marks the import jobs that were queued or running when the service stopped as failed with reason and
+// returns how many there were.
+func (dr *DisburserRepo) FailUnfinishedImportJobs(ctx context.Context, reason string, at time.Time) (int64, error) {
+	res, err := dr.failUnfinishedImportJobs.ExecContext(ctx, types.IMPORT_FAILED, reason, at.UTC().Format(time.DateTime),
+		types.IMPORT_DONE, types.IMPORT_FAILED, types.IMPORT_CANCELLED)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// InsertImportRejects stores the rejects with bulk inserts in a single transaction.
+func (dr *DisburserRepo) InsertImportRejects(ctx context.Context, rejects []types.ImportReject) error {
+	tx, err := dr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows := make([][]any, 0, len(rejects))
+	for _, r := range rejects {
+		rows = append(rows, []any{r.JobID, r.File, r.Line, r.Record, r.Reason})
+	}
+
+	err = bulkInsert(ctx, tx, bulkInsertImportRejects, rows, types.IMPORT_BATCH_SIZE)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetImportRejects returns the rejects of the import job, those of the merchants file first, in line order.
+func (dr *DisburserRepo) GetImportRejects(ctx context.Context, jobID uuid.UUID) ([]types.ImportReject, error) {
+	rows, err := dr.getImportRejects.QueryContext(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rejects []types.ImportReject
+	for rows.Next() {
+		var r types.ImportReject
+		err = rows.Scan(&r.JobID, &r.File, &r.Line, &r.Record, &r.Reason)
+		if err != nil {
+			return nil, err
+		}
+		rejects = append(rejects, r)
+	}
+	return rejects, rows.Err()
+}
+
+// GetMerchants returns the stored merchants by id, without their fee schedules.
+func (dr *DisburserRepo) GetMerchants(ctx context.Context) (map[uuid.UUID]types.Merchant, error) {
+	rows, err := dr.getMerchants.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	merchants := map[uuid.UUID]types.Merchant{}
+	for rows.Next() {
+		var m types.Merchant
+		var liveOn string
+		err = rows.Scan(&m.ID, &m.Reference, &m.Email, &liveOn, &m.DisbursementFrequency, &m.MinMonthlyFee, &m.Currency, &m.Timezone, &m.PayoutDay, &m.Reserve.RateBasisPoints, &m.Reserve.Days)
+		if err != nil {
+			return nil, err
+		}
+
+		m.LiveOn, err = parseDBTime(liveOn)
+		if err != nil {
+			return nil, err
+		}
+		merchants[m.ID] = m
+	}
+	return merchants, rows.Err()
+}
+
+// GetImportDigests returns the digest every merchant was last imported with by merchant reference, see BulkTx.SetImportDigest.
+func (dr *DisburserRepo) GetImportDigests(ctx context.Context) (map[string]string, error) {
+	rows, err := dr.getImportDigests.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	digests := map[string]string{}
+	for rows.Next() {
+		var merchRef, digest string
+		err = rows.Scan(&merchRef, &digest)
+		if err != nil {
+			return nil, err
+		}
+		digests[merchRef] = digest
+	}
+	return digests, rows.Err()
+}
+
+// GetImportWatermarks returns the high-water mark of the orders imported for every merchant by merchant reference.
+func (dr *DisburserRepo) GetImportWatermarks(ctx context.Context) (map[string]types.ImportWatermark, error) {
+	rows, err := dr.getImportWatermarks.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watermarks := map[string]types.ImportWatermark{}
+	for rows.Next() {
+		var wm types.ImportWatermark
+		var createdAt, orderIDs string
+		err = rows.Scan(&wm.MerchantReference, &createdAt, &orderIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		wm.CreatedAt, err = parseDBTime(createdAt)
+		if err != nil {
+			return nil, err
+		}
+		if orderIDs != "" {
+			wm.OrderIDs = strings.Split(orderIDs, ",")
+		}
+		watermarks[wm.MerchantReference] = wm
+	}
+	return watermarks, rows.Err()
+}
+
+// GetOpenImportedGroups returns the records of the latest imported disbursement group of the merchant in each currency that has not
+// been paid out yet, in the order of their orders. Their running totals are not stored: they are summed from the fee revenue and
+// merchant payable postings of the journal entries of the orders of the group, which skip zero amounts.
+func (dr *DisburserRepo) GetOpenImportedGroups(ctx context.Context, merchRef string) ([]types.Disbursement, error) {
+	rows, err := dr.getOpenImportedGroups.QueryContext(ctx, merchRef)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var group []types.Disbursement
+	for rows.Next() {
+		var d types.Disbursement
+		var payoutDate, rolledPayoutDate string
+		err = rows.Scan(&d.RecordUUID, &d.DisbursementGroupID, &d.MerchReference, &d.OrderID, &d.OrderAmount, &d.Currency, &d.OrderFee, &d.FeeScheduleID,
+			&d.FeeScheduleVersion, &d.OrderFeeRunningTotal, &payoutDate, &rolledPayoutDate, &d.PayoutRunningTotal, &d.OnRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		d.PayoutDate, err = parseDBTime(payoutDate)
+		if err != nil {
+			return nil, err
+		}
+
+		if !d.OnRequest {
+			d.RolledPayoutDate, err = parseDBTime(rolledPayoutDate)
+			if err != nil {
+				return nil, err
+			}
+		}
+		group = append(group, d)
+	}
+	return group, rows.Err()
+}
+
+// GetLastMonthlyFeeDate returns the month of the latest monthly record of the merchant, the zero time when it has none.
+func (dr *DisburserRepo) GetLastMonthlyFeeDate(ctx context.Context, merchRef string) (time.Time, error) {
+	var month sql.NullString
+	err := dr.getLastMonthlyFeeDate.QueryRowContext(ctx, merchRef).Scan(&month)
+	if err != nil || !month.Valid {
+		return time.Time{}, err
+	}
+	return parseDBTime(month.String)
+}
+
+func scanImportJob(row interface{ Scan(dest ...any) error }) (types.ImportJob, error) {
+	var job types.ImportJob
+	var stats, createdAt string
+	var startedAt, completedAt sql.NullString
+	err := row.Scan(&job.ID, &job.State, &job.RowsProcessed, &job.RowsRejected, &job.Error, &stats, &createdAt, &startedAt, &completedAt)
+	if err != nil {
+		return job, err
+	}
+
+	if stats != "" {
+		err = json.Unmarshal([]byte(stats), &job.Stats)
+		if err != nil {
+			return job, err
+		}
+	}
+
+	job.CreatedAt, err = parseDBTime(createdAt)
+	if err != nil {
+		return job, err
+	}
+
+	if startedAt.Valid {
+		job.StartedAt, err = parseDBTime(startedAt.String)
+		if err != nil {
+			return job, err
+		}
+	}
+
+	if completedAt.Valid {
+		job.CompletedAt, err = parseDBTime(completedAt.String)
+		if err != nil {
+			return job, err
+		}
+	}
+	return job, nil
+}
+
+// nullDateTime stores the zero time as NULL.
+func nullDateTime(t time.Time) sql.NullString {
+	if t.IsZero() {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.UTC().Format(time.DateTime), Valid: true}
+}
+
+// nullDate stores the day of t, the zero time as NULL.
+func nullDate(t time.Time) sql.NullString {
+	if t.IsZero() {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.UTC().Format(time.DateOnly), Valid: true}
+}
+
+// ErrImportPaidOut is returned by BulkTx.ResetImported when a disbursement run has paid out imported records of the merchant, which
+// can then no longer be replaced.
+var ErrImportPaidOut = errors.New("imported records already paid out by a disbursement run")
+
+// BulkTx writes records with multi-row inserts of up to batchSize rows inside a single transaction, posting their ledger entries
+// as the single row inserts do. The disbursement, monthly and journal entry rows it writes are marked as imported. Nothing is
+// stored until Commit; a BulkTx that is not committed must be rolled back.
+type BulkTx struct {
+	dr        *DisburserRepo
+	ctx       context.Context
+	tx        *sql.Tx
+	batchSize int
+}
+
+// BeginBulk starts a transaction for bulk inserts of batchSize rows per statement, IMPORT_BATCH_SIZE when batchSize is not positive.
+func (dr *DisburserRepo) BeginBulk(ctx context.Context, batchSize int) (*BulkTx, error) {
+	if batchSize <= 0 {
+		batchSize = types.IMPORT_BATCH_SIZE
+	}
+
+	tx, err := dr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BulkTx{dr: dr, ctx: ctx, tx: tx, batchSize: batchSize}, nil
+}
+
+func (b *BulkTx) Commit() error {
+	return b.tx.Commit()
+}
+
+func (b *BulkTx) Rollback() error {
+	return b.tx.Rollback()
+}
+
+// UpsertMerchants stores the merchants, replacing the stored merchant with the same id.
+func (b *BulkTx) UpsertMerchants(merchants []types.Merchant) error {
+	rows := make([][]any, 0, len(merchants))
+	for _, m := range merchants {
+		rows = append(rows, []any{m.ID, m.Reference, m.Email, m.LiveOn, m.DisbursementFrequency, m.MinMonthlyFee, types.CurrencyCode(m.Currency), m.Timezone, m.PayoutDay})
+	}
+	return bulkUpsert(b.ctx, b.tx, bulkUpsertMerchants, upsertMerchantsOnDuplicate, rows, b.batchSize)
+}
+
+func (b *BulkTx) InsertOrders(orders []types.Order) error {
+	return bulkInsert(b.ctx, b.tx, bulkInsertOrders, orderRows(orders), b.batchSize)
+}
+
+// UpsertOrders stores the orders, replacing the stored order with the same id.
+func (b *BulkTx) UpsertOrders(orders []types.Order) error {
+	return bulkUpsert(b.ctx, b.tx, bulkInsertOrders, upsertOrdersOnDuplicate, orderRows(orders), b.batchSize)
+}
+
+func orderRows(orders []types.Order) [][]any {
+	rows := make([][]any, 0, len(orders))
+	for _, o := range orders {
+		rows = append(rows, []any{o.ID, o.MerchantReference, o.MerchantID, o.Amount, types.CurrencyCode(o.Currency), o.CreatedAt})
+	}
+	return rows
+}
+
+// GetStoredOrders returns the stored orders of the merchant by order id.
+func (b *BulkTx) GetStoredOrders(merchRef string) (map[string]types.Order, error) {
+	rows, err := b.tx.QueryContext(b.ctx, getStoredOrders, merchRef)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := map[string]types.Order{}
+	for rows.Next() {
+		var o types.Order
+		var createdAt string
+		err = rows.Scan(&o.ID, &o.MerchantReference, &o.MerchantID, &o.Amount, &o.Currency, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		o.CreatedAt, err = parseDBTime(createdAt)
+		if err != nil {
+			return nil, err
+		}
+		orders[o.ID] = o
+	}
+	return orders, rows.Err()
+}
+
+// ResetImported deletes the imported disbursement and monthly records of the merchant and their journal entries, so they can be
+// imported again. The adjustments still waiting for the payout of a deleted group, such as the refunds of its orders, go back to
+// pending for the merchant's next payout, as the group is recomputed under a new id. Records a disbursement run has paid out, or
+// deducted a monthly fee for, are never deleted: ErrImportPaidOut is returned instead and nothing is deleted.
+func (b *BulkTx) ResetImported(merchRef string) error {
+	var paidOut int
+	err := b.tx.QueryRowContext(b.ctx, countPaidOutImports, merchRef, merchRef).Scan(&paidOut)
+	if err != nil {
+		return err
+	}
+
+	if paidOut > 0 {
+		return ErrImportPaidOut
+	}
+
+	for _, query := range []string{deleteImportedPostings, deleteImportedJournalEntries, releaseImportedAdjustments, deleteImportedDisbursements, deleteImportedMonthly} {
+		_, err = b.tx.ExecContext(b.ctx, query, merchRef)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRemovedOrders deletes the orders of the merchant left without a disbursement record once its imported records have been
+// replaced, the orders no longer in the imported file, and returns how many were deleted. Orders that have been refunded are kept.
+func (b *BulkTx) DeleteRemovedOrders(merchRef string) (int, error) {
+	res, err := b.tx.ExecContext(b.ctx, deleteRemovedOrders, merchRef)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// UpdateMonthlyFeeDeductions stores the monthly fee deducted from a payout on the stored monthly records, skipping those without
+// a deduction.
+func (b *BulkTx) UpdateMonthlyFeeDeductions(monthly []types.Monthly) error {
+	updatedAt := time.Now().UTC().Format(time.DateTime)
+	for _, m := range monthly {
+		if m.DisbursementGroupID == uuid.Nil {
+			continue
+		}
+
+		_, err := b.tx.ExecContext(b.ctx, setMonthlyFeeDeducted, m.FeeDeducted, m.DisbursementGroupID, updatedAt, m.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetImportWatermark records the high-water mark of the orders imported for the merchant.
+func (b *BulkTx) SetImportWatermark(wm types.ImportWatermark) error {
+	_, err := b.tx.ExecContext(b.ctx, setImportWatermark, wm.MerchantReference, wm.CreatedAt.UTC().Format(time.DateTime),
+		strings.Join(wm.OrderIDs, ","), time.Now().UTC().Format(time.DateTime))
+	return err
+}
+
+// ClearImportDigest forgets the digest the merchant was last imported with, so the next full import recomputes it.
+func (b *BulkTx) ClearImportDigest(merchRef string) error {
+	_, err := b.tx.ExecContext(b.ctx, clearImportDigest, merchRef)
+	return err
+}
+
+// SetImportDigest records digest as the digest the merchant was last imported with.
+func (b *BulkTx) SetImportDigest(merchRef string, digest string) error {
+	_, err := b.tx.ExecContext(b.ctx, setImportDigest, merchRef, digest, time.Now().UTC().Format(time.DateTime))
+	return err
+}
+
+// InsertDisbursements stores the disbursement records and posts their ledger entries, see InsertDisbursement.
+func (b *BulkTx) InsertDisbursements(disbursements []types.Disbursement) error {
+	return b.upsertDisbursements(disbursements, "")
+}
+
+// UpsertDisbursements is InsertDisbursements for records that may already be stored unpaid, such as those of an open disbursement
+// group extended by an incremental import: their payout total, monthly fee deduction and paid out flag are updated.
+func (b *BulkTx) UpsertDisbursements(disbursements []types.Disbursement) error {
+	return b.upsertDisbursements(disbursements, upsertDisbursementsOnDuplicate)
+}
+
+func (b *BulkTx) upsertDisbursements(disbursements []types.Disbursement, onDuplicate string) error {
+	rows := make([][]any, 0, len(disbursements))
+	entries := make([]types.JournalEntry, 0, len(disbursements))
+	for _, d := range disbursements {
+		rows = append(rows, []any{d.RecordUUID, d.DisbursementGroupID, d.MerchReference, d.OrderID, d.OrderAmount, types.CurrencyCode(d.Currency), d.OrderFee, d.FeeScheduleID, d.FeeScheduleVersion, d.PayoutDate, nullDate(d.RolledPayoutDate), d.PayoutTotal, d.MonthlyFeeDeduction, d.IsPaidOut, d.OnRequest, true})
+		entries = append(entries, types.NewOrderEntry(d))
+		if d.IsPaidOut && d.PayoutTotal > 0 {
+			entries = append(entries, types.NewPayoutEntry(d.DisbursementGroupID, d.MerchReference, d.Currency, d.PayoutTotal, d.PayoutDate))
+		}
+		if d.IsPaidOut && d.MonthlyFeeDeduction > 0 {
+			entries = append(entries, types.NewMonthlyFeeDeductionEntry(d.DisbursementGroupID, d.MerchReference, d.Currency, d.MonthlyFeeDeduction, d.PayoutDate))
+		}
+	}
+
+	err := bulkUpsert(b.ctx, b.tx, bulkInsertDisbursements, onDuplicate, rows, b.batchSize)
+	if err != nil {
+		return err
+	}
+	return b.postJournalEntries(entries)
+}
+
+// InsertMonthly stores the monthly records and posts their ledger entries, see DisburserRepo.InsertMonthly.
+func (b *BulkTx) InsertMonthly(monthly []types.Monthly) error {
+	rows := make([][]any, 0, len(monthly))
+	entries := make([]types.JournalEntry, 0, len(monthly))
+	updatedAt := time.Now().UTC().Format(time.DateTime)
+	for _, m := range monthly {
+		groupID := uuid.NullUUID{UUID: m.DisbursementGroupID, Valid: m.DisbursementGroupID != uuid.Nil}
+		rows = append(rows, []any{m.ID.String(), m.MerchantID.String(), m.MerchantReference, types.CurrencyCode(m.Currency), m.MonthlyFeeDate, m.DidPayFee, m.MonthlyFee, m.TotalOrderAmt, m.OrderFeeTotal, m.FeeDeducted, groupID, m.CreatedAt, updatedAt, true})
+		entries = append(entries, types.NewMonthlyFeeEntry(m))
+	}
+
+	err := bulkInsert(b.ctx, b.tx, bulkInsertMonthly, rows, b.batchSize)
+	if err != nil {
+		return err
+	}
+	return b.postJournalEntries(entries)
+}
+
+// postJournalEntries is the bulk counterpart of postJournalEntry: entries without postings, entries already posted and repeated
+// entries are skipped, and the rest are written with their postings in multi-row inserts.
+func (b *BulkTx) postJournalEntries(entries []types.JournalEntry) error {
+	posted := make(map[[2]string]bool, len(entries))
+	for i := 0; i < len(entries); i += b.batchSize {
+		err := b.getPostedJournalEntries(entries[i:min(i+b.batchSize, len(entries))], posted)
+		if err != nil {
+			return err
+		}
+	}
+
+	var entryRows, postingRows [][]any
+	for _, e := range entries {
+		key := [2]string{e.Kind, e.Reference}
+		if len(e.Postings) == 0 || posted[key] {
+			continue
+		}
+
+		err := e.Validate()
+		if err != nil {
+			return err
+		}
+		posted[key] = true
+
+		e.CreatedAt = b.dr.clock.Now()
+		entryRows = append(entryRows, []any{e.ID, e.Kind, e.Reference, e.MerchantReference, e.EffectiveDate.Format(time.DateOnly), e.CreatedAt.Format(time.DateTime), true})
+		for _, p := range e.Postings {
+			postingRows = append(postingRows, []any{p.ID, p.EntryID, p.Account, p.MerchantReference, types.CurrencyCode(p.Currency), p.Amount})
+		}
+	}
+
+	err := bulkInsert(b.ctx, b.tx, bulkInsertJournalEntries, entryRows, b.batchSize)
+	if err != nil {
+		return err
+	}
+	return bulkInsert(b.ctx, b.tx, bulkInsertPostings, postingRows, b.batchSize)
+}
+
+// getPostedJournalEntries adds the kind and reference of the entries that have already been posted to posted.
+func (b *BulkTx) getPostedJournalEntries(entries []types.JournalEntry, posted map[[2]string]bool) error {
+	args := make([]any, 0, 2*len(entries))
+	for _, e := range entries {
+		args = append(args, e.Kind, e.Reference)
+	}
+	query := getPostedJournalEntries + "(" + placeholders(len(entries), 2) + ");"
+
+	rows, err := b.tx.QueryContext(b.ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key [2]string
+		err = rows.Scan(&key[0], &key[1])
+		if err != nil {
+			return err
+		}
+		posted[key] = true
+	}
+	return rows.Err()
+}
+
+// bulkInsert executes query, an INSERT ending in VALUES, for the rows in statements of up to size rows each.
+func bulkInsert(ctx context.Context, tx *sql.Tx, query string, rows [][]any, size int) error {
+	return bulkUpsert(ctx, tx, query, "", rows, size)
+}
+
+// bulkUpsert is bulkInsert with onDuplicate, an ON DUPLICATE KEY UPDATE clause, appended to every statement.
+func bulkUpsert(ctx context.Context, tx *sql.Tx, query string, onDuplicate string, rows [][]any, size int) error {
+	for len(rows) > 0 {
+		n := min(size, len(rows))
+		args := make([]any, 0, n*len(rows[0]))
+		for _, r := range rows[:n] {
+			args = append(args, r...)
+		}
+
+		_, err := tx.ExecContext(ctx, query+placeholders(n, len(rows[0]))+onDuplicate+";", args...)
+		if err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
+
+// placeholders returns the placeholder tuples for n rows of cols columns, e.g. (?,?),(?,?) for 2 rows of 2 columns.
+func placeholders(n, cols int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?,", cols), ",") + ")"
+	return strings.TrimSuffix(strings.Repeat(row+",", n), ",")
+}
+
+// parseDBTime parses the textual date and datetime representations returned by the mysql and sqlite3 drivers.
+func parseDBTime(s string) (time.Time, error) {
+	layouts := []string{time.RFC3339Nano, time.DateTime, "2006-01-02 15:04:05+00:00", time.DateOnly}
+	for _, layout := range layouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.New("unrecognised date format " + s)
 }
@@ -0,0 +1,160 @@
+package types
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Calendar tells business days from weekends and holidays. Payouts are only made on business days: a payout date that falls on a
+// weekend or holiday is rolled forward to the next business day. Weekend defaults to Saturday and Sunday when empty, and Holidays
+// maps the YYYY-MM-DD date of each holiday to its name. The zero value, and a nil *Calendar, is a calendar of weekends without
+// holidays.
+//
+// Through is the last year the holidays are known for, 0 when that is not known. Holiday lists are published a few years ahead, so
+// a day after Through may be a holiday the calendar does not have yet: see Covers.
+type Calendar struct {
+	Name     string
+	Weekend  []time.Weekday
+	Holidays map[string]string
+	Through  int
+}
+
+var defaultWeekend = []time.Weekday{time.Saturday, time.Sunday}
+
+// NewCalendar returns an empty calendar named name with the default weekend.
+func NewCalendar(name string) *Calendar {
+	return &Calendar{Name: name, Holidays: map[string]string{}}
+}
+
+// AddHoliday adds the day of t as the holiday name.
+func (c *Calendar) AddHoliday(t time.Time, name string) {
+	if c.Holidays == nil {
+		c.Holidays = map[string]string{}
+	}
+	c.Holidays[StartOfDay(t).Format(time.DateOnly)] = name
+}
+
+// Holiday returns the name of the holiday on the day of t, if it is one.
+func (c *Calendar) Holiday(t time.Time) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	name, ok := c.Holidays[StartOfDay(t).Format(time.DateOnly)]
+	return name, ok
+}
+
+// Covers reports whether the holidays of the year of t, in UTC, are known. A calendar without a Through year covers every day.
+func (c *Calendar) Covers(t time.Time) bool {
+	return c == nil || c.Through == 0 || t.UTC().Year() <= c.Through
+}
+
+// IsBusinessDay reports whether the day of t, in UTC, is neither a weekend day nor a holiday.
+func (c *Calendar) IsBusinessDay(t time.Time) bool {
+	weekend := defaultWeekend
+	if c != nil && len(c.Weekend) > 0 {
+		weekend = c.Weekend
+	}
+	if slices.Contains(weekend, t.UTC().Weekday()) {
+		return false
+	}
+	_, holiday := c.Holiday(t)
+	return !holiday
+}
+
+// RollForward returns the first business day on or after the day of t, at midnight UTC. A calendar whose every weekday is a weekend
+// day has no business days; the day of t is returned unchanged then.
+func (c *Calendar) RollForward(t time.Time) time.Time {
+	day := StartOfDay(t)
+	for i := 0; i < 366; i++ {
+		if c.IsBusinessDay(day) {
+			return day
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return StartOfDay(t)
+}
+
+// CombineCalendars returns the calendar named name whose weekend and holidays are those of all of calendars, so a day is only a
+// business day of the result when it is one in every calendar. Payouts settled through TARGET2 to Spanish banks use the
+// combination of the TARGET2 and ES calendars. The result covers the years covered by all of calendars.
+func CombineCalendars(name string, calendars ...*Calendar) *Calendar {
+	combined := NewCalendar(name)
+	for _, c := range calendars {
+		if c == nil {
+			continue
+		}
+		weekend := c.Weekend
+		if len(weekend) == 0 {
+			weekend = defaultWeekend
+		}
+		for _, wd := range weekend {
+			if !slices.Contains(combined.Weekend, wd) {
+				combined.Weekend = append(combined.Weekend, wd)
+			}
+		}
+		for day, holiday := range c.Holidays {
+			if _, ok := combined.Holidays[day]; !ok {
+				combined.Holidays[day] = holiday
+			}
+		}
+		if c.Through > 0 && (combined.Through == 0 || c.Through < combined.Through) {
+			combined.Through = c.Through
+		}
+	}
+	return combined
+}
+
+// LoadCalendars reads the holiday lists of a semicolon separated file with the header calendar;date;name and one holiday per line,
+// dated YYYY-MM-DD, and returns a calendar with the default weekend for every calendar named in it. Calendar names are upper
+// cased. Each calendar is taken to list all the holidays up to the year of its last holiday, which is its Through year.
+func LoadCalendars(r io.Reader) (map[string]*Calendar, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = ';'
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("holidays file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if strings.Join(header, ";") != "calendar;date;name" {
+		return nil, fmt.Errorf("holidays file header is %q, want %q", strings.Join(header, ";"), "calendar;date;name")
+	}
+
+	calendars := map[string]*Calendar{}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return calendars, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := cr.FieldPos(0)
+		name := strings.ToUpper(strings.TrimSpace(rec[0]))
+		if name == "" {
+			return nil, fmt.Errorf("holidays file line %d: missing calendar", line)
+		}
+		day, err := time.Parse(time.DateOnly, strings.TrimSpace(rec[1]))
+		if err != nil {
+			return nil, fmt.Errorf("holidays file line %d: %w", line, err)
+		}
+
+		c, ok := calendars[name]
+		if !ok {
+			c = NewCalendar(name)
+			calendars[name] = c
+		}
+		c.AddHoliday(day, strings.TrimSpace(rec[2]))
+		c.Through = max(c.Through, day.Year())
+	}
+}
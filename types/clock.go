@@ -0,0 +1,51 @@
+package types
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time. Payout dates and cut-offs read the time through a Clock rather than time.Now so they can be
+// evaluated at any instant, in tests and when replaying orders.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock of the system's wall clock, in UTC.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// TestClock is a Clock frozen at the time it is set to, which only moves when it is set again or advanced. It is safe for
+// concurrent use.
+type TestClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewTestClock returns a TestClock frozen at now.
+func NewTestClock(now time.Time) *TestClock {
+	return &TestClock{now: now.UTC()}
+}
+
+func (c *TestClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set freezes the clock at now.
+func (c *TestClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now.UTC()
+}
+
+// Advance moves the clock forward by d.
+func (c *TestClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -1,13 +1,53 @@
 package types
 
 const (
-	RATE_LESS_THAN_50       int64  = 10
-	RATE_BETWEEN_50_AND_300 int64  = 5
-	RATE_ABOVE_300          int64  = 25
-	MAX_ORDER               int64  = 1000000 //Should be configured per Merchant during onboarding
-	TIME_CUT_OFF            string = "08:00:00"
-	OREDERS_FILENAME               = "orders.csv"
-	MERCHANTS_FILENAME             = "merchants.csv"
-	WEEKLY                         = "WEEKLY"
-	DAILY                          = "DAILY"
+	MAX_ORDER                      int64  = 1000000 //Default max order in cents, configured per Merchant by its FeeSchedule
+	DEFAULT_CURRENCY                      = "EUR"
+	TIME_CUT_OFF                   string = "08:00:00"
+	OREDERS_FILENAME                      = "orders.csv"
+	MERCHANTS_FILENAME                    = "merchants.csv"
+	HOLIDAYS_FILENAME                     = "holidays.csv"
+	PAYOUT_CALENDARS                      = "TARGET2,ES"
+	IMPORT_CHUNK_SIZE                     = 100000 //Orders sorted in memory per chunk by the import
+	IMPORT_BATCH_SIZE                     = 1000   //Records written per batch by the import
+	WEEKLY                                = "WEEKLY"
+	DAILY                                 = "DAILY"
+	BIWEEKLY                              = "BIWEEKLY"
+	MONTHLY                               = "MONTHLY"
+	ON_DEMAND                             = "ON_DEMAND"
+	RUN_RUNNING                           = "RUNNING"
+	RUN_COMPLETED                         = "COMPLETED"
+	RUN_FAILED                            = "FAILED"
+	TRANSFER_PENDING                      = "PENDING"
+	TRANSFER_COMPLETED                    = "COMPLETED"
+	TRANSFER_FAILED                       = "FAILED"
+	TRANSFER_CANCELLED                    = "CANCELLED"
+	ADJUSTMENT_REFUND                     = "REFUND"
+	ADJUSTMENT_CARRY_FORWARD              = "CARRY_FORWARD"
+	ACCOUNT_MERCHANT_PAYABLE              = "MERCHANT_PAYABLE"
+	ACCOUNT_FEE_REVENUE                   = "FEE_REVENUE"
+	ACCOUNT_MONTHLY_FEE_RECEIVABLE        = "MONTHLY_FEE_RECEIVABLE"
+	ACCOUNT_BANK_CLEARING                 = "BANK_CLEARING"
+	ACCOUNT_MERCHANT_RESERVE              = "MERCHANT_RESERVE"
+	ENTRY_ORDER                           = "ORDER"
+	ENTRY_PAYOUT                          = "PAYOUT"
+	ENTRY_MONTHLY_FEE                     = "MONTHLY_FEE"
+	ENTRY_REFUND                          = "REFUND"
+	ENTRY_MONTHLY_FEE_DEDUCTION           = "FEE_DEDUCTION"
+	ENTRY_RESERVE                         = "RESERVE"
+	ENTRY_RESERVE_RELEASE                 = "RESERVE_RELEASE"
+	IMPORT_QUEUED                         = "QUEUED"
+	IMPORT_PARSING                        = "PARSING"
+	IMPORT_BUILDING                       = "BUILDING"
+	IMPORT_INSERTING                      = "INSERTING"
+	IMPORT_DONE                           = "DONE"
+	IMPORT_FAILED                         = "FAILED"
+	IMPORT_CANCELLED                      = "CANCELLED"
+	IMPORT_FILE_ORDERS                    = "orders"
+	IMPORT_FILE_MERCHANTS                 = "merchants"
+	IMPORT_QUEUE_SIZE                     = 16      //Import jobs waiting to run before new ones are refused
+	IMPORT_MAX_UPLOAD_SIZE                = 1 << 30 //Bytes of files uploaded by an import request
+	IMPORT_FORMAT_CSV                     = "csv"   //Legacy semicolon separated file with a header line
+	IMPORT_FORMAT_JSONL                   = "jsonl" //One JSON object per line
+	IMPORT_FORMAT_JSON                    = "json"  //JSON array of objects
 )
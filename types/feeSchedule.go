@@ -0,0 +1,139 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+// FeeTier charges RateBasisPoints of the order amount for orders below UpTo. The last tier of a schedule has UpTo set to zero and
+// applies to every amount above the previous tier.
+type FeeTier struct {
+	UpTo            int64 `json:"up_to"`
+	RateBasisPoints int64 `json:"rate_basis_points"`
+}
+
+// FeeSchedule is the pricing negotiated with a merchant for the orders in one currency. The order fee is the rate of the tier the
+// order amount falls in plus the optional FlatFee. Orders above MaxOrder are rejected. The tier thresholds, FlatFee and MaxOrder are
+// in the minor unit of Currency, the DEFAULT_CURRENCY when empty. Each schedule is a numbered version in force for orders created from
+// EffectiveFrom up to, but excluding, EffectiveTo; a zero EffectiveTo leaves the window open. Orders created outside every window of
+// their currency, including all orders of a merchant without negotiated pricing, are charged under DefaultFeeSchedule which is
+// version 0. The windows of the schedules of different currencies are independent.
+type FeeSchedule struct {
+	ID                uuid.UUID `json:"id" DB:"id"`
+	MerchantReference string    `json:"merchant_reference" DB:"merchant_reference"`
+	Currency          string    `json:"currency" DB:"currency"`
+	Version           int       `json:"version" DB:"version"`
+	EffectiveFrom     time.Time `json:"effective_from" DB:"effective_from"`
+	EffectiveTo       time.Time `json:"effective_to,omitempty" DB:"effective_to"`
+	FlatFee           int64     `json:"flat_fee" DB:"flat_fee"`
+	MaxOrder          int64     `json:"max_order" DB:"max_order"`
+	Tiers             []FeeTier `json:"tiers" DB:"tiers"`
+}
+
+// DefaultFeeSchedule returns the standard pricing in the currency c: 10% below 50.00, 5% from 50.00 up to 300.00 and 2.5% from
+// 300.00, with the thresholds and the MAX_ORDER in the minor unit of c.
+func DefaultFeeSchedule(c Currency) FeeSchedule {
+	return FeeSchedule{
+		Currency: c.Code,
+		MaxOrder: c.MinorUnits(MAX_ORDER / 100),
+		Tiers: []FeeTier{
+			{UpTo: c.MinorUnits(50), RateBasisPoints: 1000},
+			{UpTo: c.MinorUnits(300), RateBasisPoints: 500},
+			{UpTo: 0, RateBasisPoints: 250},
+		},
+	}
+}
+
+// Validate checks the currency is supported, the tiers are in ascending order ending with an unbounded tier and that rates and fees
+// are within range.
+func (fs FeeSchedule) Validate() error {
+	_, err := LookupCurrency(fs.Currency)
+	if err != nil {
+		return err
+	}
+
+	if fs.EffectiveFrom.IsZero() {
+		return errors.New("fee schedule effective_from is required")
+	}
+
+	if !fs.EffectiveTo.IsZero() && !fs.EffectiveTo.After(fs.EffectiveFrom) {
+		return errors.New("fee schedule effective_to must be after effective_from")
+	}
+
+	if len(fs.Tiers) == 0 {
+		return errors.New("fee schedule must have at least one tier")
+	}
+
+	if fs.FlatFee < 0 {
+		return errors.New("fee schedule flat_fee can not be negative")
+	}
+
+	if fs.MaxOrder < 0 {
+		return errors.New("fee schedule max_order can not be negative")
+	}
+
+	var previous int64
+	for i, tier := range fs.Tiers {
+		if tier.RateBasisPoints < 0 || tier.RateBasisPoints > 10000 {
+			return fmt.Errorf("fee tier %d rate_basis_points must be between 0 and 10000", i)
+		}
+
+		if i == len(fs.Tiers)-1 {
+			if tier.UpTo != 0 {
+				return errors.New("last fee tier must be unbounded with up_to of 0")
+			}
+			break
+		}
+
+		if tier.UpTo <= previous {
+			return fmt.Errorf("fee tier %d up_to must be greater than the previous tier", i)
+		}
+		previous = tier.UpTo
+	}
+	return nil
+}
+
+// InForceAt reports whether t falls within the schedule's effective window.
+func (fs FeeSchedule) InForceAt(t time.Time) bool {
+	if t.Before(fs.EffectiveFrom) {
+		return false
+	}
+	return fs.EffectiveTo.IsZero() || t.Before(fs.EffectiveTo)
+}
+
+// MaxOrderAmount returns the largest order amount, in the minor unit of the schedule's currency, accepted under the schedule,
+// MAX_ORDER when the schedule sets none.
+func (fs FeeSchedule) MaxOrderAmount() int64 {
+	if fs.MaxOrder == 0 {
+		return MAX_ORDER
+	}
+	return fs.MaxOrder
+}
+
+// CalculateFee returns the fee for an order amount, which must be in the currency of the schedule. Fees are in the same currency and
+// truncated to its minor unit.
+func (fs FeeSchedule) CalculateFee(amount Money) (Money, error) {
+	fee := Money{Amount: -1, Currency: amount.Currency}
+	if !SameCurrency(amount.Currency.Code, fs.Currency) {
+		return fee, fmt.Errorf("order amount in %s can not be charged under a fee schedule in %s", amount.Currency.Code, CurrencyCode(fs.Currency))
+	}
+
+	if amount.Amount > fs.MaxOrderAmount() {
+		return fee, errors.New("orderamt submitted above max orderamt value permitted")
+	}
+
+	if amount.Amount <= 0 {
+		fee.Amount = 0
+		return fee, nil
+	}
+
+	for _, tier := range fs.Tiers {
+		if tier.UpTo == 0 || amount.Amount < tier.UpTo {
+			fee.Amount = amount.Amount*tier.RateBasisPoints/10000 + fs.FlatFee
+			return fee, nil
+		}
+	}
+	return fee, errors.New("no fee tier matched the order amount")
+}
@@ -1,21 +1,9 @@
 package types
 
 import (
-	"math"
-	"strconv"
 	"time"
 )
 
-// StrToInt64 parses strings to int64 for use as money
-func StrToInt64(s string) (int64, error) {
-	fltFromStr, err := strconv.ParseFloat(s, 64)
-	if err != nil {
-		return 0, err
-	}
-
-	return int64(math.Round(fltFromStr * 100)), nil
-}
-
 // IsNewMonth takes two arguments of time.Time and returns true if they do not fall
 // in the same month. It should be noted it does not evaluate the year.
 func IsNewMonth(lastPeriod time.Time, thisPeriod time.Time) bool {
@@ -25,3 +13,63 @@ func IsNewMonth(lastPeriod time.Time, thisPeriod time.Time) bool {
 		return false
 	}
 }
+
+// StartOfDay truncates t to midnight UTC of the same calendar day.
+func StartOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// IsBeforeCutOff reports whether t is before the daily TIME_CUT_OFF UTC of its day.
+func IsBeforeCutOff(t time.Time) (bool, error) {
+	return IsBeforeCutOffIn(t, time.UTC)
+}
+
+// IsBeforeCutOffIn reports whether t is before the daily TIME_CUT_OFF of its day in loc.
+func IsBeforeCutOffIn(t time.Time, loc *time.Location) (bool, error) {
+	cutOff, err := time.Parse(time.TimeOnly, TIME_CUT_OFF)
+	if err != nil {
+		return false, err
+	}
+
+	t = t.In(loc)
+	h, m, s := cutOff.Clock()
+	return t.Before(time.Date(t.Year(), t.Month(), t.Day(), h, m, s, 0, loc)), nil
+}
+
+// CutOffDay returns the day an order created at t is paid out with: the day of t when t is before the TIME_CUT_OFF and the next
+// day otherwise. Orders only known by their date, at midnight, are taken as received before the cut-off.
+func CutOffDay(t time.Time) (time.Time, error) {
+	return CutOffDayIn(t, time.UTC)
+}
+
+// CutOffDayIn is CutOffDay with the day and the TIME_CUT_OFF of t taken in loc. The day is returned at midnight UTC, like every
+// payout date. Orders only known by their date, at midnight UTC, are paid out on that date whatever loc.
+func CutOffDayIn(t time.Time, loc *time.Location) (time.Time, error) {
+	if t.Equal(StartOfDay(t)) {
+		return StartOfDay(t), nil
+	}
+
+	ok, err := IsBeforeCutOffIn(t, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	day := DayIn(t, loc)
+	if !ok {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+// DayIn returns the calendar day of t in loc at midnight UTC.
+func DayIn(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// StartOfMonth truncates t to midnight UTC of the first day of its month.
+func StartOfMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
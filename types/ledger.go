@@ -0,0 +1,197 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"slices"
+	"time"
+)
+
+// JournalEntry is a balanced set of ledger postings recorded for a single business event. Kind and Reference identify the event,
+// e.g. ENTRY_ORDER and the order id, so an event is only ever posted once. All postings of an entry are in its Currency.
+type JournalEntry struct {
+	ID                uuid.UUID `json:"id" DB:"id"`
+	Kind              string    `json:"kind" DB:"kind"`
+	Reference         string    `json:"reference" DB:"reference"`
+	MerchantReference string    `json:"merchant_reference" DB:"merchant_reference"`
+	Currency          string    `json:"currency" DB:"currency"`
+	EffectiveDate     time.Time `json:"effective_date" DB:"effective_date"`
+	CreatedAt         time.Time `json:"created_at" DB:"created_at"`
+	Postings          []Posting `json:"postings" DB:"-"`
+}
+
+// Posting moves Amount, in the minor unit of Currency, into or out of an account of a merchant. Debits are positive and credits
+// negative, so the postings of a balanced entry sum to zero.
+type Posting struct {
+	ID                uuid.UUID `json:"id" DB:"id"`
+	EntryID           uuid.UUID `json:"entry_id" DB:"entry_id"`
+	Account           string    `json:"account" DB:"account"`
+	MerchantReference string    `json:"merchant_reference" DB:"merchant_reference"`
+	Currency          string    `json:"currency" DB:"currency"`
+	Amount            int64     `json:"amount" DB:"amount"`
+}
+
+// AccountBalance is the sum of the postings in a currency to an account of a merchant, positive for a debit balance.
+type AccountBalance struct {
+	Account           string `json:"account" DB:"account"`
+	MerchantReference string `json:"merchant_reference" DB:"merchant_reference"`
+	Currency          string `json:"currency" DB:"currency"`
+	Balance           int64  `json:"balance" DB:"balance"`
+}
+
+// TrialBalance totals the debit and credit balances of every account per currency. The books balance when the totals of every
+// currency are equal and no journal entry is unbalanced on its own.
+type TrialBalance struct {
+	Totals            []TrialBalanceTotal `json:"totals"`
+	UnbalancedEntries []uuid.UUID         `json:"unbalanced_entries"`
+	Balanced          bool                `json:"balanced"`
+	Accounts          []AccountBalance    `json:"accounts"`
+}
+
+// TrialBalanceTotal is the total of the debit and of the credit balances of the accounts in one currency.
+type TrialBalanceTotal struct {
+	Currency string `json:"currency"`
+	Debits   int64  `json:"debits"`
+	Credits  int64  `json:"credits"`
+}
+
+// newJournalEntry returns an entry without postings effective on the day of effective. Its CreatedAt is left to the repo, which sets
+// it when the entry is posted.
+func newJournalEntry(kind, reference, merchRef, currency string, effective time.Time) JournalEntry {
+	return JournalEntry{
+		ID:                uuid.New(),
+		Kind:              kind,
+		Reference:         reference,
+		MerchantReference: merchRef,
+		Currency:          CurrencyCode(currency),
+		EffectiveDate:     effective.UTC(),
+	}
+}
+
+// post adds a posting of amount to the account, skipping zero amounts.
+func (e *JournalEntry) post(account string, amount int64) {
+	if amount == 0 {
+		return
+	}
+	e.Postings = append(e.Postings, Posting{
+		ID:                uuid.New(),
+		EntryID:           e.ID,
+		Account:           account,
+		MerchantReference: e.MerchantReference,
+		Currency:          e.Currency,
+		Amount:            amount,
+	})
+}
+
+// NewOrderEntry records the order amount of the disbursement owed to the merchant less the order fee earned on it. Entries are
+// dated on the payout date of the disbursement.
+func NewOrderEntry(d Disbursement) JournalEntry {
+	e := newJournalEntry(ENTRY_ORDER, d.OrderID, d.MerchReference, d.Currency, d.PayoutDate)
+	e.post(ACCOUNT_BANK_CLEARING, d.OrderAmount)
+	e.post(ACCOUNT_MERCHANT_PAYABLE, -(d.OrderAmount - d.OrderFee))
+	e.post(ACCOUNT_FEE_REVENUE, -d.OrderFee)
+	return e
+}
+
+// NewPayoutEntry records amount, in the currency of the disbursement group, paid out to the merchant for the group.
+func NewPayoutEntry(groupID uuid.UUID, merchRef string, currency string, amount int64, payoutDate time.Time) JournalEntry {
+	e := newJournalEntry(ENTRY_PAYOUT, groupID.String(), merchRef, currency, payoutDate)
+	e.post(ACCOUNT_MERCHANT_PAYABLE, amount)
+	e.post(ACCOUNT_BANK_CLEARING, -amount)
+	return e
+}
+
+// NewMonthlyFeeEntry records the part of the minimum monthly fee not covered by the order fees of the month as owed by the merchant.
+func NewMonthlyFeeEntry(m Monthly) JournalEntry {
+	e := newJournalEntry(ENTRY_MONTHLY_FEE, m.ID.String(), m.MerchantReference, m.Currency, m.MonthlyFeeDate)
+	if m.DidPayFee == 1 && m.MonthlyFee > m.OrderFeeTotal {
+		e.post(ACCOUNT_MONTHLY_FEE_RECEIVABLE, m.MonthlyFee-m.OrderFeeTotal)
+		e.post(ACCOUNT_FEE_REVENUE, -(m.MonthlyFee - m.OrderFeeTotal))
+	}
+	return e
+}
+
+// NewMonthlyFeeDeductionEntry records amount of outstanding minimum monthly fees settled by deducting it from the payout of the
+// disbursement group, in the currency of the group.
+func NewMonthlyFeeDeductionEntry(groupID uuid.UUID, merchRef string, currency string, amount int64, payoutDate time.Time) JournalEntry {
+	e := newJournalEntry(ENTRY_MONTHLY_FEE_DEDUCTION, groupID.String(), merchRef, currency, payoutDate)
+	e.post(ACCOUNT_MERCHANT_PAYABLE, amount)
+	e.post(ACCOUNT_MONTHLY_FEE_RECEIVABLE, -amount)
+	return e
+}
+
+// NewRefundEntry records the refund returned to the shopper out of the amount owed to the merchant. The order fee is kept.
+func NewRefundEntry(rf Refund) JournalEntry {
+	e := newJournalEntry(ENTRY_REFUND, rf.ID.String(), rf.MerchantReference, rf.Currency, rf.CreatedAt)
+	e.post(ACCOUNT_MERCHANT_PAYABLE, rf.Amount)
+	e.post(ACCOUNT_BANK_CLEARING, -rf.Amount)
+	return e
+}
+
+// NewReserveEntry records the amount of a payout held back in the merchant's reserve. The reserve is still owed to the merchant
+// but is not paid out until it is released.
+func NewReserveEntry(r Reserve) JournalEntry {
+	e := newJournalEntry(ENTRY_RESERVE, r.ID.String(), r.MerchantReference, r.Currency, r.CreatedAt)
+	e.post(ACCOUNT_MERCHANT_PAYABLE, r.Amount)
+	e.post(ACCOUNT_MERCHANT_RESERVE, -r.Amount)
+	return e
+}
+
+// NewReserveReleaseEntry records the reserve paid out to the merchant once it is released.
+func NewReserveReleaseEntry(r Reserve) JournalEntry {
+	e := newJournalEntry(ENTRY_RESERVE_RELEASE, r.ID.String(), r.MerchantReference, r.Currency, r.ReleasedAt)
+	e.post(ACCOUNT_MERCHANT_RESERVE, r.Amount)
+	e.post(ACCOUNT_BANK_CLEARING, -r.Amount)
+	return e
+}
+
+// Validate checks the entry identifies its event, posts only to known accounts in its currency and that its postings sum to zero.
+func (e *JournalEntry) Validate() error {
+	if e.Kind == "" || e.Reference == "" {
+		return errors.New("journal entry kind and reference are required")
+	}
+
+	var sum int64
+	for _, p := range e.Postings {
+		if !SameCurrency(p.Currency, e.Currency) {
+			return fmt.Errorf("journal entry %s %s in %s has a posting in %s", e.Kind, e.Reference, CurrencyCode(e.Currency), CurrencyCode(p.Currency))
+		}
+		switch p.Account {
+		case ACCOUNT_MERCHANT_PAYABLE, ACCOUNT_FEE_REVENUE, ACCOUNT_MONTHLY_FEE_RECEIVABLE, ACCOUNT_BANK_CLEARING, ACCOUNT_MERCHANT_RESERVE:
+		default:
+			return fmt.Errorf("unknown ledger account %s", p.Account)
+		}
+		sum += p.Amount
+	}
+
+	if sum != 0 {
+		return fmt.Errorf("journal entry %s %s does not balance, postings sum to %d", e.Kind, e.Reference, sum)
+	}
+	return nil
+}
+
+// NewTrialBalance totals the account balances of each currency into a trial balance.
+func NewTrialBalance(accounts []AccountBalance, unbalancedEntries []uuid.UUID) TrialBalance {
+	tb := TrialBalance{Accounts: accounts, UnbalancedEntries: unbalancedEntries, Balanced: len(unbalancedEntries) == 0}
+	for _, a := range accounts {
+		i := slices.IndexFunc(tb.Totals, func(t TrialBalanceTotal) bool { return t.Currency == CurrencyCode(a.Currency) })
+		if i < 0 {
+			i = len(tb.Totals)
+			tb.Totals = append(tb.Totals, TrialBalanceTotal{Currency: CurrencyCode(a.Currency)})
+		}
+
+		if a.Balance > 0 {
+			tb.Totals[i].Debits += a.Balance
+		} else {
+			tb.Totals[i].Credits -= a.Balance
+		}
+	}
+
+	for _, t := range tb.Totals {
+		if t.Debits != t.Credits {
+			tb.Balanced = false
+		}
+	}
+	return tb
+}
@@ -0,0 +1,156 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrAmountPrecision is returned when an amount has more decimals than the minor unit of its currency can hold, e.g. 10.005 EUR.
+var ErrAmountPrecision = errors.New("too many decimals")
+
+// Currency is an ISO 4217 currency and the number of digits of its minor unit, e.g. EUR with an exponent of 2 as its amounts are
+// kept in cents.
+type Currency struct {
+	Code     string `json:"code"`
+	Exponent int    `json:"exponent"`
+}
+
+// currencies are the currencies orders can be placed and merchants paid out in.
+var currencies = map[string]Currency{
+	"CHF": {Code: "CHF", Exponent: 2},
+	"EUR": {Code: "EUR", Exponent: 2},
+	"GBP": {Code: "GBP", Exponent: 2},
+}
+
+// LookupCurrency returns the supported currency with the ISO 4217 code. An empty code is the DEFAULT_CURRENCY, the currency of the
+// records stored before currencies were recorded.
+func LookupCurrency(code string) (Currency, error) {
+	c, ok := currencies[CurrencyCode(code)]
+	if !ok {
+		return Currency{}, fmt.Errorf("unsupported currency %q", code)
+	}
+	return c, nil
+}
+
+// CurrencyCode returns the ISO 4217 code, the DEFAULT_CURRENCY when it is empty.
+func CurrencyCode(code string) string {
+	if code == "" {
+		return DEFAULT_CURRENCY
+	}
+	return code
+}
+
+// SameCurrency reports whether the codes a and b stand for the same currency.
+func SameCurrency(a, b string) bool {
+	return CurrencyCode(a) == CurrencyCode(b)
+}
+
+// MinorUnits returns n whole units of the currency in its minor unit, e.g. 50 euros as 5000 cents.
+func (c Currency) MinorUnits(n int64) int64 {
+	for i := 0; i < c.Exponent; i++ {
+		n *= 10
+	}
+	return n
+}
+
+// ParseAmount parses the decimal amount s, e.g. "102.29" or "-0.5", exactly into the minor unit of c without going through a float.
+// Trailing zeros beyond the exponent of c are accepted, any other digit beyond it fails with ErrAmountPrecision.
+func (c Currency) ParseAmount(s string) (int64, error) {
+	digits, negative := strings.CutPrefix(s, "-")
+	whole, frac, _ := strings.Cut(digits, ".")
+	if whole+frac == "" || !isDigits(whole) || !isDigits(frac) {
+		return 0, fmt.Errorf("malformed amount %q", s)
+	}
+
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > c.Exponent {
+		return 0, fmt.Errorf("amount %q has %w for %s", s, ErrAmountPrecision, c.Code)
+	}
+
+	var amount int64
+	for _, r := range whole + frac + strings.Repeat("0", c.Exponent-len(frac)) {
+		d := int64(r - '0')
+		if amount > (math.MaxInt64-d)/10 {
+			return 0, fmt.Errorf("amount %q out of range", s)
+		}
+		amount = amount*10 + d
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// isDigits reports whether s only holds the ASCII digits 0 to 9.
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatAmount returns amount in the minor unit of c as a decimal with the exponent of c, e.g. 10229 EUR cents as 102.29, the
+// form ParseAmount reads back.
+func (c Currency) FormatAmount(amount int64) string {
+	sign, magnitude := "", uint64(amount)
+	if amount < 0 {
+		sign, magnitude = "-", -magnitude
+	}
+
+	digits := strconv.FormatUint(magnitude, 10)
+	if c.Exponent == 0 {
+		return sign + digits
+	}
+	if len(digits) <= c.Exponent {
+		digits = strings.Repeat("0", c.Exponent-len(digits)+1) + digits
+	}
+	point := len(digits) - c.Exponent
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+// Money is an amount in the minor unit of its currency.
+type Money struct {
+	Amount   int64    `json:"amount"`
+	Currency Currency `json:"currency"`
+}
+
+// NewMoney returns amount in the minor unit of the currency with the ISO 4217 code.
+func NewMoney(amount int64, code string) (Money, error) {
+	c, err := LookupCurrency(code)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: amount, Currency: c}, nil
+}
+
+// ParseMoney parses the decimal amount s in the currency with the ISO 4217 code exactly, see Currency.ParseAmount.
+func ParseMoney(s, code string) (Money, error) {
+	c, err := LookupCurrency(code)
+	if err != nil {
+		return Money{}, err
+	}
+
+	amount, err := c.ParseAmount(s)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: amount, Currency: c}, nil
+}
+
+// Add returns the sum of m and o, which must be in the same currency.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("can not add %s to %s", o.Currency.Code, m.Currency.Code)
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}, nil
+}
+
+// String returns m with the decimals of its currency followed by the currency code, e.g. 102.29 EUR.
+func (m Money) String() string {
+	return m.Currency.FormatAmount(m.Amount) + " " + m.Currency.Code
+}
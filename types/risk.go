@@ -0,0 +1,62 @@
+package types
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"time"
+)
+
+// PayoutHold freezes the payouts of a merchant. While a hold is in place the disbursement run leaves the merchant's disbursement
+// groups open and its reserves unreleased; orders keep being processed. A hold is active until it is lifted, when LiftedAt and
+// LiftReason are set.
+type PayoutHold struct {
+	ID                uuid.UUID `json:"id" DB:"id"`
+	MerchantReference string    `json:"merchant_reference" DB:"merchant_reference"`
+	Reason            string    `json:"reason" DB:"reason"`
+	PlacedAt          time.Time `json:"placed_at" DB:"placed_at"`
+	LiftedAt          time.Time `json:"lifted_at,omitempty" DB:"lifted_at"`
+	LiftReason        string    `json:"lift_reason,omitempty" DB:"lift_reason"`
+}
+
+// ReservePolicy holds back RateBasisPoints of every payout of a merchant for Days days, e.g. 1000 basis points for 90 days keeps 10%
+// of each payout for 90 days. The zero value holds nothing back.
+type ReservePolicy struct {
+	RateBasisPoints int64 `json:"rate_basis_points" DB:"reserve_rate_basis_points"`
+	Days            int   `json:"days" DB:"reserve_days"`
+}
+
+// Validate checks the rate is at most 100% and a reserve is held back for at least a day.
+func (p ReservePolicy) Validate() error {
+	if p.RateBasisPoints < 0 || p.RateBasisPoints > 10000 {
+		return errors.New("reserve rate_basis_points must be between 0 and 10000")
+	}
+	if p.RateBasisPoints > 0 && p.Days <= 0 {
+		return errors.New("reserve days must be greater than zero")
+	}
+	if p.Days < 0 {
+		return errors.New("reserve days must not be negative")
+	}
+	return nil
+}
+
+// Amount returns the part of payout held back, rounded down to the cent. Nothing is held back from payouts of zero or less.
+func (p ReservePolicy) Amount(payout int64) int64 {
+	if payout <= 0 || p.RateBasisPoints <= 0 {
+		return 0
+	}
+	return payout * p.RateBasisPoints / 10000
+}
+
+// Reserve is an amount held back from the payout of a disbursement group, released to the merchant by the disbursement run of its
+// ReleaseDate. ReleasedAt and TransactionID are set once it is released. The amount is in the Currency of the group.
+type Reserve struct {
+	ID                  uuid.UUID `json:"id" DB:"id"`
+	MerchantReference   string    `json:"merchant_reference" DB:"merchant_reference"`
+	DisbursementGroupID uuid.UUID `json:"disbursement_group_id" DB:"disbursement_group_id"`
+	Amount              int64     `json:"amount" DB:"amount"`
+	Currency            string    `json:"currency" DB:"currency"`
+	ReleaseDate         time.Time `json:"release_date" DB:"release_date"`
+	TransactionID       string    `json:"transaction_id,omitempty" DB:"transaction_id"`
+	ReleasedAt          time.Time `json:"released_at,omitempty" DB:"released_at"`
+	CreatedAt           time.Time `json:"created_at" DB:"created_at"`
+}
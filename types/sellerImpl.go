@@ -1,63 +1,89 @@
 package types
 
 import (
-	"errors"
-	"strconv"
 	"time"
+	_ "time/tzdata" // merchant timezones are loaded from the embedded database, which works on hosts without one
 )
 
+// GetMinMonthlyFee returns the merchant's minimum monthly fee in the minor unit of its currency, parsed exactly from the decimal
+// MinMonthlyFee. A fee with more decimals than the currency allows is an error, see Currency.ParseAmount.
 func (m *Merchant) GetMinMonthlyFee() (int64, error) {
-	mmf, err := strconv.ParseFloat(m.MinMonthlyFee, 64)
+	c, err := LookupCurrency(m.Currency)
 	if err != nil {
 		return 0, err
 	}
-	return int64(mmf * 100), nil
+	return c.ParseAmount(m.MinMonthlyFee)
 }
 
-func (m *Merchant) GetMinMonthlyFeeRemaining() (int64, error) {
-	//TODO Implement
-	return 0, errors.New("not implemented.")
+// GetMinMonthlyFeeRemaining returns the part of the merchant's minimum monthly fee not covered by orderFeeTotal, the order fees
+// charged to the merchant in the month. It is zero when the order fees reach the minimum.
+func (m *Merchant) GetMinMonthlyFeeRemaining(orderFeeTotal int64) (int64, error) {
+	mmf, err := m.GetMinMonthlyFee()
+	if err != nil {
+		return 0, err
+	}
+
+	if orderFeeTotal >= mmf {
+		return 0, nil
+	}
+	return mmf - orderFeeTotal, nil
 }
 
-func (m *Merchant) GetNextPayoutDate() (time.Time, error) {
-	wd := m.LiveOn.UTC().Weekday()
-	today := time.Now().UTC().Weekday()
+// FeeOutstanding returns the part of the month's minimum monthly fee shortfall that has not been deducted from a payout yet.
+func (m *Monthly) FeeOutstanding() int64 {
+	if m.DidPayFee != 1 || m.MonthlyFee <= m.OrderFeeTotal+m.FeeDeducted {
+		return 0
+	}
+	return m.MonthlyFee - m.OrderFeeTotal - m.FeeDeducted
+}
 
-	todayDate := time.Now().UTC()
+// FeeScheduleAt returns the fee schedule of the currency c in force at t, which for an order is its creation time, or the
+// DefaultFeeSchedule of c when none of the merchant's fee schedules in c covers t.
+func (m *Merchant) FeeScheduleAt(t time.Time, c Currency) FeeSchedule {
+	for _, fs := range m.FeeSchedules {
+		if SameCurrency(fs.Currency, c.Code) && fs.InForceAt(t) {
+			return fs
+		}
+	}
+	return DefaultFeeSchedule(c)
+}
 
-	if int(today) == int(wd) {
-		return todayDate, nil
+// Location returns the timezone of the merchant, UTC when it has none.
+func (m *Merchant) Location() (*time.Location, error) {
+	if m.Timezone == "" {
+		return time.UTC, nil
 	}
+	return time.LoadLocation(m.Timezone)
+}
 
-	daysUntil := 7 - int(today)
-	return todayDate.AddDate(0, 0, daysUntil), nil
+// CutOffDay returns the payout day of an order of the merchant created at t, with the cut-off applied in the merchant's timezone,
+// see CutOffDayIn.
+func (m *Merchant) CutOffDay(t time.Time) (time.Time, error) {
+	loc, err := m.Location()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return CutOffDayIn(t, loc)
 }
 
-// CalculatePastPayoutDate assumes that the imported orders order date was received before 08:00 UTC and thus already recorded
-// correctly since we have no way of knowing what time the orders came in based on the data only format. If we can get the full timestamp of the order
-// receipt within our systems, we can then determine the true payout date if the system logic for time cutoff was the same when the original order was processed.
-func (m *Merchant) CalculatePastPayoutDate(t time.Time) (time.Time, error) {
+// GetNextPayoutDate returns the current time of clock moved forward to the merchant's weekly payout day, on or after the current
+// day. The time is in the merchant's timezone, whose calendar day is the payout date, see DayIn.
+func (m *Merchant) GetNextPayoutDate(clock Clock) (time.Time, error) {
+	loc, err := m.Location()
+	if err != nil {
+		return time.Time{}, err
+	}
+
 	wd := m.LiveOn.UTC().Weekday()
-	orderDate := t.UTC()
-	orderDayOfWeek := orderDate.Weekday()
-	if m.DisbursementFrequency == WEEKLY {
-		if int(wd) > int(orderDayOfWeek) {
-			days := int(wd) - int(orderDayOfWeek)
-			return orderDate.AddDate(0, 0, days), nil
-		}
-		if int(wd) < int(orderDayOfWeek) {
-			days := 7 - (int(orderDayOfWeek) - int(wd))
-			return orderDate.AddDate(0, 0, days), nil
-		}
+	todayDate := clock.Now().In(loc)
+	today := todayDate.Weekday()
 
-		if int(wd) == int(orderDayOfWeek) {
-			return orderDate, nil
-		}
-	}
-	if m.DisbursementFrequency == DAILY {
-		return orderDate.AddDate(0, 0, 1), nil
+	if int(today) == int(wd) {
+		return todayDate, nil
 	}
-	return time.Now().UTC(), errors.New("failed to calculate past payout date")
+
+	daysUntil := (int(wd) - int(today) + 7) % 7
+	return todayDate.AddDate(0, 0, daysUntil), nil
 }
 
 func (m Merchant) CalculateDailyTotalOrders() (int64, error) {
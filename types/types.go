@@ -3,6 +3,7 @@ package types
 import (
 	"database/sql"
 	"github.com/google/uuid"
+	"slices"
 	"time"
 )
 
@@ -11,34 +12,62 @@ type Order struct {
 	MerchantReference string    `json:"merchant_reference,omitempty" DB:"merchant_reference"`
 	MerchantID        uuid.UUID `json:"merchant_id,omitempty" DB:"merchant_id""`
 	Amount            int64     `json:"amount,omitempty" DB:"amount"`
+	Currency          string    `json:"currency,omitempty" DB:"currency"`
 	CreatedAt         time.Time `json:"created_at,omitempty" DB:"created_at"`
 }
 
+// Merchant is a merchant paid out by the service. Timezone is the IANA name of the zone the merchant's days are counted in, for the
+// cut-off, the weekly payout weekday and the months of the minimum monthly fee; it is UTC when empty. PayoutDay is the day of the
+// month MONTHLY merchants are paid out on, the day of LiveOn when zero, see PayoutFrequency in package disburse. Hold is the payout
+// hold in place on the merchant, if any, and Reserve the part of its payouts held back, see PayoutHold and ReservePolicy. Currency is
+// the ISO 4217 code of the currency the merchant's MinMonthlyFee is charged in and its orders are in unless they say otherwise; the
+// DEFAULT_CURRENCY when empty.
 type Merchant struct {
-	ID                    uuid.UUID `json:"id,omitempty" DB:"id"`
-	Reference             string    `json:"reference,omitempty" DB:"reference"`
-	Email                 string    `json:"email,omitempty" DB:"email"`
-	LiveOn                time.Time `json:"live_on,omitempty" DB:"live_on"`
-	DisbursementFrequency string    `json:"disbursement_frequency,omitempty" DB:"disbursement_frequency"`
-	MinMonthlyFee         string    `json:"minimum_monthly_fee,omitempty" DB:"minimum_monthly_fee"`
+	ID                    uuid.UUID     `json:"id,omitempty" DB:"id"`
+	Reference             string        `json:"reference,omitempty" DB:"reference"`
+	Email                 string        `json:"email,omitempty" DB:"email"`
+	LiveOn                time.Time     `json:"live_on,omitempty" DB:"live_on"`
+	DisbursementFrequency string        `json:"disbursement_frequency,omitempty" DB:"disbursement_frequency"`
+	MinMonthlyFee         string        `json:"minimum_monthly_fee,omitempty" DB:"minimum_monthly_fee"`
+	Currency              string        `json:"currency,omitempty" DB:"currency"`
+	Timezone              string        `json:"timezone,omitempty" DB:"timezone"`
+	PayoutDay             int           `json:"payout_day,omitempty" DB:"payout_day"`
+	Hold                  *PayoutHold   `json:"hold,omitempty" DB:"-"`
+	Reserve               ReservePolicy `json:"reserve" DB:"-"`
+	FeeSchedules          []FeeSchedule `json:"fee_schedules,omitempty" DB:"-"`
 }
 
+// Disbursement is the disbursement record of an order. PayoutDate is the nominal payout date of its group, which decides the group
+// and the month the order counts towards, and RolledPayoutDate the business day the group is paid out on, see Calendar. Records of
+// ON_DEMAND merchants are OnRequest: they accrue in an open group, dated on the day of their order and not rolled, until the merchant
+// requests a payout. Amounts are in the minor unit of Currency, the currency of the order; the records of a group share it.
+// OrderFeeRunningTotal and PayoutRunningTotal are the order fees and the payout of the group up to and including the order. They
+// are not stored, but derived from the ledger postings of the orders of the group when a group is read back.
 type Disbursement struct {
 	RecordUUID           uuid.UUID `json:"RecordUUID" DB:"record_uuid"`
 	DisbursementGroupID  uuid.UUID `json:"DisbursementGroupID" DB:"disbursement_group_id"`
 	TransactionID        string    `json:"TransactionID" DB:"transaction_id"`
 	MerchReference       string    `json:"MerchReference" DB:"merchReference"`
 	OrderID              string    `json:"OrderID" DB:"order_id"`
+	OrderAmount          int64     `json:"OrderAmount" DB:"order_amount"`
+	Currency             string    `json:"Currency" DB:"currency"`
 	OrderFee             int64     `json:"OrderFee" DB:"order_fee"`
-	OrderFeeRunningTotal int64     `json:"OrderFeeRunningTotal" DB:"order_fee_running_total"`
+	FeeScheduleID        uuid.UUID `json:"FeeScheduleID" DB:"fee_schedule_id"`
+	FeeScheduleVersion   int       `json:"FeeScheduleVersion" DB:"fee_schedule_version"`
+	OrderFeeRunningTotal int64     `json:"OrderFeeRunningTotal" DB:"-"`
 	PayoutDate           time.Time `json:"PayoutDate" DB:"payout_date"`
-	PayoutRunningTotal   int64     `json:"PayoutRunningTotal" DB:"payout_running_total"`
+	RolledPayoutDate     time.Time `json:"RolledPayoutDate" DB:"rolled_payout_date"`
+	PayoutRunningTotal   int64     `json:"PayoutRunningTotal" DB:"-"`
 	PayoutTotal          int64     `json:"PayoutTotal" DB:"payout_total"`
+	MonthlyFeeDeduction  int64     `json:"MonthlyFeeDeduction" DB:"monthly_fee_deduction"`
 	IsPaidOut            bool      `json:"IsPaidOut" DB:"is_paid_out"`
+	OnRequest            bool      `json:"OnRequest" DB:"on_request"`
 }
 
+// DisbursementReport sums up the disbursements and fees of a year in one currency.
 type DisbursementReport struct {
 	Year                          time.Time     `json:"year,omitempty"`
+	Currency                      string        `json:"currency,omitempty"`
 	NumberOfDisbursements         sql.NullInt64 `json:"number_of_disbursements,omitempty" DB:"number_of_disbursements"`
 	AmountDisbursedToMerchants    sql.NullInt64 `json:"amount_disbursed_to_merchants,omitempty" DB:"amt_disbursed_to_merchants"`
 	AmountOfOrderFees             sql.NullInt64 `json:"amount_of_order_fees,omitempty" DB:"amount_of_order_fees"`
@@ -46,15 +75,217 @@ type DisbursementReport struct {
 	AmountOfMonthlyFeeCharged     sql.NullInt64 `json:"amount_of_monthly_fee_charged,omitempty"`
 }
 
+// Monthly is the minimum monthly fee of a merchant for a month. Its amounts are in the merchant's currency, and only count the orders
+// in that currency.
 type Monthly struct {
-	ID                uuid.UUID `json:"id,omitempty" DB:"id"`
-	MerchantReference string    `json:"merchant_reference,omitempty" DB:"merchant_reference"`
-	MerchantID        uuid.UUID `json:"merchant_id,omitempty" DB:"merchant_id"`
-	MonthlyFeeDate    time.Time `json:"monthly_fee_date" DB:"monthly_fee_date"`
-	DidPayFee         int       `json:"did_pay_fee,omitempty" DB:"did_pay_fee"`
-	MonthlyFee        int64     `json:"monthly_fee,omitempty" DB:"monthly_fee"`
-	TotalOrderAmt     int64     `json:"total_order_amt,omitempty" DB:"total_order_amt"`
-	OrderFeeTotal     int64     `json:"order_fee_total" DB:"order_fee_total"`
+	ID                  uuid.UUID `json:"id,omitempty" DB:"id"`
+	MerchantReference   string    `json:"merchant_reference,omitempty" DB:"merchant_reference"`
+	MerchantID          uuid.UUID `json:"merchant_id,omitempty" DB:"merchant_id"`
+	Currency            string    `json:"currency,omitempty" DB:"currency"`
+	MonthlyFeeDate      time.Time `json:"monthly_fee_date" DB:"monthly_fee_date"`
+	DidPayFee           int       `json:"did_pay_fee,omitempty" DB:"did_pay_fee"`
+	MonthlyFee          int64     `json:"monthly_fee,omitempty" DB:"monthly_fee"`
+	TotalOrderAmt       int64     `json:"total_order_amt,omitempty" DB:"total_order_amt"`
+	OrderFeeTotal       int64     `json:"order_fee_total" DB:"order_fee_total"`
+	FeeDeducted         int64     `json:"fee_deducted" DB:"fee_deducted"`
+	DisbursementGroupID uuid.UUID `json:"disbursement_group_id" DB:"disbursement_group_id"`
+	CreatedAt           time.Time `json:"created_at" DB:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at" DB:"updated_at"`
+}
+
+// ImportStats counts the records written by an import. Processed counts the orders read so far, including those not yet committed,
+// and Rejected the merchant and order records left out because they failed validation. MerchantChanges and OrderChanges compare
+// the records of the files with those stored by earlier imports; Recomputed counts the merchants whose disbursement and monthly
+// records were rebuilt because their merchant record, fee schedules or orders changed, Extended the merchants an incremental import
+// added new orders to, and Skipped the changed merchants that were left as they were because a disbursement run has already paid
+// out some of their imported records.
+type ImportStats struct {
+	Merchants       int           `json:"merchants"`
+	Processed       int           `json:"processed"`
+	Rejected        int           `json:"rejected"`
+	Orders          int           `json:"orders"`
+	Disbursements   int           `json:"disbursements"`
+	Monthly         int           `json:"monthly"`
+	MerchantChanges ImportChanges `json:"merchant_changes"`
+	OrderChanges    ImportChanges `json:"order_changes"`
+	Recomputed      int           `json:"recomputed"`
+	Extended        int           `json:"extended"`
+	Skipped         int           `json:"skipped"`
+}
+
+// ImportWatermark is the high-water mark of the orders imported for a merchant: the latest order creation time and the ids of the
+// orders created at that time. An incremental import only takes the orders of the merchant created after it.
+type ImportWatermark struct {
+	MerchantReference string    `json:"merchant_reference" DB:"merchant_reference"`
 	CreatedAt         time.Time `json:"created_at" DB:"created_at"`
-	UpdatedAt         time.Time `json:"updated_at" DB:"updated_at"`
+	OrderIDs          []string  `json:"order_ids" DB:"order_ids"`
+}
+
+// Covers reports whether the order was imported up to the watermark: created before its time, or at its time with one of its ids.
+func (wm ImportWatermark) Covers(orderID string, createdAt time.Time) bool {
+	return createdAt.Before(wm.CreatedAt) || createdAt.Equal(wm.CreatedAt) && slices.Contains(wm.OrderIDs, orderID)
+}
+
+// ImportChanges counts the records of an import file that were new, that replaced a different stored record and that matched the
+// stored record, and for orders the stored orders deleted as they are no longer in the file.
+type ImportChanges struct {
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Deleted   int `json:"deleted,omitempty"`
+}
+
+// ImportJob records an import run in the background. State moves from IMPORT_QUEUED through IMPORT_PARSING, IMPORT_BUILDING and
+// IMPORT_INSERTING to IMPORT_DONE, or stops at IMPORT_FAILED or IMPORT_CANCELLED with the reason in Error. Stats summarises what
+// the import wrote so far.
+type ImportJob struct {
+	ID             uuid.UUID   `json:"id" DB:"id"`
+	State          string      `json:"state" DB:"state"`
+	RowsProcessed  int64       `json:"rows_processed" DB:"rows_processed"`
+	RowsRejected   int64       `json:"rows_rejected" DB:"rows_rejected"`
+	Error          string      `json:"error,omitempty" DB:"error"`
+	CreatedAt      time.Time   `json:"created_at" DB:"created_at"`
+	StartedAt      time.Time   `json:"started_at,omitempty" DB:"started_at"`
+	CompletedAt    time.Time   `json:"completed_at,omitempty" DB:"completed_at"`
+	ElapsedSeconds float64     `json:"elapsed_seconds" DB:"-"`
+	Stats          ImportStats `json:"stats" DB:"stats"`
+}
+
+// ImportReject is a record of an import file that failed validation and was left out of the import. Line is the line of the record
+// in File, IMPORT_FILE_ORDERS or IMPORT_FILE_MERCHANTS, or its position when the file is a JSON array, and Record the record as it
+// was read: with the delimiter of the file for CSV files and the JSON object for JSON files.
+type ImportReject struct {
+	JobID  uuid.UUID `json:"job_id" DB:"job_id"`
+	File   string    `json:"file" DB:"file"`
+	Line   int       `json:"line" DB:"line"`
+	Record string    `json:"record" DB:"record"`
+	Reason string    `json:"reason" DB:"reason"`
+}
+
+// Finished reports whether the job has stopped running.
+func (j *ImportJob) Finished() bool {
+	return j.State == IMPORT_DONE || j.State == IMPORT_FAILED || j.State == IMPORT_CANCELLED
+}
+
+// SetElapsed sets ElapsedSeconds to the time the job ran, up to now while it is still running.
+func (j *ImportJob) SetElapsed(now time.Time) {
+	switch {
+	case j.StartedAt.IsZero():
+		j.ElapsedSeconds = 0
+	case j.Finished() && !j.CompletedAt.IsZero():
+		j.ElapsedSeconds = j.CompletedAt.Sub(j.StartedAt).Seconds()
+	default:
+		j.ElapsedSeconds = now.Sub(j.StartedAt).Seconds()
+	}
+}
+
+// DisbursementGroup is the closed payout for all disbursement records sharing a DisbursementGroupID. It is written by the
+// disbursement run when the group is paid out.
+// PayoutDate is the nominal payout date of the group and RolledPayoutDate the business day it is paid out on, see Calendar.
+// ReserveAmount is the part of the payout held back in the merchant's Reserve, already taken off PayoutTotal. The amounts are in
+// Currency: a merchant selling in several currencies is paid out in separate groups per currency.
+type DisbursementGroup struct {
+	ID                  uuid.UUID    `json:"id" DB:"id"`
+	RunID               uuid.UUID    `json:"run_id" DB:"run_id"`
+	MerchReference      string       `json:"merch_reference" DB:"merchReference"`
+	Currency            string       `json:"currency" DB:"currency"`
+	PayoutDate          time.Time    `json:"payout_date" DB:"payout_date"`
+	RolledPayoutDate    time.Time    `json:"rolled_payout_date" DB:"rolled_payout_date"`
+	NumberOfOrders      int64        `json:"number_of_orders" DB:"number_of_orders"`
+	OrderTotal          int64        `json:"order_total" DB:"order_total"`
+	OrderFeeTotal       int64        `json:"order_fee_total" DB:"order_fee_total"`
+	AdjustmentTotal     int64        `json:"adjustment_total" DB:"adjustment_total"`
+	MonthlyFeeDeduction int64        `json:"monthly_fee_deduction" DB:"monthly_fee_deduction"`
+	ReserveAmount       int64        `json:"reserve_amount" DB:"reserve_amount"`
+	PayoutTotal         int64        `json:"payout_total" DB:"payout_total"`
+	TransactionID       string       `json:"transaction_id" DB:"transaction_id"`
+	PaidAt              time.Time    `json:"paid_at" DB:"paid_at"`
+	Adjustments         []Adjustment `json:"adjustments,omitempty" DB:"-"`
+	CarryForward        *Adjustment  `json:"carry_forward,omitempty" DB:"-"`
+	MonthlyFees         []Monthly    `json:"monthly_fees,omitempty" DB:"-"`
+	Reserve             *Reserve     `json:"reserve,omitempty" DB:"-"`
+}
+
+// DisbursementRun records one execution of the daily disbursement job. There is at most one run per RunDate. GroupsHeld counts the
+// due groups left open because their merchant is on hold and ReservesPaid the reserves released by the run. Totals holds the payout
+// and order fee totals of the run per currency, as amounts in different currencies can not be added up. PayoutTotal and
+// OrderFeeTotal are those of the DEFAULT_CURRENCY, the only totals of the runs recorded before currencies.
+type DisbursementRun struct {
+	ID            uuid.UUID  `json:"id" DB:"id"`
+	RunDate       time.Time  `json:"run_date" DB:"run_date"`
+	Status        string     `json:"status" DB:"status"`
+	GroupsPaid    int64      `json:"groups_paid" DB:"groups_paid"`
+	GroupsFailed  int64      `json:"groups_failed" DB:"groups_failed"`
+	GroupsHeld    int64      `json:"groups_held" DB:"groups_held"`
+	ReservesPaid  int64      `json:"reserves_paid" DB:"reserves_paid"`
+	PayoutTotal   int64      `json:"payout_total" DB:"payout_total"`
+	OrderFeeTotal int64      `json:"order_fee_total" DB:"order_fee_total"`
+	Totals        []RunTotal `json:"totals" DB:"totals"`
+	StartedAt     time.Time  `json:"started_at" DB:"started_at"`
+	CompletedAt   time.Time  `json:"completed_at" DB:"completed_at"`
+}
+
+// RunTotal is the payout and order fee total of a disbursement run in one currency.
+type RunTotal struct {
+	Currency      string `json:"currency"`
+	PayoutTotal   int64  `json:"payout_total"`
+	OrderFeeTotal int64  `json:"order_fee_total"`
+}
+
+// AddPayout adds a payout of payoutTotal, with orderFeeTotal of order fees, in the currency to the totals of the run in currency.
+func (r *DisbursementRun) AddPayout(currency string, payoutTotal, orderFeeTotal int64) {
+	currency = CurrencyCode(currency)
+	if currency == DEFAULT_CURRENCY {
+		r.PayoutTotal += payoutTotal
+		r.OrderFeeTotal += orderFeeTotal
+	}
+
+	for i := range r.Totals {
+		if r.Totals[i].Currency == currency {
+			r.Totals[i].PayoutTotal += payoutTotal
+			r.Totals[i].OrderFeeTotal += orderFeeTotal
+			return
+		}
+	}
+	r.Totals = append(r.Totals, RunTotal{Currency: currency, PayoutTotal: payoutTotal, OrderFeeTotal: orderFeeTotal})
+}
+
+// Transfer is a payout of a disbursement group sent through a payout provider.
+type Transfer struct {
+	TransactionID       string    `json:"transaction_id"`
+	DisbursementGroupID uuid.UUID `json:"disbursement_group_id"`
+	MerchReference      string    `json:"merch_reference"`
+	Amount              int64     `json:"amount"`
+	Currency            string    `json:"currency"`
+	Status              string    `json:"status"`
+	FailureReason       string    `json:"failure_reason,omitempty"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+// Refund records money returned to the shopper for an order, in full or in part, in the currency of the order.
+type Refund struct {
+	ID                uuid.UUID `json:"id" DB:"id"`
+	OrderID           string    `json:"order_id" DB:"order_id"`
+	MerchantReference string    `json:"merchant_reference" DB:"merchant_reference"`
+	Amount            int64     `json:"amount" DB:"amount"`
+	Currency          string    `json:"currency" DB:"currency"`
+	Reason            string    `json:"reason,omitempty" DB:"reason"`
+	AdjustmentID      uuid.UUID `json:"adjustment_id" DB:"adjustment_id"`
+	CreatedAt         time.Time `json:"created_at" DB:"created_at"`
+}
+
+// Adjustment is an accounting adjustment to a merchant's payout; negative amounts reduce it. An adjustment with a
+// DisbursementGroupID is applied to that group's payout. One without is pending and carried into the next payout of the merchant in
+// its Currency.
+type Adjustment struct {
+	ID                  uuid.UUID `json:"id" DB:"id"`
+	MerchantReference   string    `json:"merchant_reference" DB:"merchant_reference"`
+	DisbursementGroupID uuid.UUID `json:"disbursement_group_id" DB:"disbursement_group_id"`
+	Kind                string    `json:"kind" DB:"kind"`
+	SourceID            uuid.UUID `json:"source_id" DB:"source_id"`
+	Amount              int64     `json:"amount" DB:"amount"`
+	Currency            string    `json:"currency" DB:"currency"`
+	Reason              string    `json:"reason,omitempty" DB:"reason"`
+	CreatedAt           time.Time `json:"created_at" DB:"created_at"`
 }